@@ -710,6 +710,172 @@ func (s *StdVarAcc) Value() (float64, *histogram.FloatHistogram) {
 	return s.variance(), nil
 }
 
+// momentAcc tracks the mean and the second, third and fourth central moments of the added floats. The moments are
+// updated incrementally, see https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Higher-order_statistics.
+type momentAcc struct {
+	count    float64
+	mean     float64
+	m2       float64
+	m3       float64
+	m4       float64
+	hasValue bool
+	warn     warnings.Warnings
+}
+
+func (m *momentAcc) ValueType() ValueType {
+	if m.hasValue {
+		return SingleTypeValue
+	}
+	return NoValue
+}
+
+func (m *momentAcc) Warnings() warnings.Warnings {
+	return m.warn
+}
+
+func (m *momentAcc) Reset(_ float64) {
+	*m = momentAcc{}
+}
+
+func (m *momentAcc) add(v float64) {
+	m.hasValue = true
+	m.count++
+
+	var (
+		n      = m.count
+		delta  = v - m.mean
+		deltaN = delta / n
+		term   = delta * deltaN * (n - 1)
+	)
+	m.mean += deltaN
+	m.m4 += term*deltaN*deltaN*(n*n-3*n+3) + 6*deltaN*deltaN*m.m2 - 4*deltaN*m.m3
+	m.m3 += term*deltaN*(n-2) - 3*deltaN*m.m2
+	m.m2 += term
+}
+
+// ZScoreAcc calculates the standard score of the last added float, i.e. the number of
+// (population) standard deviations by which it differs from the mean of all added floats.
+type ZScoreAcc struct {
+	momentAcc
+	last float64
+}
+
+func NewZScoreAcc() *ZScoreAcc {
+	return &ZScoreAcc{}
+}
+
+func (z *ZScoreAcc) Add(v float64, h *histogram.FloatHistogram) error {
+	if h != nil {
+		z.warn |= warnings.WarnHistogramIgnoredInAggregation
+		return nil
+	}
+	z.add(v)
+	z.last = v
+	return nil
+}
+
+func (z *ZScoreAcc) Value() (float64, *histogram.FloatHistogram) {
+	return (z.last - z.mean) / math.Sqrt(z.m2/z.count), nil
+}
+
+func (z *ZScoreAcc) Reset(f float64) {
+	z.momentAcc.Reset(f)
+	z.last = 0
+}
+
+// SkewnessAcc calculates the population skewness of the added floats.
+type SkewnessAcc struct {
+	momentAcc
+}
+
+func NewSkewnessAcc() *SkewnessAcc {
+	return &SkewnessAcc{}
+}
+
+func (s *SkewnessAcc) Add(v float64, h *histogram.FloatHistogram) error {
+	if h != nil {
+		s.warn |= warnings.WarnHistogramIgnoredInAggregation
+		return nil
+	}
+	s.add(v)
+	return nil
+}
+
+func (s *SkewnessAcc) Value() (float64, *histogram.FloatHistogram) {
+	return math.Sqrt(s.count) * s.m3 / math.Pow(s.m2, 1.5), nil
+}
+
+// KurtosisAcc calculates the population excess kurtosis of the added floats,
+// which is 0 for normally distributed floats.
+type KurtosisAcc struct {
+	momentAcc
+}
+
+func NewKurtosisAcc() *KurtosisAcc {
+	return &KurtosisAcc{}
+}
+
+func (k *KurtosisAcc) Add(v float64, h *histogram.FloatHistogram) error {
+	if h != nil {
+		k.warn |= warnings.WarnHistogramIgnoredInAggregation
+		return nil
+	}
+	k.add(v)
+	return nil
+}
+
+func (k *KurtosisAcc) Value() (float64, *histogram.FloatHistogram) {
+	return k.count*k.m4/(k.m2*k.m2) - 3, nil
+}
+
+// EWMAAcc calculates the exponentially weighted moving average of the added floats,
+// starting with the first float and weighting each subsequent float with alpha.
+type EWMAAcc struct {
+	alpha    float64
+	value    float64
+	hasValue bool
+	warn     warnings.Warnings
+}
+
+func NewEWMAAcc(alpha float64) *EWMAAcc {
+	return &EWMAAcc{alpha: alpha}
+}
+
+func (e *EWMAAcc) Add(v float64, h *histogram.FloatHistogram) error {
+	if h != nil {
+		e.warn |= warnings.WarnHistogramIgnoredInAggregation
+		return nil
+	}
+	if !e.hasValue {
+		e.hasValue = true
+		e.value = v
+		return nil
+	}
+	e.value = e.alpha*v + (1-e.alpha)*e.value
+	return nil
+}
+
+func (e *EWMAAcc) Value() (float64, *histogram.FloatHistogram) {
+	return e.value, nil
+}
+
+func (e *EWMAAcc) ValueType() ValueType {
+	if e.hasValue {
+		return SingleTypeValue
+	}
+	return NoValue
+}
+
+func (e *EWMAAcc) Warnings() warnings.Warnings {
+	return e.warn
+}
+
+func (e *EWMAAcc) Reset(_ float64) {
+	e.hasValue = false
+	e.value = 0
+	e.warn = 0
+}
+
 type QuantileAcc struct {
 	arg      float64
 	points   []float64
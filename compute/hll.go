@@ -0,0 +1,120 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package compute
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+)
+
+const (
+	// HyperLogLogSchema is the native histogram schema used for exchanging HyperLogLog sketches.
+	HyperLogLogSchema = 0
+
+	// hllPrecision is the number of hash bits used for selecting a register. The standard
+	// error of estimates is 1.04/sqrt(2^hllPrecision), which is about 0.8%.
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+)
+
+// HyperLogLog estimates the number of distinct values in bounded memory. Sketches can be
+// exchanged as native histograms where bucket i holds the value of register i, and merged
+// by taking the maximum of each register.
+type HyperLogLog struct {
+	registers []uint8
+}
+
+// Add adds a value with the given 64-bit hash to the sketch.
+func (h *HyperLogLog) Add(hash uint64) {
+	if h.registers == nil {
+		h.registers = make([]uint8, hllRegisters)
+	}
+	idx := hash >> (64 - hllPrecision)
+	// Setting the lowest bit bounds the number of leading zeros when the remaining bits are zero.
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	h.registers[idx] = max(h.registers[idx], rank)
+}
+
+// Merge adds the values of a sketch encoded as a native histogram.
+func (h *HyperLogLog) Merge(fh *histogram.FloatHistogram) error {
+	if fh.Schema != HyperLogLogSchema || fh.ZeroCount != 0 || len(fh.NegativeBuckets) != 0 {
+		return errors.Newf("histogram with schema %d is not a HyperLogLog sketch", fh.Schema)
+	}
+	if h.registers == nil {
+		h.registers = make([]uint8, hllRegisters)
+	}
+	var (
+		idx int32
+		i   int
+	)
+	for _, span := range fh.PositiveSpans {
+		idx += span.Offset
+		for range span.Length {
+			if idx < 0 || idx >= hllRegisters {
+				return errors.Newf("register %d is out of range for a HyperLogLog sketch", idx)
+			}
+			h.registers[idx] = max(h.registers[idx], uint8(fh.PositiveBuckets[i]))
+			idx++
+			i++
+		}
+	}
+	return nil
+}
+
+// Histogram returns the sketch as a native histogram.
+func (h *HyperLogLog) Histogram() *histogram.FloatHistogram {
+	fh := &histogram.FloatHistogram{
+		CounterResetHint: histogram.GaugeType,
+		Schema:           HyperLogLogSchema,
+	}
+	var next int32
+	for i, r := range h.registers {
+		if r == 0 {
+			continue
+		}
+		idx := int32(i)
+		if len(fh.PositiveSpans) == 0 {
+			fh.PositiveSpans = append(fh.PositiveSpans, histogram.Span{Offset: idx})
+		} else if idx != next {
+			fh.PositiveSpans = append(fh.PositiveSpans, histogram.Span{Offset: idx - next})
+		}
+		fh.PositiveSpans[len(fh.PositiveSpans)-1].Length++
+		fh.PositiveBuckets = append(fh.PositiveBuckets, float64(r))
+		fh.Count += float64(r)
+		next = idx + 1
+	}
+	return fh
+}
+
+// Estimate returns the estimated number of distinct values in the sketch.
+// Small cardinalities are estimated with linear counting.
+func (h *HyperLogLog) Estimate() float64 {
+	if h.registers == nil {
+		return 0
+	}
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	m := float64(hllRegisters)
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return math.Round(estimate)
+}
+
+func (h *HyperLogLog) Reset() {
+	clear(h.registers)
+}
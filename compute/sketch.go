@@ -0,0 +1,230 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package compute
+
+import (
+	"math"
+
+	"github.com/thanos-io/promql-engine/warnings"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser/posrange"
+)
+
+const (
+	// SketchSchema is the native histogram schema used by quantile sketches. Bucket boundaries
+	// grow by a factor of 2^(2^-6), so an estimate and the true quantile are in the same bucket
+	// and the relative error of quantiles is at most 2^(2^-6)-1, which is about 1.09%, as long as
+	// no buckets are collapsed.
+	SketchSchema = 6
+
+	// maxSketchBuckets bounds the number of buckets for each sign. When a sketch grows beyond
+	// it, buckets with the smallest magnitude are collapsed, like in DDSketch. This happens when
+	// values of the same sign span more than about 2^32 in dynamic range, after which the error
+	// of low quantiles is no longer bounded.
+	maxSketchBuckets = 2048
+)
+
+// QuantileSketch is a mergeable sketch which estimates quantiles in bounded memory. Similar to
+// DDSketch, values are counted in exponential buckets. The buckets are the same as the buckets
+// of native histograms with SketchSchema so that sketches can be exchanged and merged as native
+// histograms. Non-finite values are not counted.
+type QuantileSketch struct {
+	count     float64
+	sum       float64
+	zeroCount float64
+	positive  sketchBuckets
+	negative  sketchBuckets
+}
+
+// NewQuantileSketchHistogram returns a sketch which contains the single value v as a native histogram.
+func NewQuantileSketchHistogram(v float64) *histogram.FloatHistogram {
+	var s QuantileSketch
+	s.Add(v)
+	return s.Histogram()
+}
+
+func (s *QuantileSketch) Add(v float64) {
+	switch {
+	case math.IsNaN(v) || math.IsInf(v, 0):
+		return
+	case v > 0:
+		s.positive.add(sketchIndex(v), 1)
+	case v < 0:
+		s.negative.add(sketchIndex(-v), 1)
+	default:
+		s.zeroCount++
+	}
+	s.count++
+	s.sum += v
+}
+
+// Merge adds the values of a sketch encoded as a native histogram.
+func (s *QuantileSketch) Merge(h *histogram.FloatHistogram) error {
+	if h.Schema != SketchSchema || h.ZeroThreshold != 0 {
+		return errors.Newf("histogram with schema %d and zero threshold %v is not a quantile sketch", h.Schema, h.ZeroThreshold)
+	}
+	s.positive.merge(h.PositiveSpans, h.PositiveBuckets)
+	s.negative.merge(h.NegativeSpans, h.NegativeBuckets)
+	s.zeroCount += h.ZeroCount
+	s.count += h.Count
+	s.sum += h.Sum
+	return nil
+}
+
+// Histogram returns the sketch as a native histogram.
+func (s *QuantileSketch) Histogram() *histogram.FloatHistogram {
+	h := &histogram.FloatHistogram{
+		CounterResetHint: histogram.GaugeType,
+		Schema:           SketchSchema,
+		Count:            s.count,
+		Sum:              s.sum,
+		ZeroCount:        s.zeroCount,
+	}
+	h.PositiveSpans, h.PositiveBuckets = s.positive.spans()
+	h.NegativeSpans, h.NegativeBuckets = s.negative.spans()
+	return h
+}
+
+// Quantile estimates the q-quantile of the values in the sketch.
+func (s *QuantileSketch) Quantile(q float64) float64 {
+	v, _ := promql.HistogramQuantile(q, s.Histogram(), "", posrange.PositionRange{})
+	return v
+}
+
+func (s *QuantileSketch) Reset() {
+	s.count = 0
+	s.sum = 0
+	s.zeroCount = 0
+	s.positive.reset()
+	s.negative.reset()
+}
+
+// sketchIndex returns the index of the bucket containing v, which must be positive.
+// Bucket i contains values in (base^(i-1), base^i] like in native histograms.
+func sketchIndex(v float64) int32 {
+	return int32(math.Ceil(math.Log2(v) * (1 << SketchSchema)))
+}
+
+// sketchBuckets holds bucket counts densely, starting at the bucket with index offset.
+type sketchBuckets struct {
+	offset int32
+	counts []float64
+}
+
+func (b *sketchBuckets) add(idx int32, c float64) {
+	if len(b.counts) == 0 {
+		b.offset = idx
+	}
+	if idx < b.offset {
+		grow := int(b.offset - idx)
+		b.counts = append(make([]float64, grow, grow+len(b.counts)), b.counts...)
+		b.offset = idx
+	}
+	for int(idx-b.offset) >= len(b.counts) {
+		b.counts = append(b.counts, 0)
+	}
+	b.counts[idx-b.offset] += c
+
+	if excess := len(b.counts) - maxSketchBuckets; excess > 0 {
+		for _, c := range b.counts[:excess] {
+			b.counts[excess] += c
+		}
+		b.counts = append(b.counts[:0], b.counts[excess:]...)
+		b.offset += int32(excess)
+	}
+}
+
+func (b *sketchBuckets) merge(spans []histogram.Span, buckets []float64) {
+	var (
+		idx int32
+		i   int
+	)
+	for _, span := range spans {
+		idx += span.Offset
+		for range span.Length {
+			if buckets[i] != 0 {
+				b.add(idx, buckets[i])
+			}
+			idx++
+			i++
+		}
+	}
+}
+
+// spans returns the non-empty buckets in the span layout of native histograms.
+func (b *sketchBuckets) spans() ([]histogram.Span, []float64) {
+	var (
+		spans   []histogram.Span
+		buckets []float64
+		next    int32
+	)
+	for i, c := range b.counts {
+		if c == 0 {
+			continue
+		}
+		idx := b.offset + int32(i)
+		if len(spans) == 0 {
+			spans = append(spans, histogram.Span{Offset: idx})
+		} else if idx != next {
+			spans = append(spans, histogram.Span{Offset: idx - next})
+		}
+		spans[len(spans)-1].Length++
+		buckets = append(buckets, c)
+		next = idx + 1
+	}
+	return spans, buckets
+}
+
+func (b *sketchBuckets) reset() {
+	b.offset = 0
+	b.counts = b.counts[:0]
+}
+
+// QuantileSketchAcc approximates the quantile aggregation using a QuantileSketch.
+type QuantileSketchAcc struct {
+	arg      float64
+	sketch   QuantileSketch
+	hasValue bool
+	warn     warnings.Warnings
+}
+
+func NewQuantileSketchAcc() Accumulator {
+	return &QuantileSketchAcc{}
+}
+
+func (q *QuantileSketchAcc) Add(v float64, h *histogram.FloatHistogram) error {
+	if h != nil {
+		q.warn |= warnings.WarnHistogramIgnoredInAggregation
+		return nil
+	}
+
+	q.hasValue = true
+	q.sketch.Add(v)
+	return nil
+}
+
+func (q *QuantileSketchAcc) Value() (float64, *histogram.FloatHistogram) {
+	return q.sketch.Quantile(q.arg), nil
+}
+
+func (q *QuantileSketchAcc) ValueType() ValueType {
+	if q.hasValue {
+		return SingleTypeValue
+	}
+	return NoValue
+}
+
+func (q *QuantileSketchAcc) Warnings() warnings.Warnings {
+	return q.warn
+}
+
+func (q *QuantileSketchAcc) Reset(f float64) {
+	q.hasValue = false
+	q.warn = 0
+	q.arg = f
+	q.sketch.Reset()
+}
@@ -0,0 +1,40 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package compute
+
+import (
+	"math"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestQuantileSketchCollapsesSmallestBuckets(t *testing.T) {
+	const n = 100000
+	var (
+		sketch QuantileSketch
+		merged QuantileSketch
+		values = make([]float64, n)
+	)
+	// Values are spread evenly over 24 orders of magnitude, far more than the dynamic range of
+	// maxSketchBuckets buckets, which is 2^(maxSketchBuckets/2^SketchSchema) = 2^32.
+	for i := range values {
+		values[i] = math.Pow(10, -12+24*float64(i)/(n-1))
+		sketch.Add(values[i])
+	}
+	testutil.Ok(t, merged.Merge(sketch.Histogram()))
+
+	for _, s := range []*QuantileSketch{&sketch, &merged} {
+		testutil.Equals(t, maxSketchBuckets, len(s.positive.counts))
+		testutil.Equals(t, float64(n), s.count)
+
+		// High quantiles are in buckets which are kept, so the error bound holds.
+		expected := values[int(0.99*n)]
+		testutil.Assert(t, math.Abs(s.Quantile(0.99)-expected)/expected < math.Exp2(math.Exp2(-SketchSchema))-1)
+
+		// Low quantiles are counted in the smallest bucket which is kept, which is far larger.
+		expected = values[int(0.01*n)]
+		testutil.Assert(t, s.Quantile(0.01) > 1e6*expected)
+	}
+}
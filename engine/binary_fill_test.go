@@ -0,0 +1,171 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/logicalplan"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestBinaryFillValues(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 30s
+	requests_total{pod="a"} 1+1x10
+	requests_total{pod="b"} 2+2x10
+	requests_total{pod="c"} 3+3x10
+	errors_total{pod="a"}   0+1x10
+	errors_total{pod="b"}   _ _ 1 _ _ 2 _ _ 3 _ _
+	errors_total{pod="d"}   5x10
+	owner{pod="a", team="x"} 1x10
+	owner{pod="c", team="y"} 1x10
+	owner{pod="e", team="z"} 1x10
+`)
+	defer storage.Close()
+
+	zero, one := 0.0, 1.0
+	cases := []struct {
+		name     string
+		query    string
+		fill     logicalplan.FillValues
+		expected string
+	}{
+		{
+			name:     "fill left",
+			query:    `errors_total / requests_total`,
+			fill:     logicalplan.FillValues{LHS: &zero},
+			expected: `errors_total / requests_total or 0 / requests_total`,
+		},
+		{
+			name:     "fill right",
+			query:    `errors_total / requests_total`,
+			fill:     logicalplan.FillValues{RHS: &one},
+			expected: `errors_total / requests_total or errors_total / 1`,
+		},
+		{
+			name:     "fill both sides",
+			query:    `errors_total - on (pod) requests_total`,
+			fill:     logicalplan.FillValues{LHS: &zero, RHS: &one},
+			expected: `errors_total - on (pod) requests_total or errors_total - 1 or 0 - requests_total`,
+		},
+		{
+			name:     "comparison",
+			query:    `errors_total < requests_total`,
+			fill:     logicalplan.FillValues{RHS: &one},
+			expected: `errors_total < requests_total or errors_total < 1`,
+		},
+		{
+			name:     "comparison with bool",
+			query:    `errors_total >= bool requests_total`,
+			fill:     logicalplan.FillValues{LHS: &zero},
+			expected: `errors_total >= bool requests_total or 0 >= bool requests_total`,
+		},
+		{
+			name:     "group left",
+			query:    `requests_total * on (pod) group_left (team) owner`,
+			fill:     logicalplan.FillValues{LHS: &zero, RHS: &one},
+			expected: `requests_total * on (pod) group_left (team) owner or on (pod) requests_total * 1 or on (pod) 0 * owner`,
+		},
+		{
+			name:     "group right",
+			query:    `owner * on (pod) group_right (team) requests_total`,
+			fill:     logicalplan.FillValues{RHS: &zero},
+			expected: `owner * on (pod) group_right (team) requests_total or on (pod) 0 * owner`,
+		},
+		{
+			name:     "filled side is not restricted by matchers of the other side",
+			query:    `errors_total{pod="a"} + requests_total`,
+			fill:     logicalplan.FillValues{LHS: &zero},
+			expected: `errors_total{pod="a"} + requests_total or 0 + requests_total`,
+		},
+	}
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, 0)
+		end   = time.Unix(300, 0)
+		step  = 30 * time.Second
+		opts  = promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10, LookbackDelta: 10 * time.Second}
+	)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			promEngine := promql.NewEngine(opts)
+			promQry, err := promEngine.NewRangeQuery(ctx, storage, nil, tc.expected, start, end, step)
+			testutil.Ok(t, err)
+			expected := promQry.Exec(ctx)
+			testutil.Ok(t, expected.Err)
+
+			expr, err := parser.ParseExpr(tc.query)
+			testutil.Ok(t, err)
+			plan, err := logicalplan.NewFromAST(expr, &query.Options{Start: start, End: end, Step: step}, logicalplan.PlanOptions{})
+			testutil.Ok(t, err)
+			root := plan.Root()
+			root.(*logicalplan.Binary).Fill = tc.fill
+
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			qry, err := ng.MakeRangeQueryFromPlan(ctx, storage, &engine.QueryOpts{}, root, start, end, step)
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+		})
+	}
+}
+
+func TestBinaryFillValuesErrors(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 30s
+	requests_total{pod="a", instance="1"} 1+1x10
+	requests_total{pod="a", instance="2"} 1+1x10
+	errors_total{pod="a"}                 1+1x10
+`)
+	defer storage.Close()
+
+	zero := 0.0
+	cases := []struct {
+		query string
+		err   string
+	}{
+		{
+			query: `errors_total and requests_total`,
+			err:   "fill values are not supported for set operator and",
+		},
+		{
+			query: `requests_total + on (pod) missing_total`,
+			err:   "multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)",
+		},
+	}
+	ctx := context.Background()
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			testutil.Ok(t, err)
+			plan, err := logicalplan.NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(60, 0), Step: 30 * time.Second}, logicalplan.PlanOptions{})
+			testutil.Ok(t, err)
+			root := plan.Root()
+			root.(*logicalplan.Binary).Fill = logicalplan.FillValues{RHS: &zero}
+
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}})
+			qry, err := ng.MakeRangeQueryFromPlan(ctx, storage, &engine.QueryOpts{}, root, time.Unix(0, 0), time.Unix(60, 0), 30*time.Second)
+			if err == nil {
+				err = qry.Exec(ctx).Err
+			}
+			testutil.NotOk(t, err)
+			testutil.Equals(t, tc.err, err.Error())
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestCalendarStep(t *testing.T) {
+	t.Parallel()
+
+	// Samples every hour from 1970-01-01 until 1970-05-05, which includes the start
+	// of daylight saving time in New York on 1970-04-26.
+	storage := promqltest.LoadedStorage(t, `
+load 1h
+	http_requests_total{pod="nginx-1"} 0+10x3000
+	http_requests_total{pod="nginx-2"} 0+20x3000
+`)
+	defer storage.Close()
+
+	newYork, err := time.LoadLocation("America/New_York")
+	testutil.Ok(t, err)
+
+	var (
+		ctx  = context.Background()
+		opts = promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10, EnableAtModifier: true}
+	)
+	cases := []struct {
+		name  string
+		step  query.CalendarStep
+		start time.Time
+		end   time.Time
+	}{
+		{
+			name:  "days across the start of daylight saving time",
+			step:  query.CalendarStep{Unit: query.Day},
+			start: time.Date(1970, 4, 20, 12, 0, 0, 0, newYork),
+			end:   time.Date(1970, 5, 2, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:  "weeks",
+			step:  query.CalendarStep{Unit: query.Week},
+			start: time.Date(1970, 1, 1, 0, 0, 0, 0, newYork),
+			end:   time.Date(1970, 5, 1, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:  "months",
+			step:  query.CalendarStep{Unit: query.Month},
+			start: time.Date(1970, 1, 1, 0, 0, 0, 0, newYork),
+			end:   time.Date(1970, 5, 4, 0, 0, 0, 0, newYork),
+		},
+	}
+	queries := []string{
+		`http_requests_total`,
+		`rate(http_requests_total[2h])`,
+		`max_over_time(http_requests_total[1d])`,
+		`max_over_time(rate(http_requests_total[2h])[1d:1h])`,
+		`http_requests_total @ 36000`,
+		`timestamp(http_requests_total)`,
+		`time()`,
+		`vector(1)`,
+	}
+	for _, tc := range cases {
+		for _, qs := range queries {
+			t.Run(tc.name+"/"+qs, func(t *testing.T) {
+				ng := engine.New(engine.Opts{EngineOpts: opts})
+				qry, err := ng.MakeRangeQuery(ctx, storage, &engine.QueryOpts{CalendarStep: &tc.step, Location: newYork}, qs, tc.start, tc.end, time.Minute)
+				testutil.Ok(t, err)
+				defer qry.Close()
+				res := qry.Exec(ctx)
+				testutil.Ok(t, res.Err)
+
+				// Each step is expected to match an instant query at the calendar boundary.
+				var (
+					promEngine = promql.NewEngine(opts)
+					expected   = make(map[uint64]*promql.Series)
+				)
+				for _, ts := range calendarSteps(tc.step, tc.start.In(newYork), tc.end) {
+					promQry, err := promEngine.NewInstantQuery(ctx, storage, nil, qs, ts)
+					testutil.Ok(t, err)
+					promRes := promQry.Exec(ctx)
+					testutil.Ok(t, promRes.Err)
+					promQry.Close()
+
+					var vector promql.Vector
+					switch v := promRes.Value.(type) {
+					case promql.Vector:
+						vector = v
+					case promql.Scalar:
+						vector = promql.Vector{{T: v.T, F: v.V}}
+					}
+					for _, s := range vector {
+						series, ok := expected[s.Metric.Hash()]
+						if !ok {
+							series = &promql.Series{Metric: s.Metric}
+							expected[s.Metric.Hash()] = series
+						}
+						series.Floats = append(series.Floats, promql.FPoint{T: s.T, F: s.F})
+					}
+				}
+				matrix := make(promql.Matrix, 0, len(expected))
+				for _, s := range expected {
+					matrix = append(matrix, *s)
+				}
+				sort.Sort(matrix)
+				testutil.WithGoCmp(comparer).Equals(t, &promql.Result{Value: matrix}, res, queryExplanation(qry))
+			})
+		}
+	}
+}
+
+// calendarSteps returns the calendar boundaries between start and end in the location of start.
+func calendarSteps(step query.CalendarStep, start, end time.Time) []time.Time {
+	var (
+		steps []time.Time
+		y, m  = start.Year(), start.Month()
+		d     = start.Day()
+	)
+	switch step.Unit {
+	case query.Week:
+		d -= (int(start.Weekday()) + 6) % 7
+	case query.Month:
+		d = 1
+	}
+	for {
+		ts := time.Date(y, m, d, 0, 0, 0, 0, start.Location())
+		switch step.Unit {
+		case query.Week:
+			d += 7
+		case query.Month:
+			m++
+		default:
+			d++
+		}
+		if ts.Before(start) {
+			continue
+		}
+		if ts.After(end) {
+			return steps
+		}
+		steps = append(steps, ts)
+	}
+}
+
+func TestCalendarStepWithPerStepStats(t *testing.T) {
+	t.Parallel()
+
+	ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}})
+	_, err := ng.MakeRangeQuery(context.Background(), nil, &engine.QueryOpts{
+		EnablePerStepStatsParam: true,
+		CalendarStep:            &query.CalendarStep{Unit: query.Day},
+	}, `time()`, time.Unix(0, 0), time.Unix(86400*7, 0), time.Minute)
+	testutil.Equals(t, engine.ErrPerStepStatsWithCalendarStep, err)
+}
@@ -0,0 +1,131 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/logicalplan"
+	"github.com/thanos-io/promql-engine/storage/prometheus"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestCostBasedOptimizer(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+		http_requests_total{pod="nginx-1", job="app"} 1+1x40
+		http_requests_total{pod="nginx-2", job="app"} 2+2x40
+		http_requests_total{pod="nginx-3", job="api"} 3+3x40
+		http_requests_total{pod="nginx-4", job="api"} 4+4x40
+		errors_total{pod="nginx-1", job="app"} 0.5+0.5x40
+		errors_total{pod="nginx-3", job="api"} 1.5+1.5x40`
+
+	queries := []string{
+		`errors_total and http_requests_total`,
+		`errors_total and on(job) http_requests_total`,
+		`errors_total or http_requests_total`,
+		`errors_total or on(job) http_requests_total{job="api"}`,
+		`errors_total unless http_requests_total`,
+		`errors_total unless on(pod) http_requests_total{job="app"}`,
+		`http_requests_total and errors_total`,
+		`http_requests_total unless on(job) errors_total{job="app"}`,
+		`sum by (job) (http_requests_total) / on(job) sum by (job) (errors_total)`,
+		`sum(rate(http_requests_total[2m]))`,
+	}
+
+	opts := promql.EngineOpts{
+		Timeout:    1 * time.Hour,
+		MaxSamples: 1e10,
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	ix, err := storage.Head().Index()
+	testutil.Ok(t, err)
+	defer ix.Close()
+
+	normalEngine := engine.New(engine.Opts{
+		EngineOpts:        opts,
+		LogicalOptimizers: logicalplan.NoOptimizers,
+	})
+	optimizedEngine := engine.New(engine.Opts{
+		EngineOpts: opts,
+		LogicalOptimizers: append(slices.Clone(logicalplan.DefaultOptimizers), logicalplan.CostBasedOptimizer{
+			Statistics:        prometheus.NewPostingsStatistics(ix),
+			SeriesPerDecoder:  1,
+			SamplesPerBatch:   20,
+			Shards:            2,
+			ShardingThreshold: 100,
+		}),
+	})
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, 0)
+		end   = time.Unix(1200, 0)
+		step  = 30 * time.Second
+	)
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			normalQuery, err := normalEngine.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer normalQuery.Close()
+			normalResult := normalQuery.Exec(ctx)
+			testutil.Ok(t, normalResult.Err)
+
+			optimizedQuery, err := optimizedEngine.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer optimizedQuery.Close()
+			optimizedResult := optimizedQuery.Exec(ctx)
+			testutil.Ok(t, optimizedResult.Err)
+
+			testutil.WithGoCmp(comparer).Equals(t, normalResult, optimizedResult, queryExplanation(optimizedQuery))
+		})
+	}
+}
+
+func TestQueryExplainCost(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `load 30s
+		http_requests_total{pod="nginx-1"} 1+1x40
+		http_requests_total{pod="nginx-2"} 2+2x40
+		http_requests_total{pod="nginx-3"} 3+3x40`)
+	defer storage.Close()
+
+	ix, err := storage.Head().Index()
+	testutil.Ok(t, err)
+	defer ix.Close()
+
+	ng := engine.New(engine.Opts{
+		EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour},
+		LogicalOptimizers: []logicalplan.Optimizer{
+			logicalplan.CostBasedOptimizer{Statistics: prometheus.NewPostingsStatistics(ix)},
+		},
+	})
+
+	ctx := context.Background()
+	query, err := ng.NewRangeQuery(ctx, storage, nil, `http_requests_total`, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer query.Close()
+
+	// A single decoder is used for the three selected series.
+	expected := &engine.ExplainOutputNode{
+		OperatorName: "[concurrent(buff=2)]",
+		Cost:         &logicalplan.Cost{Series: 3, Samples: 63},
+		Children: []engine.ExplainOutputNode{
+			{OperatorName: `[vectorSelector] {[__name__="http_requests_total"]} 0 mod 1`},
+		},
+	}
+	testutil.Equals(t, expected, query.(engine.ExplainableQuery).Explain())
+}
@@ -0,0 +1,115 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/ringbuffer"
+	promstorage "github.com/thanos-io/promql-engine/storage/prometheus"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+var _ promstorage.CreatedTimestampIterator = &createdTimestampIterator{}
+
+type createdTimestampSeries struct {
+	*mockSeries
+	createdTimestamps []int64
+}
+
+func (m createdTimestampSeries) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
+	return &createdTimestampIterator{
+		mockIterator:      m.mockSeries.Iterator(it).(*mockIterator),
+		createdTimestamps: m.createdTimestamps,
+	}
+}
+
+type createdTimestampIterator struct {
+	*mockIterator
+	createdTimestamps []int64
+}
+
+func (m *createdTimestampIterator) AtCT() int64 { return m.createdTimestamps[m.i] * 1000 }
+
+func TestCreatedTimestamps(t *testing.T) {
+	t.Parallel()
+
+	var (
+		lbls = []string{"__name__", "http_requests_total", "pod", "nginx-1"}
+		// The counter is created at 95s and reset at 215s.
+		timestamps        = []int64{110, 140, 170, 200, 230, 260, 290}
+		values            = []float64{5, 8, 11, 20, 3, 6, 9}
+		createdTimestamps = []int64{95, 95, 95, 95, 215, 215, 215}
+		// Zero samples which Prometheus appends at created timestamps during ingestion.
+		zeroTimestamps = []int64{95, 110, 140, 170, 200, 215, 230, 260, 290}
+		zeroValues     = []float64{0, 5, 8, 11, 20, 0, 3, 6, 9}
+	)
+	withCreatedTimestamps := storageWithSeries(createdTimestampSeries{
+		mockSeries:        newMockSeries(lbls, append([]int64{}, timestamps...), values),
+		createdTimestamps: createdTimestamps,
+	})
+	withZeroSamples := storageWithMockSeries(newMockSeries(lbls, zeroTimestamps, zeroValues))
+	withoutZeroSamples := storageWithMockSeries(newMockSeries(lbls, append([]int64{}, timestamps...), values))
+
+	queries := []string{
+		`rate(http_requests_total[1m])`,
+		`increase(http_requests_total[1m])`,
+		`increase(http_requests_total[2m])`,
+		`delta(http_requests_total[1m])`,
+		`rate(http_requests_total[30s] offset 10s)`,
+		`max_over_time(http_requests_total[1m])`,
+	}
+	opts := promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10}
+	ctx := context.Background()
+	start, end := time.Unix(60, 0), time.Unix(330, 0)
+
+	// Zero samples are injected before samples are pushed to the ring buffer, so that both the
+	// ring buffer holding all samples of a range and the streaming RateBuffer receive them.
+	steps := map[string]time.Duration{"buffered": 10 * time.Second, "streaming": 30 * time.Second}
+	for name, step := range steps {
+		streaming := ringbuffer.UseStreamingRingBuffers(query.Options{Start: start, End: end, Step: step}, time.Minute.Milliseconds())
+		testutil.Equals(t, name == "streaming", streaming)
+	}
+	for _, query := range queries {
+		for name, step := range steps {
+			t.Run(query+" "+name, func(t *testing.T) {
+				for _, tcase := range []struct {
+					enabled  bool
+					expected storage.Queryable
+				}{
+					{enabled: true, expected: withZeroSamples},
+					{enabled: false, expected: withoutZeroSamples},
+				} {
+					// Created timestamps are not used by functions other than rate, increase and delta.
+					expectedStorage := tcase.expected
+					if query == `max_over_time(http_requests_total[1m])` {
+						expectedStorage = withoutZeroSamples
+					}
+
+					promEngine := promql.NewEngine(opts)
+					promQry, err := promEngine.NewRangeQuery(ctx, expectedStorage, nil, query, start, end, step)
+					testutil.Ok(t, err)
+					expected := promQry.Exec(ctx)
+					testutil.Ok(t, expected.Err)
+
+					ng := engine.New(engine.Opts{EngineOpts: opts, EnableCreatedTimestamps: tcase.enabled})
+					qry, err := ng.NewRangeQuery(ctx, withCreatedTimestamps, nil, query, start, end, step)
+					testutil.Ok(t, err)
+					res := qry.Exec(ctx)
+					testutil.Ok(t, res.Err)
+
+					testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestDelayedNameRemoval(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 30s
+	http_requests_total{pod="nginx-1", code="200"} 1+1x20
+	http_requests_total{pod="nginx-2", code="200"} 2+3x20
+	http_requests_total{pod="nginx-1", code="500"} 0+1x20
+	http_errors_total{pod="nginx-1", code="503"}   0+2x20
+	http_request_duration_seconds_bucket{pod="nginx-1", le="0.1"}  0+2x20
+	http_request_duration_seconds_bucket{pod="nginx-1", le="1"}    0+5x20
+	http_request_duration_seconds_bucket{pod="nginx-1", le="+Inf"} 0+6x20
+`)
+	defer storage.Close()
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		step  = 30 * time.Second
+		opts  = promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10, EnableDelayedNameRemoval: true}
+	)
+	cases := []struct {
+		name  string
+		query string
+	}{
+		{name: "label_replace of metric name", query: `label_replace(rate(http_requests_total[2m]), "metric", "$1", "__name__", "(.*)")`},
+		{name: "aggregation by metric name", query: `sum by (__name__) ({__name__=~"http_(requests|errors)_total"})`},
+		{name: "aggregation by removed metric name", query: `sum by (__name__, code) (rate({__name__=~"http_(requests|errors)_total"}[2m]))`},
+		{name: "aggregation without labels", query: `sum without (code) (rate({__name__=~"http_(requests|errors)_total"}[2m]))`},
+		{name: "unary negation", query: `-http_requests_total`},
+		{name: "arithmetic with scalar", query: `http_requests_total * 2`},
+		{name: "comparison with scalar", query: `http_requests_total > 5`},
+		{name: "comparison with bool", query: `http_requests_total > bool 5`},
+		{name: "vector comparison with bool", query: `http_requests_total{code="200"} > bool on (pod) http_errors_total`},
+		{name: "vector arithmetic", query: `http_errors_total / ignoring (code) group_left http_requests_total{code="200"}`},
+		{name: "topk", query: `topk(1, rate(http_requests_total[2m]))`},
+		{name: "histogram_quantile", query: `histogram_quantile(0.9, rate(http_request_duration_seconds_bucket[2m]))`},
+		{name: "subquery", query: `max_over_time(rate(http_requests_total[2m])[5m:1m])`},
+		{name: "label_replace sets metric name", query: `label_replace(-http_errors_total, "__name__", "http_failures", "", "")`},
+		{name: "names are dropped after aggregation", query: `sum by (pod) (-{__name__=~"http_(requests|errors)_total"})`},
+		{name: "timestamp", query: `timestamp(http_requests_total)`},
+		{name: "label_replace of drop name marker", query: `label_replace(rate(http_requests_total[2m]), "foo", "$1", "__drop_name__", "(.*)")`},
+		{name: "label_join of drop name marker", query: `label_join(-http_requests_total, "foo", ",", "__drop_name__")`},
+		{name: "vector matching on drop name marker", query: `rate(http_requests_total[2m]) + on (__drop_name__) group_left http_errors_total`},
+		{name: "vector matching ignoring drop name marker", query: `rate(http_errors_total[2m]) / ignoring (__drop_name__, code) group_left rate(http_requests_total{code="200"}[2m])`},
+		{name: "aggregation by drop name marker", query: `sum by (__drop_name__, pod) (rate(http_requests_total[2m]))`},
+		{name: "count_values by drop name marker", query: `count_values by (__drop_name__) ("value", -http_requests_total)`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			promEngine := promql.NewEngine(opts)
+			promQry, err := promEngine.NewRangeQuery(ctx, storage, nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			expected := promQry.Exec(ctx)
+			testutil.Ok(t, expected.Err)
+
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			qry, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+		})
+	}
+
+	instantCases := []struct {
+		name  string
+		query string
+	}{
+		{name: "sort_by_label of metric name", query: `sort_by_label(rate({__name__=~"http_(requests|errors)_total", pod="nginx-1"}[2m]), "__name__")`},
+		{name: "sort_by_label_desc of metric name", query: `sort_by_label_desc(rate({__name__=~"http_(requests|errors)_total", pod="nginx-1"}[2m]), "__name__")`},
+		{name: "sort_by_label of drop name marker", query: `sort_by_label(rate(http_requests_total[2m]), "__drop_name__", "pod", "code")`},
+	}
+	for _, tc := range instantCases {
+		t.Run(tc.name, func(t *testing.T) {
+			promEngine := promql.NewEngine(opts)
+			promQry, err := promEngine.NewInstantQuery(ctx, storage, nil, tc.query, end)
+			testutil.Ok(t, err)
+			expected := promQry.Exec(ctx)
+			testutil.Ok(t, expected.Err)
+
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			qry, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, end)
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+		})
+	}
+}
+
+func TestDelayedNameRemovalDuplicateLabelSets(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 30s
+	http_requests_total{pod="nginx-1"} 1+1x20
+	http_errors_total{pod="nginx-1"}   0+2x20
+`)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: time.Hour, EnableDelayedNameRemoval: true}
+	for _, query := range []string{
+		`rate({__name__=~"http_(requests|errors)_total"}[2m])`,
+		`label_replace(-{__name__=~"http_(requests|errors)_total"}, "pod", "nginx-2", "", "")`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			ctx := context.Background()
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			qry, err := ng.NewRangeQuery(ctx, storage, nil, query, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.NotOk(t, res.Err)
+			testutil.Equals(t, "vector cannot contain metrics with the same labelset", res.Err.Error())
+		})
+	}
+}
@@ -12,6 +12,8 @@ import (
 
 	"github.com/thanos-io/promql-engine/api"
 	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/execution"
+	"github.com/thanos-io/promql-engine/query"
 
 	"github.com/efficientgo/core/errors"
 	"github.com/efficientgo/core/testutil"
@@ -451,3 +453,206 @@ func TestDistributedEngineWarnings(t *testing.T) {
 	res := q.Exec(context.Background())
 	testutil.Equals(t, 1, len(res.Warnings))
 }
+
+func TestDistributedEngineWithCalendarStep(t *testing.T) {
+	t.Parallel()
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			MaxSamples: math.MaxInt64,
+			Timeout:    1 * time.Minute,
+		},
+	}
+	series := storageWithMockSeries(newMockSeries([]string{labels.MetricName, "bar", "zone", "east-1"}, []int64{0, 30, 60}, []float64{1, 2, 3}))
+	remote := engine.NewRemoteEngine(opts, series, math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("zone", "east-1")})
+	endpoints := api.NewStaticEndpoints([]api.RemoteEngine{remote})
+
+	ng := engine.NewDistributedEngine(opts)
+	qOpts := &engine.QueryOpts{CalendarStep: &query.CalendarStep{Unit: query.Day}}
+	_, err := ng.MakeRangeQuery(context.Background(), series, endpoints, qOpts, `sum(bar)`, time.Unix(0, 0), time.Unix(86400*7, 0), time.Minute)
+	testutil.Assert(t, errors.Is(err, execution.ErrRemoteExecutionWithCalendarStep), "unexpected error: %v", err)
+}
+
+func TestDistributedApproximateQuantiles(t *testing.T) {
+	t.Parallel()
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			MaxSamples: math.MaxInt64,
+			Timeout:    1 * time.Minute,
+		},
+		EnableApproximateQuantiles: true,
+	}
+
+	var (
+		allSeries  []*mockSeries
+		partitions []partition
+	)
+	for _, zone := range []string{"east-1", "west-1"} {
+		p := partition{extLset: []labels.Labels{labels.FromStrings("zone", zone)}}
+		for i := range 100 {
+			// Values are dense so that the interpolation of exact quantiles is close to the sketch.
+			v := float64(100 + i)
+			if zone == "west-1" {
+				v = 150 + float64(i)/2
+			}
+			series := []string{labels.MetricName, "bar", "zone", zone, "pod", fmt.Sprintf("nginx-%d", i%3)}
+			p.series = append(p.series, newMockSeries(append(series, "instance", fmt.Sprint(i)), []int64{0, 30, 60}, []float64{v, v * 2, v * 3}))
+		}
+		allSeries = append(allSeries, p.series...)
+		partitions = append(partitions, p)
+	}
+	remoteEngines := make([]api.RemoteEngine, 0, len(partitions))
+	for _, p := range partitions {
+		remoteEngines = append(remoteEngines, engine.NewRemoteEngine(opts, storageWithMockSeries(p.series...), p.mint(), p.maxt(), p.extLset))
+	}
+	endpoints := api.NewStaticEndpoints(remoteEngines)
+	completeSeriesSet := storageWithMockSeries(allSeries...)
+
+	queries := []string{
+		`quantile(0.9, bar)`,
+		`quantile by (pod) (0.5, bar)`,
+		`quantile without (instance, zone) (0.1, bar)`,
+		`quantile by (zone) (0.99, bar)`,
+		`quantile(0.75, -bar)`,
+	}
+	ctx := context.Background()
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			start, end, step := time.Unix(0, 0), time.Unix(60, 0), 30*time.Second
+
+			distEngine := engine.NewDistributedEngine(opts)
+			distQry, err := distEngine.MakeRangeQuery(ctx, completeSeriesSet, endpoints, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			distResult := distQry.Exec(ctx)
+			testutil.Ok(t, distResult.Err)
+
+			localEngine := engine.New(opts)
+			localQry, err := localEngine.NewRangeQuery(ctx, completeSeriesSet, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			localResult := localQry.Exec(ctx)
+			testutil.Ok(t, localResult.Err)
+
+			// Merging sketches from remote engines gives the same result as computing the sketch locally.
+			testutil.WithGoCmp(comparer).Equals(t, localResult, distResult, queryExplanation(distQry))
+
+			promEngine := promql.NewEngine(opts.EngineOpts)
+			promQry, err := promEngine.NewRangeQuery(ctx, completeSeriesSet, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			promResult := promQry.Exec(ctx)
+			testutil.Ok(t, promResult.Err)
+
+			expected, err := promResult.Matrix()
+			testutil.Ok(t, err)
+			actual, err := localResult.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, len(expected), len(actual))
+			for i := range expected {
+				testutil.Equals(t, expected[i].Metric, actual[i].Metric)
+				testutil.Equals(t, len(expected[i].Floats), len(actual[i].Floats))
+				for j, p := range expected[i].Floats {
+					testutil.Assert(t, math.Abs(actual[i].Floats[j].F-p.F) <= 0.02*math.Abs(p.F), "expected %v to be close to %v", actual[i].Floats[j].F, p.F)
+				}
+			}
+		})
+	}
+}
+
+func TestDistributedApproximateCountDistinct(t *testing.T) {
+	t.Parallel()
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			MaxSamples: math.MaxInt64,
+			Timeout:    1 * time.Minute,
+		},
+		EnableApproximateCountDistinct: true,
+	}
+
+	var (
+		allSeries  []*mockSeries
+		partitions []partition
+	)
+	for _, zone := range []string{"east-1", "west-1"} {
+		p := partition{extLset: []labels.Labels{labels.FromStrings("zone", zone)}}
+		for i := range 500 {
+			// Users are shared between zones, so distinct counts from zones cannot be added.
+			user := fmt.Sprintf("user-%d", i%400)
+			if zone == "west-1" {
+				user = fmt.Sprintf("user-%d", 200+i%400)
+			}
+			series := []string{labels.MetricName, "bar", "zone", zone, "pod", fmt.Sprintf("nginx-%d", i%3), "user_id", user, "instance", fmt.Sprint(i)}
+			p.series = append(p.series, newMockSeries(series, []int64{0, 30, 60}[:1+i%3], []float64{1, 2, 3}[:1+i%3]))
+		}
+		allSeries = append(allSeries, p.series...)
+		partitions = append(partitions, p)
+	}
+	remoteEngines := make([]api.RemoteEngine, 0, len(partitions))
+	for _, p := range partitions {
+		remoteEngines = append(remoteEngines, engine.NewRemoteEngine(opts, storageWithMockSeries(p.series...), p.mint(), p.maxt(), p.extLset))
+	}
+	endpoints := api.NewStaticEndpoints(remoteEngines)
+	completeSeriesSet := storageWithMockSeries(allSeries...)
+
+	queries := []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    `count_distinct_approx("user_id", bar)`,
+			expected: `count(count by (user_id) (bar))`,
+		},
+		{
+			query:    `count_distinct_approx("user_id", bar, "pod")`,
+			expected: `count by (pod) (count by (pod, user_id) (bar))`,
+		},
+		{
+			query:    `count_distinct_approx("user_id", bar, "zone")`,
+			expected: `count by (zone) (count by (zone, user_id) (bar))`,
+		},
+		{
+			query:    `count_distinct_approx("instance", bar > 1, "zone", "pod")`,
+			expected: `count by (zone, pod) (count by (zone, pod, instance) (bar > 1))`,
+		},
+	}
+	ctx := context.Background()
+	for _, tcase := range queries {
+		t.Run(tcase.query, func(t *testing.T) {
+			start, end, step := time.Unix(0, 0), time.Unix(60, 0), 30*time.Second
+
+			distEngine := engine.NewDistributedEngine(opts)
+			distQry, err := distEngine.MakeRangeQuery(ctx, completeSeriesSet, endpoints, nil, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+			distResult := distQry.Exec(ctx)
+			testutil.Ok(t, distResult.Err)
+
+			localEngine := engine.New(opts)
+			localQry, err := localEngine.NewRangeQuery(ctx, completeSeriesSet, nil, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+			localResult := localQry.Exec(ctx)
+			testutil.Ok(t, localResult.Err)
+
+			// Merging sketches from remote engines gives the same result as computing the sketch locally.
+			testutil.WithGoCmp(comparer).Equals(t, localResult, distResult, queryExplanation(distQry))
+
+			promEngine := promql.NewEngine(opts.EngineOpts)
+			promQry, err := promEngine.NewRangeQuery(ctx, completeSeriesSet, nil, tcase.expected, start, end, step)
+			testutil.Ok(t, err)
+			promResult := promQry.Exec(ctx)
+			testutil.Ok(t, promResult.Err)
+
+			expected, err := promResult.Matrix()
+			testutil.Ok(t, err)
+			actual, err := localResult.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, len(expected), len(actual))
+			for i := range expected {
+				testutil.Equals(t, expected[i].Metric, actual[i].Metric)
+				testutil.Equals(t, len(expected[i].Floats), len(actual[i].Floats))
+				for j, p := range expected[i].Floats {
+					testutil.Assert(t, math.Abs(actual[i].Floats[j].F-p.F) <= 0.02*p.F, "expected %v to be close to %v", actual[i].Floats[j].F, p.F)
+				}
+			}
+		})
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/thanos-io/promql-engine/execution/parse"
 	"github.com/thanos-io/promql-engine/execution/telemetry"
 	"github.com/thanos-io/promql-engine/extlabels"
+	"github.com/thanos-io/promql-engine/functions"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
 	engstorage "github.com/thanos-io/promql-engine/storage"
@@ -28,6 +29,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
@@ -74,9 +76,88 @@ type Opts struct {
 	// This will default to false.
 	EnableXFunctions bool
 
+	// EnableApproximateQuantiles evaluates the quantile aggregation with mergeable sketches which use bounded memory.
+	// Quantiles are estimated with a relative error of at most 1.09% while the values span fewer than 2048 buckets of
+	// schema 6, which is about 2^32 in dynamic range. Beyond that, the smallest buckets are collapsed and low quantiles
+	// degrade. In distributed mode, remote engines return sketches from the quantile_sketch function which are merged
+	// locally, and must have this option enabled as well.
+	EnableApproximateQuantiles bool
+
+	// EnableApproximateCountDistinct enables the count_distinct_approx function which estimates the number of distinct
+	// values of a label with HyperLogLog sketches. For example, count_distinct_approx("user_id", X, "zone") approximates
+	// count by (zone) (count by (zone, user_id) (X)). In distributed mode, remote engines return sketches from the
+	// count_distinct_sketch function which are merged locally, and must have this option enabled as well.
+	EnableApproximateCountDistinct bool
+
+	// Location is the time zone in which date and time functions like hour() and day_of_week() are evaluated.
+	// Defaults to UTC.
+	Location *time.Location
+
+	// EnableTimeZoneFunctions enables variants of date and time functions with the _tz suffix, like
+	// hour_tz("Europe/Berlin", X), which take the name of the time zone as their first argument.
+	// This will default to false.
+	EnableTimeZoneFunctions bool
+
+	// EnableNHCBConversion enables the to_nhcb function, which converts classic histograms to native
+	// histograms with custom buckets.
+	// This will default to false.
+	EnableNHCBConversion bool
+
+	// EnableClassicConversion enables the to_classic function, which converts native histograms to classic
+	// histograms with the given bucket boundaries.
+	// This will default to false.
+	EnableClassicConversion bool
+
+	// EnableSeasonalFunctions enables holt_winters_seasonal and predict_seasonal, which smooth and forecast
+	// series with seasonality.
+	// This will default to false.
+	EnableSeasonalFunctions bool
+
+	// EnableStatisticalFunctions enables range vector functions which calculate statistics over the samples in
+	// a range, like ewma_over_time, zscore_over_time, skew_over_time and slope_over_time.
+	// This will default to false.
+	EnableStatisticalFunctions bool
+
+	// EnablePairedRangeFunctions enables the range vector functions of two series corr_over_time,
+	// covar_over_time and ratio_over_time.
+	// This will default to false.
+	EnablePairedRangeFunctions bool
+
+	// EnableHistogramQuantiles enables the histogram_quantiles function, which calculates several quantiles
+	// of the same histograms in a single pass.
+	// This will default to false.
+	EnableHistogramQuantiles bool
+
+	// EnableLabelFunctions enables label_keep, label_drop, label_copy and label_map, which transform the labels
+	// of their input series in addition to label_replace and label_join.
+	// This will default to false.
+	EnableLabelFunctions bool
+
+	// EnableGapFillingFunctions enables fill_gaps and interpolate, which fill steps without a sample in series of
+	// range query results.
+	// This will default to false.
+	EnableGapFillingFunctions bool
+
+	// EnableCreatedTimestamps makes rate, increase and delta inject a zero sample at the created timestamp
+	// of counters, like Prometheus does when ingesting created timestamps. This keeps the increase of counters
+	// which are created within the range, which would otherwise be lost. Created timestamps are read from
+	// sample iterators which implement the CreatedTimestampIterator interface from the storage/prometheus package.
+	// Zero samples are injected by matrix selectors of the storage/prometheus package before samples are pushed to
+	// ring buffers, so other callers of ringbuffer.RateBuffer have to push them themselves.
+	EnableCreatedTimestamps bool
+
+	// Functions contains user defined functions which can be used in queries in addition to built-in functions.
+	// Functions must be registered before the engine is created.
+	Functions *functions.Registry
+
 	// EnableAnalysis enables query analysis.
 	EnableAnalysis bool
 
+	// EnableExtendedRangeSelectors enables planning and executing the experimental anchored and smoothed
+	// modifiers for selectors, like rate(X[5m] anchored). The Prometheus parser only accepts them when its
+	// package-level flag parser.EnableExtendedRangeSelectors is set, which callers have to set themselves.
+	EnableExtendedRangeSelectors bool
+
 	// The Prometheus engine has internal check for duplicate labels produced by functions, aggregations or binary operators.
 	// This check can produce false positives when querying time-series data which does not conform to the Prometheus data model,
 	// and can be disabled if it leads to false positives.
@@ -98,6 +179,14 @@ type QueryOpts struct {
 
 	// LogicalOptimizers can be used to override the LogicalOptimizers engine setting.
 	LogicalOptimizers []logicalplan.Optimizer
+
+	// Location can be used to override the Location engine setting.
+	Location *time.Location
+
+	// CalendarStep evaluates range queries at calendar boundaries in the time zone of the
+	// query, like at every local midnight, instead of at the given step. Queries which are
+	// executed by remote engines in distributed mode do not support calendar steps.
+	CalendarStep *query.CalendarStep
 }
 
 func (opts QueryOpts) LookbackDelta() time.Duration { return opts.LookbackDeltaParam }
@@ -107,10 +196,15 @@ func fromPromQLOpts(opts promql.QueryOpts) *QueryOpts {
 	if opts == nil {
 		return &QueryOpts{}
 	}
-	return &QueryOpts{
+	res := &QueryOpts{
 		LookbackDeltaParam:      opts.LookbackDelta(),
 		EnablePerStepStatsParam: opts.EnablePerStepStats(),
 	}
+	// Calendar steps are kept so that queries with them are rejected instead of evaluated at a fixed step.
+	if o, ok := opts.(*QueryOpts); ok {
+		res.CalendarStep = o.CalendarStep
+	}
+	return res
 }
 
 // New creates a new query engine with the given options. The query engine will
@@ -128,6 +222,9 @@ func NewWithScanners(opts Opts, scanners engstorage.Scanners) *Engine {
 	if opts.Logger == nil {
 		opts.Logger = promslog.NewNopLogger()
 	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
 	if opts.LookbackDelta == 0 {
 		opts.LookbackDelta = 5 * time.Minute
 		opts.Logger.Debug("lookback delta is zero, setting to default value", "value", 5*time.Minute)
@@ -142,11 +239,45 @@ func NewWithScanners(opts Opts, scanners engstorage.Scanners) *Engine {
 		)
 	}
 
-	functions := make(map[string]*parser.Function, len(parser.Functions))
-	maps.Copy(functions, parser.Functions)
+	parserFunctions := make(map[string]*parser.Function, len(parser.Functions))
+	maps.Copy(parserFunctions, parser.Functions)
 	if opts.EnableXFunctions {
-		maps.Copy(functions, parse.XFunctions)
+		maps.Copy(parserFunctions, parse.XFunctions)
+	}
+	if opts.EnableApproximateQuantiles {
+		maps.Copy(parserFunctions, parse.QuantileSketchFunctions)
+	}
+	if opts.EnableApproximateCountDistinct {
+		maps.Copy(parserFunctions, parse.CountDistinctFunctions)
+	}
+	if opts.EnableTimeZoneFunctions {
+		maps.Copy(parserFunctions, parse.TimeZoneFunctions)
+	}
+	if opts.EnableLabelFunctions {
+		maps.Copy(parserFunctions, parse.LabelFunctions)
+	}
+	if opts.EnableGapFillingFunctions {
+		maps.Copy(parserFunctions, parse.GapFillingFunctions)
+	}
+	if opts.EnableNHCBConversion {
+		maps.Copy(parserFunctions, parse.NHCBConversionFunctions)
 	}
+	if opts.EnableClassicConversion {
+		maps.Copy(parserFunctions, parse.ClassicConversionFunctions)
+	}
+	if opts.EnableHistogramQuantiles {
+		maps.Copy(parserFunctions, parse.HistogramQuantilesFunctions)
+	}
+	if opts.EnableSeasonalFunctions {
+		maps.Copy(parserFunctions, parse.SeasonalFunctions)
+	}
+	if opts.EnableStatisticalFunctions {
+		maps.Copy(parserFunctions, parse.StatisticalFunctions)
+	}
+	if opts.EnablePairedRangeFunctions {
+		maps.Copy(parserFunctions, parse.PairedRangeFunctions)
+	}
+	maps.Copy(parserFunctions, opts.Functions.Signatures())
 
 	metrics := &engineMetrics{
 		currentQueries: promauto.With(opts.Reg).NewGauge(
@@ -179,11 +310,17 @@ func NewWithScanners(opts Opts, scanners engstorage.Scanners) *Engine {
 	}
 
 	return &Engine{
-		functions:          functions,
+		functions:          parserFunctions,
+		userFunctions:      opts.Functions,
 		scanners:           scanners,
 		activeQueryTracker: queryTracker,
+		location:           opts.Location,
 
 		disableDuplicateLabelChecks: opts.DisableDuplicateLabelChecks,
+		approximateQuantiles:        opts.EnableApproximateQuantiles,
+		createdTimestamps:           opts.EnableCreatedTimestamps,
+		delayedNameRemoval:          opts.EnableDelayedNameRemoval,
+		extendedRangeSelectors:      opts.EnableExtendedRangeSelectors,
 
 		logger:             opts.Logger,
 		lookbackDelta:      opts.LookbackDelta,
@@ -207,14 +344,26 @@ var (
 	// As long as we use this method we need to have batches that are smaller
 	// then 64 steps.
 	ErrStepsBatchTooLarge = errors.New("'StepsBatch' must be less than 64")
+
+	// Per-step statistics are tracked at a fixed interval.
+	ErrPerStepStatsWithCalendarStep = errors.New("per-step statistics are not supported with calendar steps")
+
+	// Anchored and smoothed selectors are only evaluated when EnableExtendedRangeSelectors is set.
+	ErrExtendedRangeSelectorsDisabled = errors.New("anchored and smoothed modifiers are not enabled")
 )
 
 type Engine struct {
 	functions          map[string]*parser.Function
+	userFunctions      *functions.Registry
 	scanners           engstorage.Scanners
 	activeQueryTracker promql.QueryTracker
+	location           *time.Location
 
 	disableDuplicateLabelChecks bool
+	approximateQuantiles        bool
+	createdTimestamps           bool
+	delayedNameRemoval          bool
+	extendedRangeSelectors      bool
 
 	logger             *slog.Logger
 	lookbackDelta      time.Duration
@@ -231,6 +380,28 @@ type Engine struct {
 	maxSamplesPerQuery       int
 }
 
+// checkExtendedRangeSelectors rejects plans with anchored or smoothed selectors unless they are enabled.
+func (e *Engine) checkExtendedRangeSelectors(plan logicalplan.Plan) error {
+	if e.extendedRangeSelectors {
+		return nil
+	}
+	var err error
+	root := plan.Root()
+	logicalplan.Traverse(&root, func(node *logicalplan.Node) {
+		switch n := (*node).(type) {
+		case *logicalplan.VectorSelector:
+			if n.Anchored || n.Smoothed {
+				err = ErrExtendedRangeSelectorsDisabled
+			}
+		case *logicalplan.MatrixSelector:
+			if n.Anchored || n.Smoothed {
+				err = ErrExtendedRangeSelectorsDisabled
+			}
+		}
+	})
+	return err
+}
+
 func (e *Engine) MakeInstantQuery(ctx context.Context, q storage.Queryable, opts *QueryOpts, qs string, ts time.Time) (promql.Query, error) {
 	idx, err := e.activeQueryTracker.Insert(ctx, qs)
 	if err != nil {
@@ -259,7 +430,10 @@ func (e *Engine) MakeInstantQuery(ctx context.Context, q storage.Queryable, opts
 	if err != nil {
 		return nil, errors.Wrap(err, "creating plan")
 	}
-	optimizedPlan, warns := initialPlan.Optimize(e.getLogicalOptimizers(opts))
+	optimizedPlan, warns := initialPlan.Optimize(e.getLogicalOptimizers(ctx, opts))
+	if err := e.checkExtendedRangeSelectors(optimizedPlan); err != nil {
+		return nil, err
+	}
 
 	ctx = warnings.NewContext(ctx)
 	defer func() { warns.Merge(warnings.FromContext(ctx)) }()
@@ -300,7 +474,10 @@ func (e *Engine) MakeInstantQueryFromPlan(ctx context.Context, q storage.Queryab
 	planOpts := logicalplan.PlanOptions{
 		DisableDuplicateLabelCheck: e.disableDuplicateLabelChecks,
 	}
-	lplan, warns := logicalplan.New(root, qOpts, planOpts).Optimize(e.getLogicalOptimizers(opts))
+	lplan, warns := logicalplan.New(root, qOpts, planOpts).Optimize(e.getLogicalOptimizers(ctx, opts))
+	if err := e.checkExtendedRangeSelectors(lplan); err != nil {
+		return nil, err
+	}
 
 	ctx = warnings.NewContext(ctx)
 	defer func() { warns.Merge(warnings.FromContext(ctx)) }()
@@ -349,6 +526,9 @@ func (e *Engine) MakeRangeQuery(ctx context.Context, q storage.Queryable, opts *
 	if qOpts.StepsBatch > 64 {
 		return nil, ErrStepsBatchTooLarge
 	}
+	if qOpts.CalendarStep != nil && qOpts.EnablePerStepStats {
+		return nil, ErrPerStepStatsWithCalendarStep
+	}
 	planOpts := logicalplan.PlanOptions{
 		DisableDuplicateLabelCheck: e.disableDuplicateLabelChecks,
 	}
@@ -357,7 +537,10 @@ func (e *Engine) MakeRangeQuery(ctx context.Context, q storage.Queryable, opts *
 	if err != nil {
 		return nil, errors.Wrap(err, "creating plan")
 	}
-	optimizedPlan, warns := initialPlan.Optimize(e.getLogicalOptimizers(opts))
+	optimizedPlan, warns := initialPlan.Optimize(e.getLogicalOptimizers(ctx, opts))
+	if err := e.checkExtendedRangeSelectors(optimizedPlan); err != nil {
+		return nil, err
+	}
 
 	ctx = warnings.NewContext(ctx)
 	defer func() { warns.Merge(warnings.FromContext(ctx)) }()
@@ -394,10 +577,16 @@ func (e *Engine) MakeRangeQueryFromPlan(ctx context.Context, q storage.Queryable
 	if qOpts.StepsBatch > 64 {
 		return nil, ErrStepsBatchTooLarge
 	}
+	if qOpts.CalendarStep != nil && qOpts.EnablePerStepStats {
+		return nil, ErrPerStepStatsWithCalendarStep
+	}
 	planOpts := logicalplan.PlanOptions{
 		DisableDuplicateLabelCheck: e.disableDuplicateLabelChecks,
 	}
-	lplan, warns := logicalplan.New(root, qOpts, planOpts).Optimize(e.getLogicalOptimizers(opts))
+	lplan, warns := logicalplan.New(root, qOpts, planOpts).Optimize(e.getLogicalOptimizers(ctx, opts))
+	if err := e.checkExtendedRangeSelectors(lplan); err != nil {
+		return nil, err
+	}
 
 	scnrs, err := e.storageScanners(q, qOpts, lplan)
 	if err != nil {
@@ -447,6 +636,11 @@ func (e *Engine) makeQueryOpts(start time.Time, end time.Time, step time.Duratio
 		NoStepSubqueryIntervalFn: e.noStepSubqueryIntervalFn,
 		DecodingConcurrency:      e.decodingConcurrency,
 		SampleTracker:            query.NewSampleTracker(e.maxSamplesPerQuery),
+		Functions:                e.userFunctions,
+		ApproximateQuantiles:     e.approximateQuantiles,
+		Location:                 e.location,
+		CreatedTimestamps:        e.createdTimestamps,
+		EnableDelayedNameRemoval: e.delayedNameRemoval,
 	}
 
 	if opts == nil {
@@ -463,11 +657,18 @@ func (e *Engine) makeQueryOpts(start time.Time, end time.Time, step time.Duratio
 	if opts.DecodingConcurrency != 0 {
 		res.DecodingConcurrency = opts.DecodingConcurrency
 	}
+	if opts.Location != nil {
+		res.Location = opts.Location
+	}
+	// Instant queries do not have steps.
+	if opts.CalendarStep != nil && step != 0 {
+		res = res.WithCalendarStep(*opts.CalendarStep)
+	}
 
 	return res
 }
 
-func (e *Engine) getLogicalOptimizers(opts *QueryOpts) []logicalplan.Optimizer {
+func (e *Engine) getLogicalOptimizers(ctx context.Context, opts *QueryOpts) []logicalplan.Optimizer {
 	var optimizers []logicalplan.Optimizer
 	if len(opts.LogicalOptimizers) != 0 {
 		optimizers = slices.Clone(opts.LogicalOptimizers)
@@ -478,7 +679,7 @@ func (e *Engine) getLogicalOptimizers(opts *QueryOpts) []logicalplan.Optimizer {
 	if opts.SelectorBatchSize != 0 {
 		selectorBatchSize = opts.SelectorBatchSize
 	}
-	return append(optimizers, logicalplan.SelectorBatchSize{Size: selectorBatchSize})
+	return logicalplan.WithContext(ctx, append(optimizers, logicalplan.SelectorBatchSize{Size: selectorBatchSize}))
 }
 
 func (e *Engine) storageScanners(queryable storage.Queryable, qOpts *query.Options, lplan logicalplan.Plan) (engstorage.Scanners, error) {
@@ -609,6 +810,7 @@ loop:
 			}
 			matrix = append(matrix, s)
 		}
+		dropMarkedMetricNames(matrix)
 		sort.Sort(matrix)
 		ret.Value = matrix
 		ret.Warnings = warnings.FromContext(ctx)
@@ -621,7 +823,12 @@ loop:
 	var result parser.Value
 	switch q.plan.Root().ReturnType() {
 	case parser.ValueTypeMatrix:
-		result = promql.Matrix(series)
+		matrix := promql.Matrix(series)
+		dropMarkedMetricNames(matrix)
+		if matrix.ContainsSameLabelset() {
+			return newErrResult(ret, extlabels.ErrDuplicateLabelSet)
+		}
+		result = matrix
 	case parser.ValueTypeVector:
 		// Convert matrix with one value per series into vector.
 		vector := make(promql.Vector, 0, len(resultSeries))
@@ -650,6 +857,11 @@ loop:
 			vector = filterFloats(vector)
 		}
 		sort.Slice(vector, q.resultSort.comparer(&vector))
+		// Names are only dropped after sorting, so that series can be sorted by their name.
+		var b labels.ScratchBuilder
+		for i := range vector {
+			vector[i].Metric = extlabels.DropMarkedMetricName(vector[i].Metric, b)
+		}
 		if vector.ContainsSameLabelset() {
 			return newErrResult(ret, extlabels.ErrDuplicateLabelSet)
 		}
@@ -669,6 +881,14 @@ loop:
 	return ret
 }
 
+// dropMarkedMetricNames removes the metric names of series which were marked for delayed name removal.
+func dropMarkedMetricNames(matrix promql.Matrix) {
+	var b labels.ScratchBuilder
+	for i := range matrix {
+		matrix[i].Metric = extlabels.DropMarkedMetricName(matrix[i].Metric, b)
+	}
+}
+
 func newErrResult(r *promql.Result, err error) *promql.Result {
 	if r == nil {
 		r = &promql.Result{}
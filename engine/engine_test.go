@@ -53,6 +53,9 @@ import (
 
 func TestMain(m *testing.M) {
 	parser.EnableExperimentalFunctions = true
+	// The parser only accepts the anchored and smoothed modifiers with its
+	// package-level flag, which callers of the engine have to set themselves.
+	parser.EnableExtendedRangeSelectors = true
 	goleak.VerifyTestMain(m,
 		// https://github.com/census-instrumentation/opencensus-go/blob/d7677d6af5953e0506ac4c08f349c62b917a443a/stats/view/worker.go#L34
 		goleak.IgnoreTopFunction("go.opencensus.io/stats/view.(*worker).start"),
@@ -73,9 +76,12 @@ func (s *skipTest) Run(name string, t func(*testing.T)) bool {
 }
 
 func TestPromqlAcceptance(t *testing.T) {
-	// promql acceptance tests disable experimental functions again
+	// promql acceptance tests disable experimental functions and modifiers again
 	// since we use them in our tests too we need to enable them afterwards again
-	t.Cleanup(func() { parser.EnableExperimentalFunctions = true })
+	t.Cleanup(func() {
+		parser.EnableExperimentalFunctions = true
+		parser.EnableExtendedRangeSelectors = true
+	})
 
 	engine := engine.New(engine.Opts{
 		EngineOpts: promql.EngineOpts{
@@ -85,16 +91,17 @@ func TestPromqlAcceptance(t *testing.T) {
 			MaxSamples:               5e10,
 			Timeout:                  1 * time.Hour,
 			NoStepSubqueryIntervalFn: func(rangeMillis int64) int64 { return 30 * time.Second.Milliseconds() },
-		}})
+			// Like the test engine of Prometheus, which name_label_dropping.test depends on.
+			EnableDelayedNameRemoval: true,
+		},
+		EnableExtendedRangeSelectors: true,
+	})
 
 	st := &skipTest{
 		skipTests: []string{
-			"testdata/name_label_dropping.test", // feature unsupported
-			"testdata/type_and_unit.test",       // feature unsupported
-			"testdata/extended_vectors.test",    // experimental anchored/smoothed modifiers unsupported
-			"testdata/info.test",                // info() function unsupported
-			"testdata/literals.test",            // string literal expressions as query results unsupported
-			"testdata/range_queries.test",       // matrix selector as instant query result unsupported
+			"testdata/type_and_unit.test", // feature unsupported
+			"testdata/literals.test",      // string literal expressions as query results unsupported
+			"testdata/range_queries.test", // matrix selector as instant query result unsupported
 		}, // TODO(sungjin1212): change to test whole cases
 		TBRun: t,
 	}
@@ -388,6 +395,35 @@ or
 			    http_requests_total{pod="nginx-2"} 1+2x18`,
 			query: `quantile_over_time(0.9, http_requests_total[1m])`,
 		},
+		{
+			name: "quantile_over_time with non-constant param",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 41.00+0.20x40
+			    http_requests_total{pod="nginx-2"} 51+21.71x40
+			    param_series 0+0.02x40`,
+			query: `quantile_over_time(scalar(param_series), http_requests_total[2m])`,
+			start: start,
+			end:   end,
+		},
+		{
+			name: "quantile_over_time with non-constant param out of range",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 41.00+0.20x40
+			    http_requests_total{pod="nginx-2"} 51+21.71x40
+			    param_series -0.5+0.05x40`,
+			query: `quantile_over_time(scalar(param_series), http_requests_total[2m])`,
+			start: start,
+			end:   end,
+		},
+		{
+			name: "quantile_over_time with param from time",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 41.00+0.20x40
+			    http_requests_total{pod="nginx-2"} 51+21.71x40`,
+			query: `quantile_over_time(time() / 1000, http_requests_total[2m])`,
+			start: start,
+			end:   end,
+		},
 		{
 			name: "quantile_over_time with subquery",
 			load: `load 30s
@@ -417,6 +453,25 @@ or
 			start: start,
 			end:   end,
 		},
+		{
+			name: "predict_linear with non-constant param",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 41.00+0.20x40
+			    http_requests_total{pod="nginx-2"} 51+21.71x40
+			    param_series 1+1x40`,
+			query: `predict_linear(http_requests_total[5m], scalar(param_series))`,
+			start: start,
+			end:   end,
+		},
+		{
+			name: "predict_linear with param from time",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 41.00+0.20x40
+			    http_requests_total{pod="nginx-2"} 51+21.71x40`,
+			query: `predict_linear(http_requests_total[5m], time() - 600)`,
+			start: start,
+			end:   end,
+		},
 		{
 			name: "predict_linear with subquery and non-existing param series",
 			load: `load 30s
@@ -874,6 +929,38 @@ or
 			load:  "",
 			query: `vector(24)`,
 		},
+		{
+			name:  "constant vector arithmetic",
+			load:  "",
+			query: `abs(vector(-2)) + scalar(vector(3)) * vector(2) > bool 7`,
+		},
+		{
+			name: "identity operations",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 1+1x15
+			    http_requests_total{pod="nginx-2"} 1+2x20`,
+			query: `((http_requests_total * 1) / 1 + -(-sum by (pod) (http_requests_total) * 1)) + 0`,
+		},
+		{
+			name: "contradicting matchers",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", job="a"} 1+1x15
+			    http_requests_total{pod="nginx-2", job="b"} 1+2x20`,
+			query: `sum(rate(http_requests_total{job="a", job="b"}[1m])) or (http_requests_total{job!=""} unless http_requests_total{job=~"", job!=""}) and on(pod) http_requests_total`,
+		},
+		{
+			name: "absent with contradicting matchers",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", job="a"} 1+1x15`,
+			query: `absent(http_requests_total{job="a", job="b", pod="nginx-1"})`,
+		},
+		{
+			name: "binary operation with contradicting sides",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", job="a"} 1+1x15
+			    http_requests_total{pod="nginx-2", job="b"} 1+2x20`,
+			query: `(http_requests_total{job="a"} * on(job) http_requests_total{job="b"}) or (http_requests_total{job="a"} unless on(job) http_requests_total{job="b"})`,
+		},
 		{
 			name: "binary operation atan2",
 			load: `load 30s
@@ -6734,6 +6821,59 @@ func TestDoubleExponentialSmoothing(t *testing.T) {
 			    http_requests_histogram{job="api-server", instance="1"} {{schema:0 count:1 sum:2}}x1000`,
 			query: `double_exponential_smoothing(http_requests_histogram[5m], 0.01, 0.1)`,
 		},
+		{
+			name: "double exponential smoothing with non-constant factors",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 1+1x15
+			    http_requests_total{pod="nginx-2"} 1+2x18
+			    smoothing_factor 0.1+0.01x40
+			    trend_factor 0.5-0.01x40`,
+			query: `double_exponential_smoothing(http_requests_total[5m], scalar(smoothing_factor), scalar(trend_factor))`,
+		},
+		{
+			name: "double exponential smoothing with non-constant smoothing factor",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 1+1x15
+			    smoothing_factor 0.1+0.01x40`,
+			query: `double_exponential_smoothing(http_requests_total[5m], scalar(smoothing_factor), 0.3)`,
+		},
+		{
+			name: "double exponential smoothing with missing non-constant factor",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `double_exponential_smoothing(http_requests_total[5m], 0.3, scalar(trend_factor))`,
+		},
+		{
+			name: "double exponential smoothing with invalid smoothing factor",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `double_exponential_smoothing(http_requests_total[5m], 1, 0.1)`,
+		},
+		{
+			name: "double exponential smoothing with invalid trend factor",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `double_exponential_smoothing(http_requests_total[5m], 0.1, 0)`,
+		},
+		{
+			name: "double exponential smoothing with invalid factor and no series",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `double_exponential_smoothing(missing_total[5m], 0.1, 0)`,
+		},
+		{
+			name: "double exponential smoothing with non-constant factor becoming invalid",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 1+1x15
+			    trend_factor 0.5+0.05x40`,
+			query: `double_exponential_smoothing(http_requests_total[5m], 0.1, scalar(trend_factor))`,
+		},
+		{
+			name: "double exponential smoothing over subquery with invalid factor",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `double_exponential_smoothing(http_requests_total[5m:1m], 0.1, 1)`,
+		},
 	}
 
 	for _, tcase := range cases {
@@ -16,6 +16,7 @@ import (
 	"github.com/thanos-io/promql-engine/api"
 	"github.com/thanos-io/promql-engine/engine"
 	"github.com/thanos-io/promql-engine/logicalplan"
+	"github.com/thanos-io/promql-engine/query"
 
 	"github.com/cortexproject/promqlsmith"
 	"github.com/efficientgo/core/errors"
@@ -52,6 +53,9 @@ const (
 // shouldValidateSamples checks if the samples can be compared for the expr.
 // For certain known cases, Thanos engine returns less samples than Prometheus engine due to optimizations.
 func shouldValidateSamples(expr parser.Expr) bool {
+	if selectsFewerSeries(expr) {
+		return false
+	}
 	valid := true
 
 	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
@@ -82,6 +86,34 @@ func shouldValidateSamples(expr parser.Expr) bool {
 	return valid
 }
 
+// selectsFewerSeries checks if matchers are propagated into selectors of the expr using
+// PropagateMatchersOptimizer or selectors are pruned using PruneContradictionsOptimizer.
+// Both select fewer series than Prometheus engine, but must not change the result.
+func selectsFewerSeries(expr parser.Expr) bool {
+	optimize := func(optimizers ...logicalplan.Optimizer) string {
+		// Planning modifies the expression, so each plan is created from a copy.
+		ast, err := parser.ParseExpr(expr.String())
+		if err != nil {
+			return ""
+		}
+		plan, err := logicalplan.NewFromAST(ast, &query.Options{}, logicalplan.PlanOptions{})
+		if err != nil {
+			return ""
+		}
+		optimized, _ := plan.Optimize(optimizers)
+		// Matrix selectors are rendered with their original string, so all selectors are added.
+		root := optimized.Root()
+		selectors := []string{root.String()}
+		logicalplan.Traverse(&root, func(node *logicalplan.Node) {
+			if vs, ok := (*node).(*logicalplan.VectorSelector); ok {
+				selectors = append(selectors, vs.String())
+			}
+		})
+		return strings.Join(selectors, ",")
+	}
+	return optimize() != optimize(logicalplan.PropagateMatchersOptimizer{}, logicalplan.PruneContradictionsOptimizer{})
+}
+
 // validateExpr checks if the given expression is valid for fuzz tests.
 // For certain known cases Thanos engine results do not match with Prometheus engine.
 func validateExpr(expr parser.Expr, testType testType) bool {
@@ -6,6 +6,7 @@ package engine
 import (
 	"sync"
 
+	"github.com/thanos-io/promql-engine/execution"
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/execution/telemetry"
 	"github.com/thanos-io/promql-engine/logicalplan"
@@ -33,6 +34,7 @@ type AnalyzeOutputNode struct {
 
 type ExplainOutputNode struct {
 	OperatorName string              `json:"name,omitempty"`
+	Cost         *logicalplan.Cost   `json:"cost,omitempty"`
 	Children     []ExplainOutputNode `json:"children,omitempty"`
 }
 
@@ -120,6 +122,7 @@ func explainVector(v model.VectorOperator) *ExplainOutputNode {
 
 	return &ExplainOutputNode{
 		OperatorName: v.String(),
+		Cost:         execution.EstimatedCost(v),
 		Children:     children,
 	}
 }
@@ -108,6 +108,39 @@ func TestQueryExplain(t *testing.T) {
 	}
 }
 
+func TestQueryExplainMatrixSelectorParams(t *testing.T) {
+	t.Parallel()
+	series := storage.MockSeries(
+		[]int64{240, 270, 300, 600, 630, 660},
+		[]float64{1, 2, 3, 4, 5, 6},
+		[]string{labels.MetricName, "foo"},
+	)
+
+	ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+	query, err := ng.NewRangeQuery(context.Background(), storageWithSeries(series), nil, `quantile_over_time(time() / 1000, foo[1m])`, time.Unix(0, 0), time.Unix(1000, 0), 30*time.Second)
+	testutil.Ok(t, err)
+
+	// collect returns the nodes in the tree whose operator name has the given prefix.
+	var collect func(node engine.ExplainOutputNode, prefix string) []engine.ExplainOutputNode
+	collect = func(node engine.ExplainOutputNode, prefix string) []engine.ExplainOutputNode {
+		var nodes []engine.ExplainOutputNode
+		if strings.HasPrefix(node.OperatorName, prefix) {
+			nodes = append(nodes, node)
+		}
+		for _, child := range node.Children {
+			nodes = append(nodes, collect(child, prefix)...)
+		}
+		return nodes
+	}
+
+	selectors := collect(*query.(engine.ExplainableQuery).Explain(), "[matrixSelector]")
+	testutil.Assert(t, len(selectors) > 0)
+	for _, selector := range selectors {
+		testutil.Equals(t, 1, len(selector.Children))
+		testutil.Equals(t, 1, len(collect(selector.Children[0], "[noArgFunction]")))
+	}
+}
+
 func TestQueryAnalyzeOperatorID(t *testing.T) {
 	t.Parallel()
 	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
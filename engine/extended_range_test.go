@@ -0,0 +1,167 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/logicalplan"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestExtendedRangeSelectors(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 15s
+	http_requests_total{pod="a"} 1+1x4 9+1x4 _ _ _ 20+3x10
+	http_requests_total{pod="b"} 0+10x8 5+10x20
+	http_requests_total{pod="c"} 100 _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ 130+5x5
+	temperature{room="a"} 20 18 25 21 19 17 22 30 _ _ _ _ 15 16 17
+`)
+	defer storage.Close()
+
+	queries := []string{
+		`rate(http_requests_total[1m] anchored)`,
+		`increase(http_requests_total[1m] anchored)`,
+		`increase(http_requests_total[2m] anchored)`,
+		`increase(http_requests_total[1m1ms] anchored)`,
+		`delta(temperature[1m] anchored)`,
+		`changes(temperature[1m] anchored)`,
+		`resets(http_requests_total[1m] anchored)`,
+		`increase(http_requests_total[1m] anchored offset 30s)`,
+		`rate(http_requests_total[1m] smoothed)`,
+		`increase(http_requests_total[1m] smoothed)`,
+		`increase(http_requests_total[45s] smoothed)`,
+		`delta(temperature[1m] smoothed)`,
+		`increase(http_requests_total[1m] smoothed offset 20s)`,
+		`sum by (pod) (increase(http_requests_total[1m] smoothed))`,
+		`http_requests_total smoothed`,
+		`timestamp(temperature smoothed)`,
+		`sum(http_requests_total smoothed)`,
+	}
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		opts  = promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10}
+	)
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			for _, step := range []time.Duration{10 * time.Second, 30 * time.Second, 5 * time.Minute} {
+				promEngine := promql.NewEngine(opts)
+				promQry, err := promEngine.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+				testutil.Ok(t, err)
+				expected := promQry.Exec(ctx)
+				testutil.Ok(t, expected.Err)
+
+				ng := engine.New(engine.Opts{EngineOpts: opts, EnableExtendedRangeSelectors: true})
+				qry, err := ng.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+				testutil.Ok(t, err)
+				res := qry.Exec(ctx)
+				testutil.Ok(t, res.Err)
+				testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+			}
+			for _, ts := range []time.Time{time.Unix(5, 0), time.Unix(95, 0), time.Unix(300, 0)} {
+				promEngine := promql.NewEngine(opts)
+				promQry, err := promEngine.NewInstantQuery(ctx, storage, nil, query, ts)
+				testutil.Ok(t, err)
+				expected := promQry.Exec(ctx)
+				testutil.Ok(t, expected.Err)
+
+				ng := engine.New(engine.Opts{EngineOpts: opts, EnableExtendedRangeSelectors: true})
+				qry, err := ng.NewInstantQuery(ctx, storage, nil, query, ts)
+				testutil.Ok(t, err)
+				res := qry.Exec(ctx)
+				testutil.Ok(t, res.Err)
+				testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+			}
+		})
+	}
+}
+
+func TestExtendedRangeSelectorErrors(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 15s
+	http_requests_total{pod="a"} 1+1x10
+	native_requests{pod="a"} {{schema:0 sum:1 count:1 buckets:[1]}}+{{schema:0 sum:1 count:1 buckets:[1]}}x10
+`)
+	defer storage.Close()
+
+	cases := []struct {
+		query string
+		err   string
+	}{
+		{
+			query: `max_over_time(http_requests_total[1m] anchored)`,
+			err:   "anchored modifier can only be used with: changes, delta, increase, rate, resets - not with max_over_time",
+		},
+		{
+			query: `changes(http_requests_total[1m] smoothed)`,
+			err:   "smoothed modifier can only be used with: delta, increase, rate - not with changes",
+		},
+		{
+			query: `rate(native_requests[1m] anchored)`,
+			err:   "smoothed and anchored modifiers do not work with native histograms",
+		},
+	}
+	ctx := context.Background()
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnableExtendedRangeSelectors: true})
+			qry, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(120, 0))
+			if err == nil {
+				err = qry.Exec(ctx).Err
+			}
+			testutil.NotOk(t, err)
+			testutil.Equals(t, tc.err, err.Error())
+		})
+	}
+}
+
+func TestExtendedRangeSelectorsOption(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 15s
+	http_requests_total{pod="a"} 1+1x10
+`)
+	defer storage.Close()
+
+	var (
+		ctx  = context.Background()
+		opts = promql.EngineOpts{Timeout: time.Hour}
+	)
+	// The parser flag is set in TestMain, and the option only enables planning and execution.
+	for _, qs := range []string{`rate(http_requests_total[1m] anchored)`, `http_requests_total smoothed`} {
+		t.Run(qs, func(t *testing.T) {
+			_, err := engine.New(engine.Opts{EngineOpts: opts}).NewInstantQuery(ctx, storage, nil, qs, time.Unix(60, 0))
+			testutil.Equals(t, engine.ErrExtendedRangeSelectorsDisabled, err)
+
+			expr, err := parser.ParseExpr(qs)
+			testutil.Ok(t, err)
+			plan, err := logicalplan.NewFromAST(expr, &query.Options{Start: time.Unix(60, 0), End: time.Unix(60, 0)}, logicalplan.PlanOptions{})
+			testutil.Ok(t, err)
+			_, err = engine.New(engine.Opts{EngineOpts: opts}).MakeInstantQueryFromPlan(ctx, storage, &engine.QueryOpts{}, plan.Root(), time.Unix(60, 0))
+			testutil.Equals(t, engine.ErrExtendedRangeSelectorsDisabled, err)
+
+			qry, err := engine.New(engine.Opts{EngineOpts: opts, EnableExtendedRangeSelectors: true}).NewInstantQuery(ctx, storage, nil, qs, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer qry.Close()
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestGapFillingFunctions(t *testing.T) {
+	t.Parallel()
+
+	// With a lookback delta of 1s, series only have samples at steps with a raw sample.
+	storage := storageWithMockSeries(
+		newMockSeries([]string{labels.MetricName, "requests", "pod", "a"}, []int64{0, 30, 150, 300}, []float64{1, 2, 6, 10}),
+		newMockSeries([]string{labels.MetricName, "requests", "pod", "b"}, []int64{60}, []float64{5}),
+		newMockSeries([]string{labels.MetricName, "requests", "pod", "c"}, []int64{900}, []float64{1}),
+	)
+
+	var (
+		podA   = labels.FromStrings(labels.MetricName, "requests", "pod", "a")
+		podB   = labels.FromStrings(labels.MetricName, "requests", "pod", "b")
+		points = func(values ...float64) []promql.FPoint {
+			result := make([]promql.FPoint, 0, len(values))
+			for i, v := range values {
+				// -1 marks steps without a sample.
+				if v != -1 {
+					result = append(result, promql.FPoint{T: int64(i) * 30000, F: v})
+				}
+			}
+			return result
+		}
+	)
+	cases := []struct {
+		query    string
+		expected promql.Matrix
+	}{
+		{
+			query: `fill_gaps(requests, 0)`,
+			expected: promql.Matrix{
+				{Metric: podA, Floats: points(1, 2, 0, 0, 0, 6, 0, 0, 0, 0, 10)},
+				{Metric: podB, Floats: points(0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 0)},
+			},
+		},
+		{
+			query: `fill_gaps(requests{pod="b"}, time())`,
+			expected: promql.Matrix{
+				{Metric: podB, Floats: points(0, 30, 5, 90, 120, 150, 180, 210, 240, 270, 300)},
+			},
+		},
+		{
+			query: `interpolate(requests, "linear")`,
+			expected: promql.Matrix{
+				{Metric: podA, Floats: points(1, 2, 3, 4, 5, 6, 6.8, 7.6, 8.4, 9.2, 10)},
+				{Metric: podB, Floats: points(-1, -1, 5, -1, -1, -1, -1, -1, -1, -1, -1)},
+			},
+		},
+		{
+			query: `interpolate(requests, "previous", 120)`,
+			expected: promql.Matrix{
+				{Metric: podA, Floats: points(1, 2, 2, 2, 2, 6, -1, -1, -1, -1, 10)},
+				{Metric: podB, Floats: points(-1, -1, 5, -1, -1, -1, -1, -1, -1, -1, -1)},
+			},
+		},
+		{
+			query: `interpolate(requests, "next")`,
+			expected: promql.Matrix{
+				{Metric: podA, Floats: points(1, 2, 6, 6, 6, 6, 10, 10, 10, 10, 10)},
+				{Metric: podB, Floats: points(-1, -1, 5, -1, -1, -1, -1, -1, -1, -1, -1)},
+			},
+		},
+		{
+			query: `sum(fill_gaps(requests, 1))`,
+			expected: promql.Matrix{
+				{Metric: labels.EmptyLabels(), Floats: points(2, 3, 6, 2, 2, 7, 2, 2, 2, 2, 11)},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour, LookbackDelta: time.Second}, EnableGapFillingFunctions: true})
+			qry, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			testutil.WithGoCmp(comparer).Equals(t, &promql.Result{Value: tc.expected}, res, queryExplanation(qry))
+		})
+	}
+}
+
+func TestGapFillingFunctionErrors(t *testing.T) {
+	t.Parallel()
+
+	storage := storageWithMockSeries(newMockSeries([]string{labels.MetricName, "requests"}, []int64{0, 60}, []float64{1, 2}))
+
+	cases := []struct {
+		query string
+		err   string
+	}{
+		{
+			query: `interpolate(requests, "cubic")`,
+			err:   `invalid interpolation method in interpolate: "cubic", expected one of "linear", "previous" or "next"`,
+		},
+		{
+			query: `interpolate(requests, "linear", 0)`,
+			err:   "invalid maximum gap in interpolate. Expected: a positive number of seconds, got: 0.000000",
+		},
+		{
+			query: `interpolate(requests, "linear", time())`,
+			err:   "maximum gap of interpolate must be a number literal",
+		},
+	}
+	ctx := context.Background()
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnableGapFillingFunctions: true})
+			qry, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, time.Unix(0, 0), time.Unix(60, 0), 30*time.Second)
+			if err == nil {
+				err = qry.Exec(ctx).Err
+			}
+			testutil.NotOk(t, err)
+			testutil.Assert(t, strings.HasPrefix(err.Error(), tc.err), "unexpected error: %s", err)
+		})
+	}
+}
+
+func TestGapFillingFunctionsWhenDisabled(t *testing.T) {
+	t.Parallel()
+
+	ng := engine.New(engine.Opts{})
+	for _, query := range []string{
+		`fill_gaps(requests, 0)`,
+		`interpolate(requests, "linear")`,
+	} {
+		_, err := ng.NewRangeQuery(context.Background(), nil, nil, query, time.Unix(0, 0), time.Unix(60, 0), 30*time.Second)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "unknown function with name"), "unexpected error: %v", err)
+	}
+}
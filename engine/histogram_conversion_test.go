@@ -0,0 +1,203 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestToNHCB(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 30s
+	http_request_duration_seconds_bucket{pod="a", le="0.1"}  0+2x20
+	http_request_duration_seconds_bucket{pod="a", le="0.5"}  0+5x20
+	http_request_duration_seconds_bucket{pod="a", le="1"}    0+9x20
+	http_request_duration_seconds_bucket{pod="a", le="+Inf"} 0+10x20
+	http_request_duration_seconds_sum{pod="a"}               0+4x20
+	http_request_duration_seconds_count{pod="a"}             0+10x20
+	http_request_duration_seconds_bucket{pod="b", le="0.1"}  0+1x20
+	http_request_duration_seconds_bucket{pod="b", le="0.5"}  0+1x20
+	http_request_duration_seconds_bucket{pod="b", le="1"}    0+6x20
+	http_request_duration_seconds_bucket{pod="b", le="+Inf"} 0+8x20
+	http_request_duration_seconds_sum{pod="b"}               0+5x20
+	http_request_duration_seconds_count{pod="b"}             0+8x20
+	native_duration_seconds{pod="c"} {{schema:-53 sum:4 count:10 custom_values:[0.1 0.5 1] buckets:[2 3 4 1]}}+{{schema:-53 sum:4 count:10 custom_values:[0.1 0.5 1] buckets:[2 3 4 1]}}x20
+`)
+	defer storage.Close()
+
+	var (
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		step  = 30 * time.Second
+	)
+	cases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "histogram_quantile",
+			query:    `histogram_quantile(0.9, to_nhcb(http_request_duration_seconds_bucket))`,
+			expected: `histogram_quantile(0.9, http_request_duration_seconds_bucket)`,
+		},
+		{
+			name:     "histogram_quantile in lowest bucket",
+			query:    `histogram_quantile(0.1, to_nhcb(http_request_duration_seconds_bucket))`,
+			expected: `histogram_quantile(0.1, http_request_duration_seconds_bucket)`,
+		},
+		{
+			name:     "histogram_quantile of rate",
+			query:    `histogram_quantile(0.5, to_nhcb(rate(http_request_duration_seconds_bucket[2m])))`,
+			expected: `histogram_quantile(0.5, rate(http_request_duration_seconds_bucket[2m]))`,
+		},
+		{
+			name:     "histogram_quantile of aggregated buckets",
+			query:    `histogram_quantile(0.75, sum(to_nhcb(http_request_duration_seconds_bucket)))`,
+			expected: `histogram_quantile(0.75, sum by (le) (http_request_duration_seconds_bucket))`,
+		},
+		{
+			name:     "histogram_fraction",
+			query:    `histogram_fraction(0, 0.5, to_nhcb(http_request_duration_seconds_bucket))`,
+			expected: `histogram_fraction(0, 0.5, http_request_duration_seconds_bucket)`,
+		},
+		{
+			name:     "histogram_count",
+			query:    `histogram_count(to_nhcb(http_request_duration_seconds_bucket))`,
+			expected: `sum without (le) (http_request_duration_seconds_bucket{le="+Inf"})`,
+		},
+		{
+			name:     "histogram_sum",
+			query:    `histogram_sum(to_nhcb({__name__=~"http_request_duration_seconds_(bucket|sum)"}))`,
+			expected: `sum without () (http_request_duration_seconds_sum)`,
+		},
+		{
+			name:     "native histograms are unchanged",
+			query:    `histogram_quantile(0.9, to_nhcb(native_duration_seconds))`,
+			expected: `histogram_quantile(0.9, native_duration_seconds)`,
+		},
+		{
+			name:     "classic and native histograms",
+			query:    `histogram_quantile(0.9, to_nhcb({__name__=~"http_request_duration_seconds_bucket|native_duration_seconds", pod=~"a|c"}))`,
+			expected: `histogram_quantile(0.9, {__name__=~"http_request_duration_seconds_bucket|native_duration_seconds", pod=~"a|c"})`,
+		},
+		{
+			name:     "metric name",
+			query:    `count by (__name__) (to_nhcb(http_request_duration_seconds_bucket))`,
+			expected: `label_replace(count by (__name__) (http_request_duration_seconds_count), "__name__", "http_request_duration_seconds", "", "")`,
+		},
+	}
+
+	ctx := context.Background()
+	ng := engine.New(engine.Opts{
+		EngineOpts:           promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10},
+		EnableNHCBConversion: true,
+	})
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			qry, err := ng.NewRangeQuery(ctx, storage, nil, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+			defer qry.Close()
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+
+			expectedQry, err := ng.NewRangeQuery(ctx, storage, nil, tcase.expected, start, end, step)
+			testutil.Ok(t, err)
+			defer expectedQry.Close()
+			expected := expectedQry.Exec(ctx)
+			testutil.Ok(t, expected.Err)
+
+			testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+		})
+	}
+}
+
+func TestToClassic(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 30s
+	http_request_duration_seconds_bucket{pod="a", le="0.1"}  0+2x20
+	http_request_duration_seconds_bucket{pod="a", le="0.5"}  0+5x20
+	http_request_duration_seconds_bucket{pod="a", le="1"}    0+9x20
+	http_request_duration_seconds_bucket{pod="a", le="+Inf"} 0+10x20
+	native_duration_seconds{pod="c"} {{schema:-53 sum:4 count:10 custom_values:[0.1 0.5 1] buckets:[2 3 4 1]}}+{{schema:-53 sum:4 count:10 custom_values:[0.1 0.5 1] buckets:[2 3 4 1]}}x20
+	exponential_duration_seconds{pod="d"} {{schema:0 sum:10 count:4 buckets:[1 2 1]}}x20
+	float_metric{pod="e"} 1x20
+`)
+	defer storage.Close()
+
+	ctx := context.Background()
+	ng := engine.New(engine.Opts{
+		EngineOpts:              promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10},
+		EnableNHCBConversion:    true,
+		EnableClassicConversion: true,
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		var (
+			start = time.Unix(0, 0)
+			end   = time.Unix(600, 0)
+			step  = 30 * time.Second
+		)
+		for query, expected := range map[string]string{
+			`to_classic(to_nhcb(http_request_duration_seconds_bucket), 0.1, 0.5, 1)`:               `http_request_duration_seconds_bucket`,
+			`histogram_quantile(0.9, to_classic(native_duration_seconds, 1, 0.1, 0.5, +Inf, 0.5))`: `histogram_quantile(0.9, native_duration_seconds)`,
+			`sum by (le) (to_classic(native_duration_seconds, 0.5))`:                               `sum by (le) (to_classic(native_duration_seconds, 0.5, +Inf))`,
+		} {
+			qry, err := ng.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+
+			expectedQry, err := ng.NewRangeQuery(ctx, storage, nil, expected, start, end, step)
+			testutil.Ok(t, err)
+			expectedRes := expectedQry.Exec(ctx)
+			testutil.Ok(t, expectedRes.Err)
+
+			testutil.WithGoCmp(comparer).Equals(t, expectedRes, res, queryExplanation(qry))
+		}
+	})
+
+	t.Run("exponential buckets", func(t *testing.T) {
+		qry, err := ng.NewInstantQuery(ctx, storage, nil, `to_classic({__name__=~"exponential_duration_seconds|float_metric"}, 1, 2, 3, 4, 0.1)`, time.Unix(60, 0))
+		testutil.Ok(t, err)
+		res := qry.Exec(ctx)
+		testutil.Ok(t, res.Err)
+
+		bucket := func(le string, v float64) promql.Sample {
+			return promql.Sample{
+				Metric: labels.FromStrings(labels.MetricName, "exponential_duration_seconds_bucket", "le", le, "pod", "d"),
+				T:      60000,
+				F:      v,
+			}
+		}
+		// Buckets are (0.5, 1], (1, 2] and (2, 4]. Counts within a bucket are interpolated exponentially.
+		expected := &promql.Result{Value: promql.Vector{
+			bucket("+Inf", 4),
+			bucket("0.1", 0),
+			bucket("1", 1),
+			bucket("2", 3),
+			bucket("3", 3+math.Log2(1.5)),
+			bucket("4", 4),
+		}}
+		testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+	})
+
+	t.Run("boundaries must be number literals", func(t *testing.T) {
+		_, err := ng.NewInstantQuery(ctx, storage, nil, `to_classic(native_duration_seconds, scalar(float_metric))`, time.Unix(60, 0))
+		testutil.NotOk(t, err)
+	})
+}
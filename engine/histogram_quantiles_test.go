@@ -0,0 +1,156 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestHistogramQuantiles(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 30s
+	http_request_duration_seconds_bucket{pod="a", le="0.1"}  0+2x20
+	http_request_duration_seconds_bucket{pod="a", le="0.5"}  0+5x20
+	http_request_duration_seconds_bucket{pod="a", le="1"}    0+9x20
+	http_request_duration_seconds_bucket{pod="a", le="+Inf"} 0+10x20
+	http_request_duration_seconds_bucket{pod="b", le="0.1"}  0+1x20
+	http_request_duration_seconds_bucket{pod="b", le="0.5"}  0+1x20
+	http_request_duration_seconds_bucket{pod="b", le="1"}    0+6x20
+	http_request_duration_seconds_bucket{pod="b", le="+Inf"} 0+8x20
+	http_request_duration_seconds_bucket{pod="c", le="1"}    0+3x20
+	native_duration_seconds{pod="d"} {{schema:0 sum:4 count:10 buckets:[2 3 4 1]}}+{{schema:0 sum:4 count:10 buckets:[2 3 4 1]}}x20
+	native_duration_seconds{pod="e"} {{schema:-53 sum:4 count:10 custom_values:[0.1 0.5 1] buckets:[2 3 4 1]}}x20
+`)
+	defer storage.Close()
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		step  = 30 * time.Second
+		opts  = promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10}
+	)
+	cases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:  "classic histograms",
+			query: `histogram_quantiles(http_request_duration_seconds_bucket, "quantile", 0.5, 0.9, 0.99)`,
+			expected: `
+  label_replace(histogram_quantile(0.5, http_request_duration_seconds_bucket), "quantile", "0.5", "", "")
+or
+  label_replace(histogram_quantile(0.9, http_request_duration_seconds_bucket), "quantile", "0.9", "", "")
+or
+  label_replace(histogram_quantile(0.99, http_request_duration_seconds_bucket), "quantile", "0.99", "", "")`,
+		},
+		{
+			name:  "native histograms",
+			query: `histogram_quantiles(native_duration_seconds, "p", 0.25, 0.75)`,
+			expected: `
+  label_replace(histogram_quantile(0.25, native_duration_seconds), "p", "0.25", "", "")
+or
+  label_replace(histogram_quantile(0.75, native_duration_seconds), "p", "0.75", "", "")`,
+		},
+		{
+			name:  "rate of classic histograms",
+			query: `histogram_quantiles(sum by (le) (rate(http_request_duration_seconds_bucket[2m])), "quantile", 0.1, 0.5)`,
+			expected: `
+  label_replace(histogram_quantile(0.1, sum by (le) (rate(http_request_duration_seconds_bucket[2m]))), "quantile", "0.1", "", "")
+or
+  label_replace(histogram_quantile(0.5, sum by (le) (rate(http_request_duration_seconds_bucket[2m]))), "quantile", "0.5", "", "")`,
+		},
+		{
+			name:     "duplicate quantiles",
+			query:    `histogram_quantiles(native_duration_seconds, "quantile", 0.5, 0.5)`,
+			expected: `label_replace(histogram_quantile(0.5, native_duration_seconds), "quantile", "0.5", "", "")`,
+		},
+		{
+			name:  "quantiles out of range",
+			query: `histogram_quantiles(http_request_duration_seconds_bucket, "quantile", -1, 2)`,
+			expected: `
+  label_replace(histogram_quantile(-1, http_request_duration_seconds_bucket), "quantile", "-1", "", "")
+or
+  label_replace(histogram_quantile(2, http_request_duration_seconds_bucket), "quantile", "2", "", "")`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			promEngine := promql.NewEngine(opts)
+			promQry, err := promEngine.NewRangeQuery(ctx, storage, nil, tc.expected, start, end, step)
+			testutil.Ok(t, err)
+			expected := promQry.Exec(ctx)
+			testutil.Ok(t, expected.Err)
+
+			ng := engine.New(engine.Opts{EngineOpts: opts, EnableHistogramQuantiles: true})
+			qry, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+		})
+	}
+}
+
+func TestHistogramQuantilesErrors(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 30s
+	http_request_duration_seconds_bucket{le="1"}    0+1x10
+	http_request_duration_seconds_bucket{le="+Inf"} 0+2x10
+`)
+	defer storage.Close()
+
+	cases := []struct {
+		query string
+		err   string
+	}{
+		{
+			query: `histogram_quantiles(http_request_duration_seconds_bucket, "quantile")`,
+			err:   "expected at least 3 argument(s) in call to \"histogram_quantiles\", got 2",
+		},
+		{
+			query: `histogram_quantiles(http_request_duration_seconds_bucket, "quantile", time())`,
+			err:   "quantiles of histogram_quantiles must be number literals",
+		},
+		{
+			query: `histogram_quantiles(http_request_duration_seconds_bucket, "", 0.5)`,
+			err:   "invalid quantile label name in histogram_quantiles: ",
+		},
+	}
+	ctx := context.Background()
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnableHistogramQuantiles: true})
+			qry, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(60, 0))
+			if err == nil {
+				err = qry.Exec(ctx).Err
+			}
+			testutil.NotOk(t, err)
+			testutil.Assert(t, strings.Contains(err.Error(), tc.err), "unexpected error: %s", err)
+		})
+	}
+}
+
+func TestHistogramQuantilesWhenDisabled(t *testing.T) {
+	t.Parallel()
+
+	ng := engine.New(engine.Opts{})
+	_, err := ng.NewInstantQuery(context.Background(), nil, nil, `histogram_quantiles(http_request_duration_seconds_bucket, "quantile", 0.5, 0.9)`, time.Unix(0, 0))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "unknown function with name"), "unexpected error: %v", err)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestLabelFunctions(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 30s
+	http_requests_total{pod="nginx-1", namespace="web", region="us-east-1", env="prod"} 1+1x10
+	http_requests_total{pod="nginx-2", namespace="web", region="eu-west-1", env="dev"}  2+2x10
+	http_requests_total{pod="api-1", namespace="api", region="us-east-1"}              3+3x10
+`)
+	defer storage.Close()
+
+	cases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "label_keep",
+			query:    `label_keep(http_requests_total, "pod", "region")`,
+			expected: `sum by (pod, region) (http_requests_total)`,
+		},
+		{
+			name:     "label_keep with regex",
+			query:    `label_keep(rate(http_requests_total[1m]), "p.*", "n.+")`,
+			expected: `sum by (pod, namespace) (rate(http_requests_total[1m]))`,
+		},
+		{
+			name:     "label_drop",
+			query:    `label_drop(http_requests_total, "env", "region")`,
+			expected: `label_replace(label_replace(http_requests_total, "env", "", "", ""), "region", "", "", "")`,
+		},
+		{
+			name:     "label_drop with regex",
+			query:    `label_drop(http_requests_total, "__name__|re.*")`,
+			expected: `sum without (region) (http_requests_total)`,
+		},
+		{
+			name:     "label_copy",
+			query:    `label_copy(http_requests_total, "service", "namespace")`,
+			expected: `label_replace(http_requests_total, "service", "$1", "namespace", "(.*)")`,
+		},
+		{
+			name:     "label_copy of missing label",
+			query:    `label_copy(http_requests_total, "pod", "env")`,
+			expected: `label_join(http_requests_total, "pod", "", "env")`,
+		},
+		{
+			name:  "label_map",
+			query: `label_map(http_requests_total, "location", "region", "us-east-1", "Virginia", "eu-west-1", "Ireland")`,
+			expected: `
+  label_replace(http_requests_total{region="us-east-1"}, "location", "Virginia", "", "")
+or
+  label_replace(http_requests_total{region="eu-west-1"}, "location", "Ireland", "", "")`,
+		},
+		{
+			name:     "label_map keeps unmapped values",
+			query:    `label_map(http_requests_total, "region", "region", "us-east-1", "us")`,
+			expected: `label_replace(http_requests_total, "region", "us", "region", "us-east-1")`,
+		},
+		{
+			name:     "label_map to empty value",
+			query:    `label_map(http_requests_total, "env", "env", "dev", "")`,
+			expected: `label_replace(http_requests_total, "env", "", "env", "dev")`,
+		},
+		{
+			name:     "aggregation over label_keep",
+			query:    `sum by (region) (label_keep(http_requests_total, "region", "pod"))`,
+			expected: `sum by (region) (http_requests_total)`,
+		},
+		{
+			name:     "aggregation over label_map",
+			query:    `sum by (location) (label_map(http_requests_total, "location", "region", "us-east-1", "us", "eu-west-1", "eu"))`,
+			expected: `sum by (location) (label_replace(http_requests_total, "location", "$1", "region", "(us|eu)-.*"))`,
+		},
+	}
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, 0)
+		end   = time.Unix(300, 0)
+		step  = 30 * time.Second
+		opts  = promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10}
+	)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			promEngine := promql.NewEngine(opts)
+			promQry, err := promEngine.NewRangeQuery(ctx, storage, nil, tc.expected, start, end, step)
+			testutil.Ok(t, err)
+			expected := promQry.Exec(ctx)
+			testutil.Ok(t, expected.Err)
+
+			ng := engine.New(engine.Opts{EngineOpts: opts, EnableLabelFunctions: true})
+			qry, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+		})
+	}
+}
+
+func TestLabelFunctionErrors(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 30s
+	http_requests_total{pod="nginx-1", namespace="web"} 1+1x10
+	http_requests_total{pod="nginx-2", namespace="web"} 2+2x10
+`)
+	defer storage.Close()
+
+	cases := []struct {
+		query string
+		err   string
+	}{
+		{
+			query: `label_keep(http_requests_total, "namespace")`,
+			err:   "vector cannot contain metrics with the same labelset",
+		},
+		{
+			query: `label_drop(http_requests_total, "(pod")`,
+			err:   "invalid regular expression in label_drop(): (pod",
+		},
+		{
+			query: `label_copy(http_requests_total, "", "pod")`,
+			err:   "invalid destination label name in label_copy: ",
+		},
+		{
+			query: `label_map(http_requests_total, "dst", "pod", "nginx-1", "a", "nginx-2")`,
+			err:   "label_map expects pairs of source and destination values, got 3 values",
+		},
+		{
+			query: `label_map(http_requests_total, "dst", "pod", "nginx-1", "a", "nginx-1", "b")`,
+			err:   "duplicate source value in label_map: nginx-1",
+		},
+	}
+	ctx := context.Background()
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnableLabelFunctions: true})
+			qry, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.NotOk(t, res.Err)
+			testutil.Equals(t, tc.err, res.Err.Error())
+		})
+	}
+}
+
+func TestLabelFunctionsWhenDisabled(t *testing.T) {
+	t.Parallel()
+
+	ng := engine.New(engine.Opts{})
+	for _, query := range []string{
+		`label_keep(http_requests_total, "pod")`,
+		`label_drop(http_requests_total, "pod")`,
+		`label_copy(http_requests_total, "dst", "pod")`,
+		`label_map(http_requests_total, "dst", "pod", "nginx-1", "a")`,
+	} {
+		_, err := ng.NewInstantQuery(context.Background(), nil, nil, query, time.Unix(0, 0))
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "unknown function with name"), "unexpected error: %v", err)
+	}
+}
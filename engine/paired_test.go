@@ -0,0 +1,168 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestPairedRangeFunctions(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 15s
+	latency{pod="a", instance="1"}    1 4 2 8 5 7 3 9 6 10 2 11 4 7 5 13 1 6 8 12 3 9 14 2 7 5 10 4 8 6 11 3 9 12 5 7 2 10 6 8 4
+	latency{pod="a", instance="2"}    1+1x40
+	latency{pod="b", instance="1"}    5x40
+	latency{pod="c", instance="1"}    1+1x40
+	saturation{pod="a", instance="1"} 2 3 1 9 4 8 2 7 7 12 1 10 5 6 6 11 2 5 9 14 2 8 12 3 6 4 9 5 9 7 10 2 8 13 6 6 3 11 5 9 3
+	saturation{pod="a", instance="2"} 40-1x40
+	saturation{pod="b", instance="1"} 1+2x40
+	saturation{pod="d", instance="1"} 1+1x40
+`)
+	defer storage.Close()
+
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    `ratio_over_time(latency[5m], saturation[5m])`,
+			expected: `sum_over_time(latency[5m]) / sum_over_time(saturation[5m])`,
+		},
+		{
+			query:    `covar_over_time(latency[5m], saturation[5m])`,
+			expected: `avg_over_time((latency * saturation)[5m:15s]) - avg_over_time(latency[5m]) * avg_over_time(saturation[5m])`,
+		},
+		{
+			query:    `corr_over_time(latency[5m], saturation[5m])`,
+			expected: `(avg_over_time((latency * saturation)[5m:15s]) - avg_over_time(latency[5m]) * avg_over_time(saturation[5m])) / (stddev_over_time(latency[5m]) * stddev_over_time(saturation[5m]))`,
+		},
+		{
+			query:    `ratio_over_time(latency[2m] offset 1m, saturation[3m])`,
+			expected: `sum_over_time(latency[2m] offset 1m) / sum_over_time(saturation[2m] offset 1m)`,
+		},
+		{
+			query:    `sum by (pod) (ratio_over_time(latency[5m], saturation[5m]))`,
+			expected: `sum by (pod) (sum_over_time(latency[5m]) / sum_over_time(saturation[5m]))`,
+		},
+	}
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		opts  = promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10}
+	)
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			for _, step := range []time.Duration{10 * time.Second, 30 * time.Second, time.Minute} {
+				promEngine := promql.NewEngine(opts)
+				promQry, err := promEngine.NewRangeQuery(ctx, storage, nil, tc.expected, start, end, step)
+				testutil.Ok(t, err)
+				expected := promQry.Exec(ctx)
+				testutil.Ok(t, expected.Err)
+
+				ng := engine.New(engine.Opts{EngineOpts: opts, EnablePairedRangeFunctions: true})
+				qry, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, start, end, step)
+				testutil.Ok(t, err)
+				res := qry.Exec(ctx)
+				testutil.Ok(t, res.Err)
+				testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+			}
+		})
+	}
+}
+
+func TestPairedRangeFunctionsAlignSamples(t *testing.T) {
+	t.Parallel()
+
+	// Samples of the second series are scraped 5s after samples of the first one.
+	storage := storageWithMockSeries(
+		newMockSeries([]string{labels.MetricName, "errors", "pod", "a"}, []int64{10, 20, 30, 40}, []float64{1, 2, 3, 4}),
+		newMockSeries([]string{labels.MetricName, "requests", "pod", "a"}, []int64{15, 25, 35}, []float64{10, 10, 10}),
+	)
+
+	ctx := context.Background()
+	ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnablePairedRangeFunctions: true})
+	qry, err := ng.NewInstantQuery(ctx, storage, nil, `ratio_over_time(errors[1m], requests[1m])`, time.Unix(40, 0))
+	testutil.Ok(t, err)
+	res := qry.Exec(ctx)
+	testutil.Ok(t, res.Err)
+
+	// The first sample of errors has no earlier sample of requests and is not used.
+	expected := promql.Vector{{Metric: labels.FromStrings("pod", "a"), T: 40000, F: 9. / 30}}
+	testutil.WithGoCmp(comparer).Equals(t, &promql.Result{Value: expected}, res, queryExplanation(qry))
+}
+
+func TestPairedRangeFunctionErrors(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 15s
+	latency{pod="a"}    1+1x10
+	saturation{pod="a"} 1+1x10
+	queue{pod="a"}      1+1x10
+`)
+	defer storage.Close()
+
+	cases := []struct {
+		query string
+		err   string
+	}{
+		{
+			query: `corr_over_time(latency[1m], {__name__=~"saturation|queue"}[1m])`,
+			err:   `found duplicate series for the match group in the second argument of corr_over_time: {__name__="queue", pod="a"} and {__name__="saturation", pod="a"}; series of each argument must have unique labels apart from the metric name`,
+		},
+		{
+			query: `corr_over_time({__name__=~"saturation|queue"}[1m], latency[1m])`,
+			err:   `found duplicate series for the match group in the first argument of corr_over_time: {__name__="queue", pod="a"} and {__name__="saturation", pod="a"}; series of each argument must have unique labels apart from the metric name`,
+		},
+		{
+			query: `corr_over_time(latency[1m:15s], saturation[1m])`,
+			err:   "corr_over_time is only supported with matrix selectors as arguments: unsupported expression",
+		},
+		{
+			query: `ratio_over_time(latency[1m] anchored, saturation[1m])`,
+			err:   "anchored modifier can only be used with: changes, delta, increase, rate, resets - not with ratio_over_time",
+		},
+	}
+	ctx := context.Background()
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnablePairedRangeFunctions: true, EnableExtendedRangeSelectors: true})
+			qry, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(60, 0))
+			if err == nil {
+				err = qry.Exec(ctx).Err
+			}
+			testutil.NotOk(t, err)
+			testutil.Equals(t, tc.err, err.Error())
+		})
+	}
+}
+
+func TestPairedRangeFunctionsWhenDisabled(t *testing.T) {
+	t.Parallel()
+
+	ng := engine.New(engine.Opts{})
+	for _, query := range []string{
+		`corr_over_time(latency[5m], saturation[5m])`,
+		`covar_over_time(latency[5m], saturation[5m])`,
+		`ratio_over_time(errors[5m], requests[5m])`,
+	} {
+		_, err := ng.NewInstantQuery(context.Background(), nil, nil, query, time.Unix(0, 0))
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "unknown function with name"), "unexpected error: %v", err)
+	}
+}
@@ -144,6 +144,86 @@ func TestPropagateMatchers(t *testing.T) {
 	}
 }
 
+func TestPropagateMatchersThroughExpressions(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+		http_requests_total{pod="nginx-1", job="app", env="prod", instance="1"} 1+1x40
+		http_requests_total{pod="nginx-2", job="app", env="dev", instance="2"} 2+2x40
+		http_requests_total{pod="nginx-3", job="api", env="prod", instance="3"} 3+3x40
+		http_requests_total{pod="nginx-4", job="api", env="dev", instance="4"} 4+4x40
+		errors_total{pod="nginx-1", job="app", env="prod", instance="1"} 0.5+0.5x40
+		errors_total{pod="nginx-3", job="api", env="prod", instance="3"} 1.5+1.5x40
+		errors_total{pod="nginx-4", job="api", env="dev", instance="5"} 1+1x40
+		http_request_duration_seconds_bucket{pod="nginx-1", job="app", le="0.1"} 1+1x40
+		http_request_duration_seconds_bucket{pod="nginx-1", job="app", le="+Inf"} 3+3x40
+		http_request_duration_seconds_bucket{pod="nginx-3", job="api", le="0.1"} 1+2x40
+		http_request_duration_seconds_bucket{pod="nginx-3", job="api", le="+Inf"} 4+4x40`
+
+	queries := []string{
+		`errors_total{job="app"} * on(instance) http_requests_total`,
+		`errors_total{job="app", instance="1"} * ignoring(instance) http_requests_total`,
+		`sum by (job) (rate(errors_total{job="api"}[2m])) / on(job) sum by (job) (rate(http_requests_total[2m]))`,
+		`sum without (pod, instance) (errors_total{env="prod"}) / sum without (pod, instance) (http_requests_total)`,
+		`topk by (job) (1, http_requests_total) and on(job) errors_total{job="api"}`,
+		`count_values by (job) ("job", http_requests_total) * on(job) group_left errors_total{job="app"}`,
+		`errors_total{env="dev"} and on(env) http_requests_total`,
+		`http_requests_total unless on(job) errors_total{job="app"}`,
+		`http_requests_total{job="app"} unless on(job, instance) errors_total`,
+		`errors_total{job="app"} or on(job) http_requests_total`,
+		`label_replace(errors_total{job="api"}, "dst", "$1", "pod", "(.*)") * on(job, instance) http_requests_total`,
+		`label_replace(errors_total, "job", "app", "", "") * on(job, instance) http_requests_total{job="app"}`,
+		`max_over_time(errors_total{job="api"}[5m:1m]) * on(job, instance) max_over_time(rate(http_requests_total[1m])[5m:1m])`,
+		`histogram_quantile(0.9, http_request_duration_seconds_bucket{le="0.1"}) * on(job, pod) group_left http_requests_total`,
+		`(errors_total{job="app"} * 2) / on(job, instance) (http_requests_total + 1)`,
+		`errors_total{instance=""} * ignoring(instance) http_requests_total`,
+		`errors_total{pod!="nginx-1", pod!="nginx-3"} * http_requests_total`,
+	}
+
+	opts := promql.EngineOpts{
+		Timeout:              1 * time.Hour,
+		MaxSamples:           1e10,
+		EnableNegativeOffset: true,
+		EnableAtModifier:     true,
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	normalEngine := engine.New(engine.Opts{
+		EngineOpts:        opts,
+		LogicalOptimizers: logicalplan.NoOptimizers,
+	})
+	optimizedEngine := engine.New(engine.Opts{
+		EngineOpts:        opts,
+		LogicalOptimizers: logicalplan.DefaultOptimizers,
+	})
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, 0)
+		end   = time.Unix(1200, 0)
+		step  = 30 * time.Second
+	)
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			normalQuery, err := normalEngine.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer normalQuery.Close()
+			normalResult := normalQuery.Exec(ctx)
+			testutil.Ok(t, normalResult.Err)
+
+			optimizedQuery, err := optimizedEngine.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer optimizedQuery.Close()
+			optimizedResult := optimizedQuery.Exec(ctx)
+			testutil.Ok(t, optimizedResult.Err)
+
+			testutil.WithGoCmp(comparer).Equals(t, normalResult, optimizedResult, queryExplanation(optimizedQuery))
+		})
+	}
+}
+
 func replaceMetricNameIfEqual(node parser.Expr, metricNameMapping map[string]string) {
 	parser.Inspect(node, func(node parser.Node, nodes []parser.Node) error {
 		binOp, ok := (node).(*parser.BinaryExpr)
@@ -0,0 +1,201 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestSeasonalFunctions(t *testing.T) {
+	t.Parallel()
+
+	// A series with a linear trend and a season of 6 samples, scraped every 30s.
+	var (
+		pattern    = []float64{0, 10, 20, 10, -15, -25}
+		value      = func(i int64) float64 { return 100 + 0.5*float64(i) + pattern[i%int64(len(pattern))] }
+		timestamps = make([]int64, 100)
+		values     = make([]float64, 100)
+	)
+	for i := range timestamps {
+		timestamps[i] = int64(i) * 30
+		values[i] = value(int64(i))
+	}
+	storage := storageWithMockSeries(newMockSeries([]string{"__name__", "requests", "pod", "a"}, timestamps, values))
+
+	cases := []struct {
+		name  string
+		query string
+		// ahead is the number of samples after the last sample in the range for which the value is expected.
+		ahead int64
+	}{
+		{
+			name:  "holt_winters_seasonal",
+			query: `holt_winters_seasonal(requests[30m], 0.5, 0.3, 0.4, 6)`,
+		},
+		{
+			name:  "predict_seasonal",
+			query: `predict_seasonal(requests[30m], 0.5, 0.3, 0.4, 6, 3)`,
+			ahead: 3,
+		},
+		{
+			name:  "predict_seasonal over more than a season",
+			query: `predict_seasonal(requests[30m], 0.2, 0.1, 0.7, 6, 10)`,
+			ahead: 10,
+		},
+		{
+			name:  "predict_seasonal of subquery",
+			query: `predict_seasonal(requests[30m:30s], 0.5, 0.3, 0.4, 6, 3)`,
+			ahead: 3,
+		},
+		{
+			name:  "predict_seasonal with step parameter",
+			query: `predict_seasonal(requests[30m], scalar(vector(0.5)), 0.3, 0.4, 6, 3)`,
+			ahead: 3,
+		},
+	}
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(1200, 0)
+		end   = time.Unix(2970, 0)
+		step  = 30 * time.Second
+	)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnableSeasonalFunctions: true})
+			qry, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+
+			m, err := res.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(m))
+			testutil.Equals(t, int((end.Sub(start))/step)+1, len(m[0].Floats))
+			for _, p := range m[0].Floats {
+				expected := value(p.T/30000 + tc.ahead)
+				testutil.Assert(t, math.Abs(expected-p.F) < 1e-9, "at %d: expected %f, got %f", p.T, expected, p.F)
+			}
+		})
+	}
+}
+
+func TestSeasonalFunctionsWithoutTwoSeasons(t *testing.T) {
+	t.Parallel()
+
+	storage := storageWithMockSeries(newMockSeries(
+		[]string{"__name__", "requests", "pod", "a"},
+		[]int64{0, 30, 60, 90, 120, 150, 180, 210, 240, 270, 300},
+		[]float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	))
+
+	ctx := context.Background()
+	ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnableSeasonalFunctions: true})
+	qry, err := ng.NewInstantQuery(ctx, storage, nil, `holt_winters_seasonal(requests[10m], 0.5, 0.5, 0.5, 6)`, time.Unix(300, 0))
+	testutil.Ok(t, err)
+	res := qry.Exec(ctx)
+	testutil.Ok(t, res.Err)
+	v, err := res.Vector()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(v))
+}
+
+func TestSeasonalFunctionErrors(t *testing.T) {
+	t.Parallel()
+
+	storage := storageWithMockSeries(newMockSeries(
+		[]string{"__name__", "requests", "pod", "a"},
+		[]int64{0, 30, 60, 90},
+		[]float64{1, 2, 3, 4},
+	))
+
+	cases := []struct {
+		query string
+		err   string
+	}{
+		{
+			query: `holt_winters_seasonal(requests[5m], 0.5, 0.5, 1, 6)`,
+			err:   "invalid seasonal factor. Expected: 0 < sf < 1, got: 1.000000",
+		},
+		{
+			query: `holt_winters_seasonal(requests[5m], 0.5, 0.5, 0.5, 2.5)`,
+			err:   "invalid season length. Expected: an integer between 2 and 2147483647, got: 2.500000",
+		},
+		{
+			query: `holt_winters_seasonal(requests[5m], 0.5, 0.5, 0.5, 2147483648)`,
+			err:   "invalid season length. Expected: an integer between 2 and 2147483647, got: 2147483648.000000",
+		},
+		{
+			query: `predict_seasonal(requests[5m], 0.5, 0.5, 0.5, 6, 0)`,
+			err:   "invalid number of forecast samples. Expected: an integer between 1 and 2147483647, got: 0.000000",
+		},
+		{
+			query: `predict_seasonal(requests[10m], 0.5, 0.5, 0.5, 2, 1e19)`,
+			err:   "invalid number of forecast samples. Expected: an integer between 1 and 2147483647, got: 10000000000000000000.000000",
+		},
+		{
+			query: `predict_seasonal(requests[5m:30s], 0.5, 0.5, 0.5, 6, time())`,
+			err:   "seasonal factor, season length and forecast samples of predict_seasonal must be number literals",
+		},
+		{
+			query: `holt_winters_seasonal(requests[5m], 1.5, 0.5, 0.5, 6)`,
+			err:   "invalid smoothing factor. Expected: 0 < sf < 1, got: 1.500000",
+		},
+	}
+	ctx := context.Background()
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnableSeasonalFunctions: true})
+			qry, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(90, 0))
+			if err == nil {
+				err = qry.Exec(ctx).Err
+			}
+			testutil.NotOk(t, err)
+			testutil.Assert(t, strings.HasPrefix(err.Error(), tc.err), "unexpected error: %s", err)
+		})
+	}
+}
+
+func TestPredictSeasonalWithMaximumForecastSamples(t *testing.T) {
+	t.Parallel()
+
+	storage := storageWithMockSeries(newMockSeries(
+		[]string{"__name__", "requests", "pod", "a"},
+		[]int64{0, 30, 60, 90},
+		[]float64{1, 2, 3, 4},
+	))
+
+	ctx := context.Background()
+	ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnableSeasonalFunctions: true})
+	qry, err := ng.NewInstantQuery(ctx, storage, nil, `predict_seasonal(requests[10m], 0.5, 0.5, 0.5, 2, 2147483647)`, time.Unix(90, 0))
+	testutil.Ok(t, err)
+	res := qry.Exec(ctx)
+	testutil.Ok(t, res.Err)
+	v, err := res.Vector()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(v))
+}
+
+func TestSeasonalFunctionsWhenDisabled(t *testing.T) {
+	t.Parallel()
+
+	ng := engine.New(engine.Opts{})
+	for _, query := range []string{
+		`holt_winters_seasonal(requests[10m], 0.5, 0.5, 0.5, 6)`,
+		`predict_seasonal(requests[10m], 0.5, 0.5, 0.5, 6, 1)`,
+	} {
+		_, err := ng.NewInstantQuery(context.Background(), nil, nil, query, time.Unix(0, 0))
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "unknown function with name"), "unexpected error: %v", err)
+	}
+}
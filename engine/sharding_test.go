@@ -0,0 +1,106 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/logicalplan"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestQuerySharding(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+		http_requests_total{pod="nginx-1", job="app", env="prod"} 1+1x40
+		http_requests_total{pod="nginx-2", job="app", env="dev"} 2+2x40
+		http_requests_total{pod="nginx-3", job="api", env="prod"} 3+3x40
+		http_requests_total{pod="nginx-4", job="api", env="dev"} 4+4x40
+		http_requests_total{pod="nginx-5", job="api", env="dev"} 5+5x40
+		http_requests_total{pod="nginx-6", job="db", env="prod"} 6+1x20 _x5 1+1x15
+		errors_total{pod="nginx-1", job="app", env="prod"} 0.5+0.5x40
+		errors_total{pod="nginx-2", job="app", env="dev"} 1+1x40
+		errors_total{pod="nginx-3", job="api", env="prod"} 1.5+1.5x40
+		http_request_duration_seconds_bucket{pod="nginx-1", job="app", le="0.1"} 1+1x40
+		http_request_duration_seconds_bucket{pod="nginx-1", job="app", le="0.5"} 2+2x40
+		http_request_duration_seconds_bucket{pod="nginx-1", job="app", le="+Inf"} 3+3x40
+		http_request_duration_seconds_bucket{pod="nginx-2", job="api", le="0.1"} 1+2x40
+		http_request_duration_seconds_bucket{pod="nginx-2", job="api", le="0.5"} 3+3x40
+		http_request_duration_seconds_bucket{pod="nginx-2", job="api", le="+Inf"} 4+4x40
+		native_histogram{pod="nginx-1"} {{schema:0 sum:5 count:4 buckets:[1 2 1]}}+{{schema:0 sum:2 count:1 buckets:[1]}}x40
+		native_histogram{pod="nginx-2"} {{schema:0 sum:3 count:3 buckets:[1 1 1]}}+{{schema:0 sum:1 count:2 buckets:[1 1]}}x40`
+
+	queries := []string{
+		`sum(http_requests_total)`,
+		`sum by (job) (rate(http_requests_total[2m]))`,
+		`sum without (pod) (http_requests_total)`,
+		`count by (env) (http_requests_total)`,
+		`min by (job) (http_requests_total)`,
+		`max(rate(http_requests_total[2m]) * 8)`,
+		`group by (job) (http_requests_total > 10)`,
+		`topk(2, http_requests_total)`,
+		`bottomk by (job) (1, http_requests_total)`,
+		`max(sum by (pod) (http_requests_total))`,
+		`sum(rate(errors_total[2m])) / sum(rate(http_requests_total[2m]))`,
+		`histogram_quantile(0.9, sum by (le) (rate(http_request_duration_seconds_bucket[2m])))`,
+		`sum by (job) (max_over_time(rate(http_requests_total[1m])[5m:30s]))`,
+		`sum(rate(native_histogram[2m]))`,
+		`count(http_requests_total{job="unknown"})`,
+		`count_distinct_approx("pod", http_requests_total, "job")`,
+		`count_distinct_approx("env", rate(http_requests_total[2m]))`,
+	}
+
+	opts := promql.EngineOpts{
+		Timeout:              1 * time.Hour,
+		MaxSamples:           1e10,
+		EnableNegativeOffset: true,
+		EnableAtModifier:     true,
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	normalEngine := engine.New(engine.Opts{
+		EngineOpts:                     opts,
+		LogicalOptimizers:              logicalplan.DefaultOptimizers,
+		EnableApproximateCountDistinct: true,
+	})
+	shardedEngine := engine.New(engine.Opts{
+		EngineOpts:                     opts,
+		LogicalOptimizers:              append(slices.Clone(logicalplan.DefaultOptimizers), logicalplan.QueryShardingOptimizer{Shards: 3}),
+		EnableApproximateCountDistinct: true,
+	})
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, 0)
+		end   = time.Unix(1200, 0)
+		step  = 30 * time.Second
+	)
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			normalQuery, err := normalEngine.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer normalQuery.Close()
+			normalResult := normalQuery.Exec(ctx)
+			testutil.Ok(t, normalResult.Err)
+
+			shardedQuery, err := shardedEngine.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer shardedQuery.Close()
+			shardedResult := shardedQuery.Exec(ctx)
+			testutil.Ok(t, shardedResult.Err)
+
+			testutil.WithGoCmp(comparer).Equals(t, normalResult, shardedResult, queryExplanation(shardedQuery))
+		})
+	}
+}
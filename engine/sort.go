@@ -6,6 +6,8 @@ package engine
 import (
 	"math"
 
+	"github.com/thanos-io/promql-engine/extlabels"
+
 	"github.com/facette/natsort"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
@@ -67,7 +69,7 @@ func extractSortingLabels(f *parser.Call) []string {
 	for i := range args {
 		res = append(res, args[i].(*parser.StringLiteral).Val)
 	}
-	return res
+	return extlabels.WithoutDropNameLabel(res)
 }
 
 func newResultSort(expr parser.Expr) resultSorter {
@@ -87,19 +89,19 @@ func newResultSort(expr parser.Expr) resultSorter {
 		switch texpr.Op {
 		case parser.TOPK:
 			return aggregateResultSort{
-				sortingLabels: texpr.Grouping,
+				sortingLabels: extlabels.WithoutDropNameLabel(texpr.Grouping),
 				sortOrder:     sortOrderDesc,
 				groupBy:       !texpr.Without,
 			}
 		case parser.BOTTOMK:
 			return aggregateResultSort{
-				sortingLabels: texpr.Grouping,
+				sortingLabels: extlabels.WithoutDropNameLabel(texpr.Grouping),
 				sortOrder:     sortOrderAsc,
 				groupBy:       !texpr.Without,
 			}
 		case parser.LIMITK, parser.LIMIT_RATIO:
 			return aggregateResultSort{
-				sortingLabels: texpr.Grouping,
+				sortingLabels: extlabels.WithoutDropNameLabel(texpr.Grouping),
 				groupBy:       !texpr.Without,
 			}
 		}
@@ -157,7 +159,7 @@ func (s sortByLabelFuncResult) comparer(samples *promql.Vector) func(i, j int) b
 			}
 		}
 		// If all labels provided as arguments were equal, sort by the full label set. This ensures a consistent ordering.
-		if lblsCmp := labels.Compare(iLb.Labels(), jLb.Labels()); lblsCmp < 0 {
+		if lblsCmp := labels.Compare(iLb.Del(extlabels.DropNameLabel).Labels(), jLb.Del(extlabels.DropNameLabel).Labels()); lblsCmp < 0 {
 			return s.sortOrder == sortOrderAsc
 		} else {
 			return s.sortOrder == sortOrderDesc
@@ -0,0 +1,210 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestStatisticalOverTimeFunctions(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 15s
+	http_requests{pod="a"} 1 4 2 8 5 7 3 9 6 10 2 11 4 7 5 13 1 6 8 12 3 9 14 2 7 5 10 4 8 6 11 3 9 12 5 7 2 10 6 8 4
+	http_requests{pod="b"} 0+3x40
+	http_requests{pod="c"} 5x40
+	http_requests{pod="d"} {{schema:0 sum:1 count:1}}x10 1+2x29
+`)
+	defer storage.Close()
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		opts  = promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10}
+		steps = []time.Duration{10 * time.Second, 30 * time.Second, time.Minute}
+	)
+
+	t.Run("equivalent expressions", func(t *testing.T) {
+		cases := []struct {
+			query    string
+			expected string
+		}{
+			{
+				query:    `zscore_over_time(http_requests{pod!="d"}[5m])`,
+				expected: `(last_over_time(http_requests{pod!="d"}[5m]) - avg_over_time(http_requests{pod!="d"}[5m])) / stddev_over_time(http_requests{pod!="d"}[5m])`,
+			},
+			{
+				query:    `slope_over_time(http_requests[5m])`,
+				expected: `deriv(http_requests[5m])`,
+			},
+			{
+				query:    `intercept_over_time(http_requests[5m])`,
+				expected: `predict_linear(http_requests[5m], 0)`,
+			},
+			{
+				query:    `ewma_over_time(http_requests{pod!="d"}[5m], 1)`,
+				expected: `last_over_time(http_requests{pod!="d"}[5m]) * 1`,
+			},
+		}
+		for _, tc := range cases {
+			t.Run(tc.query, func(t *testing.T) {
+				for _, step := range steps {
+					promEngine := promql.NewEngine(opts)
+					promQry, err := promEngine.NewRangeQuery(ctx, storage, nil, tc.expected, start, end, step)
+					testutil.Ok(t, err)
+					expected := promQry.Exec(ctx)
+					testutil.Ok(t, expected.Err)
+
+					ng := engine.New(engine.Opts{EngineOpts: opts, EnableStatisticalFunctions: true})
+					qry, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, start, end, step)
+					testutil.Ok(t, err)
+					res := qry.Exec(ctx)
+					testutil.Ok(t, res.Err)
+					testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+				}
+			})
+		}
+	})
+
+	// Subqueries are always evaluated with the generic ring buffer, so comparing
+	// them with matrix selectors also covers the streaming buffers.
+	t.Run("subqueries", func(t *testing.T) {
+		for _, fn := range []string{
+			"ewma_over_time(%s, 0.3)",
+			"zscore_over_time(%s)",
+			"skew_over_time(%s)",
+			"kurtosis_over_time(%s)",
+			"slope_over_time(%s)",
+			"intercept_over_time(%s)",
+			"r2_over_time(%s)",
+			"percent_rank_over_time(%s)",
+		} {
+			query := fmt.Sprintf(fn, `http_requests[5m]`)
+			t.Run(query, func(t *testing.T) {
+				for _, step := range steps {
+					ng := engine.New(engine.Opts{EngineOpts: opts, EnableStatisticalFunctions: true})
+					subQry, err := ng.NewRangeQuery(ctx, storage, nil, fmt.Sprintf(fn, `http_requests[5m:15s]`), start, end, step)
+					testutil.Ok(t, err)
+					expected := subQry.Exec(ctx)
+					testutil.Ok(t, expected.Err)
+
+					qry, err := ng.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+					testutil.Ok(t, err)
+					res := qry.Exec(ctx)
+					testutil.Ok(t, res.Err)
+					testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(qry))
+				}
+			})
+		}
+	})
+}
+
+func TestStatisticalOverTimeFunctionValues(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 15s
+	increasing 1 2 3 4 10
+	shuffled   4 2 9 1 5
+	constant   3 3 3 3 3
+`)
+	defer storage.Close()
+
+	cases := []struct {
+		query    string
+		expected float64
+	}{
+		{query: `zscore_over_time(increasing[5m])`, expected: 6 / math.Sqrt(10)},
+		{query: `skew_over_time(increasing[5m])`, expected: math.Sqrt(5) * 180 / math.Pow(50, 1.5)},
+		{query: `kurtosis_over_time(increasing[5m])`, expected: 5*1394/2500. - 3},
+		{query: `ewma_over_time(increasing[5m], 0.5)`, expected: 6.5625},
+		{query: `r2_over_time(increasing[5m])`, expected: 0.8},
+		{query: `r2_over_time(constant[5m])`, expected: 1},
+		{query: `percent_rank_over_time(increasing[5m])`, expected: 1},
+		{query: `percent_rank_over_time(shuffled[5m])`, expected: 0.75},
+		{query: `percent_rank_over_time(shuffled[1m] offset 15s)`, expected: 0},
+	}
+	ctx := context.Background()
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnableStatisticalFunctions: true})
+			qry, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+
+			v, err := res.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(v))
+			testutil.Assert(t, math.Abs(tc.expected-v[0].F) < 1e-9, "expected %f, got %f", tc.expected, v[0].F)
+		})
+	}
+}
+
+func TestEWMAOverTimeErrors(t *testing.T) {
+	t.Parallel()
+
+	storage := promqltest.LoadedStorage(t, `
+load 15s
+	http_requests 1+1x10
+`)
+	defer storage.Close()
+
+	cases := []struct {
+		query string
+		err   string
+	}{
+		{
+			query: `ewma_over_time(http_requests[1m], 0)`,
+			err:   "invalid smoothing factor. Expected: 0 < alpha <= 1, got: 0.000000",
+		},
+		{
+			query: `ewma_over_time(http_requests[1m], 1.5)`,
+			err:   "invalid smoothing factor. Expected: 0 < alpha <= 1, got: 1.500000",
+		},
+		{
+			query: `ewma_over_time(http_requests[1m:15s], 1.5)`,
+			err:   "invalid smoothing factor. Expected: 0 < alpha <= 1, got: 1.500000",
+		},
+	}
+	ctx := context.Background()
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnableStatisticalFunctions: true})
+			qry, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(120, 0))
+			testutil.Ok(t, err)
+			res := qry.Exec(ctx)
+			testutil.NotOk(t, res.Err)
+			testutil.Equals(t, tc.err, res.Err.Error())
+		})
+	}
+}
+
+func TestStatisticalFunctionsWhenDisabled(t *testing.T) {
+	t.Parallel()
+
+	ng := engine.New(engine.Opts{})
+	for _, query := range []string{
+		`ewma_over_time(http_requests_total[5m], 0.5)`,
+		`zscore_over_time(http_requests_total[5m])`,
+		`percent_rank_over_time(http_requests_total[5m])`,
+	} {
+		_, err := ng.NewInstantQuery(context.Background(), nil, nil, query, time.Unix(0, 0))
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "unknown function with name"), "unexpected error: %v", err)
+	}
+}
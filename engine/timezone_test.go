@@ -0,0 +1,126 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/engine"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+)
+
+func TestTimeZones(t *testing.T) {
+	t.Parallel()
+
+	newYork, err := time.LoadLocation("America/New_York")
+	testutil.Ok(t, err)
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	testutil.Ok(t, err)
+
+	storage := promqltest.LoadedStorage(t, "")
+	defer storage.Close()
+
+	var (
+		// Daylight saving time starts in New York at 2024-03-10 07:00 UTC.
+		start = time.Date(2024, 3, 10, 4, 0, 0, 0, time.UTC)
+		end   = time.Date(2024, 3, 10, 9, 0, 0, 0, time.UTC)
+		step  = 30 * time.Minute
+	)
+	cases := []struct {
+		name      string
+		query     string
+		engineLoc *time.Location
+		queryLoc  *time.Location
+		loc       *time.Location
+		expected  func(time.Time) float64
+	}{
+		{
+			name:     "hour in UTC",
+			query:    `hour()`,
+			loc:      time.UTC,
+			expected: func(t time.Time) float64 { return float64(t.Hour()) },
+		},
+		{
+			name:      "hour in engine time zone",
+			query:     `hour()`,
+			engineLoc: newYork,
+			loc:       newYork,
+			expected:  func(t time.Time) float64 { return float64(t.Hour()) },
+		},
+		{
+			name:      "query time zone overrides engine time zone",
+			query:     `hour()`,
+			engineLoc: newYork,
+			queryLoc:  kolkata,
+			loc:       kolkata,
+			expected:  func(t time.Time) float64 { return float64(t.Hour()) },
+		},
+		{
+			name:      "time zone argument overrides query time zone",
+			query:     `minute_tz("Asia/Kolkata")`,
+			engineLoc: newYork,
+			loc:       kolkata,
+			expected:  func(t time.Time) float64 { return float64(t.Minute()) },
+		},
+		{
+			name:     "time zone argument with vector",
+			query:    `day_of_month_tz("America/New_York", vector(time()))`,
+			loc:      newYork,
+			expected: func(t time.Time) float64 { return float64(t.Day()) },
+		},
+		{
+			name:     "time zone argument with expression",
+			query:    `hour_tz("America/New_York", vector(time() + 3600))`,
+			loc:      newYork,
+			expected: func(t time.Time) float64 { return float64(t.Add(time.Hour).Hour()) },
+		},
+	}
+
+	ctx := context.Background()
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			ng := engine.New(engine.Opts{
+				EngineOpts: promql.EngineOpts{Timeout: time.Hour, MaxSamples: 1e10},
+				Location:   tcase.engineLoc,
+
+				EnableTimeZoneFunctions: true,
+			})
+			qry, err := ng.MakeRangeQuery(ctx, storage, &engine.QueryOpts{Location: tcase.queryLoc}, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+			defer qry.Close()
+
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			mat, err := res.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(mat))
+
+			var expected []promql.FPoint
+			for ts := start; !ts.After(end); ts = ts.Add(step) {
+				expected = append(expected, promql.FPoint{T: ts.UnixMilli(), F: tcase.expected(ts.In(tcase.loc))})
+			}
+			testutil.Equals(t, expected, mat[0].Floats)
+		})
+	}
+
+	t.Run("invalid time zone", func(t *testing.T) {
+		ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}, EnableTimeZoneFunctions: true})
+		_, err := ng.MakeRangeQuery(ctx, storage, &engine.QueryOpts{}, `hour_tz("Mars/Olympus_Mons")`, start, end, step)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "Mars/Olympus_Mons"), "unexpected error: %v", err)
+	})
+
+	t.Run("time zone functions are disabled by default", func(t *testing.T) {
+		ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: time.Hour}})
+		_, err := ng.MakeRangeQuery(ctx, storage, &engine.QueryOpts{}, `hour_tz("Europe/Berlin")`, start, end, step)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "unknown function"), "unexpected error: %v", err)
+	})
+}
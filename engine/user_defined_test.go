@@ -5,18 +5,24 @@ package engine_test
 
 import (
 	"context"
+	"math"
 	"slices"
 	"testing"
 	"time"
 
 	"github.com/thanos-io/promql-engine/engine"
 	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/functions"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/ringbuffer"
+	"github.com/thanos-io/promql-engine/warnings"
 
 	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/promql/promqltest"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/util/annotations"
@@ -129,3 +135,147 @@ func (c *vectorSelectorOperator) Series(ctx context.Context) ([]labels.Labels, e
 func (c *vectorSelectorOperator) Explain() (next []model.VectorOperator) {
 	return nil
 }
+
+func TestUserDefinedFunctions(t *testing.T) {
+	t.Parallel()
+
+	opts := promql.EngineOpts{
+		Timeout:    1 * time.Hour,
+		MaxSamples: 1e10,
+	}
+
+	load := `
+load 30s
+	http_requests_total{pod="nginx-1", container="a"} 1+1x30
+	http_requests_total{pod="nginx-2", container="b"} 2+3x30 _ 5+2x20`
+
+	registry := functions.NewRegistry()
+	registry.MustRegister(
+		functions.Function{
+			Signature: parser.Function{
+				Name:       "scale",
+				ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeScalar},
+				ReturnType: parser.ValueTypeVector,
+			},
+			InstantVector: func(f float64, h *histogram.FloatHistogram, vargs ...float64) (float64, bool) {
+				if h != nil {
+					return 0, false
+				}
+				return f * vargs[0], true
+			},
+		},
+		functions.Function{
+			Signature: parser.Function{
+				Name:       "spread_over_time",
+				ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix},
+				ReturnType: parser.ValueTypeVector,
+			},
+			RangeVector: func(f ringbuffer.FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+				if len(f.Samples) == 0 {
+					return 0, nil, false, 0, nil
+				}
+				minVal, maxVal := math.Inf(1), math.Inf(-1)
+				for _, s := range f.Samples {
+					minVal = math.Min(minVal, s.V.F)
+					maxVal = math.Max(maxVal, s.V.F)
+				}
+				return maxVal - minVal, nil, true, 0, nil
+			},
+		},
+		functions.Function{
+			Signature: parser.Function{
+				Name:       "label_prefix",
+				ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString, parser.ValueTypeString},
+				ReturnType: parser.ValueTypeVector,
+			},
+			Label: func(lbls labels.Labels, args []string) (labels.Labels, error) {
+				b := labels.NewBuilder(lbls)
+				b.Set(args[0], args[1]+lbls.Get(args[0]))
+				return b.Labels(), nil
+			},
+		},
+	)
+
+	cases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "instant vector function",
+			query:    `scale(http_requests_total, 2)`,
+			expected: `http_requests_total * 2`,
+		},
+		{
+			name:     "instant vector function with expression argument",
+			query:    `scale(http_requests_total, scalar(sum(http_requests_total)))`,
+			expected: `http_requests_total * scalar(sum(http_requests_total))`,
+		},
+		{
+			name:     "range vector function",
+			query:    `spread_over_time(http_requests_total[2m])`,
+			expected: `max_over_time(http_requests_total[2m]) - min_over_time(http_requests_total[2m])`,
+		},
+		{
+			name:     "range vector function over subquery",
+			query:    `spread_over_time(rate(http_requests_total[1m])[5m:1m])`,
+			expected: `max_over_time(rate(http_requests_total[1m])[5m:1m]) - min_over_time(rate(http_requests_total[1m])[5m:1m])`,
+		},
+		{
+			name:     "label function",
+			query:    `label_prefix(http_requests_total, "pod", "k8s-")`,
+			expected: `label_replace(http_requests_total, "pod", "k8s-$1", "pod", "(.*)")`,
+		},
+		{
+			name:     "label function under aggregation",
+			query:    `sum by (pod) (label_prefix(http_requests_total, "pod", "k8s-"))`,
+			expected: `sum by (pod) (label_replace(http_requests_total, "pod", "k8s-$1", "pod", "(.*)"))`,
+		},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	var (
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		step  = 30 * time.Second
+		ctx   = context.Background()
+	)
+	oldEngine := promql.NewEngine(opts)
+	newEngines := map[string]*engine.Engine{
+		"default": engine.New(engine.Opts{EngineOpts: opts, Functions: registry}),
+		"projection": engine.New(engine.Opts{
+			EngineOpts: opts,
+			Functions:  registry,
+			LogicalOptimizers: []logicalplan.Optimizer{
+				logicalplan.ProjectionOptimizer{SeriesHashLabel: "__series_hash__"},
+			},
+		}),
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			q1, err := oldEngine.NewRangeQuery(ctx, storage, nil, tcase.expected, start, end, step)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			oldResult := q1.Exec(ctx)
+			testutil.Ok(t, oldResult.Err)
+
+			for name, newEngine := range newEngines {
+				t.Run(name, func(t *testing.T) {
+					q2, err := newEngine.NewRangeQuery(ctx, storage, nil, tcase.query, start, end, step)
+					testutil.Ok(t, err)
+					defer q2.Close()
+					newResult := q2.Exec(ctx)
+					testutil.Ok(t, newResult.Err)
+					testutil.WithGoCmp(comparer).Equals(t, oldResult, newResult)
+				})
+			}
+		})
+	}
+
+	t.Run("unknown function without registry", func(t *testing.T) {
+		_, err := engine.New(engine.Opts{EngineOpts: opts}).NewRangeQuery(ctx, storage, nil, `scale(http_requests_total, 2)`, start, end, step)
+		testutil.NotOk(t, err)
+	})
+}
@@ -0,0 +1,197 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/thanos-io/promql-engine/compute"
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/efficientgo/core/errors"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+type CountDistinctMode int
+
+const (
+	// CountDistinctEstimate estimates the number of distinct label values in each group.
+	CountDistinctEstimate CountDistinctMode = iota
+	// CountDistinctSketch returns the sketch of distinct label values in each group as a native histogram.
+	CountDistinctSketch
+	// CountDistinctMerge merges sketches in each group and estimates the number of distinct label values.
+	CountDistinctMerge
+)
+
+type countDistinctOperator struct {
+	next     model.VectorOperator
+	mode     CountDistinctMode
+	label    string
+	grouping []string
+
+	once   sync.Once
+	series []labels.Labels
+
+	// inputToOutput maps input series IDs to output series IDs.
+	inputToOutput []int
+	// valueHashes contains the hash of the label value of each input series.
+	valueHashes []uint64
+	sketches    []compute.HyperLogLog
+	seen        []bool
+	touched     []int
+}
+
+// NewCountDistinct returns an operator which approximates the number of distinct values of a label
+// in each group, like count by (grouping) (count by (grouping, label) (X)). In CountDistinctMerge
+// mode, the label is unused and the input must contain sketches from CountDistinctSketch.
+func NewCountDistinct(next model.VectorOperator, mode CountDistinctMode, label string, grouping []string, opts *query.Options) model.VectorOperator {
+	// Grouping labels need to be sorted in order for metric hashing to work.
+	slices.Sort(grouping)
+
+	op := &countDistinctOperator{
+		next:     next,
+		mode:     mode,
+		label:    label,
+		grouping: grouping,
+	}
+	return telemetry.NewOperator(telemetry.NewTelemetry(op, opts), op)
+}
+
+func (c *countDistinctOperator) Explain() []model.VectorOperator {
+	return []model.VectorOperator{c.next}
+}
+
+func (c *countDistinctOperator) String() string {
+	switch c.mode {
+	case CountDistinctSketch:
+		return fmt.Sprintf("[countDistinctSketch] by (%v) - label (%v)", c.grouping, c.label)
+	case CountDistinctMerge:
+		return fmt.Sprintf("[countDistinctMerge] by (%v)", c.grouping)
+	default:
+		return fmt.Sprintf("[countDistinct] by (%v) - label (%v)", c.grouping, c.label)
+	}
+}
+
+func (c *countDistinctOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	c.once.Do(func() { err = c.initSeriesOnce(ctx) })
+	return c.series, err
+}
+
+func (c *countDistinctOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	var err error
+	c.once.Do(func() { err = c.initSeriesOnce(ctx) })
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.next.Next(ctx, buf)
+	if err != nil {
+		return 0, err
+	}
+	for i := range n {
+		if err := c.aggregate(&buf[i]); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// aggregate replaces the samples of the input vector with the result for each group.
+func (c *countDistinctOperator) aggregate(vector *model.StepVector) error {
+	for _, id := range c.touched {
+		c.sketches[id].Reset()
+		c.seen[id] = false
+	}
+	c.touched = c.touched[:0]
+
+	if c.mode == CountDistinctMerge {
+		for j, h := range vector.Histograms {
+			outputID := c.touch(vector.HistogramIDs[j])
+			if err := c.sketches[outputID].Merge(h); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, id := range vector.SampleIDs {
+			c.sketches[c.touch(id)].Add(c.valueHashes[id])
+		}
+		for _, id := range vector.HistogramIDs {
+			c.sketches[c.touch(id)].Add(c.valueHashes[id])
+		}
+	}
+
+	vector.SampleIDs = vector.SampleIDs[:0]
+	vector.Samples = vector.Samples[:0]
+	vector.HistogramIDs = vector.HistogramIDs[:0]
+	vector.Histograms = vector.Histograms[:0]
+	for _, id := range c.touched {
+		if c.mode == CountDistinctSketch {
+			vector.AppendHistogram(uint64(id), c.sketches[id].Histogram())
+		} else {
+			vector.AppendSample(uint64(id), c.sketches[id].Estimate())
+		}
+	}
+	return nil
+}
+
+func (c *countDistinctOperator) touch(inputID uint64) int {
+	outputID := c.inputToOutput[inputID]
+	if !c.seen[outputID] {
+		c.seen[outputID] = true
+		c.touched = append(c.touched, outputID)
+	}
+	return outputID
+}
+
+func (c *countDistinctOperator) initSeriesOnce(ctx context.Context) error {
+	if c.mode != CountDistinctMerge && !prommodel.UTF8Validation.IsValidLabelName(c.label) {
+		return errors.Newf("invalid label name %q", c.label)
+	}
+
+	nextSeries, err := c.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		hashToOutputID = make(map[uint64]int)
+		hashingBuf     = make([]byte, 1024)
+		builder        labels.ScratchBuilder
+		groupingSet    = make(map[string]struct{})
+	)
+	for _, lblName := range c.grouping {
+		groupingSet[lblName] = struct{}{}
+	}
+
+	c.inputToOutput = make([]int, len(nextSeries))
+	c.valueHashes = make([]uint64, len(nextSeries))
+	for i, s := range nextSeries {
+		hash, lbls := hashMetric(builder, s, false, c.grouping, groupingSet, hashingBuf)
+		outputID, ok := hashToOutputID[hash]
+		if !ok {
+			outputID = len(c.series)
+			hashToOutputID[hash] = outputID
+			c.series = append(c.series, lbls)
+		}
+		c.inputToOutput[i] = outputID
+		c.valueHashes[i] = xxhash.Sum64String(s.Get(c.label))
+	}
+	c.sketches = make([]compute.HyperLogLog, len(c.series))
+	c.seen = make([]bool, len(c.series))
+	return nil
+}
@@ -31,6 +31,8 @@ type aggregate struct {
 	aggregation parser.ItemType
 	stepsBatch  int
 
+	approximateQuantiles bool
+
 	once   sync.Once
 	series []labels.Labels
 	tables []aggregateTable
@@ -52,7 +54,7 @@ func NewHashAggregate(
 	opts *query.Options,
 ) (model.VectorOperator, error) {
 	// Verify that the aggregation is supported.
-	if _, err := newScalarAccumulator(aggregation); err != nil {
+	if _, err := newScalarAccumulator(aggregation, opts.ApproximateQuantiles); err != nil {
 		return nil, err
 	}
 
@@ -67,6 +69,8 @@ func NewHashAggregate(
 		aggregation: aggregation,
 		stepsBatch:  opts.StepsBatch,
 		params:      make([]float64, opts.StepsBatch),
+
+		approximateQuantiles: opts.ApproximateQuantiles,
 	}
 
 	return telemetry.NewOperator(telemetry.NewTelemetry(a, opts), a), nil
@@ -260,7 +264,7 @@ func (a *aggregate) initializeScalarTables(ctx context.Context) ([]aggregateTabl
 
 		inputCache[i] = output.ID
 	}
-	tables, err := newScalarTables(a.stepsBatch, inputCache, outputCache, a.aggregation)
+	tables, err := newScalarTables(a.stepsBatch, inputCache, outputCache, a.aggregation, a.approximateQuantiles)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -11,6 +11,7 @@ import (
 	"github.com/thanos-io/promql-engine/compute"
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/execution/parse"
+	"github.com/thanos-io/promql-engine/extlabels"
 	"github.com/thanos-io/promql-engine/warnings"
 
 	"github.com/efficientgo/core/errors"
@@ -43,10 +44,10 @@ type scalarTable struct {
 	accumulators []compute.Accumulator
 }
 
-func newScalarTables(stepsBatch int, inputCache []uint64, outputCache []*model.Series, aggregation parser.ItemType) ([]aggregateTable, error) {
+func newScalarTables(stepsBatch int, inputCache []uint64, outputCache []*model.Series, aggregation parser.ItemType, approximateQuantiles bool) ([]aggregateTable, error) {
 	tables := make([]aggregateTable, stepsBatch)
 	for i := range tables {
-		table, err := newScalarTable(inputCache, outputCache, aggregation)
+		table, err := newScalarTable(inputCache, outputCache, aggregation, approximateQuantiles)
 		if err != nil {
 			return nil, err
 		}
@@ -59,10 +60,10 @@ func (t *scalarTable) timestamp() int64 {
 	return t.ts
 }
 
-func newScalarTable(inputSampleIDs []uint64, outputs []*model.Series, aggregation parser.ItemType) (*scalarTable, error) {
+func newScalarTable(inputSampleIDs []uint64, outputs []*model.Series, aggregation parser.ItemType, approximateQuantiles bool) (*scalarTable, error) {
 	accumulators := make([]compute.Accumulator, len(outputs))
 	for i := range accumulators {
-		acc, err := newScalarAccumulator(aggregation)
+		acc, err := newScalarAccumulator(aggregation, approximateQuantiles)
 		if err != nil {
 			return nil, err
 		}
@@ -163,7 +164,7 @@ func hashMetric(
 
 	if without {
 		metric.Range(func(lbl labels.Label) {
-			if lbl.Name == labels.MetricName {
+			if lbl.Name == labels.MetricName || lbl.Name == extlabels.DropNameLabel {
 				return
 			}
 			if _, ok := groupingSet[lbl.Name]; ok {
@@ -171,8 +172,10 @@ func hashMetric(
 			}
 			builder.Add(lbl.Name, lbl.Value)
 		})
-		key, _ := metric.HashWithoutLabels(buf, grouping...)
-		return key, builder.Labels()
+		// The marker of delayed name removal is not part of the key, so that marked series
+		// are grouped with unmarked series with the same labels.
+		lbls := builder.Labels()
+		return lbls.Hash(), lbls
 	}
 
 	if len(grouping) == 0 {
@@ -186,7 +189,12 @@ func hashMetric(
 		builder.Add(lbl.Name, lbl.Value)
 	})
 	key, _ := metric.HashForLabels(buf, grouping...)
-	return key, builder.Labels()
+	lbls := builder.Labels()
+	// Grouping by the metric name keeps it only if it was not going to be removed already.
+	if metric.Has(extlabels.DropNameLabel) {
+		lbls = extlabels.DropMetricName(lbls, builder, true)
+	}
+	return key, lbls
 }
 
 // doing it the prometheus way
@@ -200,7 +208,7 @@ func addRatioSample(ratioLimit float64, series labels.Labels) bool {
 		(ratioLimit < 0 && sampleOffset >= (1.0+ratioLimit))
 }
 
-func newScalarAccumulator(expr parser.ItemType) (compute.Accumulator, error) {
+func newScalarAccumulator(expr parser.ItemType, approximateQuantiles bool) (compute.Accumulator, error) {
 	t := parser.ItemTypeStr[expr]
 	switch t {
 	case "sum":
@@ -220,6 +228,9 @@ func newScalarAccumulator(expr parser.ItemType) (compute.Accumulator, error) {
 	case "stdvar":
 		return compute.NewStdVarAcc(), nil
 	case "quantile":
+		if approximateQuantiles {
+			return compute.NewQuantileSketchAcc(), nil
+		}
 		return compute.NewQuantileAcc(), nil
 	case "histogram_avg":
 		return compute.NewHistogramAvgAcc(), nil
@@ -30,6 +30,8 @@ type scalarOperator struct {
 	returnBool bool
 	stepsBatch int
 
+	delayedNameRemoval bool
+
 	once   sync.Once
 	series []labels.Labels
 
@@ -54,6 +56,8 @@ func NewScalar(
 		opType:     opType,
 		returnBool: returnBool,
 		stepsBatch: opts.StepsBatch,
+
+		delayedNameRemoval: opts.EnableDelayedNameRemoval,
 	}
 
 	return telemetry.NewOperator(telemetry.NewTelemetry(op, opts), op), nil
@@ -148,7 +152,7 @@ func (o *scalarOperator) loadSeries(ctx context.Context) error {
 		if !vectorSeries[i].IsEmpty() {
 			lbls := vectorSeries[i]
 			if shouldDropMetricName(o.opType, o.returnBool) {
-				lbls = extlabels.DropReserved(lbls, b)
+				lbls = extlabels.DropMetricName(lbls, b, o.delayedNameRemoval)
 			}
 			series[i] = lbls
 		} else {
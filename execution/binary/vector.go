@@ -38,6 +38,12 @@ type vectorOperator struct {
 	returnBool bool
 	stepsBatch int
 	sigFunc    func(labels.Labels) uint64
+	// hcFill and lcFill are substituted for a missing sample on the high and
+	// low card side, or nil if series without a match are dropped.
+	hcFill, lcFill *float64
+	// delayedNameRemoval keeps the metric name of results of comparisons with the
+	// bool modifier until the end of the evaluation.
+	delayedNameRemoval bool
 
 	once         sync.Once
 	series       []labels.Labels
@@ -50,10 +56,17 @@ type vectorOperator struct {
 	hcOutputBase   []uint64
 	lcOutputBase   []uint64
 	lcOutputOffset []uint64
+	// output series indices of series whose sample on the other side is filled.
+	hcFillOutput []uint64
+	lcFillOutput []uint64
 
 	lcJoinBuckets []*joinBucket
 	hcJoinBuckets []*joinBucket
 
+	// keepLabels are the labels kept by one-to-one matching with on(), including the
+	// marker of delayed name removal which is not a label of the series.
+	keepLabels []string
+
 	lhsBuf []model.StepVector
 	rhsBuf []model.StepVector
 }
@@ -64,8 +77,14 @@ func NewVectorOperator(
 	matching *parser.VectorMatching,
 	opType parser.ItemType,
 	returnBool bool,
+	fillLHS, fillRHS *float64,
 	opts *query.Options,
 ) (model.VectorOperator, error) {
+	isSetOperation := opType == parser.LAND || opType == parser.LOR || opType == parser.LUNLESS
+	if isSetOperation && (fillLHS != nil || fillRHS != nil) {
+		return nil, errors.Newf("fill values are not supported for set operator %s", parser.ItemTypeStr[opType])
+	}
+	matching = withoutDropNameLabel(matching)
 	op := &vectorOperator{
 		lhs:        lhs,
 		rhs:        rhs,
@@ -73,7 +92,15 @@ func NewVectorOperator(
 		opType:     opType,
 		returnBool: returnBool,
 		sigFunc:    signatureFunc(matching.On, matching.MatchingLabels...),
+		keepLabels: append(slices.Clone(matching.MatchingLabels), extlabels.DropNameLabel),
 		stepsBatch: opts.StepsBatch,
+		hcFill:     fillLHS,
+		lcFill:     fillRHS,
+
+		delayedNameRemoval: opts.EnableDelayedNameRemoval,
+	}
+	if matching.Card == parser.CardOneToMany {
+		op.hcFill, op.lcFill = fillRHS, fillLHS
 	}
 
 	return telemetry.NewOperator(telemetry.NewTelemetry(op, opts), op), nil
@@ -347,7 +374,7 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 	}
 
 	// shortcut: if we have no samples and histograms on the high card side we cannot compute pairings
-	if len(hcs.Samples) == 0 && len(hcs.Histograms) == 0 {
+	if len(hcs.Samples) == 0 && len(hcs.Histograms) == 0 && o.hcFill == nil {
 		return nil
 	}
 	for i, sampleID := range lcs.SampleIDs {
@@ -377,7 +404,7 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 
 	for i, histogramID := range hcs.HistogramIDs {
 		jp := o.hcJoinBuckets[histogramID]
-		if jp.ats != ts {
+		if jp.ats != ts && o.lcFill == nil {
 			continue
 		}
 		// Hash collisions on the high card side are expected except if a one-to-one
@@ -386,6 +413,10 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 			return o.newImplicitManyToOneError()
 		}
 		jp.bts = ts
+		if jp.ats != ts {
+			o.appendFilled(ctx, step, o.hcFillOutput[histogramID], 0, hcs.Histograms[i], *o.lcFill, nil, histogramHint)
+			continue
+		}
 
 		var warn warnings.Warnings
 		if jp.histogramVal != nil {
@@ -424,7 +455,7 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 
 	for i, sampleID := range hcs.SampleIDs {
 		jp := o.hcJoinBuckets[sampleID]
-		if jp.ats != ts {
+		if jp.ats != ts && o.lcFill == nil {
 			continue
 		}
 		// Hash collisions on the high card side are expected except if a one-to-one
@@ -433,6 +464,10 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 			return o.newImplicitManyToOneError()
 		}
 		jp.bts = ts
+		if jp.ats != ts {
+			o.appendFilled(ctx, step, o.hcFillOutput[sampleID], hcs.Samples[i], nil, *o.lcFill, nil, sampleHint)
+			continue
+		}
 		var val float64
 		var warn warnings.Warnings
 
@@ -472,9 +507,57 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 			step.AppendSampleWithSizeHint(o.hcOutputBase[sampleID]+o.lcOutputOffset[jp.sid], val, sampleHint)
 		}
 	}
+
+	// Low card series which were not matched by any high card series at this step.
+	if o.hcFill == nil {
+		return nil
+	}
+	for i, sampleID := range lcs.SampleIDs {
+		if jp := o.lcJoinBuckets[sampleID]; jp.bts != ts {
+			o.appendFilled(ctx, step, o.lcFillOutput[sampleID], *o.hcFill, nil, lcs.Samples[i], nil, sampleHint)
+		}
+	}
+	for i, histogramID := range lcs.HistogramIDs {
+		if jp := o.lcJoinBuckets[histogramID]; jp.bts != ts {
+			o.appendFilled(ctx, step, o.lcFillOutput[histogramID], *o.hcFill, nil, 0, lcs.Histograms[i], histogramHint)
+		}
+	}
 	return nil
 }
 
+// appendFilled appends the result of the operation between a sample and the fill value
+// which is substituted for its missing match on the other side.
+func (o *vectorOperator) appendFilled(ctx context.Context, step *model.StepVector, id uint64, hval float64, hh *histogram.FloatHistogram, lval float64, lh *histogram.FloatHistogram, hint int) {
+	lhs, rhs, hlhs, hrhs := hval, lval, hh, lh
+	if o.matching.Card == parser.CardOneToMany {
+		lhs, rhs, hlhs, hrhs = lval, hval, lh, hh
+	}
+	val, h, keep, warn, err := binOp(o.opType, lhs, rhs, hlhs, hrhs)
+	if err != nil {
+		warnings.AddToContext(err, ctx)
+		return
+	}
+	if warn != 0 {
+		emitBinaryOpWarnings(ctx, warn, o.opType)
+		if warn&warnings.WarnIncompatibleTypesInBinOp != 0 {
+			return
+		}
+	}
+	switch {
+	case o.returnBool:
+		val = 0
+		if keep {
+			val = 1
+		}
+	case !keep:
+		return
+	case h != nil:
+		step.AppendHistogramWithSizeHint(id, h, hint)
+		return
+	}
+	step.AppendSampleWithSizeHint(id, val, hint)
+}
+
 func (o *vectorOperator) newManyToManyMatchErrorOnLowCardSide(originalSampleId, duplicateSampleId uint64) error {
 	side := rhBinOpSide
 	labels := o.rhsSampleIDs
@@ -511,11 +594,17 @@ func (o *vectorOperator) initJoinTables(highCardSide, lowCardSide []labels.Label
 		hcSampleIdToSignature = make([]uint64, len(highCardSide))
 	)
 
-	// initialize join bucket mappings
 	for i := range lowCardSide {
 		sig := o.sigFunc(lowCardSide[i])
 		lcSampleIdToSignature[i] = sig
 		lcHashToSeriesIDs[sig] = append(lcHashToSeriesIDs[sig], uint64(i))
+	}
+	for i := range highCardSide {
+		hcSampleIdToSignature[i] = o.sigFunc(highCardSide[i])
+	}
+
+	// initialize join bucket mappings; the hash table is built from the low card side.
+	for i, sig := range lcSampleIdToSignature {
 		if jb, ok := joinBucketsByHash[sig]; ok {
 			lcJoinBuckets[i] = jb
 		} else {
@@ -524,16 +613,22 @@ func (o *vectorOperator) initJoinTables(highCardSide, lowCardSide []labels.Label
 			lcJoinBuckets[i] = &jb
 		}
 	}
-	for i := range highCardSide {
-		sig := o.sigFunc(highCardSide[i])
-		hcSampleIdToSignature[i] = sig
-		if jb, ok := joinBucketsByHash[sig]; ok {
-			hcJoinBuckets[i] = jb
-		} else {
-			jb := joinBucket{ats: -1, bts: -1}
-			joinBucketsByHash[sig] = &jb
-			hcJoinBuckets[i] = &jb
+	// High card side series without a match share a bucket which is never
+	// marked by the low card side, so they never pair with any series. When
+	// their missing samples are filled, each signature needs its own bucket
+	// to detect duplicate series of one-to-one matches.
+	unmatched := &joinBucket{ats: -1, bts: -1}
+	for i, sig := range hcSampleIdToSignature {
+		jb, ok := joinBucketsByHash[sig]
+		switch {
+		case ok:
+		case o.lcFill != nil:
+			jb = &joinBucket{ats: -1, bts: -1}
+			joinBucketsByHash[sig] = jb
+		default:
+			jb = unmatched
 		}
+		hcJoinBuckets[i] = jb
 	}
 
 	// initialize series
@@ -600,6 +695,21 @@ func (o *vectorOperator) initJoinTables(highCardSide, lowCardSide []labels.Label
 			}
 		}
 		o.lcOutputOffset = lcOutputOffset
+
+		// a high card series with a filled match has no included labels, and a low
+		// card series with a filled match takes the place of the high card series.
+		if o.lcFill != nil {
+			o.hcFillOutput = make([]uint64, len(highCardSide))
+			for i := range highCardSide {
+				o.hcFillOutput[i] = uint64(h.append(o.resultMetric(b, highCardSide[i], labels.EmptyLabels())))
+			}
+		}
+		if o.hcFill != nil {
+			o.lcFillOutput = make([]uint64, len(lowCardSide))
+			for i := range lowCardSide {
+				o.lcFillOutput[i] = uint64(h.append(o.resultMetric(b, lowCardSide[i], lowCardSide[i])))
+			}
+		}
 	}
 	o.series = h.ls
 	o.hcOutputBase = hcOutputBase
@@ -628,15 +738,17 @@ func (h *joinHelper) append(ls labels.Labels) int {
 func (o *vectorOperator) resultMetric(b *labels.Builder, highCard, lowCard labels.Labels) labels.Labels {
 	b.Reset(highCard)
 
-	if shouldDropMetricName(o.opType, o.returnBool) {
+	delayed := o.returnBool && o.delayedNameRemoval
+	if shouldDropMetricName(o.opType, o.returnBool) && !delayed {
 		b.Del(labels.MetricName)
 		b.Del(extlabels.MetricType)
 		b.Del(extlabels.MetricUnit)
+		b.Del(extlabels.DropNameLabel)
 	}
 
 	if o.matching.Card == parser.CardOneToOne {
 		if o.matching.On {
-			b.Keep(o.matching.MatchingLabels...)
+			b.Keep(o.keepLabels...)
 		} else {
 			b.Del(o.matching.MatchingLabels...)
 		}
@@ -648,6 +760,9 @@ func (o *vectorOperator) resultMetric(b *labels.Builder, highCard, lowCard label
 			b.Del(ln)
 		}
 	}
+	if delayed {
+		return extlabels.DropMetricName(b.Labels(), labels.ScratchBuilder{}, true)
+	}
 	if o.returnBool {
 		b.Del(labels.MetricName)
 		b.Del(extlabels.MetricType)
@@ -656,6 +771,20 @@ func (o *vectorOperator) resultMetric(b *labels.Builder, highCard, lowCard label
 	return b.Labels()
 }
 
+// withoutDropNameLabel returns the vector matching without the marker of delayed name removal,
+// which must not be matched on like a label of the series.
+func withoutDropNameLabel(matching *parser.VectorMatching) *parser.VectorMatching {
+	matchingLabels := extlabels.WithoutDropNameLabel(matching.MatchingLabels)
+	include := extlabels.WithoutDropNameLabel(matching.Include)
+	if len(matchingLabels) == len(matching.MatchingLabels) && len(include) == len(matching.Include) {
+		return matching
+	}
+	m := *matching
+	m.MatchingLabels = matchingLabels
+	m.Include = include
+	return &m
+}
+
 func signatureFunc(on bool, names ...string) func(labels.Labels) uint64 {
 	b := make([]byte, 256)
 	if on {
@@ -664,7 +793,7 @@ func signatureFunc(on bool, names ...string) func(labels.Labels) uint64 {
 			return xxhash.Sum64(lset.BytesWithLabels(b, names...))
 		}
 	}
-	names = append([]string{labels.MetricName}, names...)
+	names = append([]string{labels.MetricName, extlabels.DropNameLabel}, names...)
 	slices.Sort(names)
 	return func(lset labels.Labels) uint64 {
 		return xxhash.Sum64(lset.BytesWithoutLabels(b, names...))
@@ -0,0 +1,46 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package execution
+
+import (
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/logicalplan"
+)
+
+// CostEstimator is implemented by operators which have an estimated cost.
+type CostEstimator interface {
+	EstimatedCost() logicalplan.Cost
+}
+
+// costedOperator wraps a selector operator with the cost estimated by the planner.
+type costedOperator struct {
+	model.VectorOperator
+	cost logicalplan.Cost
+}
+
+func withCost(op model.VectorOperator, cost *logicalplan.Cost) model.VectorOperator {
+	if cost == nil {
+		return op
+	}
+	return &costedOperator{VectorOperator: op, cost: *cost}
+}
+
+func (o *costedOperator) EstimatedCost() logicalplan.Cost { return o.cost }
+
+func (o *costedOperator) Unwrap() model.VectorOperator { return o.VectorOperator }
+
+// EstimatedCost returns the cost of the operator estimated by the planner, if any.
+func EstimatedCost(op model.VectorOperator) *logicalplan.Cost {
+	for {
+		if c, ok := op.(CostEstimator); ok {
+			cost := c.EstimatedCost()
+			return &cost
+		}
+		u, ok := op.(model.Unwrapper)
+		if !ok {
+			return nil
+		}
+		op = u.Unwrap()
+	}
+}
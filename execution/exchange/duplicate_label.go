@@ -26,6 +26,11 @@ type duplicateLabelCheckOperator struct {
 }
 
 func NewDuplicateLabelCheck(next model.VectorOperator, opts *query.Options) model.VectorOperator {
+	// With delayed name removal, series only need to be unique once their names are
+	// removed at the end of the evaluation, which is checked by the engine.
+	if opts.EnableDelayedNameRemoval {
+		return next
+	}
 	oper := &duplicateLabelCheckOperator{
 		next: next,
 	}
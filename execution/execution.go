@@ -32,6 +32,7 @@ import (
 	"github.com/thanos-io/promql-engine/execution/scan"
 	"github.com/thanos-io/promql-engine/execution/step_invariant"
 	"github.com/thanos-io/promql-engine/execution/unary"
+	"github.com/thanos-io/promql-engine/extlabels"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
 	"github.com/thanos-io/promql-engine/storage"
@@ -42,6 +43,10 @@ import (
 	promstorage "github.com/prometheus/prometheus/storage"
 )
 
+// ErrRemoteExecutionWithCalendarStep is returned for queries with calendar steps which are executed by remote engines,
+// since remote engines evaluate range queries at a fixed step.
+var ErrRemoteExecutionWithCalendarStep = errors.New("remote execution is not supported with calendar steps")
+
 // New creates new physical query execution for a given query expression which represents logical plan.
 // TODO(bwplotka): Add definition (could be parameters for each execution operator) we can optimize - it would represent physical plan.
 func New(ctx context.Context, expr logicalplan.Node, storage storage.Scanners, opts *query.Options) (model.VectorOperator, error) {
@@ -71,6 +76,8 @@ func newOperator(ctx context.Context, expr logicalplan.Node, storage storage.Sca
 		return newUnaryExpression(ctx, e, storage, opts, hints)
 	case *logicalplan.StepInvariantExpr:
 		return newStepInvariantExpression(ctx, e, storage, opts, hints)
+	case *logicalplan.Sharded:
+		return newShardedExpression(ctx, e, storage, opts, hints)
 	case logicalplan.Deduplicate:
 		return newDeduplication(ctx, e, storage, opts, hints)
 	case logicalplan.RemoteExecution:
@@ -94,7 +101,7 @@ func newVectorSelector(ctx context.Context, e *logicalplan.VectorSelector, scann
 	if err != nil {
 		return nil, err
 	}
-	return model.WithID(op, logicalplan.NodeFingerprint(e)), nil
+	return model.WithID(withCost(op, e.Cost), logicalplan.NodeFingerprint(e)), nil
 }
 
 func newCall(ctx context.Context, e *logicalplan.FunctionCall, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
@@ -105,6 +112,15 @@ func newCall(ctx context.Context, e *logicalplan.FunctionCall, scanners storage.
 	if e.Func.Name == "absent_over_time" {
 		return newAbsentOverTimeOperator(ctx, e, scanners, opts, hints)
 	}
+	if e.Func.Name == "info" {
+		return newInfoOperator(ctx, e, scanners, opts, hints)
+	}
+	if _, ok := parse.CountDistinctFunctions[e.Func.Name]; ok {
+		return newCountDistinct(ctx, e, scanners, opts, hints)
+	}
+	if _, ok := parse.PairedRangeFunctions[e.Func.Name]; ok {
+		return newPairedRangeVectorFunction(ctx, e, scanners, opts, hints)
+	}
 	if e.Func.Name == "timestamp" {
 		switch arg := e.Args[0].(type) {
 		case *logicalplan.VectorSelector:
@@ -178,23 +194,118 @@ func newAbsentOverTimeOperator(ctx context.Context, call *logicalplan.FunctionCa
 	}
 }
 
+func newInfoOperator(ctx context.Context, call *logicalplan.FunctionCall, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
+	next, err := newOperator(ctx, call.Args[0], scanners, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+
+	// Info series are selected at each step like in Prometheus, regardless of modifiers
+	// of selectors in the first argument. Both selectors use a single decoder so that
+	// they return series in the same order.
+	matchers := function.InfoSelectorMatchers(call)
+	infoValues, err := newVectorSelector(ctx, &logicalplan.VectorSelector{
+		VectorSelector:      &parser.VectorSelector{LabelMatchers: matchers},
+		DecodingConcurrency: 1,
+	}, scanners, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	infoTimes, err := newVectorSelector(ctx, &logicalplan.VectorSelector{
+		VectorSelector:      &parser.VectorSelector{LabelMatchers: matchers},
+		DecodingConcurrency: 1,
+		SelectTimestamp:     true,
+	}, scanners, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	return function.NewFunctionOperator(call, []model.VectorOperator{next, infoValues, infoTimes}, opts.StepsBatch, opts)
+}
+
 func newRangeVectorFunction(ctx context.Context, e *logicalplan.FunctionCall, t *logicalplan.MatrixSelector, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
 	// TODO(saswatamcode): Range vector result might need new operator
 	// before it can be non-nested. https://github.com/thanos-io/promql-engine/issues/39
+	params, err := newScalarParams(ctx, e, scanners, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+
 	milliSecondRange := t.Range.Milliseconds()
 	if parse.IsExtFunction(e.Func.Name) {
 		milliSecondRange += opts.ExtLookbackDelta.Milliseconds()
 	}
+	if t.Anchored || t.Smoothed {
+		milliSecondRange += opts.LookbackDelta.Milliseconds()
+	}
 
 	start, end := getTimeRangesForVectorSelector(t.VectorSelector, opts, milliSecondRange)
+	if t.Smoothed {
+		end += opts.LookbackDelta.Milliseconds()
+	}
 	hints.Start = start
 	hints.End = end
 	hints.Range = milliSecondRange
-	op, err := scanners.NewMatrixSelector(ctx, opts, hints, *t, *e)
+	var op model.VectorOperator
+	if params == nil {
+		op, err = scanners.NewMatrixSelector(ctx, opts, hints, *t, *e)
+	} else if paramScanners, ok := scanners.(storage.ParamScanners); ok {
+		op, err = paramScanners.NewMatrixSelectorWithParams(ctx, opts, hints, *t, *e, params)
+	} else {
+		return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "%s with non-constant scalar arguments is not supported by the storage", e.Func.Name)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return model.WithID(op, logicalplan.NodeFingerprint(t)), nil
+	return model.WithID(withCost(op, t.VectorSelector.Cost), logicalplan.NodeFingerprint(t)), nil
+}
+
+// newPairedRangeVectorFunction creates an operator for range vector functions of two series.
+// Both matrix selectors are selected with hints which cover the time ranges of both of them.
+func newPairedRangeVectorFunction(ctx context.Context, e *logicalplan.FunctionCall, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
+	var first *logicalplan.MatrixSelector
+	for i, arg := range e.Args {
+		t, ok := arg.(*logicalplan.MatrixSelector)
+		if !ok {
+			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "%s is only supported with matrix selectors as arguments", e.Func.Name)
+		}
+		start, end := getTimeRangesForVectorSelector(t.VectorSelector, opts, t.Range.Milliseconds())
+		if i == 0 {
+			first = t
+			hints.Start, hints.End, hints.Range = start, end, t.Range.Milliseconds()
+			continue
+		}
+		hints.Start = min(hints.Start, start)
+		hints.End = max(hints.End, end)
+		hints.Range = max(hints.Range, t.Range.Milliseconds())
+	}
+	op, err := scanners.NewMatrixSelector(ctx, opts, hints, *first, *e)
+	if err != nil {
+		return nil, err
+	}
+	return model.WithID(withCost(op, first.VectorSelector.Cost), logicalplan.NodeFingerprint(e)), nil
+}
+
+// newScalarParams creates operators for the scalar arguments of a range vector
+// function which are not constant and therefore need to be evaluated at each step.
+func newScalarParams(ctx context.Context, e *logicalplan.FunctionCall, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) ([]model.VectorOperator, error) {
+	var params []model.VectorOperator
+	for i, arg := range e.Args {
+		if arg.ReturnType() != parser.ValueTypeScalar {
+			continue
+		}
+		if _, err := logicalplan.UnwrapFloat(arg); err == nil {
+			continue
+		}
+		op, err := newOperator(ctx, arg, scanners, opts, hints)
+		if err != nil {
+			return nil, err
+		}
+		if params == nil {
+			params = make([]model.VectorOperator, len(e.Args))
+		}
+		params[i] = op
+	}
+	return params, nil
 }
 
 func newSubqueryFunction(ctx context.Context, e *logicalplan.FunctionCall, t *logicalplan.Subquery, storage storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
@@ -229,14 +340,15 @@ func newSubqueryFunction(ctx context.Context, e *logicalplan.FunctionCall, t *lo
 		if err != nil {
 			return nil, err
 		}
-	case "predict_linear":
+	case "predict_linear", "ewma_over_time":
 		// predict_linear(range-vector, scalar)
 		scalarArg, err = newOperator(ctx, e.Args[1], storage, opts, hints)
 		if err != nil {
 			return nil, err
 		}
-	case "double_exponential_smoothing":
-		// double_exponential_smoothing(range-vector, scalar, scalar)
+	case "double_exponential_smoothing", "holt_winters_seasonal", "predict_seasonal":
+		// double_exponential_smoothing(range-vector, scalar, scalar). The
+		// remaining arguments of the seasonal functions are constant.
 		scalarArg, err = newOperator(ctx, e.Args[1], storage, opts, hints)
 		if err != nil {
 			return nil, err
@@ -245,6 +357,25 @@ func newSubqueryFunction(ctx context.Context, e *logicalplan.FunctionCall, t *lo
 		if err != nil {
 			return nil, err
 		}
+	default:
+		// User defined functions receive their scalar arguments in order.
+		if _, ok := opts.Functions.Get(e.Func.Name); !ok {
+			break
+		}
+		for _, arg := range e.Args {
+			if arg.ReturnType() != parser.ValueTypeScalar {
+				continue
+			}
+			op, err := newOperator(ctx, arg, storage, opts, hints)
+			if err != nil {
+				return nil, err
+			}
+			if scalarArg == nil {
+				scalarArg = op
+			} else {
+				scalarArg2 = op
+			}
+		}
 	}
 
 	return scan.NewSubqueryOperator(inner, scalarArg, scalarArg2, &outerOpts, e, t)
@@ -267,6 +398,35 @@ func newInstantVectorFunction(ctx context.Context, e *logicalplan.FunctionCall,
 	return function.NewFunctionOperator(e, nextOperators, opts.StepsBatch, opts)
 }
 
+func newCountDistinct(ctx context.Context, e *logicalplan.FunctionCall, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
+	var (
+		mode  = aggregate.CountDistinctEstimate
+		label string
+		args  = e.Args
+	)
+	switch e.Func.Name {
+	case "count_distinct_sketch":
+		mode = aggregate.CountDistinctSketch
+	case "count_distinct_merge":
+		mode = aggregate.CountDistinctMerge
+	}
+	if mode != aggregate.CountDistinctMerge {
+		label = logicalplan.UnsafeUnwrapString(args[0])
+		args = args[1:]
+	}
+	grouping := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		grouping = append(grouping, logicalplan.UnsafeUnwrapString(arg))
+	}
+	grouping = extlabels.WithoutDropNameLabel(grouping)
+
+	next, err := newOperator(ctx, args[0], scanners, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	return aggregate.NewCountDistinct(next, mode, label, grouping, opts), nil
+}
+
 func newAggregateExpression(ctx context.Context, e *logicalplan.Aggregation, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
 	hints.Func = e.Op.String()
 	hints.Grouping = e.Grouping
@@ -276,9 +436,11 @@ func newAggregateExpression(ctx context.Context, e *logicalplan.Aggregation, sca
 	if err != nil {
 		return nil, err
 	}
+	// The marker of delayed name removal is not a label of the series and cannot be grouped by.
+	grouping := extlabels.WithoutDropNameLabel(e.Grouping)
 	if e.Op == parser.COUNT_VALUES {
 		param := logicalplan.UnsafeUnwrapString(e.Param)
-		return aggregate.NewCountValues(next, param, !e.Without, e.Grouping, opts), nil
+		return aggregate.NewCountValues(next, param, !e.Without, grouping, opts), nil
 	}
 
 	// parameter is only required for count_values, quantile, topk, bottomk, limitk, and limit_ratio.
@@ -291,9 +453,9 @@ func newAggregateExpression(ctx context.Context, e *logicalplan.Aggregation, sca
 		}
 	}
 	if e.Op == parser.TOPK || e.Op == parser.BOTTOMK || e.Op == parser.LIMITK || e.Op == parser.LIMIT_RATIO {
-		next, err = aggregate.NewKHashAggregate(next, paramOp, e.Op, !e.Without, e.Grouping, opts)
+		next, err = aggregate.NewKHashAggregate(next, paramOp, e.Op, !e.Without, grouping, opts)
 	} else {
-		next, err = aggregate.NewHashAggregate(next, paramOp, e.Op, !e.Without, e.Grouping, opts)
+		next, err = aggregate.NewHashAggregate(next, paramOp, e.Op, !e.Without, grouping, opts)
 	}
 	if err != nil {
 		return nil, err
@@ -318,7 +480,7 @@ func newVectorBinaryOperator(ctx context.Context, e *logicalplan.Binary, storage
 	if err != nil {
 		return nil, err
 	}
-	return binary.NewVectorOperator(leftOperator, rightOperator, e.VectorMatching, e.Op, e.ReturnBool, opts)
+	return binary.NewVectorOperator(leftOperator, rightOperator, e.VectorMatching, e.Op, e.ReturnBool, e.Fill.LHS, e.Fill.RHS, opts)
 }
 
 func newScalarBinaryOperator(ctx context.Context, e *logicalplan.Binary, storage storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
@@ -385,7 +547,27 @@ func newDeduplication(ctx context.Context, e logicalplan.Deduplicate, scanners s
 	return exchange.NewConcurrent(dedup, 2, opts), nil
 }
 
+func newShardedExpression(ctx context.Context, e *logicalplan.Sharded, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
+	operators := make([]model.VectorOperator, e.Shards)
+	for i := range operators {
+		// Each shard gets its own copy of the expression since
+		// operator construction can modify logical nodes.
+		shardHints := hints
+		shardHints.ShardIndex = uint64(i)
+		shardHints.ShardCount = uint64(e.Shards)
+		operator, err := newOperator(ctx, e.Expr.Clone(), scanners, opts, shardHints)
+		if err != nil {
+			return nil, err
+		}
+		operators[i] = exchange.NewConcurrent(operator, 2, opts)
+	}
+	return exchange.NewCoalesce(opts, 0, operators...), nil
+}
+
 func newRemoteExecution(ctx context.Context, e logicalplan.RemoteExecution, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
+	if opts.CalendarStep != nil {
+		return nil, ErrRemoteExecutionWithCalendarStep
+	}
 	// Create a new remote query scoped to the calculated start time.
 	qry, err := e.Engine.NewRangeQuery(ctx, promql.NewPrometheusQueryOpts(false, opts.LookbackDelta), e.Query, e.QueryRangeStart, e.QueryRangeEnd, opts.Step)
 	if err != nil {
@@ -419,6 +601,10 @@ func getTimeRangesForVectorSelector(n *logicalplan.VectorSelector, opts *query.O
 	}
 	if evalRange == 0 {
 		start -= opts.LookbackDelta.Milliseconds() - 1
+		// Smoothed selectors also read samples after the step.
+		if n.Smoothed {
+			end += opts.LookbackDelta.Milliseconds()
+		}
 	} else {
 		start -= evalRange - 1
 	}
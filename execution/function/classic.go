@@ -0,0 +1,147 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/logicalplan"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser/posrange"
+)
+
+// classicOperator expands native histograms into classic histogram bucket series. Each input series
+// is expanded into one series with the cumulative count for each of the given boundaries, and the
+// _bucket suffix is added to its metric name. Counts at boundaries which do not match a bucket boundary
+// of the histogram are interpolated like in histogram_fraction. Float samples are dropped.
+type classicOperator struct {
+	next model.VectorOperator
+
+	// upperBounds are the sorted bucket boundaries of the output series, ending with +Inf.
+	upperBounds []float64
+
+	once   sync.Once
+	series []labels.Labels
+}
+
+func newClassicOperator(funcExpr *logicalplan.FunctionCall, next model.VectorOperator, opts *query.Options) (model.VectorOperator, error) {
+	upperBounds := make([]float64, 0, len(funcExpr.Args))
+	for _, arg := range funcExpr.Args[1:] {
+		upperBound, err := logicalplan.UnwrapFloat(arg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bucket boundaries of %s must be number literals", funcExpr.Func.Name)
+		}
+		if math.IsNaN(upperBound) {
+			return nil, errors.Newf("bucket boundaries of %s must not be NaN", funcExpr.Func.Name)
+		}
+		upperBounds = append(upperBounds, upperBound)
+	}
+	slices.Sort(upperBounds)
+	upperBounds = slices.Compact(upperBounds)
+	if upperBounds[len(upperBounds)-1] != math.Inf(1) {
+		upperBounds = append(upperBounds, math.Inf(1))
+	}
+
+	oper := &classicOperator{
+		next:        next,
+		upperBounds: upperBounds,
+	}
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper), nil
+}
+
+func (o *classicOperator) Explain() (next []model.VectorOperator) {
+	return []model.VectorOperator{o.next}
+}
+
+func (o *classicOperator) String() string {
+	return "[toClassic]"
+}
+
+func (o *classicOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *classicOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := o.next.Next(ctx, buf)
+	if err != nil {
+		return 0, err
+	}
+	for i := range n {
+		vector := &buf[i]
+		vector.SampleIDs = vector.SampleIDs[:0]
+		vector.Samples = vector.Samples[:0]
+		for j, h := range vector.Histograms {
+			firstID := vector.HistogramIDs[j] * uint64(len(o.upperBounds))
+			for k, upperBound := range o.upperBounds {
+				vector.AppendSample(firstID+uint64(k), cumulativeCount(h, upperBound))
+			}
+		}
+		vector.HistogramIDs = vector.HistogramIDs[:0]
+		vector.Histograms = vector.Histograms[:0]
+	}
+	return n, nil
+}
+
+// cumulativeCount returns the number of observations in the histogram which are less than or equal to the upper bound.
+func cumulativeCount(h *histogram.FloatHistogram, upperBound float64) float64 {
+	if h.Count == 0 || math.IsInf(upperBound, 1) {
+		return h.Count
+	}
+	fraction, _ := promql.HistogramFraction(math.Inf(-1), upperBound, h, "", posrange.PositionRange{})
+	return fraction * h.Count
+}
+
+func (o *classicOperator) loadSeries(ctx context.Context) error {
+	series, err := o.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	bucketLabels := make([]string, len(o.upperBounds))
+	for i, upperBound := range o.upperBounds {
+		bucketLabels[i] = strconv.FormatFloat(upperBound, 'f', -1, 64)
+	}
+
+	o.series = make([]labels.Labels, 0, len(series)*len(o.upperBounds))
+	b := labels.NewBuilder(labels.EmptyLabels())
+	for _, s := range series {
+		b.Reset(s)
+		if name := s.Get(labels.MetricName); name != "" {
+			b.Set(labels.MetricName, name+"_bucket")
+		}
+		for _, le := range bucketLabels {
+			b.Set(labels.BucketLabel, le)
+			o.series = append(o.series, b.Labels())
+		}
+	}
+	return nil
+}
@@ -5,9 +5,15 @@ package function
 
 import (
 	"math"
+	"strings"
 	"time"
 
 	"github.com/thanos-io/promql-engine/compute"
+	"github.com/thanos-io/promql-engine/execution/parse"
+	"github.com/thanos-io/promql-engine/logicalplan"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/errors"
 
 	"github.com/prometheus/prometheus/model/histogram"
 )
@@ -152,15 +158,6 @@ var instantVectorFuncs = map[string]functionCall{
 		}
 		return histogramStdVar(h), true
 	},
-	// variants of date time functions with an argument
-	"days_in_month": dateTimeFunc(daysInMonth),
-	"day_of_month":  dateTimeFunc(dayOfMonth),
-	"day_of_week":   dateTimeFunc(dayOfWeek),
-	"day_of_year":   dateTimeFunc(dayOfYear),
-	"hour":          dateTimeFunc(hour),
-	"minute":        dateTimeFunc(minute),
-	"month":         dateTimeFunc(month),
-	"year":          dateTimeFunc(year),
 	// hack we only have sort functions as argument for "timestamp" possibly so they dont actually
 	// need to sort anything. This is only for compatibility to prometheus as this sort of query does
 	// not make too much sense.
@@ -187,15 +184,19 @@ var noArgFuncs = map[string]noArgFunctionCall{
 	"time": func(t int64) float64 {
 		return float64(t) / 1000
 	},
-	// variants of date time functions with no argument
-	"days_in_month": dateTimeNoArgFunc(daysInMonth),
-	"day_of_month":  dateTimeNoArgFunc(dayOfMonth),
-	"day_of_week":   dateTimeNoArgFunc(dayOfWeek),
-	"day_of_year":   dateTimeNoArgFunc(dayOfYear),
-	"hour":          dateTimeNoArgFunc(hour),
-	"minute":        dateTimeNoArgFunc(minute),
-	"month":         dateTimeNoArgFunc(month),
-	"year":          dateTimeNoArgFunc(year),
+}
+
+// dateTimeFuncs are evaluated in the time zone of the query, or in the time
+// zone passed as the first argument to their variants with the _tz suffix.
+var dateTimeFuncs = map[string]func(time.Time) float64{
+	"days_in_month": daysInMonth,
+	"day_of_month":  dayOfMonth,
+	"day_of_week":   dayOfWeek,
+	"day_of_year":   dayOfYear,
+	"hour":          hour,
+	"minute":        minute,
+	"month":         month,
+	"year":          year,
 }
 
 func simpleFunc(f func(float64) float64) functionCall {
@@ -207,31 +208,52 @@ func simpleFunc(f func(float64) float64) functionCall {
 	}
 }
 
-func dateTimeFunc(f func(time.Time) float64) functionCall {
+// lookupDateTimeFunc returns the date time function called by funcExpr and the time zone to evaluate it in.
+func lookupDateTimeFunc(funcExpr *logicalplan.FunctionCall, opts *query.Options) (func(time.Time) float64, *time.Location, bool, error) {
+	loc := opts.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	name := funcExpr.Func.Name
+	if _, ok := parse.TimeZoneFunctions[name]; ok {
+		zone, err := logicalplan.UnwrapString(funcExpr.Args[0])
+		if err != nil {
+			return nil, nil, false, errors.Wrap(err, "unable to unwrap string argument")
+		}
+		if loc, err = time.LoadLocation(zone); err != nil {
+			return nil, nil, false, errors.Wrapf(err, "invalid time zone in %s", name)
+		}
+		name = strings.TrimSuffix(name, "_tz")
+	}
+	f, ok := dateTimeFuncs[name]
+	return f, loc, ok, nil
+}
+
+func dateTimeFunc(f func(time.Time) float64, loc *time.Location) functionCall {
 	return func(v float64, h *histogram.FloatHistogram, vargs ...float64) (float64, bool) {
 		if h != nil {
 			return 0., false
 		}
-		return f(dateFromSampleValue(v)), true
+		return f(dateFromSampleValue(v, loc)), true
 	}
 }
 
-func dateTimeNoArgFunc(f func(time.Time) float64) noArgFunctionCall {
+func dateTimeNoArgFunc(f func(time.Time) float64, loc *time.Location) noArgFunctionCall {
 	return func(t int64) float64 {
-		return f(dateFromStepTime(t))
+		return f(dateFromStepTime(t, loc))
 	}
 }
 
-func dateFromSampleValue(f float64) time.Time {
-	return time.Unix(int64(f), 0).UTC()
+func dateFromSampleValue(f float64, loc *time.Location) time.Time {
+	return time.Unix(int64(f), 0).In(loc)
 }
 
-func dateFromStepTime(t int64) time.Time {
-	return time.Unix(t/1000, 0).UTC()
+func dateFromStepTime(t int64, loc *time.Location) time.Time {
+	return time.Unix(t/1000, 0).In(loc)
 }
 
 func daysInMonth(t time.Time) float64 {
-	return float64(32 - time.Date(t.Year(), t.Month(), 32, 0, 0, 0, 0, time.UTC).Day())
+	return float64(32 - time.Date(t.Year(), t.Month(), 32, 0, 0, 0, 0, t.Location()).Day())
 }
 
 func dayOfMonth(t time.Time) float64 {
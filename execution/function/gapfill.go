@@ -0,0 +1,279 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/logicalplan"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	interpolateLinear   = "linear"
+	interpolatePrevious = "previous"
+	interpolateNext     = "next"
+)
+
+// gapFillOperator fills steps without a sample in series of its input. fill_gaps emits the value of
+// its scalar argument at all steps without a sample of series which have a sample at some step of the
+// query. interpolate fills steps between two samples of a series from these samples, either linearly
+// or with the value of the previous or next sample, if they are at most the maximum gap apart.
+// Filling a step can depend on samples at any later step, so the whole input is read at once.
+type gapFillOperator struct {
+	funcName string
+	next     model.VectorOperator
+	scalarOp model.VectorOperator
+
+	method string
+	// maxGap is the maximum time between two samples in milliseconds for interpolating between
+	// them, or zero if there is no limit.
+	maxGap int64
+
+	stepsBatch int
+	curStep    int
+
+	once   sync.Once
+	series []labels.Labels
+	steps  []model.StepVector
+}
+
+func newGapFillOperator(funcExpr *logicalplan.FunctionCall, nextOps []model.VectorOperator, stepsBatch int, opts *query.Options) (model.VectorOperator, error) {
+	o := &gapFillOperator{
+		funcName:   funcExpr.Func.Name,
+		next:       nextOps[0],
+		stepsBatch: stepsBatch,
+	}
+	switch o.funcName {
+	case "fill_gaps":
+		o.scalarOp = nextOps[1]
+	case "interpolate":
+		method, err := logicalplan.UnwrapString(funcExpr.Args[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "interpolation method of %s must be a string literal", o.funcName)
+		}
+		switch method {
+		case interpolateLinear, interpolatePrevious, interpolateNext:
+		default:
+			return nil, errors.Newf("invalid interpolation method in %s: %q, expected one of %q, %q or %q", o.funcName, method, interpolateLinear, interpolatePrevious, interpolateNext)
+		}
+		o.method = method
+
+		if len(funcExpr.Args) > 2 {
+			maxGap, err := logicalplan.UnwrapFloat(funcExpr.Args[2])
+			if err != nil {
+				return nil, errors.Wrapf(err, "maximum gap of %s must be a number literal", o.funcName)
+			}
+			if math.IsNaN(maxGap) || maxGap <= 0 {
+				return nil, errors.Newf("invalid maximum gap in %s. Expected: a positive number of seconds, got: %f", o.funcName, maxGap)
+			}
+			if !math.IsInf(maxGap, 1) {
+				o.maxGap = int64(maxGap * 1000)
+			}
+		}
+	default:
+		return nil, errors.Newf("invalid function name for gap filling operator: %s", o.funcName)
+	}
+	return telemetry.NewOperator(telemetry.NewTelemetry(o, opts), o), nil
+}
+
+func (o *gapFillOperator) Explain() (next []model.VectorOperator) {
+	if o.scalarOp != nil {
+		return []model.VectorOperator{o.next, o.scalarOp}
+	}
+	return []model.VectorOperator{o.next}
+}
+
+func (o *gapFillOperator) String() string {
+	if o.funcName == "interpolate" {
+		return fmt.Sprintf("[interpolate] %s", o.method)
+	}
+	return "[fillGaps]"
+}
+
+func (o *gapFillOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *gapFillOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for ; n < min(o.stepsBatch, len(buf)) && o.curStep < len(o.steps); n++ {
+		step := o.steps[o.curStep]
+		buf[n].Reset(step.T)
+		buf[n].AppendSamples(step.SampleIDs, step.Samples)
+		buf[n].AppendHistograms(step.HistogramIDs, step.Histograms)
+		o.curStep++
+	}
+	return n, nil
+}
+
+func (o *gapFillOperator) loadSeries(ctx context.Context) error {
+	series, err := o.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+	o.series = series
+
+	fillValues, err := o.readInput(ctx)
+	if err != nil {
+		return err
+	}
+
+	// seriesSamples are the samples of each series in the order of their steps.
+	seriesSamples := make([][]sampleRef, len(series))
+	for i, step := range o.steps {
+		for j, id := range step.SampleIDs {
+			seriesSamples[id] = append(seriesSamples[id], sampleRef{step: i, index: j})
+		}
+		for j, id := range step.HistogramIDs {
+			seriesSamples[id] = append(seriesSamples[id], sampleRef{step: i, index: j, histogram: true})
+		}
+	}
+	for id, samples := range seriesSamples {
+		if len(samples) == 0 {
+			continue
+		}
+		if o.funcName == "fill_gaps" {
+			o.fillConstant(uint64(id), samples, fillValues)
+			continue
+		}
+		for j := 1; j < len(samples); j++ {
+			o.interpolate(uint64(id), samples[j-1], samples[j])
+		}
+	}
+	return nil
+}
+
+// sampleRef references the sample of a series in a step of the input.
+type sampleRef struct {
+	step      int
+	index     int
+	histogram bool
+}
+
+// readInput reads all steps of the input, and returns the value of the scalar argument of fill_gaps at each step.
+func (o *gapFillOperator) readInput(ctx context.Context) ([]float64, error) {
+	var (
+		fillValues []float64
+		vectorBuf  = make([]model.StepVector, o.stepsBatch)
+		scalarBuf  []model.StepVector
+	)
+	if o.scalarOp != nil {
+		scalarBuf = make([]model.StepVector, o.stepsBatch)
+	}
+	for {
+		n, err := o.next.Next(ctx, vectorBuf)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return fillValues, nil
+		}
+		for _, in := range vectorBuf[:n] {
+			step := model.StepVector{T: in.T}
+			step.AppendSamples(in.SampleIDs, in.Samples)
+			for i, h := range in.Histograms {
+				step.AppendHistogram(in.HistogramIDs[i], h.Copy())
+			}
+			o.steps = append(o.steps, step)
+		}
+		if o.scalarOp == nil {
+			continue
+		}
+		scalarN, err := o.scalarOp.Next(ctx, scalarBuf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for i := range n {
+			v := math.NaN()
+			if i < scalarN && len(scalarBuf[i].Samples) > 0 {
+				v = scalarBuf[i].Samples[0]
+			}
+			fillValues = append(fillValues, v)
+		}
+	}
+}
+
+// fillConstant appends the fill value at each step without a sample of the series.
+func (o *gapFillOperator) fillConstant(id uint64, samples []sampleRef, fillValues []float64) {
+	next := 0
+	for i := range o.steps {
+		if next < len(samples) && samples[next].step == i {
+			next++
+			continue
+		}
+		o.steps[i].AppendSample(id, fillValues[i])
+	}
+}
+
+// interpolate fills the steps between two consecutive samples of the series.
+func (o *gapFillOperator) interpolate(id uint64, prev, next sampleRef) {
+	if next.step-prev.step < 2 {
+		return
+	}
+	var (
+		prevT, nextT = o.steps[prev.step].T, o.steps[next.step].T
+		prevF, prevH = o.sampleOf(prev)
+		nextF, nextH = o.sampleOf(next)
+	)
+	if o.maxGap > 0 && nextT-prevT > o.maxGap {
+		return
+	}
+	for i := prev.step + 1; i < next.step; i++ {
+		step := &o.steps[i]
+		switch o.method {
+		case interpolatePrevious:
+			appendSampleOf(step, id, prevF, prevH)
+		case interpolateNext:
+			appendSampleOf(step, id, nextF, nextH)
+		case interpolateLinear:
+			// Histograms are not interpolated.
+			if prevH != nil || nextH != nil {
+				return
+			}
+			step.AppendSample(id, prevF+(nextF-prevF)*float64(step.T-prevT)/float64(nextT-prevT))
+		}
+	}
+}
+
+func (o *gapFillOperator) sampleOf(ref sampleRef) (float64, *histogram.FloatHistogram) {
+	if ref.histogram {
+		return 0, o.steps[ref.step].Histograms[ref.index]
+	}
+	return o.steps[ref.step].Samples[ref.index], nil
+}
+
+func appendSampleOf(step *model.StepVector, id uint64, f float64, h *histogram.FloatHistogram) {
+	if h != nil {
+		step.AppendHistogram(id, h.Copy())
+		return
+	}
+	step.AppendSample(id, f)
+}
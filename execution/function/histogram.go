@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"slices"
 	"strconv"
 	"sync"
 
@@ -18,6 +19,8 @@ import (
 	"github.com/thanos-io/promql-engine/warnings"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/efficientgo/core/errors"
+	prommodel "github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser/posrange"
@@ -32,6 +35,8 @@ type histogramSeries struct {
 }
 
 // histogramOperator is a function operator that calculates percentiles.
+// For histogram_quantiles, each histogram is expanded into one output series for each of
+// the requested quantiles, which are all calculated from the same buckets.
 type histogramOperator struct {
 	once   sync.Once
 	series []labels.Labels
@@ -47,6 +52,11 @@ type histogramOperator struct {
 	scalar1Points []float64
 	scalar2Points []float64
 
+	// quantiles are the quantiles calculated by histogram_quantiles, and quantileLabel is
+	// the name of the label which holds the quantile in each output series.
+	quantiles     []float64
+	quantileLabel string
+
 	// outputIndex is a mapping from input series ID to the output series ID and its upper boundary value
 	// parsed from the le label.
 	// If outputIndex[i] is nil then series[i] has no valid `le` label.
@@ -64,6 +74,8 @@ type histogramOperator struct {
 	vectorBuf  []model.StepVector
 	scalar1Buf []model.StepVector
 	scalar2Buf []model.StepVector
+
+	delayedNameRemoval bool
 }
 
 func newHistogramOperator(
@@ -71,11 +83,12 @@ func newHistogramOperator(
 	nextOps []model.VectorOperator,
 	stepsBatch int,
 	opts *query.Options,
-) model.VectorOperator {
+) (model.VectorOperator, error) {
 	o := &histogramOperator{
-		funcName:   call.Func.Name,
-		funcArgs:   call.Args,
-		stepsBatch: stepsBatch,
+		funcName:           call.Func.Name,
+		funcArgs:           call.Args,
+		stepsBatch:         stepsBatch,
+		delayedNameRemoval: opts.EnableDelayedNameRemoval,
 	}
 
 	switch o.funcName {
@@ -89,10 +102,29 @@ func newHistogramOperator(
 		o.vectorOp = nextOps[2]
 		o.scalar1Points = make([]float64, stepsBatch)
 		o.scalar2Points = make([]float64, stepsBatch)
+	case "histogram_quantiles":
+		o.vectorOp = nextOps[0]
+		quantileLabel, err := logicalplan.UnwrapString(call.Args[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "quantile label of %s must be a string literal", o.funcName)
+		}
+		if !prommodel.UTF8Validation.IsValidLabelName(quantileLabel) {
+			return nil, errors.Newf("invalid quantile label name in %s: %s", o.funcName, quantileLabel)
+		}
+		o.quantileLabel = quantileLabel
+		for _, arg := range call.Args[2:] {
+			q, err := logicalplan.UnwrapFloat(arg)
+			if err != nil {
+				return nil, errors.Wrapf(err, "quantiles of %s must be number literals", o.funcName)
+			}
+			if !slices.Contains(o.quantiles, q) {
+				o.quantiles = append(o.quantiles, q)
+			}
+		}
 	default:
 		panic("unsupported function passed")
 	}
-	return telemetry.NewOperator(telemetry.NewTelemetry(o, opts), o)
+	return telemetry.NewOperator(telemetry.NewTelemetry(o, opts), o), nil
 }
 
 func (o *histogramOperator) String() string {
@@ -105,6 +137,8 @@ func (o *histogramOperator) Explain() (next []model.VectorOperator) {
 		return []model.VectorOperator{o.scalar1Op, o.vectorOp}
 	case "histogram_fraction":
 		return []model.VectorOperator{o.scalar1Op, o.scalar2Op, o.vectorOp}
+	case "histogram_quantiles":
+		return []model.VectorOperator{o.vectorOp}
 	}
 	return nil
 }
@@ -256,6 +290,14 @@ func (o *histogramOperator) processInputSeries(ctx context.Context, vectors []mo
 				case "histogram_fraction":
 					v, annos = promql.HistogramFraction(o.scalar1Points[stepIndex], o.scalar2Points[stepIndex], vector.Histograms[i], o.inputSeriesNames[seriesID], posrange.PositionRange{})
 					buf[n].AppendSample(uint64(outputSeriesID), v)
+				case "histogram_quantiles":
+					firstID := outputSeriesID * len(o.quantiles)
+					for k, q := range o.quantiles {
+						var qAnnos annotations.Annotations
+						v, qAnnos = promql.HistogramQuantile(q, vector.Histograms[i], o.inputSeriesNames[seriesID], posrange.PositionRange{})
+						buf[n].AppendSample(uint64(firstID+k), v)
+						annos.Merge(qAnnos)
+					}
 				}
 				warnings.MergeToContext(annos, ctx)
 			} else {
@@ -269,6 +311,10 @@ func (o *histogramOperator) processInputSeries(ctx context.Context, vectors []mo
 			if len(stepBuckets) == 0 {
 				continue
 			}
+			if o.funcName == "histogram_quantiles" {
+				o.appendBucketQuantiles(ctx, &buf[n], i, stepBuckets)
+				continue
+			}
 			// If we are after how many scalar points we have then it needs to be NaN.
 			if stepIndex >= len(o.scalar1Points) {
 				buf[n].AppendSample(uint64(i), math.NaN())
@@ -298,6 +344,21 @@ func (o *histogramOperator) processInputSeries(ctx context.Context, vectors []mo
 	return n, nil
 }
 
+// appendBucketQuantiles appends the samples of all quantiles of histogram_quantiles calculated
+// from the buckets of a classic histogram.
+func (o *histogramOperator) appendBucketQuantiles(ctx context.Context, vector *model.StepVector, seriesID int, buckets promql.Buckets) {
+	firstID := seriesID * len(o.quantiles)
+	var forcedMonotonicity bool
+	for k, q := range o.quantiles {
+		v, forced, _ := promql.BucketQuantile(q, buckets)
+		vector.AppendSample(uint64(firstID+k), v)
+		forcedMonotonicity = forcedMonotonicity || forced
+	}
+	if forcedMonotonicity {
+		warnings.AddToContext(annotations.NewHistogramQuantileForcedMonotonicityInfo(o.inputSeriesNames[seriesID], posrange.PositionRange{}), ctx)
+	}
+}
+
 func (o *histogramOperator) loadSeries(ctx context.Context) error {
 
 	o.vectorBuf = make([]model.StepVector, o.stepsBatch)
@@ -338,7 +399,7 @@ func (o *histogramOperator) loadSeries(ctx context.Context) error {
 		// We check for duplicate series after dropped labels when
 		// showing the result of the query. Series that are equal after
 		// dropping name should not hash to the same bucket here.
-		lbls = extlabels.DropReserved(lbls, b)
+		lbls = extlabels.DropMetricName(lbls, b, o.delayedNameRemoval)
 
 		seriesHash := hasher.Sum64()
 		seriesID, ok := seriesHashes[seriesHash]
@@ -358,9 +419,35 @@ func (o *histogramOperator) loadSeries(ctx context.Context) error {
 	}
 	o.seriesBuckets = make([]promql.Buckets, len(o.series))
 	o.badBucketWarned = make(map[uint64]bool)
+	if o.funcName == "histogram_quantiles" {
+		o.expandQuantileSeries(ctx)
+	}
 	return nil
 }
 
+// expandQuantileSeries replaces each output series of histogram_quantiles with one series
+// for each quantile, labelled with the value of the quantile.
+func (o *histogramOperator) expandQuantileSeries(ctx context.Context) {
+	quantileValues := make([]string, len(o.quantiles))
+	for i, q := range o.quantiles {
+		if math.IsNaN(q) || q < 0 || q > 1 {
+			warnings.AddToContext(annotations.NewInvalidQuantileWarning(q, posrange.PositionRange{}), ctx)
+		}
+		quantileValues[i] = strconv.FormatFloat(q, 'f', -1, 64)
+	}
+
+	series := make([]labels.Labels, 0, len(o.series)*len(o.quantiles))
+	b := labels.NewBuilder(labels.EmptyLabels())
+	for _, s := range o.series {
+		b.Reset(s)
+		for _, value := range quantileValues {
+			b.Set(o.quantileLabel, value)
+			series = append(series, b.Labels())
+		}
+	}
+	o.series = series
+}
+
 func (o *histogramOperator) resetBuckets() {
 	for i := range o.seriesBuckets {
 		o.seriesBuckets[i] = o.seriesBuckets[i][:0]
@@ -0,0 +1,489 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/logicalplan"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const targetInfo = "target_info"
+
+// infoSegment is the output series of an input series starting from a given step.
+type infoSegment struct {
+	step int
+	// id is the index of the output series, or -1 if the input series is dropped.
+	id  int
+	err error
+}
+
+// infoOperator implements the info function. It adds the data labels of info series
+// to the input series which have the same values for all identifying labels.
+//
+// The data labels of a series can change over time, for example when the info series
+// of a target is replaced by one with different labels. Since all output series need to be
+// known before returning samples, the operator reads all info series samples when loading
+// series and records the output series of each input series as a list of segments over steps.
+type infoOperator struct {
+	funcExpr *logicalplan.FunctionCall
+	next     model.VectorOperator
+	// infoValues selects the info series and infoTimes selects the timestamps
+	// of their samples, which are used to resolve conflicting info series.
+	infoValues model.VectorOperator
+	infoTimes  model.VectorOperator
+	opts       *query.Options
+
+	once     sync.Once
+	series   []labels.Labels
+	segments [][]infoSegment
+	cursors  []int
+	// stepErrs are errors returned for a step if there is at least one input sample.
+	stepErrs map[int]error
+	// sharedOutput is true if different input series can have the same output series.
+	sharedOutput bool
+	seen         []bool
+	currentStep  int
+}
+
+func newInfoOperator(
+	funcExpr *logicalplan.FunctionCall,
+	next, infoValues, infoTimes model.VectorOperator,
+	opts *query.Options,
+) model.VectorOperator {
+	oper := &infoOperator{
+		funcExpr:   funcExpr,
+		next:       next,
+		infoValues: infoValues,
+		infoTimes:  infoTimes,
+		opts:       opts,
+	}
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+}
+
+// InfoSelectorMatchers returns the matchers for selecting the info series used by a call
+// to the info function. Info series are selected by the metric name matchers of the data label
+// selector, or target_info if there are none, together with all data label matchers.
+func InfoSelectorMatchers(funcExpr *logicalplan.FunctionCall) []*labels.Matcher {
+	selectorMatchers := infoLabelSelectorMatchers(funcExpr)
+	matchers := make([]*labels.Matcher, 0, len(selectorMatchers)+1)
+	if !slices.ContainsFunc(selectorMatchers, isMetricNameMatcher) {
+		matchers = append(matchers, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, targetInfo))
+	}
+	return append(matchers, selectorMatchers...)
+}
+
+// infoLabelSelectorMatchers returns the matchers of the optional data label selector.
+func infoLabelSelectorMatchers(funcExpr *logicalplan.FunctionCall) []*labels.Matcher {
+	if len(funcExpr.Args) < 2 {
+		return nil
+	}
+	selector, ok := funcExpr.Args[1].(*logicalplan.VectorSelector)
+	if !ok {
+		return nil
+	}
+	return append(slices.Clone(selector.LabelMatchers), selector.Filters...)
+}
+
+func isMetricNameMatcher(m *labels.Matcher) bool {
+	return m.Name == labels.MetricName
+}
+
+func (o *infoOperator) String() string {
+	return "[info]"
+}
+
+func (o *infoOperator) Explain() (next []model.VectorOperator) {
+	return []model.VectorOperator{o.next, o.infoValues}
+}
+
+func (o *infoOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	return o.series, err
+}
+
+func (o *infoOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	if _, err := o.Series(ctx); err != nil {
+		return 0, err
+	}
+
+	n, err := o.next.Next(ctx, buf)
+	if err != nil {
+		return 0, err
+	}
+	for i := range buf[:n] {
+		if err := o.mapVector(&buf[i], o.currentStep); err != nil {
+			return 0, err
+		}
+		o.currentStep++
+	}
+	return n, nil
+}
+
+// mapVector replaces the IDs of input series with the IDs of output series
+// and removes samples of series which are dropped at the given step.
+func (o *infoOperator) mapVector(vector *model.StepVector, step int) error {
+	if len(vector.SampleIDs) == 0 && len(vector.HistogramIDs) == 0 {
+		return nil
+	}
+	if err := o.stepErrs[step]; err != nil {
+		return err
+	}
+	if o.sharedOutput {
+		clear(o.seen)
+	}
+
+	var j int
+	for i, id := range vector.SampleIDs {
+		outID, err := o.outputAt(id, step)
+		if err != nil {
+			return err
+		}
+		if outID < 0 {
+			continue
+		}
+		vector.SampleIDs[j] = uint64(outID)
+		vector.Samples[j] = vector.Samples[i]
+		j++
+	}
+	vector.SampleIDs = vector.SampleIDs[:j]
+	vector.Samples = vector.Samples[:j]
+
+	j = 0
+	for i, id := range vector.HistogramIDs {
+		outID, err := o.outputAt(id, step)
+		if err != nil {
+			return err
+		}
+		if outID < 0 {
+			continue
+		}
+		vector.HistogramIDs[j] = uint64(outID)
+		vector.Histograms[j] = vector.Histograms[i]
+		j++
+	}
+	vector.HistogramIDs = vector.HistogramIDs[:j]
+	vector.Histograms = vector.Histograms[:j]
+	return nil
+}
+
+func (o *infoOperator) outputAt(id uint64, step int) (int, error) {
+	segments := o.segments[id]
+	c := o.cursors[id]
+	for c+1 < len(segments) && segments[c+1].step <= step {
+		c++
+	}
+	o.cursors[id] = c
+
+	segment := segments[c]
+	if segment.err != nil {
+		return 0, segment.err
+	}
+	if segment.id < 0 || !o.sharedOutput {
+		return segment.id, nil
+	}
+	if o.seen[segment.id] {
+		return 0, errors.New("vector cannot contain metrics with the same labelset")
+	}
+	o.seen[segment.id] = true
+	return segment.id, nil
+}
+
+func (o *infoOperator) loadSeries(ctx context.Context) error {
+	series, err := o.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+	infoSeries, err := o.infoValues.Series(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := o.infoTimes.Series(ctx); err != nil {
+		return err
+	}
+
+	var (
+		selectorMatchers  = infoLabelSelectorMatchers(o.funcExpr)
+		infoNameMatchers  []*labels.Matcher
+		dataLabelMatchers = make(map[string][]*labels.Matcher)
+	)
+	for _, m := range selectorMatchers {
+		if isMetricNameMatcher(m) {
+			infoNameMatchers = append(infoNameMatchers, m)
+			continue
+		}
+		dataLabelMatchers[m.Name] = append(dataLabelMatchers[m.Name], m)
+	}
+	if len(o.funcExpr.Args) < 2 {
+		infoNameMatchers = []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, targetInfo)}
+	}
+
+	// Info series themselves are not enriched.
+	ignored := make([]bool, len(series))
+	idLabelValues := make(map[string]map[string]struct{})
+	for i, s := range series {
+		name := s.Get(labels.MetricName)
+		if slices.ContainsFunc(infoNameMatchers, func(m *labels.Matcher) bool { return m.Matches(name) }) {
+			ignored[i] = true
+			continue
+		}
+		for _, l := range logicalplan.InfoIdentifyingLabels {
+			v := s.Get(l)
+			if v == "" {
+				continue
+			}
+			if idLabelValues[l] == nil {
+				idLabelValues[l] = make(map[string]struct{})
+			}
+			idLabelValues[l][v] = struct{}{}
+		}
+	}
+
+	// Only info series with identifying label values of one of the input series are
+	// used, which is the same as restricting the info selector by these values.
+	usedInfo := make([]bool, len(infoSeries))
+	infoNames := make(map[string]int)
+	infoNameIDs := make([]int, len(infoSeries))
+	for i, s := range infoSeries {
+		if len(idLabelValues) == 0 {
+			break
+		}
+		usedInfo[i] = true
+		for l, values := range idLabelValues {
+			if _, ok := values[s.Get(l)]; !ok {
+				usedInfo[i] = false
+				break
+			}
+		}
+		if !usedInfo[i] {
+			continue
+		}
+		name := s.Get(labels.MetricName)
+		if _, ok := infoNames[name]; !ok {
+			infoNames[name] = len(infoNames)
+		}
+		infoNameIDs[i] = infoNames[name]
+	}
+
+	infoSigs := make([]string, len(infoSeries))
+	for i, s := range infoSeries {
+		if usedInfo[i] {
+			infoSigs[i] = infoSignature(s.Get(labels.MetricName), s)
+		}
+	}
+	seriesSigs := make([][]string, len(series))
+	for i, s := range series {
+		if ignored[i] {
+			continue
+		}
+		seriesSigs[i] = make([]string, len(infoNames))
+		for name, k := range infoNames {
+			seriesSigs[i][k] = infoSignature(name, s)
+		}
+	}
+
+	b := &infoSeriesBuilder{
+		series:            series,
+		infoSeries:        infoSeries,
+		dataLabelMatchers: dataLabelMatchers,
+		outputIDs:         make(map[string]int),
+	}
+	o.segments = make([][]infoSegment, len(series))
+	for i, s := range series {
+		if ignored[i] {
+			o.segments[i] = []infoSegment{{id: b.outputID(s, i)}}
+		}
+	}
+
+	var (
+		vectors     = make([]model.StepVector, o.opts.StepsBatch)
+		timestamps  = make([]model.StepVector, o.opts.StepsBatch)
+		infoAtStep  = make([]int64, len(infoSeries))
+		chosen      = make(map[string]int)
+		lastChoices = make([][]int, len(series))
+		choices     = make([]int, len(infoNames))
+		step        int
+	)
+	o.stepErrs = make(map[int]error)
+	for {
+		n, err := o.infoValues.Next(ctx, vectors)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if _, err := o.infoTimes.Next(ctx, timestamps); err != nil {
+			return err
+		}
+		for v := range vectors[:n] {
+			if len(vectors[v].HistogramIDs) > 0 {
+				id := vectors[v].HistogramIDs[0]
+				return errors.Newf("this should be an info metric, with float samples: %s", infoSeries[id])
+			}
+			for j, id := range timestamps[v].SampleIDs {
+				infoAtStep[id] = int64(math.Round(timestamps[v].Samples[j] * 1000))
+			}
+
+			// For every info metric and identifying labels, pick the info series with the latest sample.
+			clear(chosen)
+			for _, id := range vectors[v].SampleIDs {
+				if !usedInfo[id] {
+					continue
+				}
+				sig := infoSigs[id]
+				existing, ok := chosen[sig]
+				switch {
+				case !ok || infoAtStep[existing] < infoAtStep[id]:
+					chosen[sig] = int(id)
+				case infoAtStep[existing] == infoAtStep[id]:
+					o.stepErrs[step] = errors.Newf("found duplicate series for info metric: existing %s @ %d, new %s @ %d",
+						infoSeries[existing], infoAtStep[existing], infoSeries[id], infoAtStep[id])
+				}
+			}
+
+			for i := range series {
+				if ignored[i] {
+					continue
+				}
+				for k, sig := range seriesSigs[i] {
+					choice, ok := chosen[sig]
+					if !ok {
+						choice = -1
+					}
+					choices[k] = choice
+				}
+				if lastChoices[i] != nil && slices.Equal(lastChoices[i], choices) {
+					continue
+				}
+				lastChoices[i] = slices.Clone(choices)
+				segment := b.segment(i, choices)
+				segment.step = step
+				o.segments[i] = append(o.segments[i], segment)
+			}
+			step++
+		}
+	}
+	// The info selector does not return any steps if there are no info series.
+	for i := range series {
+		if len(o.segments[i]) == 0 {
+			for k := range choices {
+				choices[k] = -1
+			}
+			o.segments[i] = []infoSegment{b.segment(i, choices)}
+		}
+	}
+
+	o.series = b.outputSeries
+	o.sharedOutput = b.shared
+	o.seen = make([]bool, len(o.series))
+	o.cursors = make([]int, len(series))
+	return nil
+}
+
+// infoSignature returns the signature used to match a series with info series of the given name.
+func infoSignature(name string, lset labels.Labels) string {
+	b := labels.NewScratchBuilder(len(logicalplan.InfoIdentifyingLabels) + 1)
+	b.Add(labels.MetricName, name)
+	for _, l := range logicalplan.InfoIdentifyingLabels {
+		if v := lset.Get(l); v != "" {
+			b.Add(l, v)
+		}
+	}
+	b.Sort()
+	return string(b.Labels().Bytes(nil))
+}
+
+// infoSeriesBuilder builds the output series of the info function.
+type infoSeriesBuilder struct {
+	series            []labels.Labels
+	infoSeries        []labels.Labels
+	dataLabelMatchers map[string][]*labels.Matcher
+
+	outputIDs    map[string]int
+	outputSeries []labels.Labels
+	// shared is true if the same output series was returned for different input series.
+	shared bool
+	owners []int
+}
+
+// segment returns the output series for an input series joined with the given info series.
+func (b *infoSeriesBuilder) segment(i int, infoIDs []int) infoSegment {
+	base := b.series[i]
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	for _, id := range infoIDs {
+		if id < 0 {
+			continue
+		}
+		var err error
+		b.infoSeries[id].Range(func(l labels.Label) {
+			if err != nil || l.Name == labels.MetricName {
+				return
+			}
+			if _, ok := b.dataLabelMatchers[l.Name]; len(b.dataLabelMatchers) > 0 && !ok {
+				return
+			}
+			if v := lb.Get(l.Name); v != "" && v != l.Value {
+				err = errors.Newf("conflicting label: %s", l.Name)
+				return
+			}
+			if base.Has(l.Name) {
+				return
+			}
+			lb.Set(l.Name, l.Value)
+		})
+		if err != nil {
+			return infoSegment{err: err}
+		}
+	}
+
+	infoLabels := lb.Labels()
+	if infoLabels.IsEmpty() {
+		// Series without info labels are dropped if there is a data
+		// label matcher which does not match the empty value.
+		for _, matchers := range b.dataLabelMatchers {
+			for _, m := range matchers {
+				if !m.Matches("") {
+					return infoSegment{id: -1}
+				}
+			}
+		}
+	}
+
+	lb.Reset(base)
+	infoLabels.Range(func(l labels.Label) { lb.Set(l.Name, l.Value) })
+	return infoSegment{id: b.outputID(lb.Labels(), i)}
+}
+
+// outputID returns the ID of an output series for the input series with the given index.
+func (b *infoSeriesBuilder) outputID(lset labels.Labels, owner int) int {
+	key := string(lset.Bytes(nil))
+	if id, ok := b.outputIDs[key]; ok {
+		if b.owners[id] != owner {
+			b.shared = true
+		}
+		return id
+	}
+	id := len(b.outputSeries)
+	b.outputIDs[key] = id
+	b.outputSeries = append(b.outputSeries, lset)
+	b.owners = append(b.owners, owner)
+	return id
+}
@@ -0,0 +1,273 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/warnings"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser/posrange"
+	"github.com/prometheus/prometheus/util/annotations"
+	"github.com/prometheus/prometheus/util/convertnhcb"
+)
+
+type nhcbInputKind int
+
+const (
+	// nhcbOther series are passed through if they contain native histograms.
+	nhcbOther nhcbInputKind = iota
+	// nhcbBucket series contain the cumulative count of a classic histogram bucket.
+	nhcbBucket
+	// nhcbSum series contain the sum of observations of a classic histogram.
+	nhcbSum
+)
+
+type nhcbSeries struct {
+	outputID   int
+	kind       nhcbInputKind
+	upperBound float64
+}
+
+// nhcbOperator converts classic histograms into native histograms with custom buckets.
+// Bucket series are grouped by their labels without le, and the _bucket suffix is removed
+// from their metric name. The sum of observations is taken from the corresponding _sum
+// series if it is part of the input. Native histograms are passed through unchanged.
+type nhcbOperator struct {
+	next model.VectorOperator
+
+	once   sync.Once
+	series []labels.Labels
+
+	// inputIndex maps input series IDs to output series IDs. It is nil for
+	// classic histogram buckets with an invalid le label.
+	inputIndex []*nhcbSeries
+	// inputSeriesNames are needed for compiling warnings.
+	inputSeriesNames []string
+	// badBuckets contains the le label values of buckets for which no warning has been emitted yet.
+	badBuckets map[uint64]string
+
+	// seriesBuckets are the cumulative buckets of each output series in the current step.
+	seriesBuckets []promql.Buckets
+	seriesSums    []float64
+	// seriesNative is the index of the native histogram of each output series in the current step, or -1.
+	seriesNative []int
+}
+
+func newNHCBOperator(next model.VectorOperator, opts *query.Options) model.VectorOperator {
+	oper := &nhcbOperator{
+		next: next,
+	}
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+}
+
+func (o *nhcbOperator) Explain() (next []model.VectorOperator) {
+	return []model.VectorOperator{o.next}
+}
+
+func (o *nhcbOperator) String() string {
+	return "[toNHCB]"
+}
+
+func (o *nhcbOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *nhcbOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := o.next.Next(ctx, buf)
+	if err != nil {
+		return 0, err
+	}
+	for i := range n {
+		o.convert(ctx, &buf[i])
+	}
+	return n, nil
+}
+
+// convert replaces the samples of the input vector with one histogram for each output series.
+func (o *nhcbOperator) convert(ctx context.Context, vector *model.StepVector) {
+	for i := range o.series {
+		o.seriesBuckets[i] = o.seriesBuckets[i][:0]
+		o.seriesSums[i] = 0
+		o.seriesNative[i] = -1
+	}
+
+	for i, seriesID := range vector.SampleIDs {
+		in := o.inputIndex[seriesID]
+		if in == nil {
+			if le, ok := o.badBuckets[seriesID]; ok {
+				delete(o.badBuckets, seriesID)
+				warnings.AddToContext(annotations.NewBadBucketLabelWarning(o.inputSeriesNames[seriesID], le, posrange.PositionRange{}), ctx)
+			}
+			continue
+		}
+		switch in.kind {
+		case nhcbBucket:
+			o.seriesBuckets[in.outputID] = append(o.seriesBuckets[in.outputID], promql.Bucket{
+				UpperBound: in.upperBound,
+				Count:      vector.Samples[i],
+			})
+		case nhcbSum:
+			o.seriesSums[in.outputID] = vector.Samples[i]
+		}
+	}
+	for i, seriesID := range vector.HistogramIDs {
+		if in := o.inputIndex[seriesID]; in != nil {
+			o.seriesNative[in.outputID] = i
+		}
+	}
+
+	var (
+		histograms   = vector.Histograms
+		histogramIDs = vector.HistogramIDs
+	)
+	vector.SampleIDs = vector.SampleIDs[:0]
+	vector.Samples = vector.Samples[:0]
+	vector.HistogramIDs = nil
+	vector.Histograms = nil
+	for i, buckets := range o.seriesBuckets {
+		native := o.seriesNative[i]
+		switch {
+		case native >= 0 && len(buckets) > 0:
+			// The result of mixing classic and native histograms in one series is undefined.
+			warnings.AddToContext(annotations.NewMixedClassicNativeHistogramsWarning(o.inputSeriesNames[histogramIDs[native]], posrange.PositionRange{}), ctx)
+		case native >= 0:
+			vector.AppendHistogram(uint64(i), histograms[native])
+		case len(buckets) > 0:
+			vector.AppendHistogram(uint64(i), bucketsToNHCB(buckets, o.seriesSums[i]))
+		}
+	}
+}
+
+// bucketsToNHCB converts cumulative classic histogram buckets into a native histogram with custom buckets.
+// Like in histogram_quantile, buckets with the same upper bound are merged and bucket counts are forced to be
+// monotonic. Without a +Inf bucket, the count of the highest bucket is used as the count of the histogram.
+// Like in Prometheus, the sum is zero when it is unknown since a NaN sum would indicate NaN observations.
+func bucketsToNHCB(buckets promql.Buckets, sum float64) *histogram.FloatHistogram {
+	slices.SortFunc(buckets, func(a, b promql.Bucket) int {
+		switch {
+		case a.UpperBound < b.UpperBound:
+			return -1
+		case a.UpperBound > b.UpperBound:
+			return 1
+		}
+		return 0
+	})
+	merged := buckets[:1]
+	for _, b := range buckets[1:] {
+		last := &merged[len(merged)-1]
+		if b.UpperBound == last.UpperBound {
+			last.Count += b.Count
+			continue
+		}
+		merged = append(merged, b)
+	}
+	if merged[len(merged)-1].UpperBound != math.Inf(1) {
+		merged = append(merged, promql.Bucket{UpperBound: math.Inf(1), Count: merged[len(merged)-1].Count})
+	}
+
+	fh := &histogram.FloatHistogram{
+		Schema:          histogram.CustomBucketsSchema,
+		PositiveSpans:   []histogram.Span{{Length: uint32(len(merged))}},
+		PositiveBuckets: make([]float64, len(merged)),
+		CustomValues:    make([]float64, 0, len(merged)-1),
+		Sum:             sum,
+	}
+	var prev float64
+	for i, b := range merged {
+		count := max(b.Count, prev)
+		fh.PositiveBuckets[i] = count - prev
+		prev = count
+		if !math.IsInf(b.UpperBound, 1) {
+			fh.CustomValues = append(fh.CustomValues, b.UpperBound)
+		}
+	}
+	fh.Count = prev
+	return fh.Compact(0)
+}
+
+func (o *nhcbOperator) loadSeries(ctx context.Context) error {
+	series, err := o.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	seriesHashes := make(map[uint64]int, len(series))
+	o.badBuckets = make(map[uint64]string)
+	o.inputIndex = make([]*nhcbSeries, len(series))
+	o.inputSeriesNames = make([]string, len(series))
+	for i, s := range series {
+		var (
+			name             = s.Get(labels.MetricName)
+			suffix, baseName = convertnhcb.GetHistogramMetricBaseName(name)
+			in               = &nhcbSeries{kind: nhcbOther}
+			lbls             = s
+		)
+		switch {
+		case s.Has(labels.BucketLabel):
+			le := s.Get(labels.BucketLabel)
+			upperBound, err := strconv.ParseFloat(le, 64)
+			if err != nil {
+				o.badBuckets[uint64(i)] = le
+				in = nil
+				break
+			}
+			if suffix != convertnhcb.SuffixBucket {
+				baseName = name
+			}
+			in.kind = nhcbBucket
+			in.upperBound = upperBound
+			lbls = convertnhcb.GetHistogramMetricBase(s, baseName)
+		case suffix == convertnhcb.SuffixSum:
+			in.kind = nhcbSum
+			lbls = convertnhcb.GetHistogramMetricBase(s, baseName)
+		}
+
+		o.inputSeriesNames[i] = name
+		if in == nil {
+			continue
+		}
+		hash := lbls.Hash()
+		outputID, ok := seriesHashes[hash]
+		if !ok {
+			outputID = len(o.series)
+			seriesHashes[hash] = outputID
+			o.series = append(o.series, lbls)
+		}
+		in.outputID = outputID
+		o.inputIndex[i] = in
+	}
+
+	o.seriesBuckets = make([]promql.Buckets, len(o.series))
+	o.seriesSums = make([]float64, len(o.series))
+	o.seriesNative = make([]int, len(o.series))
+	return nil
+}
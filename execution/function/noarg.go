@@ -8,14 +8,14 @@ import (
 
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/logicalplan"
+	"github.com/thanos-io/promql-engine/query"
 
 	"github.com/prometheus/prometheus/model/labels"
 )
 
 type noArgFunctionOperator struct {
-	mint        int64
+	opts        *query.Options
 	maxt        int64
-	step        int64
 	currentStep int64
 	stepsBatch  int
 	funcExpr    *logicalplan.FunctionCall
@@ -54,7 +54,7 @@ func (o *noArgFunctionOperator) Next(ctx context.Context, buf []model.StepVector
 		buf[n].Reset(o.currentStep)
 		buf[n].AppendSample(o.sampleIDs[0], o.call(o.currentStep))
 		n++
-		o.currentStep += o.step
+		o.currentStep = o.opts.NextStep(o.currentStep)
 	}
 
 	return n, nil
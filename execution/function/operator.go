@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"slices"
 	"sync"
 
 	"github.com/thanos-io/promql-engine/execution/model"
@@ -28,12 +29,25 @@ func NewFunctionOperator(funcExpr *logicalplan.FunctionCall, nextOps []model.Vec
 		return newScalarOperator(nextOps[0], opts), nil
 	case "timestamp":
 		return newTimestampOperator(nextOps[0], opts), nil
-	case "label_join", "label_replace":
+	case "quantile_sketch":
+		return newQuantileSketchOperator(nextOps[0], opts), nil
+	case "to_nhcb":
+		return newNHCBOperator(nextOps[0], opts), nil
+	case "to_classic":
+		return newClassicOperator(funcExpr, nextOps[0], opts)
+	case "label_join", "label_replace", "label_keep", "label_drop", "label_copy", "label_map":
 		return newRelabelOperator(nextOps[0], funcExpr, opts), nil
 	case "absent":
 		return newAbsentOperator(funcExpr, nextOps[0], opts), nil
-	case "histogram_quantile", "histogram_fraction":
-		return newHistogramOperator(funcExpr, nextOps, stepsBatch, opts), nil
+	case "info":
+		return newInfoOperator(funcExpr, nextOps[0], nextOps[1], nextOps[2], opts), nil
+	case "fill_gaps", "interpolate":
+		return newGapFillOperator(funcExpr, nextOps, stepsBatch, opts)
+	case "histogram_quantile", "histogram_fraction", "histogram_quantiles":
+		return newHistogramOperator(funcExpr, nextOps, stepsBatch, opts)
+	}
+	if opts.Functions.IsLabelFunction(funcExpr.Func.Name) {
+		return newRelabelOperator(nextOps[0], funcExpr, opts), nil
 	}
 
 	// Short-circuit functions that take no args. Their only input is the step's timestamp.
@@ -47,20 +61,20 @@ func NewFunctionOperator(funcExpr *logicalplan.FunctionCall, nextOps []model.Vec
 func newNoArgsFunctionOperator(funcExpr *logicalplan.FunctionCall, stepsBatch int, opts *query.Options) (model.VectorOperator, error) {
 	call, ok := noArgFuncs[funcExpr.Func.Name]
 	if !ok {
-		return nil, parse.UnknownFunctionError(funcExpr.Func.Name)
-	}
-
-	interval := opts.Step.Milliseconds()
-	// We set interval to be at least 1.
-	if interval == 0 {
-		interval = 1
+		f, loc, ok, err := lookupDateTimeFunc(funcExpr, opts)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, parse.UnknownFunctionError(funcExpr.Func.Name)
+		}
+		call = dateTimeNoArgFunc(f, loc)
 	}
 
 	op := &noArgFunctionOperator{
+		opts:        opts,
 		currentStep: opts.Start.UnixMilli(),
-		mint:        opts.Start.UnixMilli(),
 		maxt:        opts.End.UnixMilli(),
-		step:        interval,
 		stepsBatch:  stepsBatch,
 		funcExpr:    funcExpr,
 		call:        call,
@@ -91,12 +105,27 @@ type functionOperator struct {
 	call         functionCall
 	scalarPoints [][]float64
 	scalarBuf    []model.StepVector
+
+	delayedNameRemoval bool
 }
 
 func newInstantVectorFunctionOperator(funcExpr *logicalplan.FunctionCall, nextOps []model.VectorOperator, stepsBatch int, opts *query.Options) (model.VectorOperator, error) {
 	call, ok := instantVectorFuncs[funcExpr.Func.Name]
 	if !ok {
-		return nil, parse.UnknownFunctionError(funcExpr.Func.Name)
+		f, loc, ok, err := lookupDateTimeFunc(funcExpr, opts)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			call = dateTimeFunc(f, loc)
+		}
+	}
+	if call == nil {
+		f, ok := opts.Functions.Get(funcExpr.Func.Name)
+		if !ok || f.InstantVector == nil {
+			return nil, parse.UnknownFunctionError(funcExpr.Func.Name)
+		}
+		call = functionCall(f.InstantVector)
 	}
 
 	scalarPoints := make([][]float64, stepsBatch)
@@ -110,17 +139,23 @@ func newInstantVectorFunctionOperator(funcExpr *logicalplan.FunctionCall, nextOp
 		vectorIndex:  0,
 		stepsBatch:   stepsBatch,
 		scalarPoints: scalarPoints,
+
+		delayedNameRemoval: opts.EnableDelayedNameRemoval,
 	}
 
-	for i := range funcExpr.Args {
-		if funcExpr.Args[i].ReturnType() == parser.ValueTypeVector {
+	// String arguments don't have operators.
+	args := slices.DeleteFunc(slices.Clone(funcExpr.Args), func(arg logicalplan.Node) bool {
+		return arg.ReturnType() == parser.ValueTypeString
+	})
+	for i := range args {
+		if args[i].ReturnType() == parser.ValueTypeVector {
 			f.vectorIndex = i
 			break
 		}
 	}
 
 	// Check selector type.
-	switch funcExpr.Args[f.vectorIndex].ReturnType() {
+	switch args[f.vectorIndex].ReturnType() {
 	case parser.ValueTypeVector, parser.ValueTypeScalar:
 		return telemetry.NewOperator(telemetry.NewTelemetry(f, opts), f), nil
 	default:
@@ -236,7 +271,7 @@ func (o *functionOperator) loadSeries(ctx context.Context) error {
 
 		var b labels.ScratchBuilder
 		for i, s := range series {
-			lbls := extlabels.DropReserved(s, b)
+			lbls := extlabels.DropMetricName(s, b, o.delayedNameRemoval)
 			o.series[i] = lbls
 		}
 	})
@@ -11,12 +11,15 @@ import (
 
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/extlabels"
+	"github.com/thanos-io/promql-engine/functions"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
 
 	"github.com/efficientgo/core/errors"
 	prommodel "github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 )
 
 type relabelOperator struct {
@@ -24,6 +27,9 @@ type relabelOperator struct {
 	funcExpr *logicalplan.FunctionCall
 	once     sync.Once
 	series   []labels.Labels
+
+	// call is set for user defined label functions.
+	call functions.LabelFunc
 }
 
 func newRelabelOperator(
@@ -35,6 +41,9 @@ func newRelabelOperator(
 		next:     next,
 		funcExpr: funcExpr,
 	}
+	if f, ok := opts.Functions.Get(funcExpr.Func.Name); ok {
+		oper.call = f.Label
+	}
 	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
 }
 
@@ -68,8 +77,17 @@ func (o *relabelOperator) loadSeries(ctx context.Context) (err error) {
 		err = o.loadSeriesForLabelJoin(series)
 	case "label_replace":
 		err = o.loadSeriesForLabelReplace(series)
+	case "label_keep", "label_drop":
+		err = o.loadSeriesForLabelFilter(series)
+	case "label_copy":
+		err = o.loadSeriesForLabelCopy(series)
+	case "label_map":
+		err = o.loadSeriesForLabelMap(series)
 	default:
-		err = errors.Newf("invalid function name for relabel operator: %s", o.funcExpr.Func.Name)
+		if o.call == nil {
+			return errors.Newf("invalid function name for relabel operator: %s", o.funcExpr.Func.Name)
+		}
+		err = o.loadSeriesForLabelFunc(series)
 	}
 	return err
 }
@@ -100,7 +118,7 @@ func (o *relabelOperator) loadSeriesForLabelJoin(series []labels.Labels) error {
 		srcVals := make([]string, len(labelJoinSrcLabels))
 
 		for j, src := range labelJoinSrcLabels {
-			srcVals[j] = lbls.Get(src)
+			srcVals[j] = extlabels.Get(lbls, src)
 		}
 		lb := labels.NewBuilder(lbls)
 		if strval := strings.Join(srcVals, labelJoinSep); strval == "" {
@@ -108,6 +126,7 @@ func (o *relabelOperator) loadSeriesForLabelJoin(series []labels.Labels) error {
 		} else {
 			lb.Set(labelJoinDst, strval)
 		}
+		keepMetricName(lb, labelJoinDst)
 		o.series[i] = lb.Labels()
 	}
 	return nil
@@ -140,7 +159,7 @@ func (o *relabelOperator) loadSeriesForLabelReplace(series []labels.Labels) erro
 	for i, s := range series {
 		lbls := s
 
-		srcVal := lbls.Get(labelReplaceSrc)
+		srcVal := extlabels.Get(lbls, labelReplaceSrc)
 		matches := labelReplaceRegex.FindStringSubmatchIndex(srcVal)
 		if len(matches) == 0 {
 			o.series[i] = lbls
@@ -151,8 +170,147 @@ func (o *relabelOperator) loadSeriesForLabelReplace(series []labels.Labels) erro
 		if len(res) > 0 {
 			lb.Set(labelReplaceDst, string(res))
 		}
+		keepMetricName(lb, labelReplaceDst)
+		o.series[i] = lb.Labels()
+	}
+
+	return nil
+}
+
+func (o *relabelOperator) loadSeriesForLabelFilter(series []labels.Labels) error {
+	keep, err := logicalplan.LabelFilter(o.funcExpr)
+	if err != nil {
+		return err
+	}
+	b := labels.NewScratchBuilder(0)
+	for i, s := range series {
+		b.Reset()
+		s.Range(func(l labels.Label) {
+			// The marker of delayed name removal is kept so that it applies to the name if it is kept.
+			if keep(l.Name) || l.Name == extlabels.DropNameLabel {
+				b.Add(l.Name, l.Value)
+			}
+		})
+		o.series[i] = b.Labels()
+	}
+	return nil
+}
+
+func (o *relabelOperator) loadSeriesForLabelCopy(series []labels.Labels) error {
+	labelCopyDst, err := logicalplan.UnwrapString(o.funcExpr.Args[1])
+	if err != nil {
+		return errors.Wrap(err, "unable to unwrap string argument")
+	}
+	if !prommodel.UTF8Validation.IsValidLabelName(labelCopyDst) {
+		return errors.Newf("invalid destination label name in label_copy: %s", labelCopyDst)
+	}
+	labelCopySrc, err := logicalplan.UnwrapString(o.funcExpr.Args[2])
+	if err != nil {
+		return errors.Wrap(err, "unable to unwrap string argument")
+	}
+
+	for i, s := range series {
+		// Like in label_join, the destination label is removed if the source label is empty.
+		lb := labels.NewBuilder(s)
+		if val := extlabels.Get(s, labelCopySrc); val == "" {
+			lb.Del(labelCopyDst)
+		} else {
+			lb.Set(labelCopyDst, val)
+		}
+		keepMetricName(lb, labelCopyDst)
+		o.series[i] = lb.Labels()
+	}
+	return nil
+}
+
+func (o *relabelOperator) loadSeriesForLabelMap(series []labels.Labels) error {
+	labelMapDst, err := logicalplan.UnwrapString(o.funcExpr.Args[1])
+	if err != nil {
+		return errors.Wrap(err, "unable to unwrap string argument")
+	}
+	if !prommodel.UTF8Validation.IsValidLabelName(labelMapDst) {
+		return errors.Newf("invalid destination label name in label_map: %s", labelMapDst)
+	}
+	labelMapSrc, err := logicalplan.UnwrapString(o.funcExpr.Args[2])
+	if err != nil {
+		return errors.Wrap(err, "unable to unwrap string argument")
+	}
+	pairs := o.funcExpr.Args[3:]
+	if len(pairs)%2 != 0 {
+		return errors.Newf("label_map expects pairs of source and destination values, got %d values", len(pairs))
+	}
+	table := make(map[string]string, len(pairs)/2)
+	for j := 0; j < len(pairs); j += 2 {
+		from, err := logicalplan.UnwrapString(pairs[j])
+		if err != nil {
+			return errors.Wrap(err, "unable to unwrap string argument")
+		}
+		to, err := logicalplan.UnwrapString(pairs[j+1])
+		if err != nil {
+			return errors.Wrap(err, "unable to unwrap string argument")
+		}
+		if _, ok := table[from]; ok {
+			return errors.Newf("duplicate source value in label_map: %s", from)
+		}
+		table[from] = to
+	}
+
+	for i, s := range series {
+		// Series with a value which is not in the table are not changed.
+		to, ok := table[extlabels.Get(s, labelMapSrc)]
+		if !ok {
+			o.series[i] = s
+			continue
+		}
+		lb := labels.NewBuilder(s)
+		if to == "" {
+			lb.Del(labelMapDst)
+		} else {
+			lb.Set(labelMapDst, to)
+		}
+		keepMetricName(lb, labelMapDst)
 		o.series[i] = lb.Labels()
 	}
+	return nil
+}
 
+// keepMetricName removes the marker of delayed name removal if dst is the metric name,
+// since a metric name which is set explicitly is kept in the result.
+func keepMetricName(lb *labels.Builder, dst string) {
+	if dst == labels.MetricName {
+		lb.Del(extlabels.DropNameLabel)
+	}
+}
+
+func (o *relabelOperator) loadSeriesForLabelFunc(series []labels.Labels) error {
+	var args []string
+	for _, arg := range o.funcExpr.Args {
+		if arg.ReturnType() != parser.ValueTypeString {
+			continue
+		}
+		val, err := logicalplan.UnwrapString(arg)
+		if err != nil {
+			return errors.Wrap(err, "unable to unwrap string argument")
+		}
+		args = append(args, val)
+	}
+	b := labels.NewBuilder(labels.EmptyLabels())
+	for i, s := range series {
+		// The function only sees the labels of the series, and the marker of delayed name
+		// removal is restored unless the function changed the metric name.
+		marked := s.Has(extlabels.DropNameLabel)
+		if marked {
+			b.Reset(s)
+			s = b.Del(extlabels.DropNameLabel).Labels()
+		}
+		lbls, err := o.call(s, args)
+		if err != nil {
+			return errors.Wrapf(err, "%s", o.funcExpr.Func.Name)
+		}
+		if marked && lbls.Get(labels.MetricName) == s.Get(labels.MetricName) {
+			lbls = extlabels.DropMetricName(lbls, labels.ScratchBuilder{}, true)
+		}
+		o.series[i] = lbls
+	}
 	return nil
 }
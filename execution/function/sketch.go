@@ -0,0 +1,92 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"sync"
+
+	"github.com/thanos-io/promql-engine/compute"
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/extlabels"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// quantileSketchOperator converts float samples into quantile sketches with a single value.
+// Summing the sketches merges them, which allows quantiles to be approximated across engines.
+// Histogram samples are dropped since the quantile aggregation ignores them.
+type quantileSketchOperator struct {
+	next model.VectorOperator
+
+	series []labels.Labels
+	once   sync.Once
+}
+
+func newQuantileSketchOperator(next model.VectorOperator, opts *query.Options) model.VectorOperator {
+	oper := &quantileSketchOperator{
+		next: next,
+	}
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+}
+
+func (o *quantileSketchOperator) Explain() (next []model.VectorOperator) {
+	return []model.VectorOperator{o.next}
+}
+
+func (o *quantileSketchOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	if err := o.loadSeries(ctx); err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *quantileSketchOperator) String() string {
+	return "[quantileSketch]"
+}
+
+func (o *quantileSketchOperator) loadSeries(ctx context.Context) error {
+	var err error
+	o.once.Do(func() {
+		series, loadErr := o.next.Series(ctx)
+		if loadErr != nil {
+			err = loadErr
+			return
+		}
+		o.series = make([]labels.Labels, len(series))
+
+		var b labels.ScratchBuilder
+		for i, s := range series {
+			o.series[i] = extlabels.DropReserved(s, b)
+		}
+	})
+
+	return err
+}
+
+func (o *quantileSketchOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	n, err := o.next.Next(ctx, buf)
+	if err != nil {
+		return 0, err
+	}
+	for i := range n {
+		vector := &buf[i]
+		vector.HistogramIDs = vector.HistogramIDs[:0]
+		vector.Histograms = vector.Histograms[:0]
+		for j, v := range vector.Samples {
+			vector.AppendHistogram(vector.SampleIDs[j], compute.NewQuantileSketchHistogram(v))
+		}
+		vector.SampleIDs = vector.SampleIDs[:0]
+		vector.Samples = vector.Samples[:0]
+	}
+	return n, nil
+}
@@ -18,13 +18,15 @@ import (
 type timestampOperator struct {
 	next model.VectorOperator
 
-	series []labels.Labels
-	once   sync.Once
+	series             []labels.Labels
+	once               sync.Once
+	delayedNameRemoval bool
 }
 
 func newTimestampOperator(next model.VectorOperator, opts *query.Options) model.VectorOperator {
 	oper := &timestampOperator{
-		next: next,
+		next:               next,
+		delayedNameRemoval: opts.EnableDelayedNameRemoval,
 	}
 	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
 }
@@ -56,7 +58,7 @@ func (o *timestampOperator) loadSeries(ctx context.Context) error {
 
 		var b labels.ScratchBuilder
 		for i, s := range series {
-			lbls := extlabels.DropReserved(s, b)
+			lbls := extlabels.DropMetricName(s, b, o.delayedNameRemoval)
 			o.series[i] = lbls
 		}
 	})
@@ -5,6 +5,7 @@ package parse
 
 import (
 	"fmt"
+	"slices"
 
 	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/promql/parser"
@@ -28,6 +29,216 @@ var XFunctions = map[string]*parser.Function{
 	},
 }
 
+// QuantileSketchFunctions contains functions used for approximating quantiles with mergeable sketches.
+var QuantileSketchFunctions = map[string]*parser.Function{
+	"quantile_sketch": {
+		Name:       "quantile_sketch",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector},
+		ReturnType: parser.ValueTypeVector,
+	},
+}
+
+// CountDistinctFunctions contains functions used for approximating the number of distinct label values
+// with HyperLogLog sketches. All of them take grouping labels as trailing string arguments.
+var CountDistinctFunctions = map[string]*parser.Function{
+	"count_distinct_approx": {
+		Name:       "count_distinct_approx",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeString, parser.ValueTypeVector, parser.ValueTypeString},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+	"count_distinct_sketch": {
+		Name:       "count_distinct_sketch",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeString, parser.ValueTypeVector, parser.ValueTypeString},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+	"count_distinct_merge": {
+		Name:       "count_distinct_merge",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+}
+
+// LabelFunctions contains functions which transform the labels of their input series in addition to
+// label_replace and label_join. label_keep and label_drop keep or drop labels with names matching any of
+// the given regular expressions, label_copy copies the value of a label into another one, and label_map
+// maps the values of a label through a table of value pairs, such as label_map(X, "dst", "src", "a", "A").
+var LabelFunctions = map[string]*parser.Function{
+	"label_keep": {
+		Name:       "label_keep",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+	"label_drop": {
+		Name:       "label_drop",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+	"label_copy": {
+		Name:       "label_copy",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString, parser.ValueTypeString},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"label_map": {
+		Name:       "label_map",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString, parser.ValueTypeString, parser.ValueTypeString, parser.ValueTypeString, parser.ValueTypeString},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+}
+
+// GapFillingFunctions contains functions which fill steps without a sample in series of range query results.
+// fill_gaps(X, value) fills them with a constant, and interpolate(X, method, max_gap) fills steps between two
+// samples at most max_gap seconds apart with the "linear", "previous" or "next" method.
+var GapFillingFunctions = map[string]*parser.Function{
+	"fill_gaps": {
+		Name:       "fill_gaps",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeScalar},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"interpolate": {
+		Name:       "interpolate",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString, parser.ValueTypeScalar},
+		Variadic:   1,
+		ReturnType: parser.ValueTypeVector,
+	},
+}
+
+// NHCBConversionFunctions contains functions which convert classic histograms to native histograms with custom buckets.
+var NHCBConversionFunctions = map[string]*parser.Function{
+	"to_nhcb": {
+		Name:       "to_nhcb",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector},
+		ReturnType: parser.ValueTypeVector,
+	},
+}
+
+// ClassicConversionFunctions contains functions which convert native histograms to classic histograms.
+var ClassicConversionFunctions = map[string]*parser.Function{
+	"to_classic": {
+		Name:       "to_classic",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeScalar},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+}
+
+// HistogramQuantilesFunctions contains functions which calculate several quantiles of the same histograms
+// in a single pass, such as histogram_quantiles(X, "quantile", 0.5, 0.9, 0.99). The quantiles must be
+// number literals, and each one is returned as a separate series with its value in the given label.
+var HistogramQuantilesFunctions = map[string]*parser.Function{
+	"histogram_quantiles": {
+		Name:       "histogram_quantiles",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString, parser.ValueTypeScalar, parser.ValueTypeScalar},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+}
+
+// SeasonalFunctions contains functions which use Holt-Winters triple exponential smoothing to smooth
+// and forecast series with seasonality. Besides the smoothing and trend factors of double_exponential_smoothing,
+// they take a seasonal smoothing factor and the number of samples in a season, and predict_seasonal takes the
+// number of samples to forecast ahead.
+var SeasonalFunctions = map[string]*parser.Function{
+	"holt_winters_seasonal": {
+		Name:       "holt_winters_seasonal",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix, parser.ValueTypeScalar, parser.ValueTypeScalar, parser.ValueTypeScalar, parser.ValueTypeScalar},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"predict_seasonal": {
+		Name:       "predict_seasonal",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix, parser.ValueTypeScalar, parser.ValueTypeScalar, parser.ValueTypeScalar, parser.ValueTypeScalar, parser.ValueTypeScalar},
+		ReturnType: parser.ValueTypeVector,
+	},
+}
+
+// StatisticalFunctions contains range vector functions which calculate statistics over the float samples
+// in a range, such as their exponentially weighted moving average, the standard score of the latest sample,
+// or the fit of a simple linear regression.
+var StatisticalFunctions = func() map[string]*parser.Function {
+	functions := map[string]*parser.Function{
+		"ewma_over_time": {
+			Name:       "ewma_over_time",
+			ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix, parser.ValueTypeScalar},
+			ReturnType: parser.ValueTypeVector,
+		},
+	}
+	for _, name := range []string{
+		"zscore_over_time",
+		"skew_over_time",
+		"kurtosis_over_time",
+		"slope_over_time",
+		"intercept_over_time",
+		"r2_over_time",
+		"percent_rank_over_time",
+	} {
+		functions[name] = &parser.Function{
+			Name:       name,
+			ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix},
+			ReturnType: parser.ValueTypeVector,
+		}
+	}
+	return functions
+}()
+
+// PairedRangeFunctions contains range vector functions of two series. Their arguments are two range vectors,
+// and series of both arguments with the same labels apart from the metric name are evaluated together.
+// Matching series on a subset of their labels, like with on() or ignoring() in binary operations, is not supported.
+var PairedRangeFunctions = map[string]*parser.Function{
+	"corr_over_time": {
+		Name:       "corr_over_time",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix, parser.ValueTypeMatrix},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"covar_over_time": {
+		Name:       "covar_over_time",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix, parser.ValueTypeMatrix},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"ratio_over_time": {
+		Name:       "ratio_over_time",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix, parser.ValueTypeMatrix},
+		ReturnType: parser.ValueTypeVector,
+	},
+}
+
+// dateTimeFunctions are functions which return a part of the date and time of their argument,
+// or of the evaluation time when they are called without arguments.
+var dateTimeFunctions = []string{
+	"days_in_month",
+	"day_of_month",
+	"day_of_week",
+	"day_of_year",
+	"hour",
+	"minute",
+	"month",
+	"year",
+}
+
+// TimeZoneFunctions contains variants of date and time functions which take the name of the time zone used
+// for evaluating them as their first argument, for example hour_tz("Europe/Berlin", X) or hour_tz("Europe/Berlin").
+var TimeZoneFunctions = func() map[string]*parser.Function {
+	functions := make(map[string]*parser.Function, len(dateTimeFunctions))
+	for _, name := range dateTimeFunctions {
+		functions[name+"_tz"] = &parser.Function{
+			Name:       name + "_tz",
+			ArgTypes:   []parser.ValueType{parser.ValueTypeString, parser.ValueTypeVector},
+			Variadic:   1,
+			ReturnType: parser.ValueTypeVector,
+		}
+	}
+	return functions
+}()
+
+// IsDateTimeFunction returns whether the function evaluates dates and times in the time zone of the query.
+func IsDateTimeFunction(functionName string) bool {
+	return slices.Contains(dateTimeFunctions, functionName)
+}
+
 // IsExtFunction is a convenience function to determine whether extended range calculations are required.
 func IsExtFunction(functionName string) bool {
 	_, ok := XFunctions[functionName]
@@ -17,10 +17,9 @@ import (
 
 // numberLiteralSelector returns []model.StepVector with same sample value across time range.
 type numberLiteralSelector struct {
+	opts        *query.Options
 	numSteps    int
-	mint        int64
 	maxt        int64
-	step        int64
 	currentStep int64
 	series      []labels.Labels
 	once        sync.Once
@@ -30,10 +29,9 @@ type numberLiteralSelector struct {
 
 func NewNumberLiteralSelector(opts *query.Options, val float64) model.VectorOperator {
 	oper := &numberLiteralSelector{
+		opts:        opts,
 		numSteps:    opts.NumStepsPerBatch(),
-		mint:        opts.Start.UnixMilli(),
 		maxt:        opts.End.UnixMilli(),
-		step:        opts.Step.Milliseconds(),
 		currentStep: opts.Start.UnixMilli(),
 		val:         val,
 	}
@@ -73,16 +71,10 @@ func (o *numberLiteralSelector) Next(ctx context.Context, buf []model.StepVector
 		buf[n].Reset(ts)
 		buf[n].AppendSample(0, o.val)
 
-		ts += o.step
+		ts = o.opts.NextStep(ts)
 		n++
 	}
-
-	// For instant queries, set the step to a positive value
-	// so that the operator can terminate.
-	if o.step == 0 {
-		o.step = 1
-	}
-	o.currentStep += o.step * int64(n)
+	o.currentStep = ts
 
 	return n, nil
 }
@@ -10,6 +10,7 @@ import (
 	"sync"
 
 	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/parse"
 	"github.com/thanos-io/promql-engine/execution/telemetry"
 	"github.com/thanos-io/promql-engine/extlabels"
 	"github.com/thanos-io/promql-engine/logicalplan"
@@ -35,7 +36,6 @@ type subqueryOperator struct {
 	mint        int64
 	maxt        int64
 	currentStep int64
-	step        int64
 	stepsBatch  int
 
 	onceSeries sync.Once
@@ -46,8 +46,8 @@ type subqueryOperator struct {
 	buffers       []*ringbuffer.GenericRingBuffer
 
 	// params holds the function parameter for each step.
-	// quantile_over time and predict_linear use one parameter (params)
-	// double_exponential_smoothing uses two (params, params2) for (sf, tf)
+	// quantile_over time, predict_linear and ewma_over_time use one parameter (params)
+	// double_exponential_smoothing and the seasonal functions use two (params, params2) for (sf, tf)
 	params  []float64
 	params2 []float64
 
@@ -60,15 +60,18 @@ type subqueryOperator struct {
 }
 
 func NewSubqueryOperator(next, paramOp, paramOp2 model.VectorOperator, opts *query.Options, funcExpr *logicalplan.FunctionCall, subQuery *logicalplan.Subquery) (model.VectorOperator, error) {
-	call, err := ringbuffer.NewRangeVectorFunc(funcExpr.Func.Name)
+	var (
+		call ringbuffer.FunctionCall
+		err  error
+	)
+	if _, ok := parse.SeasonalFunctions[funcExpr.Func.Name]; ok {
+		call, err = ringbuffer.NewSeasonalRangeVectorFunc(funcExpr)
+	} else {
+		call, err = ringbuffer.NewRangeVectorFunc(funcExpr.Func.Name, opts.Functions)
+	}
 	if err != nil {
 		return nil, err
 	}
-	step := opts.Step.Milliseconds()
-	if step == 0 {
-		step = 1
-	}
-
 	o := &subqueryOperator{
 		next:          next,
 		paramOp:       paramOp,
@@ -80,7 +83,6 @@ func NewSubqueryOperator(next, paramOp, paramOp2 model.VectorOperator, opts *que
 		mint:          opts.Start.UnixMilli(),
 		maxt:          opts.End.UnixMilli(),
 		currentStep:   opts.Start.UnixMilli(),
-		step:          step,
 		stepsBatch:    opts.StepsBatch,
 		lastCollected: -1,
 		params:        make([]float64, opts.StepsBatch),
@@ -96,12 +98,18 @@ func (o *subqueryOperator) String() string {
 
 func (o *subqueryOperator) Explain() (next []model.VectorOperator) {
 	switch o.funcExpr.Func.Name {
-	case "quantile_over_time", "predict_linear":
+	case "quantile_over_time", "predict_linear", "ewma_over_time":
 		return []model.VectorOperator{o.paramOp, o.next}
-	case "double_exponential_smoothing":
+	case "double_exponential_smoothing", "holt_winters_seasonal", "predict_seasonal":
 		return []model.VectorOperator{o.paramOp, o.paramOp2, o.next}
 	default:
-		return []model.VectorOperator{o.next}
+		var next []model.VectorOperator
+		for _, op := range []model.VectorOperator{o.paramOp, o.paramOp2} {
+			if op != nil {
+				next = append(next, op)
+			}
+		}
+		return append(next, o.next)
 	}
 }
 
@@ -132,7 +140,7 @@ func (o *subqueryOperator) Next(ctx context.Context, buf []model.StepVector) (in
 		}
 	}
 
-	if o.paramOp2 != nil { // double_exponential_smoothing
+	if o.paramOp2 != nil { // double_exponential_smoothing and the seasonal functions
 		n, err := o.paramOp2.Next(ctx, o.param2Buf)
 		if err != nil {
 			return 0, err
@@ -224,7 +232,7 @@ func (o *subqueryOperator) Next(ctx context.Context, buf []model.StepVector) (in
 			o.telemetry.IncrementSamplesAtTimestamp(rangeSamples.SampleCount(), buf[n].T)
 		}
 		n++
-		o.currentStep += o.step
+		o.currentStep = o.opts.NextStep(o.currentStep)
 	}
 
 	return n, nil
@@ -314,7 +322,7 @@ func (o *subqueryOperator) initSeries(ctx context.Context) error {
 		for i, s := range series {
 			lbls := s
 			if o.funcExpr.Func.Name != "last_over_time" {
-				lbls = extlabels.DropReserved(s, b)
+				lbls = extlabels.DropMetricName(s, b, o.opts.EnableDelayedNameRemoval)
 			}
 			o.series[i] = lbls
 		}
@@ -25,9 +25,8 @@ type stepInvariantOperator struct {
 	cacheVectorOnce sync.Once
 	cachedVector    model.StepVector
 
-	mint        int64
+	opts        *query.Options
 	maxt        int64
-	step        int64
 	currentStep int64
 	stepsBatch  int
 }
@@ -45,19 +44,14 @@ func NewStepInvariantOperator(
 	expr logicalplan.Node,
 	opts *query.Options,
 ) (model.VectorOperator, error) {
-	// We set interval to be at least 1.
 	u := &stepInvariantOperator{
 		next:        next,
+		opts:        opts,
 		currentStep: opts.Start.UnixMilli(),
-		mint:        opts.Start.UnixMilli(),
 		maxt:        opts.End.UnixMilli(),
-		step:        opts.Step.Milliseconds(),
 		stepsBatch:  opts.StepsBatch,
 		cacheResult: true,
 	}
-	if u.step == 0 {
-		u.step = 1
-	}
 	// We do not duplicate results for range selectors since result is a matrix
 	// with their unique timestamps which does not depend on the step.
 	switch expr.(type) {
@@ -106,7 +100,7 @@ func (u *stepInvariantOperator) Next(ctx context.Context, buf []model.StepVector
 		buf[n].AppendSamples(u.cachedVector.SampleIDs, u.cachedVector.Samples)
 		buf[n].AppendHistograms(u.cachedVector.HistogramIDs, u.cachedVector.Histograms)
 		n++
-		u.currentStep += u.step
+		u.currentStep = u.opts.NextStep(u.currentStep)
 	}
 
 	return n, nil
@@ -21,12 +21,14 @@ type unaryNegation struct {
 	next model.VectorOperator
 	once sync.Once
 
-	series []labels.Labels
+	series             []labels.Labels
+	delayedNameRemoval bool
 }
 
 func NewUnaryNegation(next model.VectorOperator, opts *query.Options) (model.VectorOperator, error) {
 	u := &unaryNegation{
-		next: next,
+		next:               next,
+		delayedNameRemoval: opts.EnableDelayedNameRemoval,
 	}
 	return telemetry.NewOperator(telemetry.NewTelemetry(u, opts), u), nil
 }
@@ -57,7 +59,7 @@ func (u *unaryNegation) loadSeries(ctx context.Context) error {
 		u.series = make([]labels.Labels, len(series))
 		var b labels.ScratchBuilder
 		for i := range series {
-			lbls := extlabels.DropReserved(series[i], b)
+			lbls := extlabels.DropMetricName(series[i], b, u.delayedNameRemoval)
 			u.series[i] = lbls
 		}
 	})
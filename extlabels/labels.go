@@ -4,6 +4,8 @@
 package extlabels
 
 import (
+	"slices"
+
 	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/schema"
@@ -16,6 +18,10 @@ var (
 const (
 	MetricType = "__type__"
 	MetricUnit = "__unit__"
+
+	// DropNameLabel marks series whose reserved labels are only removed at the end of the
+	// evaluation when delayed name removal is enabled. It never appears in query results.
+	DropNameLabel = "__drop_name__"
 )
 
 // DropReserved removes all reserved labels (__name__, __type__, __unit__) and returns the remaining labels.
@@ -23,6 +29,56 @@ func DropReserved(l labels.Labels, b labels.ScratchBuilder) labels.Labels {
 	return DropLabels(l, schema.IsMetadataLabel, b)
 }
 
+// DropMetricName removes the reserved labels from l. If delayed is set, l keeps them and
+// is marked with DropNameLabel instead, so that they are removed by DropMarkedMetricName.
+func DropMetricName(l labels.Labels, b labels.ScratchBuilder, delayed bool) labels.Labels {
+	if !delayed {
+		return DropReserved(l, b)
+	}
+	if l.Has(DropNameLabel) || !hasReserved(l) {
+		return l
+	}
+	b.Reset()
+	l.Range(func(lbl labels.Label) {
+		b.Add(lbl.Name, lbl.Value)
+	})
+	b.Add(DropNameLabel, "true")
+	b.Sort()
+	return b.Labels()
+}
+
+// DropMarkedMetricName removes the reserved labels and the DropNameLabel marker from l if it is marked.
+func DropMarkedMetricName(l labels.Labels, b labels.ScratchBuilder) labels.Labels {
+	if !l.Has(DropNameLabel) {
+		return l
+	}
+	return DropLabels(l, func(name string) bool {
+		return name == DropNameLabel || schema.IsMetadataLabel(name)
+	}, b)
+}
+
+// Get returns the value of the label with the given name like l.Get, but the DropNameLabel
+// marker is not a label of the series and is never returned.
+func Get(l labels.Labels, name string) string {
+	if name == DropNameLabel {
+		return ""
+	}
+	return l.Get(name)
+}
+
+// WithoutDropNameLabel returns names without the DropNameLabel marker, so that labels given in
+// a query, like in on() or by(), do not refer to the marker.
+func WithoutDropNameLabel(names []string) []string {
+	if !slices.Contains(names, DropNameLabel) {
+		return names
+	}
+	return slices.DeleteFunc(slices.Clone(names), func(name string) bool { return name == DropNameLabel })
+}
+
+func hasReserved(l labels.Labels) bool {
+	return l.Has(labels.MetricName) || l.Has(MetricType) || l.Has(MetricUnit)
+}
+
 // DropBucketLabel removes the le label and returns the dropped name and remaining labels.
 func DropBucketLabel(l labels.Labels, b labels.ScratchBuilder) (labels.Labels, labels.Label) {
 	return DropLabel(l, labels.BucketLabel, b)
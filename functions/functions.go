@@ -0,0 +1,203 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+// Package functions allows registering user defined PromQL functions with the engine.
+package functions
+
+import (
+	"github.com/thanos-io/promql-engine/execution/parse"
+	"github.com/thanos-io/promql-engine/warnings"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Value is the value of a sample. Either F or H is set.
+type Value struct {
+	F float64
+	H *histogram.FloatHistogram
+}
+
+// Sample is a sample passed to range vector functions.
+type Sample struct {
+	T int64
+	V Value
+}
+
+// RangeVectorArgs are the arguments of a range vector function for a single step.
+type RangeVectorArgs struct {
+	Samples          []Sample
+	StepTime         int64
+	SelectRange      int64
+	Offset           int64
+	MetricAppearedTs int64
+
+	// quantile_over_time, predict_linear and ewma_over_time use one, so we only use one here.
+	ScalarPoint  float64
+	ScalarPoint2 float64 // only for double_exponential_smoothing (trend factor)
+}
+
+// InstantVectorFunc computes the value of a single output sample from an input sample and the
+// values of the scalar arguments. Returning false drops the sample from the result.
+type InstantVectorFunc func(f float64, h *histogram.FloatHistogram, vargs ...float64) (float64, bool)
+
+// RangeVectorFunc computes the value of a single output sample from the samples in the range.
+// User defined functions receive the values of their scalar arguments in ScalarPoint and ScalarPoint2.
+type RangeVectorFunc func(f RangeVectorArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error)
+
+// LabelFunc computes the labels of an output series from the labels of an input series
+// and the values of the string arguments. Samples are passed through unchanged.
+type LabelFunc func(lbls labels.Labels, args []string) (labels.Labels, error)
+
+// Function is a user defined function. Exactly one of InstantVector, RangeVector or Label must be set.
+type Function struct {
+	// Signature is used by the parser to type check calls to the function.
+	Signature parser.Function
+
+	InstantVector InstantVectorFunc
+	RangeVector   RangeVectorFunc
+	Label         LabelFunc
+}
+
+// Registry holds user defined functions by name. A nil registry is empty.
+type Registry struct {
+	functions map[string]Function
+}
+
+func NewRegistry() *Registry {
+	return &Registry{functions: make(map[string]Function)}
+}
+
+// Register adds a function to the registry. Built-in functions cannot be overridden.
+func (r *Registry) Register(f Function) error {
+	name := f.Signature.Name
+	if name == "" {
+		return errors.New("function name must not be empty")
+	}
+	for _, builtins := range []map[string]*parser.Function{
+		parser.Functions,
+		parse.XFunctions,
+		parse.QuantileSketchFunctions,
+		parse.CountDistinctFunctions,
+		parse.TimeZoneFunctions,
+		parse.LabelFunctions,
+		parse.GapFillingFunctions,
+		parse.NHCBConversionFunctions,
+		parse.ClassicConversionFunctions,
+		parse.HistogramQuantilesFunctions,
+		parse.SeasonalFunctions,
+		parse.StatisticalFunctions,
+		parse.PairedRangeFunctions,
+	} {
+		if _, ok := builtins[name]; ok {
+			return errors.Newf("function %s is a built-in function", name)
+		}
+	}
+	if _, ok := r.functions[name]; ok {
+		return errors.Newf("function %s is already registered", name)
+	}
+	if err := validate(f); err != nil {
+		return errors.Wrapf(err, "function %s", name)
+	}
+	r.functions[name] = f
+	return nil
+}
+
+// MustRegister is like Register but panics on error.
+func (r *Registry) MustRegister(fs ...Function) {
+	for _, f := range fs {
+		if err := r.Register(f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Get returns the function registered under name.
+func (r *Registry) Get(name string) (Function, bool) {
+	if r == nil {
+		return Function{}, false
+	}
+	f, ok := r.functions[name]
+	return f, ok
+}
+
+// Signatures returns the parser signatures of all registered functions.
+func (r *Registry) Signatures() map[string]*parser.Function {
+	if r == nil {
+		return nil
+	}
+	signatures := make(map[string]*parser.Function, len(r.functions))
+	for name, f := range r.functions {
+		signatures[name] = &f.Signature
+	}
+	return signatures
+}
+
+// IsLabelFunction returns whether name is a registered function which transforms labels.
+func (r *Registry) IsLabelFunction(name string) bool {
+	f, ok := r.Get(name)
+	return ok && f.Label != nil
+}
+
+func validate(f Function) error {
+	var (
+		numImpls   int
+		numVectors int
+		numRanges  int
+	)
+	for _, set := range []bool{f.InstantVector != nil, f.RangeVector != nil, f.Label != nil} {
+		if set {
+			numImpls++
+		}
+	}
+	if numImpls != 1 {
+		return errors.New("exactly one implementation must be set")
+	}
+	if f.Signature.ReturnType != parser.ValueTypeVector {
+		return errors.New("return type must be an instant vector")
+	}
+	for _, t := range f.Signature.ArgTypes {
+		switch t {
+		case parser.ValueTypeVector:
+			numVectors++
+		case parser.ValueTypeMatrix:
+			numRanges++
+		}
+	}
+
+	switch {
+	case f.InstantVector != nil:
+		if numVectors != 1 || numRanges != 0 {
+			return errors.New("instant vector functions must take exactly one instant vector argument")
+		}
+		for _, t := range f.Signature.ArgTypes {
+			if t == parser.ValueTypeString {
+				return errors.New("instant vector functions must not take string arguments")
+			}
+		}
+	case f.RangeVector != nil:
+		if numRanges != 1 || numVectors != 0 {
+			return errors.New("range vector functions must take exactly one range vector argument")
+		}
+		if f.Signature.Variadic != 0 || len(f.Signature.ArgTypes)-numRanges > 2 {
+			return errors.New("range vector functions must take at most two scalar arguments")
+		}
+		for _, t := range f.Signature.ArgTypes {
+			if t == parser.ValueTypeString {
+				return errors.New("range vector functions must not take string arguments")
+			}
+		}
+	case f.Label != nil:
+		if numVectors != 1 || numRanges != 0 {
+			return errors.New("label functions must take exactly one instant vector argument")
+		}
+		for _, t := range f.Signature.ArgTypes {
+			if t == parser.ValueTypeScalar {
+				return errors.New("label functions must not take scalar arguments")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package functions
+
+import (
+	"testing"
+
+	"github.com/thanos-io/promql-engine/warnings"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestRegister(t *testing.T) {
+	instantFunc := func(f float64, _ *histogram.FloatHistogram, _ ...float64) (float64, bool) { return f, true }
+	labelFunc := func(lbls labels.Labels, _ []string) (labels.Labels, error) { return lbls, nil }
+
+	cases := []struct {
+		name string
+		fn   Function
+		err  bool
+	}{
+		{
+			name: "valid instant vector function",
+			fn: Function{
+				Signature:     parser.Function{Name: "double", ArgTypes: []parser.ValueType{parser.ValueTypeVector}, ReturnType: parser.ValueTypeVector},
+				InstantVector: instantFunc,
+			},
+		},
+		{
+			name: "built-in function",
+			fn: Function{
+				Signature:     parser.Function{Name: "abs", ArgTypes: []parser.ValueType{parser.ValueTypeVector}, ReturnType: parser.ValueTypeVector},
+				InstantVector: instantFunc,
+			},
+			err: true,
+		},
+		{
+			name: "x function",
+			fn: Function{
+				Signature:     parser.Function{Name: "xrate", ArgTypes: []parser.ValueType{parser.ValueTypeVector}, ReturnType: parser.ValueTypeVector},
+				InstantVector: instantFunc,
+			},
+			err: true,
+		},
+		{
+			name: "no implementation",
+			fn: Function{
+				Signature: parser.Function{Name: "double", ArgTypes: []parser.ValueType{parser.ValueTypeVector}, ReturnType: parser.ValueTypeVector},
+			},
+			err: true,
+		},
+		{
+			name: "multiple implementations",
+			fn: Function{
+				Signature:     parser.Function{Name: "double", ArgTypes: []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString}, ReturnType: parser.ValueTypeVector},
+				InstantVector: instantFunc,
+				Label:         labelFunc,
+			},
+			err: true,
+		},
+		{
+			name: "range vector function without range vector argument",
+			fn: Function{
+				Signature: parser.Function{Name: "spread", ArgTypes: []parser.ValueType{parser.ValueTypeVector}, ReturnType: parser.ValueTypeVector},
+				RangeVector: func(RangeVectorArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+					return 0, nil, false, 0, nil
+				},
+			},
+			err: true,
+		},
+		{
+			name: "label function with scalar argument",
+			fn: Function{
+				Signature: parser.Function{Name: "label_set", ArgTypes: []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeScalar}, ReturnType: parser.ValueTypeVector},
+				Label:     labelFunc,
+			},
+			err: true,
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			err := NewRegistry().Register(tcase.fn)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+		})
+	}
+
+	t.Run("duplicate function", func(t *testing.T) {
+		r := NewRegistry()
+		testutil.Ok(t, r.Register(cases[0].fn))
+		testutil.NotOk(t, r.Register(cases[0].fn))
+	})
+}
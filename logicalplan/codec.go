@@ -219,6 +219,19 @@ func unmarshalNode(data []byte) (Node, error) {
 			return nil, err
 		}
 		return u, nil
+	case ShardedNode:
+		s := &Sharded{}
+		if err := json.Unmarshal(t.Data, s); err != nil {
+			return nil, err
+		}
+		var err error
+		s.Expr, err = unmarshalNode(t.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case NoopNode:
+		return Noop{}, nil
 	}
 	return nil, nil
 }
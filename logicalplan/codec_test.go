@@ -4,6 +4,7 @@
 package logicalplan
 
 import (
+	"math"
 	"math/rand"
 	"testing"
 
@@ -62,6 +63,77 @@ sum(
 	}
 }
 
+func TestMarshalExtendedRangeSelectors(t *testing.T) {
+	for _, q := range []string{
+		`rate(http_requests_total[1m] anchored)`,
+		`increase(http_requests_total[5m] smoothed offset 1m)`,
+	} {
+		ast, err := parser.ParseExpr(q)
+		testutil.Ok(t, err)
+		original, _ := NewFromAST(ast, &query.Options{}, PlanOptions{})
+
+		bytes, err := Marshal(original.Root())
+		testutil.Ok(t, err)
+		clone, err := Unmarshal(bytes)
+		testutil.Ok(t, err)
+		testutil.Equals(t, q, clone.String())
+
+		expected := original.Root().(*FunctionCall).Args[0].(*MatrixSelector)
+		ms := clone.(*FunctionCall).Args[0].(*MatrixSelector)
+		testutil.Equals(t, expected.Anchored, ms.Anchored)
+		testutil.Equals(t, expected.Smoothed, ms.Smoothed)
+	}
+}
+
+func TestMarshalUserDefinedFunction(t *testing.T) {
+	fn := &parser.Function{
+		Name:       "scale",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix, parser.ValueTypeScalar},
+		ReturnType: parser.ValueTypeVector,
+	}
+	ast, err := parser.NewParser(`scale(metric[5m], 2)`, parser.WithFunctions(map[string]*parser.Function{"scale": fn})).ParseExpr()
+	testutil.Ok(t, err)
+
+	original, _ := NewFromAST(ast, &query.Options{}, PlanOptions{})
+	bytes, err := Marshal(original.Root())
+	testutil.Ok(t, err)
+	clone, err := Unmarshal(bytes)
+	testutil.Ok(t, err)
+	testutil.Equals(t, original.Root().String(), clone.String())
+
+	call, ok := clone.(*FunctionCall)
+	testutil.Assert(t, ok)
+	testutil.Equals(t, *fn, call.Func)
+}
+
+func TestMarshalBinaryFillValues(t *testing.T) {
+	ast, err := parser.ParseExpr(`errors_total / on (pod) requests_total`)
+	testutil.Ok(t, err)
+	original, _ := NewFromAST(ast, &query.Options{}, PlanOptions{})
+
+	nan, inf := math.NaN(), math.Inf(1)
+	for _, tc := range []struct {
+		fill     FillValues
+		expected string
+	}{
+		{fill: FillValues{}, expected: `errors_total / on (pod) requests_total`},
+		{fill: FillValues{LHS: &inf, RHS: &inf}, expected: `errors_total / on (pod) fill(+Inf) requests_total`},
+		{fill: FillValues{LHS: &nan}, expected: `errors_total / on (pod) fill_left(NaN) requests_total`},
+		{fill: FillValues{LHS: &nan, RHS: &inf}, expected: `errors_total / on (pod) fill_left(NaN) fill_right(+Inf) requests_total`},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			root := original.Root().Clone()
+			root.(*Binary).Fill = tc.fill
+
+			bytes, err := Marshal(root)
+			testutil.Ok(t, err)
+			clone, err := Unmarshal(bytes)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expected, clone.String())
+		})
+	}
+}
+
 func TestUnmarshalMatchers(t *testing.T) {
 	expr := `metric{name=~"value"}`
 	ast, err := parser.ParseExpr(expr)
@@ -0,0 +1,162 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+const (
+	// DefaultScrapeInterval is the scrape interval assumed when estimating the number
+	// of samples in a range if no interval is configured.
+	DefaultScrapeInterval = time.Minute
+	// DefaultSeriesPerDecoder is the number of series for which an additional
+	// goroutine is used to decode samples if no value is configured.
+	DefaultSeriesPerDecoder = 1000
+)
+
+// StatisticsProvider provides cardinality statistics about the data in storage.
+// Implementations can be backed by TSDB head postings, label value counts or by
+// sampling series.
+type StatisticsProvider interface {
+	// SeriesCount returns the estimated number of series matching all matchers.
+	// The second return value is false if no estimate is available.
+	SeriesCount(ctx context.Context, matchers []*labels.Matcher) (int64, bool)
+}
+
+// Cost is the estimated cost of evaluating a selector.
+type Cost struct {
+	// Series is the estimated number of series selected.
+	Series int64
+	// Samples is the estimated number of samples decoded over all steps.
+	Samples int64
+}
+
+// CostBasedOptimizer estimates the number of series and samples read by each selector
+// using statistics from storage and tunes the execution of the query accordingly:
+//
+//   - small selectors are decoded with fewer goroutines than DecodingConcurrency,
+//   - batch sizes are chosen so that each batch holds about SamplesPerBatch samples,
+//   - aggregations are sharded only when the query reads more than ShardingThreshold samples.
+//
+// Selectors for which no estimate is available are left unchanged.
+type CostBasedOptimizer struct {
+	Statistics StatisticsProvider
+
+	// ScrapeInterval is the expected interval between samples of a series.
+	// Defaults to DefaultScrapeInterval.
+	ScrapeInterval time.Duration
+	// SeriesPerDecoder is the number of series for which an additional goroutine
+	// is used to decode samples. Defaults to DefaultSeriesPerDecoder.
+	SeriesPerDecoder int64
+	// SamplesPerBatch is the target number of samples in a single selector batch.
+	// Batch sizes are not changed when it is zero.
+	SamplesPerBatch int64
+	// Shards is the number of shards used for aggregations of queries which
+	// read more than ShardingThreshold samples. Queries are not sharded when
+	// Shards is less than two.
+	Shards            int
+	ShardingThreshold int64
+
+	// ctx is the context of the optimized query, which is passed to Statistics.
+	ctx context.Context
+}
+
+// WithContext returns a copy of the optimizer which looks up statistics with ctx.
+func (m CostBasedOptimizer) WithContext(ctx context.Context) Optimizer {
+	m.ctx = ctx
+	return m
+}
+
+func (m CostBasedOptimizer) Optimize(plan Node, opts *query.Options) (Node, annotations.Annotations) {
+	if m.Statistics == nil {
+		return plan, nil
+	}
+
+	batchSamples := make(map[*VectorSelector]int64)
+	totalSamples := m.estimate(plan, opts, batchSamples)
+	m.setBatchSizes(plan, batchSamples)
+
+	if m.Shards > 1 && totalSamples >= m.ShardingThreshold {
+		return QueryShardingOptimizer{Shards: m.Shards}.Optimize(plan, opts)
+	}
+	return plan, nil
+}
+
+// estimate annotates all selectors in the expression with their cost and
+// returns the total number of samples read by the expression. The number of
+// samples of a single series in one batch of steps is recorded in batchSamples.
+func (m CostBasedOptimizer) estimate(expr Node, opts *query.Options, batchSamples map[*VectorSelector]int64) int64 {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		return m.estimateSelector(e, opts, 1, batchSamples)
+	case *MatrixSelector:
+		scrapeInterval := m.ScrapeInterval
+		if scrapeInterval <= 0 {
+			scrapeInterval = DefaultScrapeInterval
+		}
+		return m.estimateSelector(e.VectorSelector, opts, max(1, int64(e.Range/scrapeInterval)), batchSamples)
+	case *StepInvariantExpr:
+		stepOpts := *opts
+		stepOpts.End = stepOpts.Start
+		return m.estimate(e.Expr, &stepOpts, batchSamples)
+	case *Subquery:
+		step := e.Step
+		if step == 0 && opts.NoStepSubqueryIntervalFn == nil {
+			step = max(opts.Step, DefaultScrapeInterval)
+		}
+		return m.estimate(e.Expr, query.NestedOptionsForSubquery(opts, step, e.Range, e.Offset), batchSamples)
+	}
+
+	var total int64
+	for _, child := range expr.Children() {
+		total += m.estimate(*child, opts, batchSamples)
+	}
+	return total
+}
+
+func (m CostBasedOptimizer) estimateSelector(selector *VectorSelector, opts *query.Options, samplesPerStep int64, batchSamples map[*VectorSelector]int64) int64 {
+	ctx := m.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	series, ok := m.Statistics.SeriesCount(ctx, append(slices.Clone(selector.LabelMatchers), selector.Filters...))
+	if !ok {
+		return 0
+	}
+	selector.Cost = &Cost{
+		Series:  series,
+		Samples: series * samplesPerStep * int64(opts.TotalSteps()),
+	}
+	batchSamples[selector] = samplesPerStep * int64(opts.NumStepsPerBatch())
+
+	seriesPerDecoder := m.SeriesPerDecoder
+	if seriesPerDecoder <= 0 {
+		seriesPerDecoder = DefaultSeriesPerDecoder
+	}
+	decoders := (series + seriesPerDecoder - 1) / seriesPerDecoder
+	selector.DecodingConcurrency = int(max(1, min(decoders, int64(opts.DecodingConcurrency))))
+
+	return selector.Cost.Samples
+}
+
+// setBatchSizes sets the batch size of selectors which can be batched so that a
+// batch of series over all steps in a step batch holds about SamplesPerBatch samples.
+func (m CostBasedOptimizer) setBatchSizes(plan Node, batchSamples map[*VectorSelector]int64) {
+	if m.SamplesPerBatch <= 0 {
+		return
+	}
+	traverseBatchableSelectors(&plan, func(selector *VectorSelector) {
+		if samples, ok := batchSamples[selector]; ok {
+			selector.BatchSize = max(1, m.SamplesPerBatch/max(1, samples))
+		}
+	})
+}
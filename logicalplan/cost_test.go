@@ -0,0 +1,181 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+type staticStatistics map[string]int64
+
+func (s staticStatistics) SeriesCount(_ context.Context, matchers []*labels.Matcher) (int64, bool) {
+	for _, m := range matchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			count, ok := s[m.Value]
+			return count, ok
+		}
+	}
+	return 0, false
+}
+
+func TestCostBasedOptimizer(t *testing.T) {
+	cases := []struct {
+		name        string
+		expr        string
+		expected    string
+		costs       []*Cost
+		concurrency []int
+	}{
+		{
+			name:        "selector",
+			expr:        `http_requests_total`,
+			expected:    `http_requests_total`,
+			costs:       []*Cost{{Series: 5000, Samples: 305000}},
+			concurrency: []int{4},
+		},
+		{
+			name:        "selector without statistics",
+			expr:        `unknown_total`,
+			expected:    `unknown_total`,
+			costs:       []*Cost{nil},
+			concurrency: []int{0},
+		},
+		{
+			name:        "small aggregation is batched and not sharded",
+			expr:        `sum(errors_total)`,
+			expected:    `sum(errors_total[batch=100])`,
+			costs:       []*Cost{{Series: 10, Samples: 610}},
+			concurrency: []int{1},
+		},
+		{
+			name:        "range selector",
+			expr:        `sum(rate(errors_total[5m]))`,
+			expected:    `sum(rate(errors_total[5m0s]))`,
+			costs:       []*Cost{{Series: 10, Samples: 3050}},
+			concurrency: []int{1},
+		},
+		{
+			name:        "large aggregation is sharded",
+			expr:        `sum(http_requests_total)`,
+			expected:    `sum(sharded[3](sum(http_requests_total[batch=100])))`,
+			costs:       []*Cost{{Series: 5000, Samples: 305000}},
+			concurrency: []int{4},
+		},
+		{
+			name:        "step invariant selector",
+			expr:        `sum(errors_total @ 0)`,
+			expected:    `sum(errors_total @ 0.000[batch=1000])`,
+			costs:       []*Cost{{Series: 10, Samples: 10}},
+			concurrency: []int{1},
+		},
+		{
+			name:        "and with smaller left side",
+			expr:        `errors_total and http_requests_total`,
+			expected:    `errors_total and http_requests_total`,
+			costs:       []*Cost{{Series: 10, Samples: 610}, {Series: 5000, Samples: 305000}},
+			concurrency: []int{1, 4},
+		},
+		{
+			name:        "unless with smaller right side",
+			expr:        `http_requests_total unless errors_total`,
+			expected:    `http_requests_total unless errors_total`,
+			costs:       []*Cost{{Series: 5000, Samples: 305000}, {Series: 10, Samples: 610}},
+			concurrency: []int{4, 1},
+		},
+		{
+			name:        "or with unknown side",
+			expr:        `errors_total or unknown_total`,
+			expected:    `errors_total or unknown_total`,
+			costs:       []*Cost{{Series: 10, Samples: 610}, nil},
+			concurrency: []int{1, 0},
+		},
+	}
+
+	optimizer := CostBasedOptimizer{
+		Statistics:        staticStatistics{"http_requests_total": 5000, "errors_total": 10},
+		SamplesPerBatch:   1000,
+		Shards:            3,
+		ShardingThreshold: 100000,
+	}
+	opts := &query.Options{
+		Start:               time.Unix(0, 0),
+		End:                 time.Unix(3600, 0),
+		Step:                time.Minute,
+		StepsBatch:          10,
+		DecodingConcurrency: 4,
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan, _ := NewFromAST(expr, opts, PlanOptions{})
+			optimizedPlan, _ := plan.Optimize([]Optimizer{optimizer})
+			root := optimizedPlan.Root()
+			testutil.Equals(t, tcase.expected, renderExprTree(root))
+
+			var (
+				costs       []*Cost
+				concurrency []int
+			)
+			Traverse(&root, func(node *Node) {
+				if e, ok := (*node).(*VectorSelector); ok {
+					costs = append(costs, e.Cost)
+					concurrency = append(concurrency, e.DecodingConcurrency)
+				}
+			})
+			testutil.Equals(t, tcase.costs, costs)
+			testutil.Equals(t, tcase.concurrency, concurrency)
+		})
+	}
+}
+
+type contextStatistics struct {
+	contexts []context.Context
+}
+
+func (s *contextStatistics) SeriesCount(ctx context.Context, _ []*labels.Matcher) (int64, bool) {
+	s.contexts = append(s.contexts, ctx)
+	return 1, true
+}
+
+func TestCostBasedOptimizerUsesQueryContext(t *testing.T) {
+	type ctxKey struct{}
+	var (
+		ctx   = context.WithValue(context.Background(), ctxKey{}, "query")
+		stats = &contextStatistics{}
+	)
+	expr, err := parser.ParseExpr(`X / Y`)
+	testutil.Ok(t, err)
+
+	plan, err := NewFromAST(expr, &query.Options{}, PlanOptions{})
+	testutil.Ok(t, err)
+	plan.Optimize(WithContext(ctx, []Optimizer{CostBasedOptimizer{Statistics: stats}}))
+
+	testutil.Equals(t, 2, len(stats.contexts))
+	for _, c := range stats.contexts {
+		testutil.Equals(t, "query", c.Value(ctxKey{}))
+	}
+}
+
+func TestSelectorBatchSizeKeepsEstimatedBatchSize(t *testing.T) {
+	expr, err := parser.ParseExpr(`sum(errors_total) / sum(unknown_total)`)
+	testutil.Ok(t, err)
+
+	opts := &query.Options{Start: time.Unix(0, 0), End: time.Unix(3600, 0), Step: time.Minute, StepsBatch: 10}
+	plan, _ := NewFromAST(expr, opts, PlanOptions{})
+	optimizedPlan, _ := plan.Optimize([]Optimizer{
+		CostBasedOptimizer{Statistics: staticStatistics{"errors_total": 10}, SamplesPerBatch: 1000},
+		SelectorBatchSize{Size: 512},
+	})
+	testutil.Equals(t, `sum(errors_total[batch=100]) / sum(unknown_total[batch=512])`, renderExprTree(optimizedPlan.Root()))
+}
@@ -0,0 +1,54 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"github.com/thanos-io/promql-engine/execution/parse"
+)
+
+// isCountDistinct returns true if the node is a call to count_distinct_approx.
+func isCountDistinct(expr *Node) bool {
+	if expr == nil {
+		return false
+	}
+	call, ok := (*expr).(*FunctionCall)
+	return ok && call.Func.Name == "count_distinct_approx"
+}
+
+// countDistinctGrouping returns the grouping labels of a call to one of the count distinct functions.
+func countDistinctGrouping(funcName string, args []Node) []string {
+	groupingArgs := args[2:]
+	if funcName == "count_distinct_merge" {
+		groupingArgs = args[1:]
+	}
+	grouping := make([]string, 0, len(groupingArgs))
+	for _, arg := range groupingArgs {
+		grouping = append(grouping, UnsafeUnwrapString(arg))
+	}
+	return grouping
+}
+
+// splitCountDistinct splits count_distinct_approx into a call to count_distinct_sketch with the given grouping
+// labels, and a function which wraps an expression with a call to count_distinct_merge which merges sketches
+// into the grouping labels of the original call.
+func splitCountDistinct(call *FunctionCall, sketchGrouping []string) (*FunctionCall, func(Node) Node) {
+	sketch := &FunctionCall{
+		Func: *parse.CountDistinctFunctions["count_distinct_sketch"],
+		Args: []Node{call.Args[0].Clone(), call.Args[1]},
+	}
+	for _, lbl := range sketchGrouping {
+		sketch.Args = append(sketch.Args, &StringLiteral{Val: lbl})
+	}
+	merge := func(sketches Node) Node {
+		merged := &FunctionCall{
+			Func: *parse.CountDistinctFunctions["count_distinct_merge"],
+			Args: []Node{sketches},
+		}
+		for _, arg := range call.Args[2:] {
+			merged.Args = append(merged.Args, arg.Clone())
+		}
+		return merged
+	}
+	return sketch, merge
+}
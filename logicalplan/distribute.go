@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/thanos-io/promql-engine/api"
+	"github.com/thanos-io/promql-engine/execution/parse"
 	"github.com/thanos-io/promql-engine/query"
 
 	"github.com/efficientgo/core/errors"
@@ -148,9 +149,14 @@ func (r Noop) Type() NodeType { return NoopNode }
 type DistributedExecutionOptimizer struct {
 	Endpoints          api.RemoteEndpoints
 	SkipBinaryPushdown bool
+
+	approximateQuantiles bool
+	location             *time.Location
 }
 
 func (m DistributedExecutionOptimizer) Optimize(plan Node, opts *query.Options) (Node, annotations.Annotations) {
+	m.approximateQuantiles = opts.ApproximateQuantiles
+	m.location = opts.Location
 	engines := m.Endpoints.Engines(MinMaxTime(plan, opts))
 	sort.Slice(engines, func(i, j int) bool {
 		return engines[i].MinT() < engines[j].MinT()
@@ -187,6 +193,11 @@ func (m DistributedExecutionOptimizer) Optimize(plan Node, opts *query.Options)
 			return true
 		}
 
+		if isCountDistinct(current) && !preservesPartitionLabels(*current, engineLabels) {
+			*current = m.distributeCountDistinct(*current, engines, m.subqueryOpts(parents, current, opts), labelRanges)
+			return true
+		}
+
 		if isAbsent(current) {
 			*current = m.distributeAbsent(*current, engines, calculateStartOffset(current, opts.LookbackDelta), m.subqueryOpts(parents, current, opts))
 			return true
@@ -212,6 +223,9 @@ func (m DistributedExecutionOptimizer) Optimize(plan Node, opts *query.Options)
 }
 
 func (m DistributedExecutionOptimizer) distributeAggregation(aggr *Aggregation, engines []api.RemoteEngine, opts *query.Options, labelRanges labelSetRanges) Node {
+	if aggr.Op == parser.QUANTILE {
+		return m.distributeQuantile(aggr, engines, opts, labelRanges)
+	}
 	localAggregation := aggr.Op
 	if aggr.Op == parser.COUNT {
 		localAggregation = parser.SUM
@@ -227,6 +241,45 @@ func (m DistributedExecutionOptimizer) distributeAggregation(aggr *Aggregation,
 	}
 }
 
+// distributeQuantile distributes a quantile aggregation by merging quantile sketches from remote engines.
+// Sketches are native histograms, so they are merged with sum() and the quantile is estimated with
+// histogram_quantile(), which results in histogram_quantile(q, sum(remote(sum(quantile_sketch(X))))).
+func (m DistributedExecutionOptimizer) distributeQuantile(aggr *Aggregation, engines []api.RemoteEngine, opts *query.Options, labelRanges labelSetRanges) Node {
+	sketchAggr := *aggr
+	sketchAggr.Op = parser.SUM
+	sketchAggr.Param = nil
+	sketchAggr.Expr = &FunctionCall{
+		Func: *parse.QuantileSketchFunctions["quantile_sketch"],
+		Args: []Node{aggr.Expr},
+	}
+	remoteAggregation := newRemoteAggregation(&sketchAggr, engines)
+	subQueries := m.distributeQuery(&remoteAggregation, engines, opts, labelRanges)
+	return &FunctionCall{
+		Func: *parser.Functions["histogram_quantile"],
+		Args: []Node{
+			aggr.Param.Clone(),
+			&Aggregation{
+				Op:       parser.SUM,
+				Expr:     subQueries,
+				Grouping: aggr.Grouping,
+				Without:  aggr.Without,
+			},
+		},
+	}
+}
+
+// distributeCountDistinct distributes count_distinct_approx by merging HyperLogLog sketches from remote engines.
+// Remote engines group sketches by partition labels in addition to the original grouping labels, which results in
+// count_distinct_merge(remote(count_distinct_sketch(label, X, grouping..., partition labels...)), grouping...).
+func (m DistributedExecutionOptimizer) distributeCountDistinct(expr Node, engines []api.RemoteEngine, opts *query.Options, labelRanges labelSetRanges) Node {
+	call := expr.(*FunctionCall)
+	grouping := remoteGrouping(countDistinctGrouping(call.Func.Name, call.Args), false, engines)
+	sketch, merge := splitCountDistinct(call, grouping)
+
+	var remoteSketch Node = sketch
+	return merge(m.distributeQuery(&remoteSketch, engines, opts, labelRanges))
+}
+
 func computeParents(plan *Node) map[*Node]*Node {
 	parents := make(map[*Node]*Node)
 	TraverseBottomUp(nil, plan, func(parent, current *Node) (stop bool) {
@@ -241,6 +294,11 @@ func (m DistributedExecutionOptimizer) computeDistributionPoints(plan *Node, par
 
 	// First pass: mark distribution points (aggregations, absent functions).
 	Traverse(plan, func(current *Node) {
+		// Distinct counts which don't preserve partition labels are distributed by merging sketches.
+		if isCountDistinct(current) && !m.isDistributive(current, engineLabels, warns) {
+			marks[current] = struct{}{}
+			return
+		}
 		if isAbsent(current) {
 			if m.isDistributive(current, engineLabels, warns) {
 				marks[current] = struct{}{}
@@ -280,7 +338,10 @@ func (m DistributedExecutionOptimizer) computeDistributionPoints(plan *Node, par
 			return
 		}
 		parent := parents[current]
-		if parent != nil && (m.isDistributive(parent, engineLabels, warns) || isAvgAggregation(parent)) {
+		if isInfoLabelSelector(parent, current) {
+			return
+		}
+		if parent != nil && (m.isDistributive(parent, engineLabels, warns) || isAvgAggregation(parent) || isCountDistinct(parent)) {
 			if !subtreeHasMark(parent, marks) {
 				return
 			}
@@ -322,15 +383,23 @@ func (m DistributedExecutionOptimizer) subqueryOpts(parents map[*Node]*Node, cur
 }
 
 func newRemoteAggregation(rootAggregation *Aggregation, engines []api.RemoteEngine) Node {
+	remoteAggregation := *rootAggregation
+	remoteAggregation.Grouping = remoteGrouping(rootAggregation.Grouping, rootAggregation.Without, engines)
+	return &remoteAggregation
+}
+
+// remoteGrouping returns the grouping labels for remote aggregations so that their results
+// keep the partition labels of remote engines.
+func remoteGrouping(grouping []string, without bool, engines []api.RemoteEngine) []string {
 	groupingSet := make(map[string]struct{})
-	for _, lbl := range rootAggregation.Grouping {
+	for _, lbl := range grouping {
 		groupingSet[lbl] = struct{}{}
 	}
 
 	for _, engine := range engines {
 		for _, lbls := range engine.PartitionLabelSets() {
 			lbls.Range(func(lbl labels.Label) {
-				if rootAggregation.Without {
+				if without {
 					delete(groupingSet, lbl.Name)
 				} else {
 					groupingSet[lbl.Name] = struct{}{}
@@ -344,10 +413,7 @@ func newRemoteAggregation(rootAggregation *Aggregation, engines []api.RemoteEngi
 		groupingLabels = append(groupingLabels, lbl)
 	}
 	sort.Strings(groupingLabels)
-
-	remoteAggregation := *rootAggregation
-	remoteAggregation.Grouping = groupingLabels
-	return &remoteAggregation
+	return groupingLabels
 }
 
 // distributeQuery takes a PromQL expression in the form of *parser.Expr and a set of remote engines.
@@ -595,6 +661,10 @@ func calculateStartOffset(expr *Node, lookbackDelta time.Duration) time.Duration
 			selectRange += n.Range
 		case *MatrixSelector:
 			selectRange += n.Range
+			// Anchored and smoothed selectors also read samples before the range.
+			if n.Anchored || n.Smoothed {
+				selectRange += lookbackDelta
+			}
 		case *VectorSelector:
 			offset = n.Offset
 		}
@@ -664,11 +734,22 @@ func preservesPartitionLabels(expr Node, partitionLabels map[string]struct{}) bo
 		return preservesPartitionLabels(e.LHS, partitionLabels) &&
 			preservesPartitionLabels(e.RHS, partitionLabels)
 	case *FunctionCall:
-		if e.Func.Name == "label_replace" || e.Func.Name == "label_join" {
+		if writesDestinationLabel(e) {
 			if _, ok := partitionLabels[UnsafeUnwrapString(e.Args[1])]; ok {
 				return false
 			}
 		}
+		if !keepsLabels(e, partitionLabels) {
+			return false
+		}
+		if e.Func.Name == "count_distinct_approx" {
+			grouping := countDistinctGrouping(e.Func.Name, e.Args)
+			for lbl := range partitionLabels {
+				if !slices.Contains(grouping, lbl) {
+					return false
+				}
+			}
+		}
 		for _, arg := range e.Args {
 			if arg.ReturnType() == parser.ValueTypeVector || arg.ReturnType() == parser.ValueTypeMatrix {
 				if !preservesPartitionLabels(arg, partitionLabels) {
@@ -692,18 +773,48 @@ func preservesPartitionLabels(expr Node, partitionLabels map[string]struct{}) bo
 	}
 }
 
+// writesDestinationLabel returns true if the function sets the label named by its second argument.
+func writesDestinationLabel(call *FunctionCall) bool {
+	switch call.Func.Name {
+	case "label_replace", "label_join", "label_copy", "label_map":
+		return true
+	}
+	return false
+}
+
+// keepsLabels returns false if the function is label_keep or label_drop and removes any of the labels.
+func keepsLabels(call *FunctionCall, lbls map[string]struct{}) bool {
+	if call.Func.Name != "label_keep" && call.Func.Name != "label_drop" {
+		return true
+	}
+	keep, err := LabelFilter(call)
+	if err != nil {
+		return false
+	}
+	for lbl := range lbls {
+		if !keep(lbl) {
+			return false
+		}
+	}
+	return true
+}
+
 func (m DistributedExecutionOptimizer) isDistributive(expr *Node, engineLabels map[string]struct{}, warns *annotations.Annotations) bool {
 	if expr == nil {
 		return false
 	}
 
 	switch e := (*expr).(type) {
-	case Deduplicate, RemoteExecution:
+	case Deduplicate, RemoteExecution, Noop:
 		return false
 	case *Binary:
 		if isBinaryExpressionWithOneScalarSide(e) {
 			return true
 		}
+		// Remote engines receive the query as PromQL, which cannot express fill values.
+		if e.Fill.IsSet() {
+			return false
+		}
 		return !m.SkipBinaryPushdown &&
 			isBinaryExpressionWithDistributableMatching(e, engineLabels) &&
 			m.isDistributive(&e.LHS, engineLabels, warns) &&
@@ -716,7 +827,15 @@ func (m DistributedExecutionOptimizer) isDistributive(expr *Node, engineLabels m
 			parser.TOPK, parser.BOTTOMK, parser.LIMITK:
 		// Non-distributive: can only be pushed as-is when they preserve
 		// partition labels (each engine computes over disjoint data).
-		case parser.AVG, parser.QUANTILE, parser.STDDEV, parser.STDVAR,
+		case parser.QUANTILE:
+			// Approximate quantiles are computed by merging sketches from remote engines.
+			if m.approximateQuantiles && IsConstantExpr(e.Param) {
+				break
+			}
+			if !preservesPartitionLabels(e, engineLabels) {
+				return false
+			}
+		case parser.AVG, parser.STDDEV, parser.STDVAR,
 			parser.COUNT_VALUES, parser.LIMIT_RATIO:
 			if !preservesPartitionLabels(e, engineLabels) {
 				return false
@@ -725,13 +844,41 @@ func (m DistributedExecutionOptimizer) isDistributive(expr *Node, engineLabels m
 			return false
 		}
 	case *FunctionCall:
-		if e.Func.Name == "label_replace" || e.Func.Name == "label_join" {
+		if writesDestinationLabel(e) {
 			targetLabel := UnsafeUnwrapString(e.Args[1])
 			if _, ok := engineLabels[targetLabel]; ok {
 				warns.Add(RewrittenExternalLabelWarning)
 				return false
 			}
 		}
+		// Dropping an external label merges series from different remote engines.
+		if !keepsLabels(e, engineLabels) {
+			return false
+		}
+		// info() joins series with info series on identifying labels. Like binary
+		// expressions, it is only distributive if partition labels are used for joining.
+		if e.Func.Name == "info" {
+			for lbl := range engineLabels {
+				if !slices.Contains(InfoIdentifyingLabels, lbl) {
+					return false
+				}
+			}
+		}
+		// Distinct counts can only be pushed down as-is when
+		// each group is computed by a single engine.
+		if e.Func.Name == "count_distinct_approx" {
+			return preservesPartitionLabels(e, engineLabels)
+		}
+		// Remote engines evaluate date and time functions in their own time zone, which can
+		// be different from the time zone of the query.
+		if parse.IsDateTimeFunction(e.Func.Name) && m.location != nil && m.location != time.UTC {
+			return false
+		}
+		// Remote engines only fill gaps from their own samples, and filled steps of
+		// one engine would overlap with samples of other engines at the same steps.
+		if e.Func.Name == "fill_gaps" || e.Func.Name == "interpolate" {
+			return false
+		}
 		// scalar() returns NaN if the vector selector returns nothing
 		// so it's not possible to know which result is correct. Hence,
 		// it is not distributive.
@@ -5,6 +5,7 @@ package logicalplan
 
 import (
 	"context"
+	"maps"
 	"math"
 	"math/rand"
 	"regexp"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/thanos-io/promql-engine/api"
+	"github.com/thanos-io/promql-engine/execution/parse"
 	"github.com/thanos-io/promql-engine/query"
 
 	"github.com/cortexproject/promqlsmith"
@@ -99,7 +101,7 @@ sum(
 		{
 			name:     "parentheses",
 			expr:     `(http_requests_total)`,
-			expected: `dedup(remote((http_requests_total)), remote((http_requests_total)))`,
+			expected: `dedup(remote(http_requests_total), remote(http_requests_total))`,
 		},
 		{
 			name:     "scalar",
@@ -716,6 +718,16 @@ count by (cluster) (
 			expr:     `max(sum without (pod) (metric_a))`,
 			expected: `max(dedup(remote(max by (region) (sum without (pod) (metric_a))), remote(max by (region) (sum without (pod) (metric_a)))))`,
 		},
+		{
+			name:     "info does not join on partition labels",
+			expr:     `info(metric_a, {k8s_cluster=~".+"})`,
+			expected: `info(dedup(remote(metric_a), remote(metric_a)), {k8s_cluster=~".+"})`,
+		},
+		{
+			name:     "aggregation over info",
+			expr:     `sum by (k8s_cluster) (info(rate(metric_a[5m])))`,
+			expected: `sum by (k8s_cluster) (info(dedup(remote(rate(metric_a[5m])), remote(rate(metric_a[5m])))))`,
+		},
 		{
 			name:     "max over sum with without() including partition",
 			expr:     `max(sum without (region) (metric_a))`,
@@ -1151,6 +1163,231 @@ max(
 	}
 }
 
+func TestDistributedExecutionInfo(t *testing.T) {
+	// Engines partitioned by an identifying label of info series.
+	engines := []api.RemoteEngine{
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("job", "a")}),
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("job", "b")}),
+	}
+	optimizers := []Optimizer{
+		DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)},
+	}
+
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "info",
+			expr:     `info(metric_a)`,
+			expected: `dedup(remote(info(metric_a)), remote(info(metric_a)))`,
+		},
+		{
+			name:     "info with data label selector",
+			expr:     `info(metric_a, {__name__="build_info", version=~".+"})`,
+			expected: `dedup(remote(info(metric_a, {__name__="build_info",version=~".+"})), remote(info(metric_a, {__name__="build_info",version=~".+"})))`,
+		},
+		{
+			name: "info over aggregation which does not preserve partition labels",
+			expr: `info(sum by (instance) (metric_a))`,
+			expected: `
+info(sum by (instance) (dedup(
+  remote(sum by (instance, job) (metric_a)),
+  remote(sum by (instance, job) (metric_a)))))`,
+		},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan, err := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}, PlanOptions{})
+			testutil.Ok(t, err)
+			optimizedPlan, _ := plan.Optimize(optimizers)
+			expectedPlan := cleanUp(replacements, tcase.expected)
+			testutil.Equals(t, expectedPlan, renderExprTree(optimizedPlan.Root()))
+		})
+	}
+}
+
+func TestDistributedExecutionApproximateQuantiles(t *testing.T) {
+	engines := []api.RemoteEngine{
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")}),
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "west")}),
+	}
+	optimizers := []Optimizer{
+		DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)},
+	}
+
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name: "quantile",
+			expr: `quantile(0.9, http_requests_total)`,
+			expected: `
+histogram_quantile(0.9, sum(dedup(
+  remote(sum by (region) (quantile_sketch(http_requests_total))),
+  remote(sum by (region) (quantile_sketch(http_requests_total))))))`,
+		},
+		{
+			name: "quantile by non-partition label",
+			expr: `quantile by (pod) (0.9, http_requests_total)`,
+			expected: `
+histogram_quantile(0.9, sum by (pod) (dedup(
+  remote(sum by (pod, region) (quantile_sketch(http_requests_total))),
+  remote(sum by (pod, region) (quantile_sketch(http_requests_total))))))`,
+		},
+		{
+			name: "quantile by partition label pushes as-is",
+			expr: `quantile by (region) (0.9, http_requests_total)`,
+			expected: `
+dedup(
+  remote(quantile by (region) (0.9, http_requests_total)),
+  remote(quantile by (region) (0.9, http_requests_total)))`,
+		},
+		{
+			name:     "quantile with non-constant parameter is not distributed",
+			expr:     `quantile(scalar(foo), http_requests_total)`,
+			expected: `quantile(scalar(dedup(remote(foo), remote(foo))), dedup(remote(http_requests_total), remote(http_requests_total)))`,
+		},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan, err := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0), ApproximateQuantiles: true}, PlanOptions{})
+			testutil.Ok(t, err)
+			optimizedPlan, _ := plan.Optimize(optimizers)
+			expectedPlan := cleanUp(replacements, tcase.expected)
+			testutil.Equals(t, expectedPlan, renderExprTree(optimizedPlan.Root()))
+		})
+	}
+}
+
+func TestDistributedExecutionCountDistinct(t *testing.T) {
+	engines := []api.RemoteEngine{
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")}),
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "west")}),
+	}
+	optimizers := []Optimizer{
+		DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)},
+	}
+	functions := maps.Clone(parser.Functions)
+	maps.Copy(functions, parse.CountDistinctFunctions)
+
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name: "count distinct",
+			expr: `count_distinct_approx("user_id", http_requests_total)`,
+			expected: `
+count_distinct_merge(dedup(
+  remote(count_distinct_sketch("user_id", http_requests_total, "region")),
+  remote(count_distinct_sketch("user_id", http_requests_total, "region"))))`,
+		},
+		{
+			name: "count distinct by non-partition label",
+			expr: `sum(count_distinct_approx("user_id", rate(http_requests_total[5m]), "pod"))`,
+			expected: `
+sum(count_distinct_merge(dedup(
+  remote(count_distinct_sketch("user_id", rate(http_requests_total[5m]), "pod", "region")),
+  remote(count_distinct_sketch("user_id", rate(http_requests_total[5m]), "pod", "region"))), "pod"))`,
+		},
+		{
+			name: "count distinct by partition label pushes as-is",
+			expr: `count_distinct_approx("user_id", http_requests_total, "region")`,
+			expected: `
+dedup(
+  remote(count_distinct_approx("user_id", http_requests_total, "region")),
+  remote(count_distinct_approx("user_id", http_requests_total, "region")))`,
+		},
+		{
+			name: "count distinct over aggregation",
+			expr: `count_distinct_approx("user_id", max by (user_id) (http_requests_total))`,
+			expected: `
+count_distinct_approx("user_id", max by (user_id) (dedup(
+  remote(max by (region, user_id) (http_requests_total)),
+  remote(max by (region, user_id) (http_requests_total)))))`,
+		},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.NewParser(tcase.expr, parser.WithFunctions(functions)).ParseExpr()
+			testutil.Ok(t, err)
+
+			plan, err := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}, PlanOptions{})
+			testutil.Ok(t, err)
+			optimizedPlan, _ := plan.Optimize(optimizers)
+			expectedPlan := cleanUp(replacements, tcase.expected)
+			testutil.Equals(t, expectedPlan, renderExprTree(optimizedPlan.Root()))
+		})
+	}
+}
+
+func TestDistributedExecutionTimeZone(t *testing.T) {
+	engines := []api.RemoteEngine{
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")}),
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "west")}),
+	}
+	optimizers := []Optimizer{
+		DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)},
+	}
+	functions := maps.Clone(parser.Functions)
+	maps.Copy(functions, parse.TimeZoneFunctions)
+
+	loc, err := time.LoadLocation("Europe/Berlin")
+	testutil.Ok(t, err)
+
+	cases := []struct {
+		name     string
+		expr     string
+		loc      *time.Location
+		expected string
+	}{
+		{
+			name:     "date function in UTC",
+			expr:     `sum(hour(http_requests_total))`,
+			loc:      time.UTC,
+			expected: `sum(dedup(remote(sum by (region) (hour(http_requests_total))), remote(sum by (region) (hour(http_requests_total)))))`,
+		},
+		{
+			name:     "date function in query time zone",
+			expr:     `sum(hour(http_requests_total))`,
+			loc:      loc,
+			expected: `sum(hour(dedup(remote(http_requests_total), remote(http_requests_total))))`,
+		},
+		{
+			name:     "date function with time zone argument",
+			expr:     `sum(hour_tz("Asia/Tokyo", http_requests_total))`,
+			loc:      loc,
+			expected: `sum(dedup(remote(sum by (region) (hour_tz("Asia/Tokyo", http_requests_total))), remote(sum by (region) (hour_tz("Asia/Tokyo", http_requests_total)))))`,
+		},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.NewParser(tcase.expr, parser.WithFunctions(functions)).ParseExpr()
+			testutil.Ok(t, err)
+
+			plan, err := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0), Location: tcase.loc}, PlanOptions{})
+			testutil.Ok(t, err)
+			optimizedPlan, _ := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, renderExprTree(optimizedPlan.Root()))
+		})
+	}
+}
+
 func TestDistributedExecutionClonesNodes(t *testing.T) {
 	var (
 		start    = time.Unix(0, 0)
@@ -1398,6 +1635,56 @@ func TestPreservesPartitionLabels(t *testing.T) {
 	}
 }
 
+func TestDistributedExecutionWithBinaryFill(t *testing.T) {
+	engines := []api.RemoteEngine{
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")}),
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "west")}),
+	}
+	optimizers := []Optimizer{DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)}}
+
+	expr, err := parser.ParseExpr(`metric_a / metric_b`)
+	testutil.Ok(t, err)
+	plan, err := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}, PlanOptions{})
+	testutil.Ok(t, err)
+	zero := 0.0
+	plan.Root().(*Binary).Fill = FillValues{LHS: &zero, RHS: &zero}
+
+	// Remote engines cannot evaluate fill values, so only the sides of the operation are distributed.
+	optimizedPlan, _ := plan.Optimize(optimizers)
+	expected := `dedup(remote(metric_a), remote(metric_a)) / fill(0) dedup(remote(metric_b), remote(metric_b))`
+	testutil.Equals(t, expected, optimizedPlan.Root().String())
+}
+
+func TestLabelFunctionsPreservePartitionLabels(t *testing.T) {
+	partitionLabels := map[string]struct{}{"region": {}}
+	functions := maps.Clone(parser.Functions)
+	maps.Copy(functions, parse.LabelFunctions)
+
+	cases := []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: `label_keep(metric, "region", "pod")`, expected: true},
+		{expr: `label_keep(metric, "re.*")`, expected: true},
+		{expr: `label_keep(metric, "pod")`, expected: false},
+		{expr: `label_drop(metric, "pod")`, expected: true},
+		{expr: `label_drop(metric, "pod", "reg.+")`, expected: false},
+		{expr: `label_copy(metric, "zone", "region")`, expected: true},
+		{expr: `label_copy(metric, "region", "zone")`, expected: false},
+		{expr: `label_map(metric, "zone", "region", "us", "us-east")`, expected: true},
+		{expr: `label_map(metric, "region", "zone", "us-east", "us")`, expected: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.expr, func(t *testing.T) {
+			parsed, err := parser.NewParser(tc.expr, parser.WithFunctions(functions)).ParseExpr()
+			testutil.Ok(t, err)
+			plan, err := NewFromAST(parsed, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}, PlanOptions{})
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expected, preservesPartitionLabels(plan.Root(), partitionLabels))
+		})
+	}
+}
+
 func FuzzDistributedExecutionPreservesPartitionLabels(f *testing.F) {
 	f.Add(int64(0))
 	f.Fuzz(func(t *testing.T, seed int64) {
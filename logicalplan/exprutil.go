@@ -4,6 +4,9 @@
 package logicalplan
 
 import (
+	"regexp"
+	"slices"
+
 	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/promql/parser"
 )
@@ -92,3 +95,26 @@ func IsConstantScalarExpr(expr Node) bool {
 		return false
 	}
 }
+
+// LabelFilter returns a function which reports whether label_keep or label_drop keep
+// the label with the given name. Their arguments are regular expressions which are
+// matched against the whole label name.
+func LabelFilter(call *FunctionCall) (func(string) bool, error) {
+	regexes := make([]*regexp.Regexp, 0, len(call.Args)-1)
+	for _, arg := range call.Args[1:] {
+		val, err := UnwrapString(arg)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to unwrap string argument")
+		}
+		regex, err := regexp.Compile("^(?:" + val + ")$")
+		if err != nil {
+			return nil, errors.Newf("invalid regular expression in %s(): %s", call.Func.Name, val)
+		}
+		regexes = append(regexes, regex)
+	}
+	keep := call.Func.Name == "label_keep"
+	return func(name string) bool {
+		matches := slices.ContainsFunc(regexes, func(regex *regexp.Regexp) bool { return regex.MatchString(name) })
+		return matches == keep
+	}, nil
+}
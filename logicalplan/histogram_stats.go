@@ -41,6 +41,10 @@ func (d DetectHistogramStatsOptimizer) optimize(plan Node, decodeStats bool) (No
 				n.Args[1], _ = d.optimize(n.Args[1], false)
 				stop = true
 				return
+			case "histogram_quantiles":
+				n.Args[0], _ = d.optimize(n.Args[0], false)
+				stop = true
+				return
 			case "histogram_fraction":
 				n.Args[2], _ = d.optimize(n.Args[2], false)
 				stop = true
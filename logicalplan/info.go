@@ -0,0 +1,43 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"slices"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// InfoIdentifyingLabels are the labels on which the info function joins series with info series.
+// They are hard coded in Prometheus so that no knowledge of individual info metrics is needed.
+var InfoIdentifyingLabels = []string{"instance", "job"}
+
+// isInfoLabelSelector returns true if the node is the data label selector of a call to info.
+// The data label selector only describes which info series and labels are used and does
+// not select series on its own.
+func isInfoLabelSelector(parent, current *Node) bool {
+	if parent == nil {
+		return false
+	}
+	call, ok := (*parent).(*FunctionCall)
+	return ok && call.Func.Name == "info" && len(call.Args) > 1 && current == &call.Args[1]
+}
+
+// infoRequiredLabels returns the labels of the first argument of info which are needed to join it with info series.
+func infoRequiredLabels(args []Node) []string {
+	required := append([]string{labels.MetricName}, InfoIdentifyingLabels...)
+	if len(args) < 2 {
+		return required
+	}
+	// Info labels are not added to series which already have them, and series without info labels
+	// can be dropped depending on data label matchers, so the labels used in data label matchers are needed as well.
+	if selector, ok := args[1].(*VectorSelector); ok {
+		for _, m := range slices.Concat(selector.LabelMatchers, selector.Filters) {
+			if !slices.Contains(required, m.Name) {
+				required = append(required, m.Name)
+			}
+		}
+	}
+	return required
+}
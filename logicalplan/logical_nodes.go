@@ -6,6 +6,7 @@ package logicalplan
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,6 +30,7 @@ const (
 	StepInvariantNode  = "step_invariant"
 	ParensNode         = "parens"
 	UnaryNode          = "unary"
+	ShardedNode        = "sharded"
 
 	RemoteExecutionNode = "remote_exec"
 	DeduplicateNode     = "dedup"
@@ -74,6 +76,11 @@ type VectorSelector struct {
 	BatchSize       int64
 	SelectTimestamp bool
 	Projection      *Projection
+	// DecodingConcurrency overrides the number of goroutines used to decode
+	// samples for this selector when it is greater than zero.
+	DecodingConcurrency int `json:",omitempty"`
+	// Cost is the estimated cost of the selector, if known.
+	Cost *Cost `json:",omitempty"`
 	// When set, histogram iterators can return objects which only have their
 	// CounterResetHint, Count and Sum values populated. Histogram buckets and spans
 	// will not be used during query evaluation.
@@ -92,6 +99,10 @@ func (f *VectorSelector) Clone() Node {
 		clone.Projection.Labels = shallowCloneSlice(f.Projection.Labels)
 		clone.Projection.Include = f.Projection.Include
 	}
+	if f.Cost != nil {
+		cost := *f.Cost
+		clone.Cost = &cost
+	}
 
 	if f.VectorSelector.Timestamp != nil {
 		ts := *f.VectorSelector.Timestamp
@@ -119,6 +130,10 @@ func (f *VectorSelector) ReturnType() parser.ValueType { return parser.ValueType
 type MatrixSelector struct {
 	VectorSelector *VectorSelector `json:"-"`
 	Range          time.Duration
+	// Anchored is set when the range uses the anchored modifier, and Smoothed
+	// is set when it uses the smoothed modifier.
+	Anchored bool `json:",omitempty"`
+	Smoothed bool `json:",omitempty"`
 
 	// Needed because this operator is used in the distributed mode
 	OriginalString string
@@ -376,6 +391,55 @@ type Binary struct {
 	ReturnBool bool
 
 	ValueType parser.ValueType
+
+	// Fill holds the values substituted for missing samples in an arithmetic
+	// or comparison operation between two vectors.
+	Fill FillValues
+}
+
+// FillValues are substituted for a sample which is missing on one side of a binary
+// operation between two vectors, so that series without a match on the other side
+// are returned instead of dropped. The PromQL parser does not support fill modifiers
+// yet, so fill values can only be set on logical plans.
+type FillValues struct {
+	// LHS is used for series of the right side without a match on the left side.
+	LHS *float64
+	// RHS is used for series of the left side without a match on the right side.
+	RHS *float64
+}
+
+// IsSet returns true if a fill value is set for any side.
+func (f FillValues) IsSet() bool { return f.LHS != nil || f.RHS != nil }
+
+func (f FillValues) Clone() FillValues {
+	return FillValues{LHS: cloneFloat(f.LHS), RHS: cloneFloat(f.RHS)}
+}
+
+// String returns the fill values as PromQL fill modifiers.
+func (f FillValues) String() string {
+	if f.LHS != nil && f.RHS != nil && *f.LHS == *f.RHS {
+		return fmt.Sprintf(" fill(%s)", formatFillValue(*f.LHS))
+	}
+	var s string
+	if f.LHS != nil {
+		s += fmt.Sprintf(" fill_left(%s)", formatFillValue(*f.LHS))
+	}
+	if f.RHS != nil {
+		s += fmt.Sprintf(" fill_right(%s)", formatFillValue(*f.RHS))
+	}
+	return s
+}
+
+func cloneFloat(f *float64) *float64 {
+	if f == nil {
+		return nil
+	}
+	v := *f
+	return &v
+}
+
+func formatFillValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
 }
 
 func (b *Binary) Clone() Node {
@@ -386,6 +450,7 @@ func (b *Binary) Clone() Node {
 		vm := *b.VectorMatching
 		clone.VectorMatching = &vm
 	}
+	clone.Fill = b.Fill.Clone()
 	return &clone
 }
 
@@ -407,7 +472,7 @@ func (b *Binary) String() string {
 	}
 
 	matching := b.getMatchingStr()
-	return fmt.Sprintf("%s %s%s%s %s", b.LHS, b.Op, returnBool, matching, b.RHS)
+	return fmt.Sprintf("%s %s%s%s%s %s", b.LHS, b.Op, returnBool, matching, b.Fill, b.RHS)
 }
 
 func (b *Binary) getMatchingStr() string {
@@ -436,6 +501,28 @@ type binary struct {
 	VectorMatching *parser.VectorMatching
 	ReturnBool     bool
 	ValueType      parser.ValueType
+	// Fill values are encoded as strings since JSON has no NaN and infinities.
+	FillLHS *string `json:",omitempty"`
+	FillRHS *string `json:",omitempty"`
+}
+
+func marshalFillValue(f *float64) *string {
+	if f == nil {
+		return nil
+	}
+	s := formatFillValue(*f)
+	return &s
+}
+
+func unmarshalFillValue(s *string) (*float64, error) {
+	if s == nil {
+		return nil, nil
+	}
+	v, err := strconv.ParseFloat(*s, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
 }
 
 func (b *Binary) MarshalJSON() ([]byte, error) {
@@ -444,6 +531,8 @@ func (b *Binary) MarshalJSON() ([]byte, error) {
 		VectorMatching: b.VectorMatching,
 		ReturnBool:     b.ReturnBool,
 		ValueType:      b.ValueType,
+		FillLHS:        marshalFillValue(b.Fill.LHS),
+		FillRHS:        marshalFillValue(b.Fill.RHS),
 	})
 }
 
@@ -460,6 +549,13 @@ func (b *Binary) UnmarshalJSON(data []byte) error {
 	b.ReturnBool = a.ReturnBool
 	b.ValueType = a.ValueType
 
+	var err error
+	if b.Fill.LHS, err = unmarshalFillValue(a.FillLHS); err != nil {
+		return err
+	}
+	if b.Fill.RHS, err = unmarshalFillValue(a.FillRHS); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -4,25 +4,28 @@
 package logicalplan
 
 import (
+	"context"
 	"math"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/thanos-io/promql-engine/execution/parse"
 	"github.com/thanos-io/promql-engine/query"
 
-	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/util/annotations"
 )
 
 var (
 	NoOptimizers  = []Optimizer{}
-	AllOptimizers = append(DefaultOptimizers, PropagateMatchersOptimizer{})
+	AllOptimizers = slices.Clone(DefaultOptimizers)
 )
 
 var DefaultOptimizers = []Optimizer{
 	SortMatchers{},
+	PropagateMatchersOptimizer{},
+	PruneContradictionsOptimizer{},
 	MergeSelectsOptimizer{},
 	DetectHistogramStatsOptimizer{},
 }
@@ -36,10 +39,33 @@ type Optimizer interface {
 	Optimize(plan Node, opts *query.Options) (Node, annotations.Annotations)
 }
 
+// ContextOptimizer is an optimizer which uses the context of the query it optimizes,
+// for example to cancel requests to storage when the query is canceled.
+type ContextOptimizer interface {
+	Optimizer
+	// WithContext returns a copy of the optimizer which uses the given context.
+	WithContext(ctx context.Context) Optimizer
+}
+
+// WithContext returns the optimizers with the given context set on each ContextOptimizer.
+func WithContext(ctx context.Context, optimizers []Optimizer) []Optimizer {
+	result := make([]Optimizer, 0, len(optimizers))
+	for _, o := range optimizers {
+		if co, ok := o.(ContextOptimizer); ok {
+			o = co.WithContext(ctx)
+		}
+		result = append(result, o)
+	}
+	return result
+}
+
 type plan struct {
 	expr     Node
 	opts     *query.Options
 	planOpts PlanOptions
+	// annos are annotations from creating the plan, which are returned with
+	// the annotations of the optimizers.
+	annos annotations.Annotations
 }
 
 type PlanOptions struct {
@@ -56,7 +82,7 @@ func New(root Node, queryOpts *query.Options, planOpts PlanOptions) Plan {
 }
 
 func NewFromAST(ast parser.Expr, queryOpts *query.Options, planOpts PlanOptions) (Plan, error) {
-	ast, err := promql.PreprocessExpr(ast, queryOpts.Start, queryOpts.End, queryOpts.Step)
+	ast, err := preprocessExpr(ast, queryOpts.Start, queryOpts.End, queryOpts.Step)
 	if err != nil {
 		return nil, err
 	}
@@ -69,13 +95,14 @@ func NewFromAST(ast parser.Expr, queryOpts *query.Options, planOpts PlanOptions)
 	// the engine handles sorting at the presentation layer
 	expr = trimSorts(expr)
 
-	// best effort evaluate constant expressions
-	expr = reduceConstantExpressions(expr)
+	// fold constant expressions and remove identity operations
+	expr, annos := simplifyExpressions(expr)
 
 	return &plan{
 		expr:     expr,
 		opts:     queryOpts,
 		planOpts: planOpts,
+		annos:    annos,
 	}, nil
 }
 
@@ -118,8 +145,21 @@ func getTimeRangesForSelector(qOpts *query.Options, n *parser.VectorSelector, pa
 
 	if evalRange == 0 {
 		start -= qOpts.LookbackDelta.Milliseconds()
+		// Smoothed vector selectors also read samples after the step.
+		if n.Smoothed {
+			end += qOpts.LookbackDelta.Milliseconds()
+		}
 	} else {
 		start -= evalRange.Milliseconds()
+		// Anchored and smoothed range selectors also read samples before the range start,
+		// and smoothed range selectors read samples after the range end.
+		switch {
+		case n.Anchored:
+			start -= qOpts.LookbackDelta.Milliseconds()
+		case n.Smoothed:
+			start -= qOpts.LookbackDelta.Milliseconds()
+			end += qOpts.LookbackDelta.Milliseconds()
+		}
 	}
 
 	start -= n.OriginalOffset.Milliseconds()
@@ -177,6 +217,18 @@ func MinMaxTime(root Node, qOpts *query.Options) (int64, int64) {
 			evalRange = 0
 		case *MatrixSelector:
 			evalRange = n.Range
+		case *FunctionCall:
+			if n.Func.Name != "info" {
+				return
+			}
+			// Info series are selected at the evaluation time of the function.
+			start, end := getTimeRangesForSelector(qOpts, &parser.VectorSelector{}, parents, 0)
+			if start < minTimestamp {
+				minTimestamp = start
+			}
+			if end > maxTimestamp {
+				maxTimestamp = end
+			}
 		}
 	})
 
@@ -191,6 +243,7 @@ func MinMaxTime(root Node, qOpts *query.Options) (int64, int64) {
 
 func (p *plan) Optimize(optimizers []Optimizer) (Plan, annotations.Annotations) {
 	annos := annotations.New()
+	annos.Merge(p.annos)
 	for _, o := range optimizers {
 		var a annotations.Annotations
 		p.expr, a = o.Optimize(p.expr, p.opts)
@@ -247,11 +300,14 @@ func replacePrometheusNodes(plan parser.Expr) Node {
 		}
 		return &StepInvariantExpr{Expr: replacePrometheusNodes(t.Expr)}
 	case *parser.MatrixSelector:
+		vs := t.VectorSelector.(*parser.VectorSelector)
 		return &MatrixSelector{
 			VectorSelector: &VectorSelector{
-				VectorSelector: t.VectorSelector.(*parser.VectorSelector),
+				VectorSelector: vs,
 			},
 			Range:          t.Range,
+			Anchored:       vs.Anchored,
+			Smoothed:       vs.Smoothed,
 			OriginalString: t.String(),
 		}
 	case *parser.VectorSelector:
@@ -366,60 +422,6 @@ func trimSorts(expr Node) Node {
 	return expr
 }
 
-func reduceConstantExpressions(expr Node) Node {
-	TraverseBottomUp(nil, &expr, func(parent, current *Node) bool {
-		if current == nil || parent == nil {
-			return true
-		}
-		switch tparent := (*parent).(type) {
-		case *Parens:
-			num, err := UnwrapFloat(tparent.Expr)
-			if err != nil {
-				return false
-			}
-			*parent = &NumberLiteral{Val: num}
-		case *Unary:
-			num, err := UnwrapFloat(tparent.Expr)
-			if err != nil {
-				return false
-			}
-			switch tparent.Op {
-			case parser.ADD:
-				*parent = &NumberLiteral{Val: num}
-			case parser.SUB:
-				*parent = &NumberLiteral{Val: -num}
-			}
-		case *Binary:
-			lnum, err := UnwrapFloat(tparent.LHS)
-			if err != nil {
-				return false
-			}
-			rnum, err := UnwrapFloat(tparent.RHS)
-			if err != nil {
-				return false
-			}
-			switch tparent.Op {
-			case parser.ADD:
-				*parent = &NumberLiteral{Val: lnum + rnum}
-			case parser.SUB:
-				*parent = &NumberLiteral{Val: lnum - rnum}
-			case parser.MUL:
-				*parent = &NumberLiteral{Val: lnum * rnum}
-			case parser.DIV:
-				*parent = &NumberLiteral{Val: lnum / rnum}
-			case parser.POW:
-				*parent = &NumberLiteral{Val: math.Pow(lnum, rnum)}
-			case parser.MOD:
-				*parent = &NumberLiteral{Val: math.Mod(lnum, rnum)}
-			default:
-				return false
-			}
-		}
-		return false
-	})
-	return expr
-}
-
 func trimParens(expr Node) Node {
 	TraverseBottomUp(nil, &expr, func(parent, current *Node) bool {
 		if current == nil || parent == nil {
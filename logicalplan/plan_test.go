@@ -5,18 +5,28 @@ package logicalplan
 
 import (
 	"fmt"
+	"maps"
+	"os"
 	"regexp"
 	"sort"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/thanos-io/promql-engine/execution/parse"
 	"github.com/thanos-io/promql-engine/query"
 
 	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 )
 
+func TestMain(m *testing.M) {
+	parser.EnableExperimentalFunctions = true
+	parser.EnableExtendedRangeSelectors = true
+	os.Exit(m.Run())
+}
+
 var spaces = regexp.MustCompile(`\s+`)
 var openParenthesis = regexp.MustCompile(`\(\s+`)
 var closedParenthesis = regexp.MustCompile(`\s+\)`)
@@ -120,6 +130,8 @@ func renderExprTree(expr Node) string {
 		return renderExprTree(t.Expr)
 	case *CheckDuplicateLabels:
 		return renderExprTree(t.Expr)
+	case *Sharded:
+		return fmt.Sprintf("sharded[%d](%s)", t.Shards, renderExprTree(t.Expr))
 	case *Subquery:
 		var b strings.Builder
 
@@ -265,7 +277,7 @@ func TestMatcherPropagation(t *testing.T) {
 		{
 			name:     "UNLESS operation with common labels",
 			expr:     `node_filesystem_files{host="$host", mountpoint="/"} unless node_filesystem_files_free`,
-			expected: `node_filesystem_files{host="$host",mountpoint="/"} unless node_filesystem_files_free`,
+			expected: `node_filesystem_files{host="$host",mountpoint="/"} unless node_filesystem_files_free{host="$host",mountpoint="/"}`,
 		},
 		{
 			name:     "one-to-many with group_right",
@@ -300,7 +312,7 @@ func TestMatcherPropagation(t *testing.T) {
 		{
 			name:     "UNLESS with vector matching",
 			expr:     `node_filesystem_files{host="$host"} unless on(host,mountpoint) node_filesystem_files_free`,
-			expected: `node_filesystem_files{host="$host"} unless on (host, mountpoint) node_filesystem_files_free`,
+			expected: `node_filesystem_files{host="$host"} unless on (host, mountpoint) node_filesystem_files_free{host="$host"}`,
 		},
 		{
 			name:     "mixed operations with common labels",
@@ -433,3 +445,49 @@ func cleanUp(replacements map[string]*regexp.Regexp, expr string) string {
 	}
 	return strings.Trim(expr, " ")
 }
+
+func TestTimeZoneFunctionsAreNotStepInvariant(t *testing.T) {
+	functions := maps.Clone(parser.Functions)
+	maps.Copy(functions, parse.TimeZoneFunctions)
+
+	cases := []struct {
+		expr     string
+		expected []string
+	}{
+		{
+			expr: `hour_tz("Europe/Berlin")`,
+		},
+		{
+			expr:     `hour_tz("Europe/Berlin", X @ 100)`,
+			expected: []string{`X @ 100.000`},
+		},
+		{
+			expr:     `hour_tz("Europe/Berlin", X @ 100) + abs(X @ 100)`,
+			expected: []string{`X @ 100.000`, `abs(X @ 100.000)`},
+		},
+		{
+			expr:     `sum(hour_tz("Europe/Berlin", X)) * (Y @ 100)`,
+			expected: []string{`Y @ 100.000`},
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.expr, func(t *testing.T) {
+			expr, err := parser.NewParser(tcase.expr, parser.WithFunctions(functions)).ParseExpr()
+			testutil.Ok(t, err)
+
+			plan, _ := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(3600, 0), Step: time.Minute}, PlanOptions{})
+			root := plan.Root()
+			var stepInvariant []string
+			Traverse(&root, func(node *Node) {
+				if e, ok := (*node).(*StepInvariantExpr); ok {
+					stepInvariant = append(stepInvariant, e.String())
+				}
+			})
+			testutil.Equals(t, tcase.expected, stepInvariant)
+		})
+	}
+	for name := range parse.TimeZoneFunctions {
+		_, ok := promql.AtModifierUnsafeFunctions[name]
+		testutil.Assert(t, !ok, "function %s must not be registered in the upstream engine", name)
+	}
+}
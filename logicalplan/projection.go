@@ -7,17 +7,24 @@ import (
 	"maps"
 	"slices"
 
+	"github.com/thanos-io/promql-engine/functions"
 	"github.com/thanos-io/promql-engine/query"
 
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/util/annotations"
 )
 
 type ProjectionOptimizer struct {
 	SeriesHashLabel string
+
+	functions *functions.Registry
 }
 
-func (p ProjectionOptimizer) Optimize(plan Node, _ *query.Options) (Node, annotations.Annotations) {
+func (p ProjectionOptimizer) Optimize(plan Node, opts *query.Options) (Node, annotations.Annotations) {
+	if opts != nil {
+		p.functions = opts.Functions
+	}
 	p.pushProjection(&plan, nil)
 	return plan, nil
 }
@@ -91,6 +98,15 @@ func (p ProjectionOptimizer) pushProjection(node *Node, projection *Projection)
 			return
 		}
 
+		// Low card series whose high card match is filled are returned
+		// with their own labels, so no side can be projected.
+		if n.Fill.IsSet() {
+			for _, child := range n.Children() {
+				p.pushProjection(child, nil)
+			}
+			return
+		}
+
 		if n.VectorMatching.Card == parser.CardOneToMany {
 			highCard, lowCard = lowCard, highCard
 		}
@@ -128,8 +144,20 @@ func (p ProjectionOptimizer) pushProjection(node *Node, projection *Projection)
 		return
 
 	case *FunctionCall:
+		// User defined label functions can read any label.
+		if p.functions.IsLabelFunction(n.Func.Name) {
+			for _, child := range n.Children() {
+				p.pushProjection(child, nil)
+			}
+			return
+		}
 		// Handle function-specific label requirements.
 		updatedProjection := getFunctionLabelRequirements(n.Func.Name, n.Args, projection)
+		if n.Func.Name == "info" {
+			// The data label selector does not select series.
+			p.pushProjection(&n.Args[0], updatedProjection)
+			return
+		}
 		for _, child := range n.Children() {
 			p.pushProjection(child, updatedProjection)
 		}
@@ -181,56 +209,71 @@ func getFunctionLabelRequirements(funcName string, args []Node, projection *Proj
 			Labels:  []string{},
 			Include: true,
 		}
-	case "histogram_quantile":
-		// Unsafe to push projection down for histogram_quantile as it requires le label.
+	case "count_distinct_approx", "count_distinct_sketch":
+		// Like aggregations, only the counted label and grouping labels are needed.
+		return &Projection{
+			Labels:  union([]string{UnsafeUnwrapString(args[0])}, countDistinctGrouping(funcName, args)),
+			Include: true,
+		}
+	case "count_distinct_merge":
+		return &Projection{
+			Labels:  countDistinctGrouping(funcName, args),
+			Include: true,
+		}
+	case "corr_over_time", "covar_over_time", "ratio_over_time":
+		// Series of both arguments are matched on all of their labels.
 		return nil
-	case "label_replace":
-		dstArg := unwrapStepInvariantExpr(args[1])
-		if dstLit, ok := dstArg.(*StringLiteral); ok {
-			dstLabel := dstLit.Val
-			needed := slices.Contains(result.Labels, dstLabel)
-			needSourceLabels := (result.Include && needed) || (!result.Include && !needed)
-			if !needSourceLabels {
-				return result
-			}
-
-			srcArg := unwrapStepInvariantExpr(args[3])
-			if strLit, ok := srcArg.(*StringLiteral); ok {
-				if result.Include && needed {
-					result.Labels = append(result.Labels, strLit.Val)
-				} else {
-					result.Labels = slices.DeleteFunc(result.Labels, func(s string) bool {
-						return s == strLit.Val
-					})
-				}
-			}
+	case "histogram_quantile", "histogram_quantiles", "to_nhcb":
+		// Unsafe to push projection down for histogram_quantile(s) and to_nhcb as they require le label.
+		return nil
+	case "to_classic":
+		// The le label of output series is added by the function.
+		result.Labels = slices.DeleteFunc(result.Labels, func(s string) bool {
+			return s == labels.BucketLabel
+		})
+	case "info":
+		required := infoRequiredLabels(args)
+		if result.Include {
+			result.Labels = union(result.Labels, required)
+		} else {
+			result.Labels = subtract(result.Labels, required)
 		}
+	case "label_replace":
+		return destinationLabelRequirements(result, args[1], args[3:4])
 	case "label_join":
-		dstArg := unwrapStepInvariantExpr(args[1])
-		if dstLit, ok := dstArg.(*StringLiteral); ok {
-			dstLabel := dstLit.Val
-			needed := slices.Contains(result.Labels, dstLabel)
-			needSourceLabels := (result.Include && needed) || (!result.Include && !needed)
-			if !needSourceLabels {
-				return result
-			}
+		return destinationLabelRequirements(result, args[1], args[3:])
+	case "label_copy", "label_map":
+		return destinationLabelRequirements(result, args[1], args[2:3])
+	}
 
-			// Only if the destination label is needed, we need the source labels
-			for i := 3; i < len(args); i++ {
-				srcArg := unwrapStepInvariantExpr(args[i])
-				if strLit, ok := srcArg.(*StringLiteral); ok {
-					if result.Include && needed {
-						result.Labels = append(result.Labels, strLit.Val)
-					} else {
-						result.Labels = slices.DeleteFunc(result.Labels, func(s string) bool {
-							return s == strLit.Val
-						})
-					}
-				}
+	return result
+}
+
+// destinationLabelRequirements updates the projection for functions which write the
+// destination label from source labels. The source labels are only needed if the
+// destination label is needed.
+func destinationLabelRequirements(result *Projection, dst Node, srcs []Node) *Projection {
+	dstLit, ok := unwrapStepInvariantExpr(dst).(*StringLiteral)
+	if !ok {
+		return result
+	}
+	needed := slices.Contains(result.Labels, dstLit.Val)
+	needSourceLabels := (result.Include && needed) || (!result.Include && !needed)
+	if !needSourceLabels {
+		return result
+	}
+
+	for _, src := range srcs {
+		if strLit, ok := unwrapStepInvariantExpr(src).(*StringLiteral); ok {
+			if result.Include && needed {
+				result.Labels = append(result.Labels, strLit.Val)
+			} else {
+				result.Labels = slices.DeleteFunc(result.Labels, func(s string) bool {
+					return s == strLit.Val
+				})
 			}
 		}
 	}
-
 	return result
 }
 
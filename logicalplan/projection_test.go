@@ -9,9 +9,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/thanos-io/promql-engine/functions"
 	"github.com/thanos-io/promql-engine/query"
 
 	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 )
 
@@ -287,6 +290,59 @@ func TestProjectionOptimizer(t *testing.T) {
 	}
 }
 
+func TestProjectionOptimizerUserDefinedFunctions(t *testing.T) {
+	registry := functions.NewRegistry()
+	registry.MustRegister(
+		functions.Function{
+			Signature: parser.Function{
+				Name:       "double",
+				ArgTypes:   []parser.ValueType{parser.ValueTypeVector},
+				ReturnType: parser.ValueTypeVector,
+			},
+			InstantVector: func(f float64, _ *histogram.FloatHistogram, _ ...float64) (float64, bool) { return 2 * f, true },
+		},
+		functions.Function{
+			Signature: parser.Function{
+				Name:       "label_upper",
+				ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString},
+				ReturnType: parser.ValueTypeVector,
+			},
+			Label: func(lbls labels.Labels, _ []string) (labels.Labels, error) { return lbls, nil },
+		},
+	)
+
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "instant vector function",
+			expr:     `sum by (job) (double(metric{instance="a", job="b"}))`,
+			expected: `sum by (job) (double(metric{instance="a",job="b"}[projection=include(job)]))`,
+		},
+		{
+			name:     "label function",
+			expr:     `sum by (job) (label_upper(metric{instance="a", job="b"}, "job"))`,
+			expected: `sum by (job) (label_upper(metric{instance="a",job="b"}, "job"))`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			expr, err := parser.NewParser(tc.expr, parser.WithFunctions(registry.Signatures())).ParseExpr()
+			testutil.Ok(t, err)
+
+			opts := &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0), Functions: registry}
+			plan, err := NewFromAST(expr, opts, PlanOptions{})
+			testutil.Ok(t, err)
+			optimizedPlan, _ := ProjectionOptimizer{}.Optimize(plan.Root(), opts)
+
+			testutil.Equals(t, tc.expected, renderExprTree(optimizedPlan))
+		})
+	}
+}
+
 func TestGetFunctionLabelRequirements(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -390,6 +446,61 @@ func TestGetFunctionLabelRequirements(t *testing.T) {
 				Include: false,
 			},
 		},
+		{
+			name:     "label_copy with destination label needed",
+			funcName: "label_copy",
+			args: []Node{
+				&VectorSelector{},
+				&StringLiteral{Val: "new_label"},
+				&StringLiteral{Val: "src_label"},
+			},
+			projection: &Projection{
+				Labels:  []string{"new_label"},
+				Include: true,
+			},
+			expected: &Projection{
+				Labels:  []string{"new_label", "src_label"},
+				Include: true,
+			},
+		},
+		{
+			name:     "label_map with destination label not needed",
+			funcName: "label_map",
+			args: []Node{
+				&VectorSelector{},
+				&StringLiteral{Val: "new_label"},
+				&StringLiteral{Val: "src_label"},
+				&StringLiteral{Val: "a"},
+				&StringLiteral{Val: "A"},
+			},
+			projection: &Projection{
+				Labels:  []string{"other_label"},
+				Include: true,
+			},
+			expected: &Projection{
+				Labels:  []string{"other_label"},
+				Include: true,
+			},
+		},
+		{
+			name:     "label_map with without clause",
+			funcName: "label_map",
+			args: []Node{
+				&VectorSelector{},
+				&StringLiteral{Val: "new_label"},
+				&StringLiteral{Val: "src_label"},
+				&StringLiteral{Val: "a"},
+				&StringLiteral{Val: "A"},
+			},
+			projection: &Projection{
+				Labels:  []string{"other_label", "src_label"},
+				Include: false,
+			},
+			expected: &Projection{
+				Labels:  []string{"other_label"},
+				Include: false,
+			},
+		},
 		{
 			name:     "scalar function returns empty projection",
 			funcName: "scalar",
@@ -448,6 +559,56 @@ func TestGetFunctionLabelRequirements(t *testing.T) {
 			},
 			expected: nil,
 		},
+		{
+			name:     "to_classic does not need le label from input",
+			funcName: "to_classic",
+			args: []Node{
+				&VectorSelector{},
+				&NumberLiteral{Val: 0.5},
+			},
+			projection: &Projection{
+				Labels:  []string{"le", "job"},
+				Include: true,
+			},
+			expected: &Projection{
+				Labels:  []string{"job"},
+				Include: true,
+			},
+		},
+		{
+			name:     "info function keeps labels for joining with info series",
+			funcName: "info",
+			args: []Node{
+				&VectorSelector{},
+				&VectorSelector{VectorSelector: &parser.VectorSelector{LabelMatchers: []*labels.Matcher{
+					labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "build_info"),
+					labels.MustNewMatcher(labels.MatchRegexp, "version", ".+"),
+				}}},
+			},
+			projection: &Projection{
+				Labels:  []string{"label1"},
+				Include: true,
+			},
+			expected: &Projection{
+				Labels:  []string{"label1", "__name__", "instance", "job", "version"},
+				Include: true,
+			},
+		},
+		{
+			name:     "info function with without clause",
+			funcName: "info",
+			args: []Node{
+				&VectorSelector{},
+			},
+			projection: &Projection{
+				Labels:  []string{"label1", "instance"},
+				Include: false,
+			},
+			expected: &Projection{
+				Labels:  []string{"label1"},
+				Include: false,
+			},
+		},
 		{
 			name:     "unknown function returns original labels",
 			funcName: "unknown_function",
@@ -4,6 +4,7 @@
 package logicalplan
 
 import (
+	"regexp"
 	"slices"
 	"sort"
 	"strings"
@@ -12,11 +13,23 @@ import (
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/schema"
 	"github.com/prometheus/prometheus/util/annotations"
 )
 
 // PropagateMatchersOptimizer implements matcher propagation between
-// two vector selectors in a binary expression.
+// both sides of a binary expression. Matchers on labels which are used for
+// joining series from both sides are copied to the other side, so that
+//
+//	sum by (pod) (rate(errors_total{pod="a"}[5m])) / on (pod) rate(requests_total[5m])
+//
+// becomes:
+//
+//	sum by (pod) (rate(errors_total{pod="a"}[5m])) / on (pod) rate(requests_total{pod="a"}[5m])
+//
+// Matchers are propagated through expressions which keep the labels of their
+// input series, such as aggregations with grouping labels, label_replace for
+// labels it does not write, subqueries and most functions.
 type PropagateMatchersOptimizer struct{}
 
 func (m PropagateMatchersOptimizer) Optimize(plan Node, _ *query.Options) (Node, annotations.Annotations) {
@@ -30,9 +43,9 @@ func (m PropagateMatchersOptimizer) Optimize(plan Node, _ *query.Options) (Node,
 		if binOp.Op.IsComparisonOperator() || binOp.Op.String() == "atan2" {
 			return
 		}
-		// Skip OR and UNLESS as their JOIN logic is different from AND and
-		// other binary arithmetic operations.
-		if binOp.Op == parser.LOR || binOp.Op == parser.LUNLESS {
+		// Series from the right side of 'or' are returned when they have no match
+		// on the left side, so none of the sides can be restricted.
+		if binOp.Op == parser.LOR {
 			return
 		}
 
@@ -54,22 +67,68 @@ func (m PropagateMatchersOptimizer) Optimize(plan Node, _ *query.Options) (Node,
 }
 
 func propagateMatchers(binOp *Binary) {
-	lhSelector, ok := binOp.LHS.(*VectorSelector)
-	if !ok {
+	lhSelector, lok := binOp.LHS.(*VectorSelector)
+	rhSelector, rok := binOp.RHS.(*VectorSelector)
+	if lok && rok && !differentMetricNames(lhSelector, rhSelector) {
 		return
 	}
-	rhSelector, ok := binOp.RHS.(*VectorSelector)
-	if !ok {
+
+	labelRequired := func(label string) bool { return isMatchingLabel(binOp.VectorMatching, label) }
+
+	lhMatchers := outputMatchers(binOp.LHS)
+	rhMatchers := outputMatchers(binOp.RHS)
+	union, stop := makeUnion(lhMatchers, rhMatchers, labelRequired)
+	if stop || len(union) == 0 {
 		return
 	}
+
+	// Matchers to add or replace.
+	matchersToChange := toSlice(union)
+	// Series without a match on the other side are returned when
+	// the other side is filled, so their side cannot be restricted.
+	if binOp.Fill.LHS == nil {
+		pushMatchers(binOp.RHS, matchersToChange)
+	}
+	// Series from the left side of 'unless' are returned when they have
+	// no match on the right side, so the left side cannot be restricted.
+	if binOp.Op != parser.LUNLESS && binOp.Fill.RHS == nil {
+		pushMatchers(binOp.LHS, matchersToChange)
+	}
+}
+
+// isMatchingLabel returns true if the label is used for matching series
+// from both sides of a binary expression with the given vector matching.
+func isMatchingLabel(vm *parser.VectorMatching, label string) bool {
+	// Metadata labels are dropped by most operations.
+	if schema.IsMetadataLabel(label) {
+		return false
+	}
+	if vm == nil {
+		return true
+	}
+	if !vm.On && len(vm.MatchingLabels) == 0 {
+		return true
+	}
+
+	if vm.On && slices.Contains(vm.MatchingLabels, label) {
+		return true
+	}
+	if !vm.On && !slices.Contains(vm.MatchingLabels, label) {
+		return true
+	}
+	return false
+}
+
+// differentMetricNames returns true if both selectors select a single and different metric name.
+func differentMetricNames(lhSelector, rhSelector *VectorSelector) bool {
 	// Only handle vector selectors with equal metric name matcher now.
 	lhMetricNameMatcher := extractMetricNameMatcher(lhSelector.LabelMatchers)
 	if lhMetricNameMatcher == nil || lhMetricNameMatcher.Type != labels.MatchEqual {
-		return
+		return false
 	}
 	rhMetricNameMatcher := extractMetricNameMatcher(rhSelector.LabelMatchers)
 	if rhMetricNameMatcher == nil || rhMetricNameMatcher.Type != labels.MatchEqual {
-		return
+		return false
 	}
 
 	// There are cases where VectorSelector.Name is empty when the metric name is
@@ -81,42 +140,160 @@ func propagateMatchers(binOp *Binary) {
 		rhSelector.Name = rhMetricNameMatcher.Value
 	}
 	// This case is handled by MergeSelectsOptimizer.
-	if lhSelector.Name == rhSelector.Name {
+	return lhSelector.Name != rhSelector.Name
+}
+
+// outputMatchers returns matchers which are satisfied by all series returned by the expression.
+func outputMatchers(expr Node) map[string]*labels.Matcher {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		return toMatcherMap(e.LabelMatchers)
+	case *MatrixSelector:
+		return outputMatchers(e.VectorSelector)
+	case *Parens:
+		return outputMatchers(e.Expr)
+	case *StepInvariantExpr:
+		return outputMatchers(e.Expr)
+	case *Subquery:
+		return outputMatchers(e.Expr)
+	case *Unary:
+		return outputMatchers(e.Expr)
+	case *Binary:
+		if next := vectorSideOfScalarBinary(e); next != nil {
+			return outputMatchers(next)
+		}
+	case *Aggregation:
+		return filterMatchers(outputMatchers(e.Expr), func(label string) bool { return aggregationKeepsLabel(e, label) })
+	case *FunctionCall:
+		if next, keepsLabel := labelPreservingArg(e); next != nil {
+			return filterMatchers(outputMatchers(next), keepsLabel)
+		}
+	}
+	return nil
+}
+
+// pushMatchers restricts all selectors in the expression with the given matchers.
+// Matchers are only pushed through expressions for which a matcher on the output
+// series is equivalent to a matcher on the input series.
+func pushMatchers(expr Node, matchers []*labels.Matcher) {
+	if len(matchers) == 0 {
 		return
 	}
+	switch e := expr.(type) {
+	case *VectorSelector:
+		updateSelectorMatchers(e, matchers)
+	case *MatrixSelector:
+		pushMatchers(e.VectorSelector, matchers)
+	case *Parens:
+		pushMatchers(e.Expr, matchers)
+	case *StepInvariantExpr:
+		pushMatchers(e.Expr, matchers)
+	case *Subquery:
+		pushMatchers(e.Expr, matchers)
+	case *Unary:
+		pushMatchers(e.Expr, matchers)
+	case *Binary:
+		if next := vectorSideOfScalarBinary(e); next != nil {
+			pushMatchers(next, matchers)
+		}
+	case *Aggregation:
+		pushMatchers(e.Expr, filterMatcherSlice(matchers, func(label string) bool { return aggregationKeepsLabel(e, label) }))
+	case *FunctionCall:
+		if next, keepsLabel := labelPreservingArg(e); next != nil {
+			pushMatchers(next, filterMatcherSlice(matchers, keepsLabel))
+		}
+	}
+}
 
-	vm := binOp.VectorMatching
-	labelRequired := func(label string) bool {
-		if label == labels.MetricName {
+// aggregationKeepsLabel returns true if the value of the label in each output series
+// of the aggregation is the value of the same label in all of its input series.
+// Filtering input series by such a label removes entire groups, which does not
+// change the result of the aggregation for the remaining groups.
+func aggregationKeepsLabel(aggr *Aggregation, label string) bool {
+	if aggr.Op == parser.COUNT_VALUES {
+		if valueLabel, err := UnwrapString(aggr.Param); err != nil || valueLabel == label {
 			return false
 		}
-		if vm == nil {
-			return true
+	}
+	if aggr.Without {
+		return !slices.Contains(aggr.Grouping, label)
+	}
+	return slices.Contains(aggr.Grouping, label)
+}
+
+// labelPreservingArg returns the argument of a function which produces exactly one
+// output series for each input series, together with a function which tells whether
+// a label is passed through unchanged from input to output series.
+func labelPreservingArg(call *FunctionCall) (Node, func(string) bool) {
+	keepsAll := func(string) bool { return true }
+	switch call.Func.Name {
+	case "label_replace", "label_join", "label_copy", "label_map":
+		dst, err := UnwrapString(call.Args[1])
+		if err != nil {
+			return nil, nil
 		}
-		if !vm.On && len(vm.MatchingLabels) == 0 {
-			return true
+		return call.Args[0], func(label string) bool { return label != dst }
+	case "label_keep", "label_drop":
+		keep, err := LabelFilter(call)
+		if err != nil {
+			return nil, nil
 		}
-
-		if vm.On && slices.Contains(vm.MatchingLabels, label) {
-			return true
+		return call.Args[0], keep
+	case "histogram_quantile", "histogram_fraction":
+		// Classic histogram buckets are merged into a single series.
+		return call.Args[len(call.Args)-1], func(label string) bool { return label != labels.BucketLabel }
+	case "histogram_quantiles":
+		// Each histogram is expanded into a series for each quantile, labelled with its value.
+		quantileLabel, err := UnwrapString(call.Args[1])
+		if err != nil {
+			return nil, nil
 		}
-		if !vm.On && !slices.Contains(vm.MatchingLabels, label) {
-			return true
+		return call.Args[0], func(label string) bool { return label != labels.BucketLabel && label != quantileLabel }
+	case "to_nhcb":
+		// Classic histogram buckets are merged into a single series without the _bucket suffix.
+		return call.Args[0], func(label string) bool { return label != labels.BucketLabel && label != labels.MetricName }
+	}
+	if _, ok := shardableFunctions[call.Func.Name]; !ok || len(call.Args) == 0 {
+		return nil, nil
+	}
+	for _, arg := range call.Args {
+		switch arg.ReturnType() {
+		case parser.ValueTypeVector, parser.ValueTypeMatrix:
+			return arg, keepsAll
 		}
-		return false
 	}
+	return nil, nil
+}
 
-	lhMatchers := toMatcherMap(lhSelector.LabelMatchers)
-	rhMatchers := toMatcherMap(rhSelector.LabelMatchers)
-	union, stop := makeUnion(lhMatchers, rhMatchers, labelRequired)
-	if stop || len(union) == 0 {
-		return
+// vectorSideOfScalarBinary returns the vector operand of a binary
+// expression between a vector and a constant scalar.
+func vectorSideOfScalarBinary(binOp *Binary) Node {
+	switch {
+	case IsConstantScalarExpr(binOp.LHS) && binOp.RHS.ReturnType() == parser.ValueTypeVector:
+		return binOp.RHS
+	case IsConstantScalarExpr(binOp.RHS) && binOp.LHS.ReturnType() == parser.ValueTypeVector:
+		return binOp.LHS
 	}
+	return nil
+}
 
-	// Matchers to add or replace.
-	matchersToChange := toSlice(union)
-	updateSelectorMatchers(lhSelector, matchersToChange)
-	updateSelectorMatchers(rhSelector, matchersToChange)
+func filterMatchers(matchers map[string]*labels.Matcher, keep func(string) bool) map[string]*labels.Matcher {
+	for name := range matchers {
+		if !keep(name) {
+			delete(matchers, name)
+		}
+	}
+	return matchers
+}
+
+func filterMatcherSlice(matchers []*labels.Matcher, keep func(string) bool) []*labels.Matcher {
+	result := make([]*labels.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		if keep(m.Name) {
+			result = append(result, m)
+		}
+	}
+	return result
 }
 
 func toSlice(union map[string]*labels.Matcher) []*labels.Matcher {
@@ -176,16 +353,29 @@ func extractMetricNameMatcher(matchers []*labels.Matcher) *labels.Matcher {
 }
 
 func updateSelectorMatchers(selector *VectorSelector, matchers []*labels.Matcher) {
-	selectorMatchersMap := toMatcherMap(selector.LabelMatchers)
+	// Matchers can be shared with other selectors, for example after merging selects.
+	selector.LabelMatchers = slices.Clone(selector.LabelMatchers)
 	for _, m := range matchers {
-		selectorMatchersMap[m.Name] = m
-	}
-	selectorMatchers := make([]*labels.Matcher, 0, len(selectorMatchersMap))
-	for _, m := range selectorMatchersMap {
-		selectorMatchers = append(selectorMatchers, m)
+		var (
+			idx   = -1
+			count = 0
+		)
+		for i, existing := range selector.LabelMatchers {
+			if existing.Name == m.Name {
+				idx = i
+				count++
+			}
+		}
+		switch {
+		case count == 1:
+			// Merged matchers are always a subset of the existing
+			// matcher for the same label so we can replace it.
+			selector.LabelMatchers[idx] = m
+		case !slices.ContainsFunc(selector.LabelMatchers, func(existing *labels.Matcher) bool { return matcherEqual(existing, m) }):
+			selector.LabelMatchers = append(selector.LabelMatchers, m)
+		}
 	}
-	selector.LabelMatchers = selectorMatchers
-	sort.Slice(selector.LabelMatchers, func(i, j int) bool {
+	sort.SliceStable(selector.LabelMatchers, func(i, j int) bool {
 		return selector.LabelMatchers[i].Name < selector.LabelMatchers[j].Name
 	})
 }
@@ -201,23 +391,45 @@ func mergeMatcher(existingMatcher *labels.Matcher, newMatcher *labels.Matcher) (
 	}
 	// Different matchers.
 
-	// As long as one matcher matches empty value or nothing, it overrides any other matcher
-	// that matches value.
-	if matchesEmptyValue(existingMatcher) || matchesNothing(existingMatcher) {
+	// A matcher which matches nothing also matches nothing when combined with other matchers.
+	if matchesNothing(existingMatcher) {
+		return existingMatcher, false
+	}
+	if matchesNothing(newMatcher) {
+		return newMatcher, false
+	}
+	// A matcher which only matches the empty value can only be combined
+	// with matchers that also match the empty value.
+	if matchesEmptyValue(existingMatcher) {
+		if !newMatcher.Matches("") {
+			return nil, true
+		}
 		return existingMatcher, false
 	}
-	if matchesEmptyValue(newMatcher) || matchesNothing(newMatcher) {
+	if matchesEmptyValue(newMatcher) {
+		if !existingMatcher.Matches("") {
+			return nil, true
+		}
+		return newMatcher, false
+	}
+	// A matcher which matches all non-empty values can be replaced by
+	// the other matcher as long as it does not match the empty value.
+	if matchesAllValues(existingMatcher) && !newMatcher.Matches("") {
 		return newMatcher, false
 	}
-	if matchesAllValues(existingMatcher) || matchesEverything(existingMatcher) {
+	if matchesAllValues(newMatcher) && !existingMatcher.Matches("") {
+		return existingMatcher, false
+	}
+	if matchesEverything(existingMatcher) {
 		return newMatcher, false
 	}
-	if matchesAllValues(newMatcher) || matchesEverything(newMatcher) {
+	if matchesEverything(newMatcher) {
 		return existingMatcher, false
 	}
 
 	if existingMatcher.Type == labels.MatchNotEqual && newMatcher.Type == labels.MatchNotEqual {
-		return labels.MustNewMatcher(labels.MatchNotRegexp, existingMatcher.Name, strings.Join([]string{existingMatcher.Value, newMatcher.Value}, "|")), false
+		values := []string{regexp.QuoteMeta(existingMatcher.Value), regexp.QuoteMeta(newMatcher.Value)}
+		return labels.MustNewMatcher(labels.MatchNotRegexp, existingMatcher.Name, strings.Join(values, "|")), false
 	}
 	// One equal matcher with another matcher type. Always use equal matcher to scope down.
 	if existingMatcher.Type == labels.MatchEqual || newMatcher.Type == labels.MatchEqual {
@@ -6,6 +6,9 @@ package logicalplan
 import (
 	"sort"
 	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/query"
 
 	"github.com/efficientgo/core/testutil"
 	"github.com/prometheus/prometheus/model/labels"
@@ -31,6 +34,13 @@ func TestMergeMatcher(t *testing.T) {
 			name:            "existing matcher matches empty value",
 			existingMatcher: labels.MustNewMatcher(labels.MatchEqual, "label", ""),
 			newMatcher:      labels.MustNewMatcher(labels.MatchEqual, "label", "value"),
+			expected:        nil,
+			shouldStop:      true,
+		},
+		{
+			name:            "existing matcher matches empty value and new matcher matches empty value",
+			existingMatcher: labels.MustNewMatcher(labels.MatchEqual, "label", ""),
+			newMatcher:      labels.MustNewMatcher(labels.MatchNotEqual, "label", "value"),
 			expected:        labels.MustNewMatcher(labels.MatchEqual, "label", ""),
 			shouldStop:      false,
 		},
@@ -38,7 +48,21 @@ func TestMergeMatcher(t *testing.T) {
 			name:            "new matcher matches empty value",
 			existingMatcher: labels.MustNewMatcher(labels.MatchEqual, "label", "value"),
 			newMatcher:      labels.MustNewMatcher(labels.MatchEqual, "label", ""),
-			expected:        labels.MustNewMatcher(labels.MatchEqual, "label", ""),
+			expected:        nil,
+			shouldStop:      true,
+		},
+		{
+			name:            "all values matcher with matcher that matches empty value",
+			existingMatcher: labels.MustNewMatcher(labels.MatchRegexp, "label", ".+"),
+			newMatcher:      labels.MustNewMatcher(labels.MatchRegexp, "label", "a|"),
+			expected:        nil,
+			shouldStop:      true,
+		},
+		{
+			name:            "not equal matchers with regexp characters",
+			existingMatcher: labels.MustNewMatcher(labels.MatchNotEqual, "label", "a.b"),
+			newMatcher:      labels.MustNewMatcher(labels.MatchNotEqual, "label", "c|d"),
+			expected:        labels.MustNewMatcher(labels.MatchNotRegexp, "label", `a\.b|c\|d`),
 			shouldStop:      false,
 		},
 		{
@@ -522,6 +546,155 @@ func TestPropagateMatchers(t *testing.T) {
 	}
 }
 
+// TestPropagateMatchersOptimizer documents why each rewrite is safe. A matcher can only be
+// pushed into a side of a binary expression when series which do not satisfy it cannot
+// contribute to the result, and only through expressions which keep the label value of
+// their input series in their output series.
+func TestPropagateMatchersOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		reason   string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "on matching labels",
+			reason:   "series from b can only match series from a when their instance labels are equal",
+			expr:     `a{job="x", instance="i"} * on(instance) b`,
+			expected: `a{instance="i",job="x"} * on (instance) b{instance="i"}`,
+		},
+		{
+			name:     "ignoring labels",
+			reason:   "labels in ignoring() do not take part in matching so they are not propagated",
+			expr:     `a{job="x", instance="i"} * ignoring(instance) b`,
+			expected: `a{instance="i",job="x"} * ignoring (instance) b{job="x"}`,
+		},
+		{
+			name:     "sum by grouping labels",
+			reason:   "every output series of sum by (job) carries the job label of all of its input series",
+			expr:     `sum by (job) (rate(a{job="x"}[5m])) / on(job) sum by (job) (rate(b[5m]))`,
+			expected: `sum by (job) (rate(a{job="x"}[5m0s])) / on (job) sum by (job) (rate(b{job="x"}[5m0s]))`,
+		},
+		{
+			name:     "sum without labels",
+			reason:   "labels removed by without() do not exist on the output so they cannot be propagated",
+			expr:     `sum without (pod) (a{job="x", pod="p"}) * b`,
+			expected: `sum without (pod) (a{job="x",pod="p"}) * b{job="x"}`,
+		},
+		{
+			name:     "sum without grouping",
+			reason:   "the output series has no labels so there is nothing to match on",
+			expr:     `sum(a{job="x"}) * on() group_right b`,
+			expected: `sum(a{job="x"}) * on () group_right () b`,
+		},
+		{
+			name:     "topk with grouping",
+			reason:   "topk keeps the labels of its input series and filters them per group",
+			expr:     `topk by (job) (1, a) and on(job) b{job="x"}`,
+			expected: `topk by (job) (1, a{job="x"}) and on (job) b{job="x"}`,
+		},
+		{
+			name:     "count_values label",
+			reason:   "the label written by count_values has a different meaning in the input series",
+			expr:     `count_values by (job) ("job", a) * on(job) b{job="x"}`,
+			expected: `count_values by (job) ("job", a) * on (job) b{job="x"}`,
+		},
+		{
+			name:     "and",
+			reason:   "only series from a with a match in b are returned and b does not contribute otherwise",
+			expr:     `a{job="x"} and on(job) b`,
+			expected: `a{job="x"} and on (job) b{job="x"}`,
+		},
+		{
+			name:     "unless",
+			reason:   "series from a without a match in b are returned so a cannot be restricted",
+			expr:     `a unless on(job) b{job="x"}`,
+			expected: `a unless on (job) b{job="x"}`,
+		},
+		{
+			name:     "unless into right side",
+			reason:   "series from b can only remove series from a which have the same job label",
+			expr:     `a{job="x"} unless on(job) b`,
+			expected: `a{job="x"} unless on (job) b{job="x"}`,
+		},
+		{
+			name:     "or",
+			reason:   "series from b are returned when they have no match in a",
+			expr:     `a{job="x"} or on(job) b`,
+			expected: `a{job="x"} or on (job) b`,
+		},
+		{
+			name:     "label_replace untouched label",
+			reason:   "label_replace only writes the destination label",
+			expr:     `label_replace(a{job="x"}, "dst", "$1", "src", "(.*)") * on(job) b`,
+			expected: `label_replace(a{job="x"}, "dst", "$1", "src", "(.*)") * on (job) b{job="x"}`,
+		},
+		{
+			name:     "label_replace destination label",
+			reason:   "the destination label on the output can differ from the input",
+			expr:     `label_replace(a, "job", "$1", "src", "(.*)") * on(job) b{job="x"}`,
+			expected: `label_replace(a, "job", "$1", "src", "(.*)") * on (job) b{job="x"}`,
+		},
+		{
+			name:     "subquery",
+			reason:   "subqueries return the series of their inner expression",
+			expr:     `max_over_time(a{job="x"}[5m:1m]) * on(job) max_over_time(rate(b[1m])[5m:1m])`,
+			expected: `max_over_time(a{job="x"}[5m0s:1m0s]) * on (job) max_over_time(rate(b{job="x"}[1m0s])[5m0s:1m0s])`,
+		},
+		{
+			name:     "histogram_quantile le label",
+			reason:   "histogram_quantile merges all buckets of a histogram into a single series without le",
+			expr:     `histogram_quantile(0.9, a{job="x", le="1"}) * b`,
+			expected: `histogram_quantile(0.9, a{job="x",le="1"}) * b{job="x"}`,
+		},
+		{
+			name:     "scalar operand",
+			reason:   "arithmetic with a scalar keeps the labels of the vector side",
+			expr:     `(a{job="x"} * 2) / on(job) (b + 1)`,
+			expected: `a{job="x"} * 2 / on (job) b{job="x"} + 1`,
+		},
+		{
+			name:     "metric name",
+			reason:   "the metric name is dropped by arithmetic operations so it is never matched on",
+			expr:     `{__name__="a", job="x"} * on(job) b`,
+			expected: `a{job="x"} * on (job) b{job="x"}`,
+		},
+		{
+			name:     "non matching matchers",
+			reason:   "the result is already empty so the query is left untouched",
+			expr:     `a{job="x"} * on(job) b{job="y"}`,
+			expected: `a{job="x"} * on (job) b{job="y"}`,
+		},
+		{
+			name:     "comparison",
+			reason:   "filtering comparisons return series from the left side regardless of the right side",
+			expr:     `a{job="x"} > on(job) b`,
+			expected: `a{job="x"} > on (job) b`,
+		},
+	}
+
+	optimizers := []Optimizer{PropagateMatchersOptimizer{}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan, _ := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}, PlanOptions{})
+			optimizedPlan, _ := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, renderExprTree(optimizedPlan.Root()), tcase.reason)
+		})
+	}
+}
+
+func TestPropagateMatchersAfterMergeSelects(t *testing.T) {
+	expr, err := parser.ParseExpr(`(a{instance="i"} * b{instance=~".+"}) or b{instance=~".+", job!="x"}`)
+	testutil.Ok(t, err)
+
+	plan, _ := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}, PlanOptions{})
+	optimizedPlan, _ := plan.Optimize([]Optimizer{MergeSelectsOptimizer{}, PropagateMatchersOptimizer{}})
+	testutil.Equals(t, `a{instance="i"} * b{instance="i"} or filter([job!="x"], b{instance=~".+"})`, renderExprTree(optimizedPlan.Root()))
+}
+
 func matchersEqual(m1, m2 []*labels.Matcher) bool {
 	if len(m1) != len(m2) {
 		return false
@@ -0,0 +1,250 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"slices"
+
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// PruneContradictionsOptimizer replaces selectors whose matchers can never be
+// satisfied at the same time, such as {job="a", job="b"}, with an empty result
+// so that no select is issued against storage. Expressions which always return
+// an empty result for an empty input are then pruned as well, for example
+//
+//	sum(a{job="a", job="b"}) or b
+//
+// becomes:
+//
+//	b
+//
+// Contradictions are commonly produced by templated dashboards and by
+// PropagateMatchersOptimizer, which is why this optimizer runs after it.
+type PruneContradictionsOptimizer struct{}
+
+func (m PruneContradictionsOptimizer) Optimize(plan Node, _ *query.Options) (Node, annotations.Annotations) {
+	TraverseBottomUp(nil, &plan, func(parent, current *Node) bool {
+		*current = pruneEmpty(parent, *current)
+		return false
+	})
+	return plan, nil
+}
+
+func pruneEmpty(parent *Node, node Node) Node {
+	switch e := node.(type) {
+	case *VectorSelector:
+		if !matchersUnsatisfiable(e.LabelMatchers) {
+			return node
+		}
+		if parent != nil {
+			switch p := (*parent).(type) {
+			case *MatrixSelector:
+				// Matrix selectors are pruned together with the function they are passed to.
+				return node
+			case *FunctionCall:
+				// The labels of the result of absent are taken from the selector.
+				if p.Func.Name == "absent" {
+					return node
+				}
+				// The data label selector of info does not select series.
+				if p.Func.Name == "info" && len(p.Args) > 1 && p.Args[1] == node {
+					return node
+				}
+			}
+		}
+		return Noop{}
+	case *Parens:
+		if isEmptyResult(e.Expr) {
+			return Noop{}
+		}
+	case *StepInvariantExpr:
+		if isEmptyResult(e.Expr) {
+			return Noop{}
+		}
+	case *Unary:
+		if isEmptyResult(e.Expr) {
+			return Noop{}
+		}
+	case *Aggregation:
+		if isEmptyResult(e.Expr) && (e.Param == nil || cannotFail(e.Param)) {
+			return Noop{}
+		}
+	case *FunctionCall:
+		if !preservesEmptyResult(e) || !slices.ContainsFunc(e.Args, isEmptyArg) {
+			return node
+		}
+		for _, arg := range e.Args {
+			if !isEmptyArg(arg) && !cannotFail(arg) {
+				return node
+			}
+		}
+		return Noop{}
+	case *Binary:
+		return pruneEmptyBinary(e)
+	}
+	return node
+}
+
+func pruneEmptyBinary(binOp *Binary) Node {
+	lhsEmpty := binOp.LHS.ReturnType() == parser.ValueTypeVector && isEmptyResult(binOp.LHS)
+	rhsEmpty := binOp.RHS.ReturnType() == parser.ValueTypeVector && isEmptyResult(binOp.RHS)
+	// Other operators can fail on duplicate series in a match group
+	// even when no series match, so only set operators are pruned.
+	if (binOp.Op == parser.LAND || binOp.Op == parser.LUNLESS) && !lhsEmpty && !rhsEmpty && sidesNeverMatch(binOp) {
+		if binOp.Op == parser.LUNLESS && cannotFail(binOp.RHS) {
+			return binOp.LHS
+		}
+		if binOp.Op == parser.LAND && cannotFail(binOp.LHS) && cannotFail(binOp.RHS) {
+			return Noop{}
+		}
+		return binOp
+	}
+	// Both sides are always evaluated, so a side can only
+	// be dropped if it cannot fail the evaluation of the query.
+	if (lhsEmpty && !cannotFail(binOp.RHS)) || (rhsEmpty && !cannotFail(binOp.LHS)) {
+		return binOp
+	}
+	switch binOp.Op {
+	case parser.LOR:
+		switch {
+		case lhsEmpty && rhsEmpty:
+			return Noop{}
+		case lhsEmpty:
+			return binOp.RHS
+		case rhsEmpty:
+			return binOp.LHS
+		}
+	case parser.LUNLESS:
+		switch {
+		case lhsEmpty:
+			return Noop{}
+		case rhsEmpty:
+			return binOp.LHS
+		}
+	default:
+		// Series without a match on the other side are dropped by all other
+		// operators unless the other side is filled, and operations with a
+		// scalar return one series per input series.
+		if (lhsEmpty && rhsEmpty) || (lhsEmpty && binOp.Fill.LHS == nil) || (rhsEmpty && binOp.Fill.RHS == nil) {
+			return Noop{}
+		}
+	}
+	return binOp
+}
+
+// sidesNeverMatch returns true if no series from the left side of a binary expression
+// between two vectors can match a series from its right side, because the sides
+// contradict each other on one of the labels used for matching.
+func sidesNeverMatch(binOp *Binary) bool {
+	if binOp.LHS.ReturnType() != parser.ValueTypeVector || binOp.RHS.ReturnType() != parser.ValueTypeVector {
+		return false
+	}
+	rhMatchers := outputMatchers(binOp.RHS)
+	for name, lm := range outputMatchers(binOp.LHS) {
+		rm, ok := rhMatchers[name]
+		if ok && isMatchingLabel(binOp.VectorMatching, name) && matchersContradict(lm, rm) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmptyResult returns true if the expression is known to never return any series.
+func isEmptyResult(expr Node) bool {
+	switch e := expr.(type) {
+	case Noop:
+		return true
+	case *VectorSelector:
+		return matchersUnsatisfiable(e.LabelMatchers)
+	case *Parens:
+		return isEmptyResult(e.Expr)
+	case *StepInvariantExpr:
+		return isEmptyResult(e.Expr)
+	}
+	return false
+}
+
+// isEmptyArg returns true if the function argument is known to never return any series.
+func isEmptyArg(arg Node) bool {
+	switch e := arg.(type) {
+	case *MatrixSelector:
+		return isEmptyResult(e.VectorSelector)
+	case *Subquery:
+		return isEmptyResult(e.Expr)
+	}
+	return isEmptyResult(arg)
+}
+
+// cannotFail returns true if evaluating the expression can never return an error,
+// for example because of duplicate series after the metric name is dropped.
+func cannotFail(expr Node) bool {
+	switch e := expr.(type) {
+	case Noop, *VectorSelector, *MatrixSelector, *NumberLiteral, *StringLiteral:
+		return true
+	case *Parens:
+		return cannotFail(e.Expr)
+	case *StepInvariantExpr:
+		return cannotFail(e.Expr)
+	case *Subquery:
+		return cannotFail(e.Expr)
+	case *Aggregation:
+		if e.Op == parser.COUNT_VALUES {
+			return false
+		}
+		return cannotFail(e.Expr) && (e.Param == nil || cannotFail(e.Param))
+	}
+	return false
+}
+
+// preservesEmptyResult returns true if the function returns an empty result when
+// its vector or matrix argument is empty. Functions like absent or scalar return
+// a result which does not depend on input series, so they are never pruned.
+func preservesEmptyResult(call *FunctionCall) bool {
+	switch call.Func.Name {
+	case "label_replace", "label_join", "label_keep", "label_drop", "label_copy", "label_map", "histogram_quantile", "histogram_quantiles", "histogram_fraction", "to_nhcb", "to_classic", "sort", "sort_desc":
+		return true
+	}
+	_, ok := shardableFunctions[call.Func.Name]
+	return ok
+}
+
+// matchersUnsatisfiable returns true if no series can satisfy all matchers at once.
+// Only contradictions which can be proven without evaluating regular expressions
+// against arbitrary values are detected.
+func matchersUnsatisfiable(matchers []*labels.Matcher) bool {
+	for i, m := range matchers {
+		if matchesNothing(m) {
+			return true
+		}
+		for _, other := range matchers[i+1:] {
+			if m.Name == other.Name && matchersContradict(m, other) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchersContradict(a, b *labels.Matcher) bool {
+	if a.Type == labels.MatchEqual && !b.Matches(a.Value) {
+		return true
+	}
+	if b.Type == labels.MatchEqual && !a.Matches(b.Value) {
+		return true
+	}
+	// A matcher which only matches the empty value contradicts
+	// any matcher which does not match the empty value.
+	if matchesEmptyValue(a) && !b.Matches("") {
+		return true
+	}
+	if matchesEmptyValue(b) && !a.Matches("") {
+		return true
+	}
+	return false
+}
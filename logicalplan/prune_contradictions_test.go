@@ -0,0 +1,135 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestPruneContradictionsOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "equal matchers with different values",
+			expr:     `http_requests_total{job="a", job="b"}`,
+			expected: `noop`,
+		},
+		{
+			name:     "empty value with non-empty matcher",
+			expr:     `http_requests_total{job=~"", job!=""}`,
+			expected: `noop`,
+		},
+		{
+			name:     "equal matcher with non matching regex",
+			expr:     `http_requests_total{job="api", job=~"app.*"}`,
+			expected: `noop`,
+		},
+		{
+			name:     "satisfiable matchers",
+			expr:     `http_requests_total{job="api", job=~"a.*", pod!=""}`,
+			expected: `http_requests_total{job="api",job=~"a.*",pod!=""}`,
+		},
+		{
+			name:     "regex matchers are not evaluated against each other",
+			expr:     `http_requests_total{job=~"a.*", job=~"b.*"}`,
+			expected: `http_requests_total{job=~"a.*",job=~"b.*"}`,
+		},
+		{
+			name:     "info data label selector",
+			expr:     `info(http_requests_total, {data="a", data="b"})`,
+			expected: `info(http_requests_total, {data="a",data="b"})`,
+		},
+		{
+			name:     "sum of empty",
+			expr:     `sum by (pod) (rate(http_requests_total{job="a", job="b"}[5m]))`,
+			expected: `noop`,
+		},
+		{
+			name:     "and with empty side",
+			expr:     `http_requests_total and on(pod) errors_total{job="a", job="b"}`,
+			expected: `noop`,
+		},
+		{
+			name:     "or with empty side",
+			expr:     `sum(errors_total{job="a", job="b"}) or http_requests_total`,
+			expected: `http_requests_total`,
+		},
+		{
+			name:     "unless with empty right side",
+			expr:     `http_requests_total unless errors_total{job="a", job="b"}`,
+			expected: `http_requests_total`,
+		},
+		{
+			name:     "arithmetic with scalar",
+			expr:     `-http_requests_total{job="a", job="b"} * 2`,
+			expected: `noop`,
+		},
+		{
+			name:     "subquery",
+			expr:     `max_over_time(rate(http_requests_total{job="a", job="b"}[1m])[5m:1m])`,
+			expected: `noop`,
+		},
+		{
+			name:     "absent keeps its selector",
+			expr:     `absent(http_requests_total{job="a", job="b"})`,
+			expected: `absent(http_requests_total{job="a",job="b"})`,
+		},
+		{
+			name:     "absent_over_time keeps its selector",
+			expr:     `absent_over_time(http_requests_total{job="a", job="b"}[5m])`,
+			expected: `absent_over_time(http_requests_total{job="a",job="b"}[5m0s])`,
+		},
+		{
+			name:     "scalar of empty",
+			expr:     `http_requests_total * scalar(errors_total{job="a", job="b"})`,
+			expected: `http_requests_total * scalar(noop)`,
+		},
+		{
+			name:     "unless with contradicting sides",
+			expr:     `errors_total{job="a"} unless on(job) http_requests_total{job="b"}`,
+			expected: `errors_total{job="a"}`,
+		},
+		{
+			name:     "or with contradicting sides",
+			expr:     `errors_total{job="a"} or on(job) http_requests_total{job="b"}`,
+			expected: `errors_total{job="a"} or on (job) http_requests_total{job="b"}`,
+		},
+		{
+			name:     "and with contradicting sides",
+			expr:     `sum by (job) (errors_total{job="a"}) and on(job) http_requests_total{job="b"}`,
+			expected: `noop`,
+		},
+		{
+			name:     "contradiction after matcher propagation",
+			expr:     `errors_total{job="a"} * on(job) http_requests_total{job!="a", job=~".+"}`,
+			expected: `noop`,
+		},
+		{
+			name:     "arithmetic with contradicting sides",
+			expr:     `errors_total{job="a"} * on(job) http_requests_total{job="b"}`,
+			expected: `errors_total{job="a"} * on (job) http_requests_total{job="b"}`,
+		},
+	}
+
+	optimizers := []Optimizer{PropagateMatchersOptimizer{}, PruneContradictionsOptimizer{}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan, _ := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}, PlanOptions{})
+			optimizedPlan, _ := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, renderExprTree(optimizedPlan.Root()))
+		})
+	}
+}
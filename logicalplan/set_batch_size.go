@@ -20,9 +20,21 @@ type SelectorBatchSize struct {
 // If any aggregate is present in the plan, the batch size is set to the configured value.
 // The two exceptions where this cannot be done is if the aggregate is quantile, or
 // when a binary expression precedes the aggregate.
+// Batch sizes which were already set by a previous optimizer are kept.
 func (m SelectorBatchSize) Optimize(plan Node, _ *query.Options) (Node, annotations.Annotations) {
+	traverseBatchableSelectors(&plan, func(selector *VectorSelector) {
+		if selector.BatchSize == 0 {
+			selector.BatchSize = m.Size
+		}
+	})
+	return plan, nil
+}
+
+// traverseBatchableSelectors calls fn for each selector whose series
+// can be returned in batches to the aggregation consuming them.
+func traverseBatchableSelectors(plan *Node, fn func(selector *VectorSelector)) {
 	canBatch := false
-	Traverse(&plan, func(current *Node) {
+	Traverse(plan, func(current *Node) {
 		switch e := (*current).(type) {
 		case *FunctionCall:
 			//TODO: calls can reduce the labelset of the input; think histogram_quantile reducing
@@ -39,10 +51,9 @@ func (m SelectorBatchSize) Optimize(plan Node, _ *query.Options) (Node, annotati
 			canBatch = true
 		case *VectorSelector:
 			if canBatch {
-				e.BatchSize = m.Size
+				fn(e)
 			}
 			canBatch = false
 		}
 	})
-	return plan, nil
 }
@@ -0,0 +1,185 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// Sharded is a logical node which evaluates Expr once for each series hash shard
+// and merges the results of all shards. Each copy of Expr only selects series
+// whose stable label hash falls into its own shard.
+type Sharded struct {
+	Expr   Node `json:"-"`
+	Shards int
+}
+
+func (s *Sharded) Clone() Node {
+	clone := *s
+	clone.Expr = s.Expr.Clone()
+	return &clone
+}
+
+func (s *Sharded) Children() []*Node            { return []*Node{&s.Expr} }
+func (s *Sharded) String() string               { return s.Expr.String() }
+func (s *Sharded) ReturnType() parser.ValueType { return s.Expr.ReturnType() }
+func (s *Sharded) Type() NodeType               { return ShardedNode }
+
+// QueryShardingOptimizer splits aggregations over series-local expressions into
+// multiple shards which can be evaluated concurrently. For example, the expression:
+//
+//	sum by (job) (rate(http_requests_total[5m]))
+//
+// becomes:
+//
+//	sum by (job) (sharded(sum by (job) (rate(http_requests_total[5m]))))
+//
+// Each shard aggregates the series from its own hash range, and the outer
+// aggregation merges the partial results of all shards. Calls to
+// count_distinct_approx are split into count_distinct_sketch in each shard
+// and count_distinct_merge of the sketches from all shards.
+type QueryShardingOptimizer struct {
+	Shards int
+}
+
+func (m QueryShardingOptimizer) Optimize(plan Node, _ *query.Options) (Node, annotations.Annotations) {
+	if m.Shards <= 1 {
+		return plan, nil
+	}
+
+	TraverseBottomUp(nil, &plan, func(_, current *Node) bool {
+		switch e := (*current).(type) {
+		case *VectorSelector, *MatrixSelector, *NumberLiteral, *StringLiteral:
+			return false
+		case *Parens, *Unary, *StepInvariantExpr, *Subquery:
+			return false
+		case *FunctionCall:
+			// Sketches of distinct label values are computed in each shard and merged.
+			if e.Func.Name == "count_distinct_approx" {
+				sketch, merge := splitCountDistinct(e, countDistinctGrouping(e.Func.Name, e.Args))
+				*current = merge(&Sharded{Expr: sketch, Shards: m.Shards})
+				return true
+			}
+			// Functions without arguments, like hour(), produce a single
+			// series which would be duplicated in each shard.
+			_, ok := shardableFunctions[e.Func.Name]
+			return !ok || len(e.Args) == 0
+		case *Binary:
+			return !isBinaryExpressionWithOneScalarSide(e)
+		case *Aggregation:
+			if mergeOp, ok := shardableAggregations[e.Op]; ok {
+				*current = shardAggregation(e, mergeOp, m.Shards)
+			}
+			// Aggregations merge series from different shards so
+			// none of the parent expressions can be sharded.
+			return true
+		default:
+			return true
+		}
+	})
+	return plan, nil
+}
+
+func shardAggregation(aggr *Aggregation, mergeOp parser.ItemType, shards int) Node {
+	merged := &Aggregation{
+		Op:       mergeOp,
+		Grouping: shallowCloneSlice(aggr.Grouping),
+		Without:  aggr.Without,
+		Expr:     &Sharded{Expr: aggr, Shards: shards},
+	}
+	if aggr.Param != nil {
+		merged.Param = aggr.Param.Clone()
+	}
+	return merged
+}
+
+// shardableAggregations maps aggregations which can be computed from partial
+// aggregates to the operation used for merging those partial aggregates.
+var shardableAggregations = map[parser.ItemType]parser.ItemType{
+	parser.SUM:     parser.SUM,
+	parser.MIN:     parser.MIN,
+	parser.MAX:     parser.MAX,
+	parser.COUNT:   parser.SUM,
+	parser.GROUP:   parser.GROUP,
+	parser.TOPK:    parser.TOPK,
+	parser.BOTTOMK: parser.BOTTOMK,
+}
+
+// shardableFunctions are functions where each output series
+// depends on exactly one input series.
+var shardableFunctions = map[string]struct{}{
+	"abs":                    {},
+	"acos":                   {},
+	"acosh":                  {},
+	"asin":                   {},
+	"asinh":                  {},
+	"atan":                   {},
+	"atanh":                  {},
+	"avg_over_time":          {},
+	"ceil":                   {},
+	"changes":                {},
+	"clamp":                  {},
+	"clamp_max":              {},
+	"clamp_min":              {},
+	"cos":                    {},
+	"cosh":                   {},
+	"count_over_time":        {},
+	"day_of_month":           {},
+	"day_of_week":            {},
+	"day_of_year":            {},
+	"days_in_month":          {},
+	"deg":                    {},
+	"delta":                  {},
+	"deriv":                  {},
+	"ewma_over_time":         {},
+	"exp":                    {},
+	"fill_gaps":              {},
+	"floor":                  {},
+	"histogram_avg":          {},
+	"histogram_count":        {},
+	"histogram_stddev":       {},
+	"histogram_stdvar":       {},
+	"histogram_sum":          {},
+	"hour":                   {},
+	"idelta":                 {},
+	"increase":               {},
+	"intercept_over_time":    {},
+	"interpolate":            {},
+	"irate":                  {},
+	"kurtosis_over_time":     {},
+	"last_over_time":         {},
+	"ln":                     {},
+	"log10":                  {},
+	"log2":                   {},
+	"mad_over_time":          {},
+	"max_over_time":          {},
+	"min_over_time":          {},
+	"minute":                 {},
+	"month":                  {},
+	"percent_rank_over_time": {},
+	"present_over_time":      {},
+	"quantile_over_time":     {},
+	"r2_over_time":           {},
+	"rad":                    {},
+	"rate":                   {},
+	"resets":                 {},
+	"round":                  {},
+	"sgn":                    {},
+	"sin":                    {},
+	"sinh":                   {},
+	"skew_over_time":         {},
+	"slope_over_time":        {},
+	"sqrt":                   {},
+	"stddev_over_time":       {},
+	"stdvar_over_time":       {},
+	"sum_over_time":          {},
+	"tan":                    {},
+	"tanh":                   {},
+	"timestamp":              {},
+	"year":                   {},
+	"zscore_over_time":       {},
+}
@@ -0,0 +1,125 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/execution/parse"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestQueryShardingOptimizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "sum",
+			expr:     `sum(http_requests_total)`,
+			expected: `sum(sharded[3](sum(http_requests_total)))`,
+		},
+		{
+			name:     "sum by rate",
+			expr:     `sum by (job) (rate(http_requests_total[5m]))`,
+			expected: `sum by (job) (sharded[3](sum by (job) (rate(http_requests_total[5m0s]))))`,
+		},
+		{
+			name:     "count is merged with sum",
+			expr:     `count without (pod) (http_requests_total)`,
+			expected: `sum without (pod) (sharded[3](count without (pod) (http_requests_total)))`,
+		},
+		{
+			name:     "topk keeps its parameter",
+			expr:     `topk(5, http_requests_total)`,
+			expected: `topk(5, sharded[3](topk(5, http_requests_total)))`,
+		},
+		{
+			name:     "binary expression with scalar side",
+			expr:     `max(rate(http_requests_total[5m]) * 8)`,
+			expected: `max(sharded[3](max(rate(http_requests_total[5m0s]) * 8)))`,
+		},
+		{
+			name:     "only innermost aggregation is sharded",
+			expr:     `max(sum by (pod) (http_requests_total))`,
+			expected: `max(sum by (pod) (sharded[3](sum by (pod) (http_requests_total))))`,
+		},
+		{
+			name:     "both sides of a binary expression are sharded",
+			expr:     `sum(rate(errors_total[5m])) / sum(rate(http_requests_total[5m]))`,
+			expected: `sum(sharded[3](sum(rate(errors_total[5m0s])))) / sum(sharded[3](sum(rate(http_requests_total[5m0s]))))`,
+		},
+		{
+			name:     "histogram_quantile over sharded aggregation",
+			expr:     `histogram_quantile(0.9, sum by (le) (rate(http_request_duration_seconds_bucket[5m])))`,
+			expected: `histogram_quantile(0.9, sum by (le) (sharded[3](sum by (le) (rate(http_request_duration_seconds_bucket[5m0s])))))`,
+		},
+		{
+			name:     "non shardable aggregation",
+			expr:     `quantile(0.9, http_requests_total)`,
+			expected: `quantile(0.9, http_requests_total)`,
+		},
+		{
+			name:     "aggregation over vector matching",
+			expr:     `sum(errors_total / http_requests_total)`,
+			expected: `sum(errors_total / http_requests_total)`,
+		},
+		{
+			name:     "aggregation over function merging series",
+			expr:     `sum(histogram_quantile(0.9, http_request_duration_seconds_bucket))`,
+			expected: `sum(histogram_quantile(0.9, http_request_duration_seconds_bucket))`,
+		},
+		{
+			name:     "aggregation over function without series argument",
+			expr:     `sum(hour())`,
+			expected: `sum(hour())`,
+		},
+		{
+			name:     "count distinct merges sketches",
+			expr:     `count_distinct_approx("user_id", rate(http_requests_total[5m]), "job")`,
+			expected: `count_distinct_merge(sharded[3](count_distinct_sketch("user_id", rate(http_requests_total[5m0s]), "job")), "job")`,
+		},
+		{
+			name:     "aggregation over count distinct",
+			expr:     `sum(count_distinct_approx("user_id", http_requests_total, "job"))`,
+			expected: `sum(count_distinct_merge(sharded[3](count_distinct_sketch("user_id", http_requests_total, "job")), "job"))`,
+		},
+	}
+
+	functions := maps.Clone(parser.Functions)
+	maps.Copy(functions, parse.CountDistinctFunctions)
+
+	optimizers := []Optimizer{QueryShardingOptimizer{Shards: 3}}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.NewParser(tcase.expr, parser.WithFunctions(functions)).ParseExpr()
+			testutil.Ok(t, err)
+
+			plan, _ := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}, PlanOptions{})
+			optimizedPlan, _ := plan.Optimize(optimizers)
+			testutil.Equals(t, tcase.expected, renderExprTree(optimizedPlan.Root()))
+		})
+	}
+}
+
+func TestShardedMarshalJSON(t *testing.T) {
+	expr, err := parser.ParseExpr(`sum by (job) (rate(http_requests_total[5m]))`)
+	testutil.Ok(t, err)
+
+	plan, _ := NewFromAST(expr, &query.Options{}, PlanOptions{})
+	original, _ := plan.Optimize([]Optimizer{QueryShardingOptimizer{Shards: 4}})
+
+	bytes, err := Marshal(original.Root())
+	testutil.Ok(t, err)
+
+	clone, err := Unmarshal(bytes)
+	testutil.Ok(t, err)
+	testutil.Equals(t, renderExprTree(original.Root()), renderExprTree(clone))
+}
@@ -0,0 +1,438 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/schema"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// newIdentityOperationInfo is returned for identity operations which are not removed
+// because they change the result of their operand.
+func newIdentityOperationInfo(expr Node) error {
+	return fmt.Errorf("%w: identity operation is evaluated because it drops the metric name or histogram samples of its operand: %q", annotations.PromQLInfo, expr.String())
+}
+
+// simplifyExpressions folds constant expressions and removes operations which
+// do not change the result of the query. The tree is rewritten bottom up so that
+// each node is simplified after all of its children.
+//
+// Identity operations are only removed when doing so preserves the labels of the
+// result. Arithmetic operations drop the metric name, so "x * 1" is not the same
+// as "x" when x still carries its name. Similarly, adding a float to a native
+// histogram drops the sample, which is why "x + 0" is only removed for scalars.
+// An info annotation is returned for each identity operation which is kept.
+func simplifyExpressions(expr Node) (Node, annotations.Annotations) {
+	annos := annotations.New()
+	TraverseBottomUp(nil, &expr, func(_, current *Node) bool {
+		*current = simplify(*current, annos)
+		return false
+	})
+	return expr, *annos
+}
+
+func simplify(node Node, annos *annotations.Annotations) Node {
+	switch e := node.(type) {
+	case *Parens:
+		if isAtomicExpr(e.Expr) {
+			return e.Expr
+		}
+	case *StepInvariantExpr:
+		inner := unwrapStepInvariantExpr(e.Expr)
+		switch inner.(type) {
+		case *NumberLiteral, *StringLiteral:
+			return inner
+		}
+		return &StepInvariantExpr{Expr: inner}
+	case *Unary:
+		return simplifyUnary(e, annos)
+	case *Binary:
+		return simplifyBinary(e, annos)
+	case *FunctionCall:
+		return simplifyFunctionCall(e)
+	}
+	return node
+}
+
+func simplifyUnary(e *Unary, annos *annotations.Annotations) Node {
+	if e.Op == parser.ADD {
+		return e.Expr
+	}
+	if num, err := UnwrapFloat(e.Expr); err == nil {
+		return &NumberLiteral{Val: -num}
+	}
+	if num, ok := unwrapConstantVector(e.Expr); ok {
+		return newConstantVector(-num)
+	}
+	// Negation drops the metric name so removing a double negation
+	// is only safe when the operand has no metric name to begin with.
+	if inner, ok := unwrapParens(e.Expr).(*Unary); ok && inner.Op == parser.SUB {
+		if dropsMetricName(inner.Expr) {
+			return inner.Expr
+		}
+		annos.Add(newIdentityOperationInfo(e))
+	}
+	return e
+}
+
+func simplifyBinary(e *Binary, annos *annotations.Annotations) Node {
+	lnum, lerr := UnwrapFloat(e.LHS)
+	rnum, rerr := UnwrapFloat(e.RHS)
+	if lerr == nil && rerr == nil {
+		if val, ok := foldBinary(e.Op, lnum, rnum, e.ReturnBool); ok {
+			return &NumberLiteral{Val: val}
+		}
+		return e
+	}
+
+	lvec, lok := unwrapConstantVector(e.LHS)
+	rvec, rok := unwrapConstantVector(e.RHS)
+	switch {
+	case lok && rok:
+		if val, ok := foldBinary(e.Op, lvec, rvec, e.ReturnBool); ok {
+			return newConstantVector(val)
+		}
+	case lok && rerr == nil:
+		if val, ok := foldBinary(e.Op, lvec, rnum, e.ReturnBool); ok {
+			return newConstantVector(val)
+		}
+	case lerr == nil && rok:
+		if val, ok := foldBinary(e.Op, lnum, rvec, e.ReturnBool); ok {
+			return newConstantVector(val)
+		}
+	}
+
+	// The operand which is returned if the operation is an identity operation.
+	var operand Node
+	switch e.Op {
+	case parser.MUL:
+		if lerr == nil && lnum == 1 {
+			operand = e.RHS
+		} else if rerr == nil && rnum == 1 {
+			operand = e.LHS
+		}
+		if operand != nil && preservesLabelsInArithmetic(operand) {
+			return operand
+		}
+	case parser.DIV:
+		if rerr == nil && rnum == 1 {
+			operand = e.LHS
+		}
+		if operand != nil && preservesLabelsInArithmetic(operand) {
+			return operand
+		}
+	case parser.ADD:
+		if lerr == nil && lnum == 0 {
+			operand = e.RHS
+		} else if rerr == nil && rnum == 0 {
+			operand = e.LHS
+		}
+		if operand != nil && operand.ReturnType() == parser.ValueTypeScalar {
+			return operand
+		}
+	case parser.SUB:
+		if rerr == nil && rnum == 0 {
+			operand = e.LHS
+		}
+		if operand != nil && operand.ReturnType() == parser.ValueTypeScalar {
+			return operand
+		}
+	}
+	if operand != nil {
+		annos.Add(newIdentityOperationInfo(e))
+	}
+	return e
+}
+
+// foldBinary evaluates a binary operation between two constants. Comparisons
+// are only folded when they return a boolean since they would otherwise filter.
+func foldBinary(op parser.ItemType, lhs, rhs float64, returnBool bool) (float64, bool) {
+	switch op {
+	case parser.ADD:
+		return lhs + rhs, true
+	case parser.SUB:
+		return lhs - rhs, true
+	case parser.MUL:
+		return lhs * rhs, true
+	case parser.DIV:
+		return lhs / rhs, true
+	case parser.POW:
+		return math.Pow(lhs, rhs), true
+	case parser.MOD:
+		return math.Mod(lhs, rhs), true
+	case parser.ATAN2:
+		return math.Atan2(lhs, rhs), true
+	}
+	if !op.IsComparisonOperator() || !returnBool {
+		return 0, false
+	}
+	var result bool
+	switch op {
+	case parser.EQLC:
+		result = lhs == rhs
+	case parser.NEQ:
+		result = lhs != rhs
+	case parser.GTR:
+		result = lhs > rhs
+	case parser.LSS:
+		result = lhs < rhs
+	case parser.GTE:
+		result = lhs >= rhs
+	case parser.LTE:
+		result = lhs <= rhs
+	default:
+		return 0, false
+	}
+	if result {
+		return 1, true
+	}
+	return 0, true
+}
+
+func simplifyFunctionCall(e *FunctionCall) Node {
+	switch e.Func.Name {
+	case "scalar":
+		if num, ok := unwrapConstantVector(e.Args[0]); ok {
+			return &NumberLiteral{Val: num}
+		}
+		return e
+	case "round", "clamp", "clamp_min", "clamp_max":
+		num, ok := unwrapConstantVector(e.Args[0])
+		if !ok {
+			return e
+		}
+		args := make([]float64, 0, len(e.Args)-1)
+		for _, arg := range e.Args[1:] {
+			v, err := UnwrapFloat(arg)
+			if err != nil {
+				return e
+			}
+			args = append(args, v)
+		}
+		if val, ok := foldFunctionWithArgs(e.Func.Name, num, args); ok {
+			return newConstantVector(val)
+		}
+		return e
+	}
+
+	f, ok := foldableFunctions[e.Func.Name]
+	if !ok || len(e.Args) != 1 {
+		return e
+	}
+	num, ok := unwrapConstantVector(e.Args[0])
+	if !ok {
+		return e
+	}
+	return newConstantVector(f(num))
+}
+
+func foldFunctionWithArgs(name string, v float64, args []float64) (float64, bool) {
+	switch name {
+	case "round":
+		toNearest := 1.0
+		if len(args) > 0 {
+			toNearest = args[0]
+		}
+		toNearestInverse := 1.0 / toNearest
+		return math.Floor(v*toNearestInverse+0.5) / toNearestInverse, true
+	case "clamp":
+		// An empty vector is returned when max is smaller than min.
+		if args[1] < args[0] {
+			return 0, false
+		}
+		return math.Max(args[0], math.Min(args[1], v)), true
+	case "clamp_min":
+		return math.Max(args[0], v), true
+	case "clamp_max":
+		return math.Min(args[0], v), true
+	}
+	return 0, false
+}
+
+// foldableFunctions are single argument functions which can be evaluated
+// in the planner when their argument is a constant vector.
+var foldableFunctions = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"ceil":  math.Ceil,
+	"exp":   math.Exp,
+	"floor": math.Floor,
+	"sqrt":  math.Sqrt,
+	"ln":    math.Log,
+	"log2":  math.Log2,
+	"log10": math.Log10,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+	"asin":  math.Asin,
+	"acos":  math.Acos,
+	"atan":  math.Atan,
+	"sinh":  math.Sinh,
+	"cosh":  math.Cosh,
+	"tanh":  math.Tanh,
+	"asinh": math.Asinh,
+	"acosh": math.Acosh,
+	"atanh": math.Atanh,
+	"rad": func(v float64) float64 {
+		return v * math.Pi / 180
+	},
+	"deg": func(v float64) float64 {
+		return v * 180 / math.Pi
+	},
+	"sgn": func(v float64) float64 {
+		switch {
+		case math.IsNaN(v):
+			return math.NaN()
+		case v > 0:
+			return 1
+		case v < 0:
+			return -1
+		}
+		return 0
+	},
+}
+
+// unwrapConstantVector returns the value of an expression of the form vector(c).
+func unwrapConstantVector(expr Node) (float64, bool) {
+	call, ok := unwrapStepInvariantExpr(unwrapParens(expr)).(*FunctionCall)
+	if !ok || call.Func.Name != "vector" {
+		return 0, false
+	}
+	num, err := UnwrapFloat(call.Args[0])
+	if err != nil {
+		return 0, false
+	}
+	return num, true
+}
+
+func newConstantVector(val float64) Node {
+	return &FunctionCall{
+		Func: *parser.Functions["vector"],
+		Args: []Node{&NumberLiteral{Val: val}},
+	}
+}
+
+// isAtomicExpr returns true if the expression renders the same with or without
+// surrounding parentheses.
+func isAtomicExpr(expr Node) bool {
+	switch e := expr.(type) {
+	case *StepInvariantExpr:
+		return isAtomicExpr(e.Expr)
+	case *NumberLiteral:
+		// Negative numbers already render with parentheses.
+		return true
+	case *StringLiteral, *VectorSelector, *MatrixSelector, *FunctionCall, *Aggregation, *Parens:
+		return true
+	}
+	return false
+}
+
+// preservesLabelsInArithmetic returns true if using the expression as an operand
+// of an arithmetic operation does not change its labels.
+func preservesLabelsInArithmetic(expr Node) bool {
+	return expr.ReturnType() == parser.ValueTypeScalar || dropsMetricName(expr)
+}
+
+// dropsMetricName returns true if the expression is known to return series
+// without the metric name and other metadata labels.
+func dropsMetricName(expr Node) bool {
+	switch e := expr.(type) {
+	case *Parens:
+		return dropsMetricName(e.Expr)
+	case *StepInvariantExpr:
+		return dropsMetricName(e.Expr)
+	case *Unary:
+		if e.Op == parser.SUB {
+			return true
+		}
+		return dropsMetricName(e.Expr)
+	case *Aggregation:
+		switch e.Op {
+		case parser.TOPK, parser.BOTTOMK, parser.LIMITK, parser.LIMIT_RATIO:
+			return false
+		}
+		return e.Without || !slices.ContainsFunc(e.Grouping, schema.IsMetadataLabel)
+	case *Binary:
+		if e.VectorMatching != nil && slices.ContainsFunc(e.VectorMatching.Include, schema.IsMetadataLabel) {
+			return false
+		}
+		switch e.Op {
+		case parser.ADD, parser.SUB, parser.MUL, parser.DIV, parser.MOD, parser.POW, parser.ATAN2:
+			return true
+		}
+		return e.Op.IsComparisonOperator() && e.ReturnBool
+	case *FunctionCall:
+		if e.Func.Name == "vector" {
+			return true
+		}
+		_, ok := metricNameDroppingFunctions[e.Func.Name]
+		return ok
+	}
+	return false
+}
+
+// metricNameDroppingFunctions are functions which always
+// remove the metric name from their results.
+var metricNameDroppingFunctions = map[string]struct{}{
+	"abs":                    {},
+	"avg_over_time":          {},
+	"ceil":                   {},
+	"changes":                {},
+	"clamp":                  {},
+	"clamp_max":              {},
+	"clamp_min":              {},
+	"corr_over_time":         {},
+	"count_over_time":        {},
+	"covar_over_time":        {},
+	"delta":                  {},
+	"deriv":                  {},
+	"ewma_over_time":         {},
+	"exp":                    {},
+	"floor":                  {},
+	"histogram_avg":          {},
+	"histogram_count":        {},
+	"histogram_fraction":     {},
+	"histogram_quantile":     {},
+	"histogram_quantiles":    {},
+	"histogram_stddev":       {},
+	"histogram_stdvar":       {},
+	"histogram_sum":          {},
+	"idelta":                 {},
+	"increase":               {},
+	"intercept_over_time":    {},
+	"irate":                  {},
+	"kurtosis_over_time":     {},
+	"ln":                     {},
+	"log10":                  {},
+	"log2":                   {},
+	"max_over_time":          {},
+	"min_over_time":          {},
+	"percent_rank_over_time": {},
+	"predict_linear":         {},
+	"quantile_over_time":     {},
+	"r2_over_time":           {},
+	"rate":                   {},
+	"ratio_over_time":        {},
+	"resets":                 {},
+	"round":                  {},
+	"sgn":                    {},
+	"skew_over_time":         {},
+	"slope_over_time":        {},
+	"sqrt":                   {},
+	"stddev_over_time":       {},
+	"stdvar_over_time":       {},
+	"sum_over_time":          {},
+	"zscore_over_time":       {},
+}
+
+func unwrapParens(expr Node) Node {
+	if p, ok := expr.(*Parens); ok {
+		return unwrapParens(p.Expr)
+	}
+	return expr
+}
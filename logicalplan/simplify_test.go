@@ -0,0 +1,188 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+func TestSimplifyExpressions(t *testing.T) {
+	cases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "math function on constant vector",
+			expr:     `abs(vector(-2))`,
+			expected: `vector(2)`,
+		},
+		{
+			name:     "nested math functions on constant vector",
+			expr:     `ceil(sqrt(vector(10)))`,
+			expected: `vector(4)`,
+		},
+		{
+			name:     "round with argument",
+			expr:     `round(vector(12.34), 0.1)`,
+			expected: `vector(12.3)`,
+		},
+		{
+			name:     "clamp with max smaller than min is not folded",
+			expr:     `clamp(vector(5), 10, 1)`,
+			expected: `clamp(vector(5), 10, 1)`,
+		},
+		{
+			name:     "scalar of constant vector",
+			expr:     `X * scalar(vector(2))`,
+			expected: `X * 2`,
+		},
+		{
+			name:     "constant vector arithmetic",
+			expr:     `vector(1) + vector(2) * 3`,
+			expected: `vector(7)`,
+		},
+		{
+			name:     "constant vector bool comparison",
+			expr:     `vector(1) > bool 2`,
+			expected: `vector(0)`,
+		},
+		{
+			name:     "constant vector filtering comparison is kept",
+			expr:     `vector(1) > 2`,
+			expected: `vector(1) > 2`,
+		},
+		{
+			name:     "negated constant vector",
+			expr:     `-vector(3)`,
+			expected: `vector((-3))`,
+		},
+		{
+			name:     "multiplication by one without metric name",
+			expr:     `sum(X) * 1`,
+			expected: `sum(X)`,
+		},
+		{
+			name:     "multiplication by one on the left",
+			expr:     `1 * rate(X[5m])`,
+			expected: `rate(X[5m])`,
+		},
+		{
+			name:     "division by one",
+			expr:     `sum by (pod) (X) / (1)`,
+			expected: `sum by (pod) (X)`,
+		},
+		{
+			name:     "multiplication by one drops the metric name",
+			expr:     `X * 1`,
+			expected: `X * 1`,
+		},
+		{
+			name:     "multiplication by one with topk keeps the metric name",
+			expr:     `topk(1, X) * 1`,
+			expected: `topk(1, X) * 1`,
+		},
+		{
+			name:     "addition of zero to scalar",
+			expr:     `scalar(X) + 0`,
+			expected: `scalar(X)`,
+		},
+		{
+			name:     "addition of zero to vector is kept for histograms",
+			expr:     `sum(X) + 0`,
+			expected: `sum(X) + 0`,
+		},
+		{
+			name:     "double negation without metric name",
+			expr:     `-(-sum(X))`,
+			expected: `sum(X)`,
+		},
+		{
+			name:     "double negation drops the metric name",
+			expr:     `-(-X)`,
+			expected: `-(-X)`,
+		},
+		{
+			name:     "unary plus",
+			expr:     `+X`,
+			expected: `X`,
+		},
+		{
+			name:     "redundant parens",
+			expr:     `((rate(X[5m]))) + (sum(X))`,
+			expected: `rate(X[5m]) + sum(X)`,
+		},
+		{
+			name:     "parens needed for precedence",
+			expr:     `(X + Y) * Z`,
+			expected: `(X + Y) * Z`,
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan, _ := NewFromAST(expr, &query.Options{}, PlanOptions{})
+			testutil.Equals(t, tcase.expected, plan.Root().String())
+		})
+	}
+}
+
+func TestSimplifyCollapsesStepInvariantExpressions(t *testing.T) {
+	expr, _ := simplifyExpressions(&StepInvariantExpr{
+		Expr: &Parens{
+			Expr: &StepInvariantExpr{
+				Expr: &StepInvariantExpr{Expr: &VectorSelector{VectorSelector: &parser.VectorSelector{Name: "X"}}},
+			},
+		},
+	})
+	invariant, ok := expr.(*StepInvariantExpr)
+	testutil.Assert(t, ok)
+	_, ok = invariant.Expr.(*VectorSelector)
+	testutil.Assert(t, ok)
+}
+
+func TestSimplifyAnnotatesKeptIdentityOperations(t *testing.T) {
+	cases := []struct {
+		expr      string
+		annotated bool
+	}{
+		{expr: `X * 1`, annotated: true},
+		{expr: `1 * X`, annotated: true},
+		{expr: `X / 1`, annotated: true},
+		{expr: `X + 0`, annotated: true},
+		{expr: `X - 0`, annotated: true},
+		{expr: `-(-X)`, annotated: true},
+		{expr: `sum(X) * 1`},
+		{expr: `-(-sum(X))`},
+		{expr: `X * 2`},
+		{expr: `time() + 0`},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.expr, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan, err := NewFromAST(expr, &query.Options{}, PlanOptions{})
+			testutil.Ok(t, err)
+			_, annos := plan.Optimize(NoOptimizers)
+			if !tcase.annotated {
+				testutil.Equals(t, 0, len(annos))
+				return
+			}
+			testutil.Equals(t, 1, len(annos))
+			for _, err := range annos {
+				testutil.Assert(t, errors.Is(err, annotations.PromQLInfo))
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"time"
+
+	"github.com/thanos-io/promql-engine/execution/parse"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// atModifierUnsafeFunctions are functions of this engine which depend on the evaluation
+// time like the functions in promql.AtModifierUnsafeFunctions, and must not be evaluated
+// as step invariant expressions.
+var atModifierUnsafeFunctions = func() map[string]struct{} {
+	functions := make(map[string]struct{}, len(parse.TimeZoneFunctions))
+	for name := range parse.TimeZoneFunctions {
+		functions[name] = struct{}{}
+	}
+	return functions
+}()
+
+func isAtModifierUnsafeFunction(name string) bool {
+	if _, ok := promql.AtModifierUnsafeFunctions[name]; ok {
+		return true
+	}
+	_, ok := atModifierUnsafeFunctions[name]
+	return ok
+}
+
+// preprocessExpr wraps the step invariant parts of the expression like promql.PreprocessExpr,
+// which only knows about the functions of Prometheus. Expressions with functions of this engine
+// which depend on the evaluation time are wrapped again with these functions taken into account.
+func preprocessExpr(expr parser.Expr, start, end time.Time, step time.Duration) (parser.Expr, error) {
+	expr, err := promql.PreprocessExpr(expr, start, end, step)
+	if err != nil || !hasAtModifierUnsafeFunction(expr) {
+		return expr, err
+	}
+	expr = removeStepInvariantExprs(expr)
+	if _, shouldWrap := wrapStepInvariantExprs(expr); shouldWrap {
+		return &parser.StepInvariantExpr{Expr: expr}, nil
+	}
+	return expr, nil
+}
+
+func hasAtModifierUnsafeFunction(expr parser.Expr) bool {
+	var found bool
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if call, ok := node.(*parser.Call); ok {
+			if _, ok := atModifierUnsafeFunctions[call.Func.Name]; ok {
+				found = true
+			}
+		}
+		return nil
+	})
+	return found
+}
+
+func removeStepInvariantExprs(expr parser.Expr) parser.Expr {
+	switch e := expr.(type) {
+	case *parser.StepInvariantExpr:
+		return removeStepInvariantExprs(e.Expr)
+	case *parser.AggregateExpr:
+		e.Expr = removeStepInvariantExprs(e.Expr)
+		if e.Param != nil {
+			e.Param = removeStepInvariantExprs(e.Param)
+		}
+	case *parser.BinaryExpr:
+		e.LHS = removeStepInvariantExprs(e.LHS)
+		e.RHS = removeStepInvariantExprs(e.RHS)
+	case *parser.Call:
+		for i := range e.Args {
+			e.Args[i] = removeStepInvariantExprs(e.Args[i])
+		}
+	case *parser.SubqueryExpr:
+		e.Expr = removeStepInvariantExprs(e.Expr)
+	case *parser.ParenExpr:
+		e.Expr = removeStepInvariantExprs(e.Expr)
+	case *parser.UnaryExpr:
+		e.Expr = removeStepInvariantExprs(e.Expr)
+	}
+	return expr
+}
+
+// wrapStepInvariantExprs wraps the children of expr at the highest level within the tree which
+// is step invariant. It follows promql.PreprocessExpr, except that start() and end() are already
+// resolved and that functions of this engine which depend on the evaluation time are not step invariant.
+func wrapStepInvariantExprs(expr parser.Expr) (isStepInvariant, shouldWrap bool) {
+	switch e := expr.(type) {
+	case *parser.VectorSelector:
+		return e.Timestamp != nil, e.Timestamp != nil
+	case *parser.AggregateExpr:
+		return wrapStepInvariantExprs(e.Expr)
+	case *parser.BinaryExpr:
+		isInvariantLHS, shouldWrapLHS := wrapStepInvariantExprs(e.LHS)
+		isInvariantRHS, shouldWrapRHS := wrapStepInvariantExprs(e.RHS)
+		if isInvariantLHS && isInvariantRHS {
+			return true, true
+		}
+		if shouldWrapLHS {
+			e.LHS = &parser.StepInvariantExpr{Expr: e.LHS}
+		}
+		if shouldWrapRHS {
+			e.RHS = &parser.StepInvariantExpr{Expr: e.RHS}
+		}
+		return false, false
+	case *parser.Call:
+		isStepInvariant := !isAtModifierUnsafeFunction(e.Func.Name)
+		shouldWrap := make([]bool, len(e.Args))
+		for i := range e.Args {
+			var argIsStepInvariant bool
+			argIsStepInvariant, shouldWrap[i] = wrapStepInvariantExprs(e.Args[i])
+			isStepInvariant = isStepInvariant && argIsStepInvariant
+		}
+		if isStepInvariant {
+			return true, true
+		}
+		for i, wrap := range shouldWrap {
+			if wrap {
+				e.Args[i] = &parser.StepInvariantExpr{Expr: e.Args[i]}
+			}
+		}
+		return false, false
+	case *parser.MatrixSelector:
+		isStepInvariant, _ := wrapStepInvariantExprs(e.VectorSelector)
+		return isStepInvariant, false
+	case *parser.SubqueryExpr:
+		if isInvariant, _ := wrapStepInvariantExprs(e.Expr); isInvariant {
+			e.Expr = &parser.StepInvariantExpr{Expr: e.Expr}
+		}
+		return e.Timestamp != nil, e.Timestamp != nil
+	case *parser.ParenExpr:
+		return wrapStepInvariantExprs(e.Expr)
+	case *parser.UnaryExpr:
+		return wrapStepInvariantExprs(e.Expr)
+	}
+	// String and number literals.
+	return true, false
+}
@@ -0,0 +1,120 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"time"
+)
+
+// CalendarUnit is the unit of calendar time between two steps of a query with calendar steps.
+type CalendarUnit int
+
+const (
+	// Day steps are at the start of a day.
+	Day CalendarUnit = iota + 1
+	// Week steps are at the start of a Monday.
+	Week
+	// Month steps are at the start of the first day of a month.
+	Month
+)
+
+const day = 24 * time.Hour
+
+// CalendarStep evaluates a range query at calendar boundaries in the time zone of the query
+// instead of at a fixed step, for example at every local midnight or on the first of each month.
+// Unlike with a fixed step, the time between two steps follows daylight saving time changes
+// and the lengths of months. Steps start at the first boundary at or after the start of the query.
+type CalendarStep struct {
+	Unit CalendarUnit
+	// Count is the number of units between two steps. Zero is treated as one.
+	Count int
+}
+
+// Duration returns the nominal duration between two steps, which is used where a fixed
+// step is needed, like in hints for storage.
+func (c CalendarStep) Duration() time.Duration {
+	switch c.Unit {
+	case Week:
+		return time.Duration(c.count()) * 7 * day
+	case Month:
+		return time.Duration(c.count()) * 30 * day
+	default:
+		return time.Duration(c.count()) * day
+	}
+}
+
+func (c CalendarStep) count() int {
+	return max(c.Count, 1)
+}
+
+// first returns the first step at or after t.
+func (c CalendarStep) first(t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch c.Unit {
+	case Week:
+		d -= (int(t.Weekday()) + 6) % 7
+	case Month:
+		d = 1
+	}
+	if start := startOfDay(y, m, d, t.Location()); !start.Before(t) {
+		return start
+	}
+	return c.add(y, m, d, 1, t.Location())
+}
+
+// next returns the step after the step at t.
+func (c CalendarStep) next(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return c.add(y, m, d, c.count(), t.Location())
+}
+
+// add returns the start of the day which is n units after the day y-m-d.
+func (c CalendarStep) add(y int, m time.Month, d, n int, loc *time.Location) time.Time {
+	switch c.Unit {
+	case Week:
+		d += 7 * n
+	case Month:
+		m += time.Month(n)
+	default:
+		d += n
+	}
+	return startOfDay(y, m, d, loc)
+}
+
+// steps returns the number of steps from the step at start until end, including both.
+func (c CalendarStep) steps(start, end time.Time) int {
+	if end.Before(start) {
+		return 0
+	}
+	sy, sm, sd := start.Date()
+	ey, em, ed := end.Date()
+	var units int
+	switch c.Unit {
+	case Month:
+		units = (ey-sy)*12 + int(em-sm)
+	default:
+		// Days are counted at noon in UTC, which does not have daylight saving time.
+		days := int(time.Date(ey, em, ed, 12, 0, 0, 0, time.UTC).Sub(time.Date(sy, sm, sd, 12, 0, 0, 0, time.UTC)) / day)
+		if c.Unit == Week {
+			units = days / 7
+		} else {
+			units = days
+		}
+	}
+	return units/c.count() + 1
+}
+
+// startOfDay returns the first instant of the day y-m-d in loc. It is after midnight
+// if the day starts with a daylight saving time gap.
+func startOfDay(y int, m time.Month, d int, loc *time.Location) time.Time {
+	// Normalize the date first, so that it can be compared with the result.
+	y, m, d = time.Date(y, m, d, 12, 0, 0, 0, time.UTC).Date()
+	t := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	if _, _, td := t.Date(); td != d {
+		// Midnight does not exist and was resolved to the previous day, so the day
+		// starts when the zone which skips midnight starts.
+		_, t = t.ZoneBounds()
+	}
+	return t
+}
@@ -0,0 +1,144 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestCalendarStep(t *testing.T) {
+	mustLoad := func(name string) *time.Location {
+		loc, err := time.LoadLocation(name)
+		testutil.Ok(t, err)
+		return loc
+	}
+	var (
+		berlin   = mustLoad("Europe/Berlin")
+		saoPaulo = mustLoad("America/Sao_Paulo")
+	)
+
+	cases := []struct {
+		name     string
+		step     CalendarStep
+		loc      *time.Location
+		start    time.Time
+		end      time.Time
+		expected []time.Time
+	}{
+		{
+			name:  "days across the start of daylight saving time",
+			step:  CalendarStep{Unit: Day},
+			loc:   berlin,
+			start: time.Date(2024, 3, 30, 0, 0, 0, 0, berlin),
+			end:   time.Date(2024, 4, 1, 0, 0, 0, 0, berlin),
+			expected: []time.Time{
+				time.Date(2024, 3, 29, 23, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 30, 23, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 31, 22, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:  "days across the end of daylight saving time",
+			step:  CalendarStep{Unit: Day},
+			loc:   berlin,
+			start: time.Date(2024, 10, 26, 12, 0, 0, 0, berlin),
+			end:   time.Date(2024, 10, 28, 12, 0, 0, 0, berlin),
+			expected: []time.Time{
+				time.Date(2024, 10, 26, 22, 0, 0, 0, time.UTC),
+				time.Date(2024, 10, 27, 23, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:  "every second day",
+			step:  CalendarStep{Unit: Day, Count: 2},
+			loc:   time.UTC,
+			start: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC),
+			expected: []time.Time{
+				time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:  "weeks start on monday",
+			step:  CalendarStep{Unit: Week},
+			loc:   time.UTC,
+			start: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2024, 1, 22, 0, 0, 0, 0, time.UTC),
+			expected: []time.Time{
+				time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 1, 22, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:  "months",
+			step:  CalendarStep{Unit: Month},
+			loc:   berlin,
+			start: time.Date(2024, 1, 1, 0, 0, 0, 0, berlin),
+			end:   time.Date(2024, 4, 15, 0, 0, 0, 0, berlin),
+			expected: []time.Time{
+				time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC),
+				time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC),
+				time.Date(2024, 2, 29, 23, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 31, 22, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:  "quarters across a year",
+			step:  CalendarStep{Unit: Month, Count: 3},
+			loc:   time.UTC,
+			start: time.Date(2023, 9, 15, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			expected: []time.Time{
+				time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:  "day starting with a daylight saving time gap",
+			step:  CalendarStep{Unit: Day},
+			loc:   saoPaulo,
+			start: time.Date(2018, 11, 3, 0, 0, 0, 0, saoPaulo),
+			end:   time.Date(2018, 11, 5, 0, 0, 0, 0, saoPaulo),
+			expected: []time.Time{
+				time.Date(2018, 11, 3, 3, 0, 0, 0, time.UTC),
+				time.Date(2018, 11, 4, 3, 0, 0, 0, time.UTC),
+				time.Date(2018, 11, 5, 2, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := (&Options{Start: tc.start, End: tc.end, Step: time.Second, Location: tc.loc}).WithCalendarStep(tc.step)
+			testutil.Equals(t, len(tc.expected), opts.TotalSteps())
+
+			var steps []time.Time
+			for ts := opts.Start.UnixMilli(); ts <= opts.End.UnixMilli(); ts = opts.NextStep(ts) {
+				steps = append(steps, time.UnixMilli(ts).UTC())
+			}
+			testutil.Equals(t, tc.expected, steps)
+		})
+	}
+}
+
+func TestNestedOptionsForCalendarStep(t *testing.T) {
+	opts := (&Options{
+		Start: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC),
+		Step:  time.Second,
+	}).WithCalendarStep(CalendarStep{Unit: Day})
+	testutil.Equals(t, 24*time.Hour, opts.Step)
+	testutil.Equals(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), opts.Start)
+
+	nOpts := NestedOptionsForSubquery(opts, time.Hour, 2*time.Hour, 0)
+	testutil.Assert(t, nOpts.CalendarStep == nil)
+	testutil.Equals(t, time.Hour, nOpts.Step)
+	testutil.Equals(t, nOpts.Start.UnixMilli()+time.Hour.Milliseconds(), nOpts.NextStep(nOpts.Start.UnixMilli()))
+}
@@ -5,6 +5,8 @@ package query
 
 import (
 	"time"
+
+	"github.com/thanos-io/promql-engine/functions"
 )
 
 type Options struct {
@@ -19,6 +21,16 @@ type Options struct {
 	EnableAnalysis           bool
 	DecodingConcurrency      int
 	SampleTracker            SampleTracker // Tracks current samples in memory
+	Functions                *functions.Registry
+	ApproximateQuantiles     bool
+	Location                 *time.Location
+	CreatedTimestamps        bool
+	// EnableDelayedNameRemoval keeps the metric name of series until the end of the
+	// evaluation, so that it can still be used by functions and aggregations.
+	EnableDelayedNameRemoval bool
+	// CalendarStep evaluates the query at calendar boundaries in Location instead of at
+	// a fixed step if it is set. Step is then the nominal duration between two steps.
+	CalendarStep *CalendarStep
 }
 
 // TotalSteps returns the total number of steps in the query, regardless of batching.
@@ -28,9 +40,39 @@ func (o *Options) TotalSteps() int {
 	if o.Step.Milliseconds() == 0 {
 		return 1
 	}
+	if o.CalendarStep != nil {
+		loc := o.location()
+		return o.CalendarStep.steps(o.Start.In(loc), o.End.In(loc))
+	}
 	return int((o.End.UnixMilli()-o.Start.UnixMilli())/o.Step.Milliseconds() + 1)
 }
 
+// NextStep returns the timestamp of the step after the step at ts, both in milliseconds.
+func (o *Options) NextStep(ts int64) int64 {
+	if o.CalendarStep != nil {
+		return o.CalendarStep.next(time.UnixMilli(ts).In(o.location())).UnixMilli()
+	}
+	// Instant evaluation has a single step, which is followed by the next millisecond.
+	return ts + max(o.Step.Milliseconds(), 1)
+}
+
+// WithCalendarStep returns a copy of the options which evaluates the query at calendar
+// boundaries. The start of the query is moved to the first boundary at or after it.
+func (o *Options) WithCalendarStep(step CalendarStep) *Options {
+	result := *o
+	result.CalendarStep = &step
+	result.Step = step.Duration()
+	result.Start = step.first(o.Start.In(o.location()))
+	return &result
+}
+
+func (o *Options) location() *time.Location {
+	if o.Location == nil {
+		return time.UTC
+	}
+	return o.Location
+}
+
 func (o *Options) NumStepsPerBatch() int {
 	totalSteps := o.TotalSteps()
 	if o.StepsBatch < totalSteps {
@@ -49,6 +91,8 @@ func (o *Options) WithEndTime(end time.Time) *Options {
 	return &result
 }
 
+// NestedOptionsForSubquery returns the options for evaluating the inner expression of a subquery.
+// Subqueries are evaluated at a fixed step, also in queries with calendar steps.
 func NestedOptionsForSubquery(opts *Options, step, queryRange, offset time.Duration) *Options {
 	nOpts := &Options{
 		End:                      opts.End.Add(-offset),
@@ -59,6 +103,11 @@ func NestedOptionsForSubquery(opts *Options, step, queryRange, offset time.Durat
 		EnableAnalysis:           opts.EnableAnalysis,
 		DecodingConcurrency:      opts.DecodingConcurrency,
 		SampleTracker:            opts.SampleTracker,
+		Functions:                opts.Functions,
+		ApproximateQuantiles:     opts.ApproximateQuantiles,
+		Location:                 opts.Location,
+		CreatedTimestamps:        opts.CreatedTimestamps,
+		EnableDelayedNameRemoval: opts.EnableDelayedNameRemoval,
 	}
 	if nOpts.SampleTracker == nil {
 		nOpts.SampleTracker = NewSampleTracker(0)
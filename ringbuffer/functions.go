@@ -4,11 +4,16 @@
 package ringbuffer
 
 import (
+	"maps"
 	"math"
+	"slices"
 	"sort"
+	"strings"
 
 	"github.com/thanos-io/promql-engine/compute"
 	"github.com/thanos-io/promql-engine/execution/parse"
+	"github.com/thanos-io/promql-engine/functions"
+	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/warnings"
 
 	"github.com/efficientgo/core/errors"
@@ -17,19 +22,9 @@ import (
 
 type SamplesBuffer GenericRingBuffer
 
-type FunctionArgs struct {
-	Samples          []Sample
-	StepTime         int64
-	SelectRange      int64
-	Offset           int64
-	MetricAppearedTs int64
+type FunctionArgs = functions.RangeVectorArgs
 
-	// quantile_over_time and predict_linear use one, so we only use one here.
-	ScalarPoint  float64
-	ScalarPoint2 float64 // only for double_exponential_smoothing (trend factor)
-}
-
-type FunctionCall func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error)
+type FunctionCall = functions.RangeVectorFunc
 
 func instantValue(samples []Sample, isRate bool) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
 	var (
@@ -414,6 +409,17 @@ var rangeVectorFuncs = map[string]FunctionCall{
 		return v, nil, ok, warn, nil
 	},
 	"double_exponential_smoothing": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		if len(f.Samples) == 0 {
+			return 0, nil, false, 0, nil
+		}
+		// Factors are only validated for series with samples in the range, like in Prometheus.
+		if sf := f.ScalarPoint; sf <= 0 || sf >= 1 {
+			return 0, nil, false, 0, errors.Newf("invalid smoothing factor. Expected: 0 < sf < 1, got: %f", sf)
+		}
+		if tf := f.ScalarPoint2; tf <= 0 || tf >= 1 {
+			return 0, nil, false, 0, errors.Newf("invalid trend factor. Expected: 0 < tf < 1, got: %f", tf)
+		}
+
 		floats, numHistograms := filterFloatOnlySamples(f.Samples)
 		var warn warnings.Warnings
 		if numHistograms > 0 && len(floats) > 0 {
@@ -430,14 +436,189 @@ var rangeVectorFuncs = map[string]FunctionCall{
 		v, ok := doubleExponentialSmoothing(floats, sf, tf)
 		return v, nil, ok, warn, nil
 	},
+	"ewma_over_time": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		if len(f.Samples) == 0 {
+			return 0, nil, false, 0, nil
+		}
+		// The smoothing factor is only validated for series with samples in the range, like in double_exponential_smoothing.
+		if alpha := f.ScalarPoint; !ValidEWMAFactor(alpha) {
+			return 0, nil, false, 0, errors.Newf("invalid smoothing factor. Expected: 0 < alpha <= 1, got: %f", alpha)
+		}
+		v, ok, warn := accumulateFloats(f.Samples, compute.NewEWMAAcc(f.ScalarPoint))
+		return v, nil, ok, warn, nil
+	},
+	"zscore_over_time": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		if len(f.Samples) == 0 {
+			return 0, nil, false, 0, nil
+		}
+		v, ok, warn := accumulateFloats(f.Samples, compute.NewZScoreAcc())
+		return v, nil, ok, warn, nil
+	},
+	"skew_over_time": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		if len(f.Samples) == 0 {
+			return 0, nil, false, 0, nil
+		}
+		v, ok, warn := accumulateFloats(f.Samples, compute.NewSkewnessAcc())
+		return v, nil, ok, warn, nil
+	},
+	"kurtosis_over_time": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		if len(f.Samples) == 0 {
+			return 0, nil, false, 0, nil
+		}
+		v, ok, warn := accumulateFloats(f.Samples, compute.NewKurtosisAcc())
+		return v, nil, ok, warn, nil
+	},
+	"slope_over_time": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		floats, warn := floatSamples(f.Samples)
+		if len(floats) < 2 {
+			return 0, nil, false, warn, nil
+		}
+		slope, _ := linearRegression(floats, floats[0].T)
+		return slope, nil, true, warn, nil
+	},
+	"intercept_over_time": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		floats, warn := floatSamples(f.Samples)
+		if len(floats) < 2 {
+			return 0, nil, false, warn, nil
+		}
+		_, intercept := linearRegression(floats, f.StepTime)
+		return intercept, nil, true, warn, nil
+	},
+	"r2_over_time": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		floats, warn := floatSamples(f.Samples)
+		if len(floats) < 2 {
+			return 0, nil, false, warn, nil
+		}
+		return coefficientOfDetermination(floats), nil, true, warn, nil
+	},
+	"percent_rank_over_time": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		floats, warn := floatSamples(f.Samples)
+		if len(floats) == 0 {
+			return 0, nil, false, warn, nil
+		}
+		return percentRank(floats), nil, true, warn, nil
+	},
 }
 
-func NewRangeVectorFunc(name string) (FunctionCall, error) {
-	call, ok := rangeVectorFuncs[name]
-	if !ok {
-		return nil, parse.UnknownFunctionError(name)
+// NewRangeVectorFunc returns the built-in range vector function with the given name,
+// falling back to range vector functions in userFunctions.
+func NewRangeVectorFunc(name string, userFunctions *functions.Registry) (FunctionCall, error) {
+	if call, ok := rangeVectorFuncs[name]; ok {
+		return call, nil
+	}
+	if f, ok := userFunctions.Get(name); ok && f.RangeVector != nil {
+		return f.RangeVector, nil
 	}
-	return call, nil
+	return nil, parse.UnknownFunctionError(name)
+}
+
+// NewSeasonalRangeVectorFunc returns holt_winters_seasonal or predict_seasonal for the given call. Like in
+// double_exponential_smoothing, the smoothing and trend factors are evaluated at each step. The seasonal factor,
+// the season length and the number of forecast samples need to be number literals and are validated upfront.
+func NewSeasonalRangeVectorFunc(call *logicalplan.FunctionCall) (FunctionCall, error) {
+	args := make([]float64, 0, len(call.Args)-3)
+	for _, arg := range call.Args[3:] {
+		v, err := logicalplan.UnwrapFloat(arg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "seasonal factor, season length and forecast samples of %s must be number literals", call.Func.Name)
+		}
+		args = append(args, v)
+	}
+
+	seasonalFactor, seasonLength := args[0], args[1]
+	if seasonalFactor <= 0 || seasonalFactor >= 1 {
+		return nil, errors.Newf("invalid seasonal factor. Expected: 0 < sf < 1, got: %f", seasonalFactor)
+	}
+	// Bounding the integer arguments keeps their conversion to int well defined.
+	if seasonLength < 2 || seasonLength > math.MaxInt32 || seasonLength != math.Trunc(seasonLength) {
+		return nil, errors.Newf("invalid season length. Expected: an integer between 2 and %d, got: %f", math.MaxInt32, seasonLength)
+	}
+	var ahead float64
+	if len(args) > 2 {
+		ahead = args[2]
+		if ahead < 1 || ahead > math.MaxInt32 || ahead != math.Trunc(ahead) {
+			return nil, errors.Newf("invalid number of forecast samples. Expected: an integer between 1 and %d, got: %f", math.MaxInt32, ahead)
+		}
+	}
+
+	return func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		if len(f.Samples) == 0 {
+			return 0, nil, false, 0, nil
+		}
+		// Factors are only validated for series with samples in the range, like in double_exponential_smoothing.
+		if sf := f.ScalarPoint; sf <= 0 || sf >= 1 {
+			return 0, nil, false, 0, errors.Newf("invalid smoothing factor. Expected: 0 < sf < 1, got: %f", sf)
+		}
+		if tf := f.ScalarPoint2; tf <= 0 || tf >= 1 {
+			return 0, nil, false, 0, errors.Newf("invalid trend factor. Expected: 0 < tf < 1, got: %f", tf)
+		}
+
+		floats, numHistograms := filterFloatOnlySamples(f.Samples)
+		var warn warnings.Warnings
+		if numHistograms > 0 && len(floats) > 0 {
+			warn |= warnings.WarnHistogramIgnoredInMixedRange
+		}
+
+		v, ok := tripleExponentialSmoothing(floats, f.ScalarPoint, f.ScalarPoint2, seasonalFactor, int(seasonLength), int(ahead))
+		return v, nil, ok, warn, nil
+	}, nil
+}
+
+// anchoredRangeVectorFuncs are the range vector functions which can be used with anchored range selectors.
+// Their samples start with the last sample at or before the range start.
+var anchoredRangeVectorFuncs = map[string]FunctionCall{
+	"rate": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		return extendedRangeRate(f.Samples, true, true, false, f.StepTime, f.SelectRange, f.Offset)
+	},
+	"delta": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		return extendedRangeRate(f.Samples, false, false, false, f.StepTime, f.SelectRange, f.Offset)
+	},
+	"increase": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		return extendedRangeRate(f.Samples, true, false, false, f.StepTime, f.SelectRange, f.Offset)
+	},
+	"changes": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		if len(f.Samples) == 0 {
+			return 0., nil, false, 0, nil
+		}
+		first := lastSampleAtOrBefore(f.Samples, f.StepTime-(f.SelectRange+f.Offset))
+		return changes(f.Samples[first:]), nil, true, 0, nil
+	},
+	"resets": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		if len(f.Samples) == 0 {
+			return 0., nil, false, 0, nil
+		}
+		first := lastSampleAtOrBefore(f.Samples, f.StepTime-(f.SelectRange+f.Offset))
+		return resets(f.Samples[first:]), nil, true, 0, nil
+	},
+}
+
+// smoothedRangeVectorFuncs are the range vector functions which can be used with smoothed range selectors.
+// Their samples start with the last sample at or before the range start and end with the first sample
+// at or after the range end.
+var smoothedRangeVectorFuncs = map[string]FunctionCall{
+	"rate": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		return extendedRangeRate(f.Samples, true, true, true, f.StepTime, f.SelectRange, f.Offset)
+	},
+	"delta": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		return extendedRangeRate(f.Samples, false, false, true, f.StepTime, f.SelectRange, f.Offset)
+	},
+	"increase": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+		return extendedRangeRate(f.Samples, true, false, true, f.StepTime, f.SelectRange, f.Offset)
+	},
+}
+
+// NewExtendedRangeVectorFunc returns the range vector function with the given name for range selectors
+// with the anchored or the smoothed modifier. Like in Prometheus, only functions which handle samples
+// outside of the range boundaries can be used with these modifiers.
+func NewExtendedRangeVectorFunc(name string, smoothed bool) (FunctionCall, error) {
+	modifier, funcs := "anchored", anchoredRangeVectorFuncs
+	if smoothed {
+		modifier, funcs = "smoothed", smoothedRangeVectorFuncs
+	}
+	if call, ok := funcs[name]; ok {
+		return call, nil
+	}
+	return nil, errors.Newf("%s modifier can only be used with: %s - not with %s", modifier, strings.Join(slices.Sorted(maps.Keys(funcs)), ", "), name)
 }
 
 // extrapolatedRate is a utility function for rate/increase/delta.
@@ -639,6 +820,84 @@ func extendedRate(samples []Sample, isCounter, isRate bool, stepTime int64, sele
 	return resultValue, nil
 }
 
+// extendedRangeRate is a utility function for rate/increase/delta over anchored and smoothed range selectors.
+// Instead of extrapolating, it uses the last sample at or before the range start as the value at the start of
+// the range. For smoothed selectors, the values at both range boundaries are interpolated from the samples
+// around them. Counter resets are handled if isCounter is true, and the result is returned either per-second
+// (if isRate is true) or overall.
+func extendedRangeRate(samples []Sample, isCounter, isRate, smoothed bool, stepTime int64, selectRange int64, offset int64) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+	if len(samples) == 0 {
+		return 0, nil, false, 0, nil
+	}
+	var (
+		rangeStart = stepTime - (selectRange + offset)
+		rangeEnd   = stepTime - offset
+		first      = lastSampleAtOrBefore(samples, rangeStart)
+		last       = len(samples) - 1
+	)
+	if smoothed {
+		last = sort.Search(last, func(i int) bool { return samples[i].T >= rangeEnd })
+	}
+	if samples[last].T <= rangeStart {
+		return 0, nil, false, 0, nil
+	}
+
+	left := samples[first].V.F
+	if smoothed && samples[first].T < rangeStart {
+		left = interpolate(samples[first], samples[first+1], rangeStart, isCounter, true)
+	}
+	right := samples[last].V.F
+	if smoothed && last > 0 && samples[last].T > rangeEnd {
+		right = interpolate(samples[last-1], samples[last], rangeEnd, isCounter, false)
+	}
+	resultValue := right - left
+
+	if isCounter {
+		// Resets at the boundaries are already handled by the interpolation,
+		// so only samples within the range need to be corrected for.
+		if samples[first].T <= rangeStart {
+			first++
+		}
+		if samples[last].T >= rangeEnd {
+			last--
+		}
+		prev := left
+		for _, s := range samples[first : last+1] {
+			if s.V.F < prev {
+				resultValue += prev
+			}
+			prev = s.V.F
+		}
+		if right < prev {
+			resultValue += prev
+		}
+	}
+	if isRate {
+		resultValue /= float64(selectRange) / 1000
+	}
+	return resultValue, nil, true, 0, nil
+}
+
+// lastSampleAtOrBefore returns the index of the last sample at or before t, or 0 if there is no such sample.
+func lastSampleAtOrBefore(samples []Sample, t int64) int {
+	return max(0, sort.Search(len(samples)-1, func(i int) bool { return samples[i].T > t })-1)
+}
+
+// interpolate returns the linearly interpolated value at t between the samples s1 and s2.
+// If isCounter is true and the counter was reset between the samples, the value of s1 is
+// treated as zero on the left range boundary and added to s2 on the right range boundary.
+func interpolate(s1, s2 Sample, t int64, isCounter, leftEdge bool) float64 {
+	y1, y2 := s1.V.F, s2.V.F
+	if isCounter && y2 < y1 {
+		if leftEdge {
+			y1 = 0
+		} else {
+			y2 += y1
+		}
+	}
+	return y1 + (y2-y1)*float64(t-s1.T)/float64(s2.T-s1.T)
+}
+
 // histogramRate is a helper function for extrapolatedRate. It requires
 // points[0] to be a histogram. It returns nil if any other Point in points is
 // not a histogram.
@@ -1091,6 +1350,54 @@ func doubleExponentialSmoothing(points []Sample, sf, tf float64) (float64, bool)
 	return s1, true
 }
 
+// tripleExponentialSmoothing runs additive Holt-Winters smoothing over the points and returns the smoothed
+// value of the last point, or the value forecast for the given number of points after it. The trend and the
+// seasonal components are initialized from the complete seasons in the range, so at least two seasons are needed.
+func tripleExponentialSmoothing(points []Sample, sf, tf, gamma float64, seasonLength, ahead int) (float64, bool) {
+	numSeasons := len(points) / seasonLength
+	if numSeasons < 2 {
+		return 0, false
+	}
+
+	// The initial trend is the average change between the first two seasons.
+	var b float64
+	for i := range seasonLength {
+		b += points[i+seasonLength].V.F - points[i].V.F
+	}
+	b /= float64(seasonLength * seasonLength)
+
+	// The initial seasonal components are the average deviations from the
+	// mean of each season, after removing the trend within the season.
+	seasonals := make([]float64, seasonLength)
+	for j := range numSeasons {
+		season := points[j*seasonLength : (j+1)*seasonLength]
+		var mean float64
+		for _, p := range season {
+			mean += p.V.F
+		}
+		mean /= float64(seasonLength)
+		for i, p := range season {
+			seasonals[i] += p.V.F - mean - b*(float64(i)-float64(seasonLength-1)/2)
+		}
+	}
+	for i := range seasonals {
+		seasonals[i] /= float64(numSeasons)
+	}
+
+	s := points[0].V.F - seasonals[0]
+	for i := 1; i < len(points); i++ {
+		x := points[i].V.F
+		k := i % seasonLength
+		s0 := s
+		s = sf*(x-seasonals[k]) + (1-sf)*(s+b)
+		b = tf*(s-s0) + (1-tf)*b
+		seasonals[k] = gamma*(x-s) + (1-gamma)*seasonals[k]
+	}
+
+	last := len(points) - 1
+	return s + float64(ahead)*b + seasonals[(last%seasonLength+ahead%seasonLength)%seasonLength], true
+}
+
 // calcTrendValue calculates the trend value at the given index i.
 // This is somewhat analogous to the slope of the trend at the given index.
 // The argument "tf" is the trend factor.
@@ -1203,6 +1510,100 @@ func linearRegression(Samples []Sample, interceptTime int64) (slope, intercept f
 	return slope, intercept
 }
 
+// ValidEWMAFactor returns whether alpha is a valid smoothing factor for ewma_over_time.
+func ValidEWMAFactor(alpha float64) bool {
+	return alpha > 0 && alpha <= 1
+}
+
+// accumulateFloats adds the float samples in points to the accumulator and returns its value. Histograms are
+// ignored, with a warning if the range also contains floats, like in the streaming buffers for the same functions.
+func accumulateFloats(points []Sample, acc compute.Accumulator) (float64, bool, warnings.Warnings) {
+	var foundFloat, foundHist bool
+	for _, p := range points {
+		if p.V.H != nil {
+			foundHist = true
+			continue
+		}
+		foundFloat = true
+		_ = acc.Add(p.V.F, nil)
+	}
+	if !foundFloat {
+		return 0, false, 0
+	}
+	var warn warnings.Warnings
+	if foundHist {
+		warn = warnings.WarnHistogramIgnoredInMixedRange
+	}
+	v, _ := acc.Value()
+	return v, true, warn
+}
+
+// floatSamples returns a copy of the float samples in points, and a warning
+// if histograms were ignored in a range which also contains floats.
+func floatSamples(points []Sample) ([]Sample, warnings.Warnings) {
+	var (
+		floats = make([]Sample, 0, len(points))
+		hists  int
+	)
+	for _, p := range points {
+		if p.V.H != nil {
+			hists++
+			continue
+		}
+		floats = append(floats, p)
+	}
+	if hists > 0 && len(floats) > 0 {
+		return floats, warnings.WarnHistogramIgnoredInMixedRange
+	}
+	return floats, 0
+}
+
+// coefficientOfDetermination returns the R² of the simple linear regression of the float samples, which is the
+// fraction of their variance explained by the fitted line. It is 1 when the line fits the samples perfectly.
+func coefficientOfDetermination(points []Sample) float64 {
+	slope, intercept := linearRegression(points, points[0].T)
+
+	var mean, cMean float64
+	for _, p := range points {
+		mean, cMean = compute.KahanSumInc(p.V.F, mean, cMean)
+	}
+	mean = (mean + cMean) / float64(len(points))
+
+	var ssRes, cRes, ssTot, cTot float64
+	for _, p := range points {
+		x := float64(p.T-points[0].T) / 1e3
+		residual := p.V.F - (slope*x + intercept)
+		ssRes, cRes = compute.KahanSumInc(residual*residual, ssRes, cRes)
+		ssTot, cTot = compute.KahanSumInc((p.V.F-mean)*(p.V.F-mean), ssTot, cTot)
+	}
+	ssRes += cRes
+	ssTot += cTot
+	if ssRes == 0 {
+		return 1
+	}
+	return 1 - ssRes/ssTot
+}
+
+// percentRank returns the relative rank of the last float sample among all float samples, which is the
+// fraction of the other samples with a lower value. It is 0 for the lowest and 1 for the highest value.
+func percentRank(points []Sample) float64 {
+	last := points[len(points)-1].V.F
+	if math.IsNaN(last) {
+		return math.NaN()
+	}
+	if len(points) == 1 {
+		return 0
+	}
+
+	var lower int
+	for _, p := range points {
+		if p.V.F < last {
+			lower++
+		}
+	}
+	return float64(lower) / float64(len(points)-1)
+}
+
 func filterFloatOnlySamples(samples []Sample) ([]Sample, int) {
 	i := 0
 	histograms := 0
@@ -8,6 +8,7 @@ import (
 	"math"
 
 	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/functions"
 	"github.com/thanos-io/promql-engine/warnings"
 
 	"github.com/prometheus/prometheus/model/histogram"
@@ -26,15 +27,9 @@ type Buffer interface {
 
 func Empty(b Buffer) bool { return b.MaxT() == math.MinInt64 }
 
-type Value struct {
-	F float64
-	H *histogram.FloatHistogram
-}
+type Value = functions.Value
 
-type Sample struct {
-	T int64
-	V Value
-}
+type Sample = functions.Sample
 
 type GenericRingBuffer struct {
 	ctx   context.Context
@@ -32,6 +32,10 @@ func overlapSteps(opts query.Options, selectRange int64) int64 {
 }
 
 func UseStreamingRingBuffers(opts query.Options, selectRange int64) bool {
+	// Streaming buffers assume that steps are evenly spaced.
+	if opts.CalendarStep != nil {
+		return false
+	}
 	return overlapSteps(opts, selectRange) <= maxStreamingStepOverlap
 }
 
@@ -123,6 +127,23 @@ func NewLastOverTimeBuffer(opts query.Options, selectRange, offset int64) *OverT
 	return newOverTimeBuffer(opts, selectRange, offset, func() compute.Accumulator { return compute.NewLastAcc() })
 }
 
+func NewZScoreOverTimeBuffer(opts query.Options, selectRange, offset int64) *OverTimeBuffer {
+	return newOverTimeBuffer(opts, selectRange, offset, func() compute.Accumulator { return compute.NewZScoreAcc() })
+}
+
+func NewSkewOverTimeBuffer(opts query.Options, selectRange, offset int64) *OverTimeBuffer {
+	return newOverTimeBuffer(opts, selectRange, offset, func() compute.Accumulator { return compute.NewSkewnessAcc() })
+}
+
+func NewKurtosisOverTimeBuffer(opts query.Options, selectRange, offset int64) *OverTimeBuffer {
+	return newOverTimeBuffer(opts, selectRange, offset, func() compute.Accumulator { return compute.NewKurtosisAcc() })
+}
+
+// NewEWMAOverTimeBuffer returns a buffer for ewma_over_time with a constant smoothing factor.
+func NewEWMAOverTimeBuffer(opts query.Options, selectRange, offset int64, alpha float64) *OverTimeBuffer {
+	return newOverTimeBuffer(opts, selectRange, offset, func() compute.Accumulator { return compute.NewEWMAAcc(alpha) })
+}
+
 func (r *OverTimeBuffer) SampleCount() int {
 	return r.stepRanges[0].sampleCount
 }
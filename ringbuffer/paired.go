@@ -0,0 +1,143 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package ringbuffer
+
+import (
+	"context"
+	"math"
+
+	"github.com/thanos-io/promql-engine/compute"
+	"github.com/thanos-io/promql-engine/execution/parse"
+	"github.com/thanos-io/promql-engine/warnings"
+)
+
+// PairedFunctionCall computes the value of a range vector function of two series
+// from the float values of their aligned samples in the range.
+type PairedFunctionCall func(xs, ys []float64) (float64, bool)
+
+var pairedRangeVectorFuncs = map[string]PairedFunctionCall{
+	"corr_over_time": func(xs, ys []float64) (float64, bool) {
+		if len(xs) == 0 {
+			return 0, false
+		}
+		varX, varY, covar := pairedMoments(xs, ys)
+		return covar / math.Sqrt(varX*varY), true
+	},
+	"covar_over_time": func(xs, ys []float64) (float64, bool) {
+		if len(xs) == 0 {
+			return 0, false
+		}
+		_, _, covar := pairedMoments(xs, ys)
+		return covar, true
+	},
+	"ratio_over_time": func(xs, ys []float64) (float64, bool) {
+		if len(xs) == 0 {
+			return 0, false
+		}
+		var sumX, cX, sumY, cY float64
+		for i := range xs {
+			sumX, cX = compute.KahanSumInc(xs[i], sumX, cX)
+			sumY, cY = compute.KahanSumInc(ys[i], sumY, cY)
+		}
+		return (sumX + cX) / (sumY + cY), true
+	},
+}
+
+// NewPairedRangeVectorFunc returns the range vector function of two series with the given name.
+func NewPairedRangeVectorFunc(name string) (PairedFunctionCall, error) {
+	if call, ok := pairedRangeVectorFuncs[name]; ok {
+		return call, nil
+	}
+	return nil, parse.UnknownFunctionError(name)
+}
+
+// PairedRingBuffer holds the samples in the ranges of two matched series, and
+// evaluates a range vector function of both series over their aligned samples.
+type PairedRingBuffer struct {
+	left  *GenericRingBuffer
+	right *GenericRingBuffer
+	call  PairedFunctionCall
+
+	xs, ys []float64
+}
+
+func NewPaired(ctx context.Context, size int, leftRange, leftOffset, rightRange, rightOffset int64, call PairedFunctionCall) *PairedRingBuffer {
+	return &PairedRingBuffer{
+		left:  New(ctx, size, leftRange, leftOffset, nil),
+		right: New(ctx, size, rightRange, rightOffset, nil),
+		call:  call,
+	}
+}
+
+// Left returns the buffer for samples of the series in the first argument.
+func (r *PairedRingBuffer) Left() *GenericRingBuffer { return r.left }
+
+// Right returns the buffer for samples of the series in the second argument.
+func (r *PairedRingBuffer) Right() *GenericRingBuffer { return r.right }
+
+func (r *PairedRingBuffer) SampleCount() int {
+	return r.left.SampleCount() + r.right.SampleCount()
+}
+
+// Eval aligns the samples of both series and evaluates the function on them. Each float sample of the
+// first series is paired with the latest float sample of the second series at or before it, so samples
+// of the first series before the first sample of the second series are not used. Histograms are ignored.
+func (r *PairedRingBuffer) Eval() (float64, bool, warnings.Warnings) {
+	var (
+		right = r.right.items
+		// latest is the index of the latest float sample of the second series at or before the current sample.
+		latest, next = -1, 0
+		foundHist    bool
+	)
+	r.xs, r.ys = r.xs[:0], r.ys[:0]
+	for _, s := range r.left.items {
+		if s.V.H != nil {
+			foundHist = true
+			continue
+		}
+		for ; next < len(right) && right[next].T <= s.T; next++ {
+			if right[next].V.H != nil {
+				foundHist = true
+				continue
+			}
+			latest = next
+		}
+		if latest == -1 {
+			continue
+		}
+		r.xs = append(r.xs, s.V.F)
+		r.ys = append(r.ys, right[latest].V.F)
+	}
+	for _, s := range right[next:] {
+		foundHist = foundHist || s.V.H != nil
+	}
+
+	f, ok := r.call(r.xs, r.ys)
+	if !ok {
+		return 0, false, 0
+	}
+	var warn warnings.Warnings
+	if foundHist {
+		warn = warnings.WarnHistogramIgnoredInMixedRange
+	}
+	return f, true, warn
+}
+
+// pairedMoments returns the (population) variances and the covariance of xs and ys.
+// They are updated incrementally like the variance in stddev_over_time.
+func pairedMoments(xs, ys []float64) (varX, varY, covar float64) {
+	var meanX, meanY, m2X, m2Y, coMoment float64
+	for i := range xs {
+		n := float64(i + 1)
+		dx := xs[i] - meanX
+		meanX += dx / n
+		dy := ys[i] - meanY
+		meanY += dy / n
+		m2X += dx * (xs[i] - meanX)
+		m2Y += dy * (ys[i] - meanY)
+		coMoment += dx * (ys[i] - meanY)
+	}
+	n := float64(len(xs))
+	return m2X / n, m2Y / n, coMoment / n
+}
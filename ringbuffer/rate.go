@@ -17,7 +17,8 @@ import (
 
 // RateBuffer is a Buffer which can calculate rate, increase and delta for a
 // series in a streaming manner, calculating the value incrementally for each
-// step where the sample is used.
+// step where the sample is used. Zero samples at created timestamps of counters
+// are not injected by the buffer and have to be pushed like other samples.
 type RateBuffer struct {
 	ctx context.Context
 	// stepRanges contain the bounds and number of samples for each evaluation step.
@@ -0,0 +1,52 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package prometheus
+
+import (
+	"github.com/thanos-io/promql-engine/ringbuffer"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// CreatedTimestampIterator is a sample iterator which knows when the counter of each sample was created.
+// When created timestamps are enabled, rate, increase and delta inject a synthetic zero sample at the
+// created timestamp of a counter so that increases after the counter was created are not lost.
+type CreatedTimestampIterator interface {
+	chunkenc.Iterator
+	// AtCT returns the created timestamp of the current sample, or 0 if it is unknown.
+	AtCT() int64
+}
+
+// createdTimestampFunctions are functions which use created timestamps when they are enabled.
+var createdTimestampFunctions = map[string]struct{}{
+	"rate":     {},
+	"increase": {},
+	"delta":    {},
+}
+
+// histogramStatsCTIterator exposes the created timestamps of the iterator wrapped by a histogram stats iterator.
+type histogramStatsCTIterator struct {
+	chunkenc.Iterator
+	ct CreatedTimestampIterator
+}
+
+func (h histogramStatsCTIterator) AtCT() int64 {
+	return h.ct.AtCT()
+}
+
+// createdTimestampZero returns the synthetic zero sample which is injected at the created
+// timestamp of the given sample. Like in Prometheus, zero histograms have the schema and
+// custom bucket boundaries of the sample they are injected for.
+func createdTimestampZero(v ringbuffer.Value) ringbuffer.Value {
+	if v.H == nil {
+		return ringbuffer.Value{}
+	}
+	return ringbuffer.Value{H: &histogram.FloatHistogram{
+		CounterResetHint: histogram.CounterReset,
+		Schema:           v.H.Schema,
+		ZeroThreshold:    v.H.ZeroThreshold,
+		CustomValues:     v.H.CustomValues,
+	}}
+}
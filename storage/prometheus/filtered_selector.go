@@ -14,6 +14,12 @@ type filteredSelector struct {
 	selector *seriesSelector
 	filter   Filter
 
+	// shardIndex and shardCount restrict the selector to series whose
+	// stable label hash belongs to the given shard. Sharding is disabled
+	// when shardCount is 0.
+	shardIndex uint64
+	shardCount uint64
+
 	once   sync.Once
 	series []SignedSeries
 }
@@ -48,7 +54,7 @@ func (f *filteredSelector) loadSeries(ctx context.Context) error {
 	var i uint64
 	f.series = make([]SignedSeries, 0, len(series))
 	for _, s := range series {
-		if f.filter.Matches(s) {
+		if f.filter.Matches(s) && f.inShard(s) {
 			f.series = append(f.series, SignedSeries{
 				Series:    s.Series,
 				Signature: i,
@@ -59,3 +65,10 @@ func (f *filteredSelector) loadSeries(ctx context.Context) error {
 
 	return nil
 }
+
+func (f *filteredSelector) inShard(s SignedSeries) bool {
+	if f.shardCount == 0 {
+		return true
+	}
+	return labels.StableHash(s.Labels())%f.shardCount == f.shardIndex
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/thanos-io/promql-engine/execution/parse"
 	"github.com/thanos-io/promql-engine/execution/telemetry"
 	"github.com/thanos-io/promql-engine/extlabels"
+	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
 	"github.com/thanos-io/promql-engine/ringbuffer"
 	"github.com/thanos-io/promql-engine/warnings"
@@ -37,6 +38,13 @@ type matrixScanner struct {
 	iterator         chunkenc.Iterator
 	lastSample       ringbuffer.Sample
 	metricAppearedTs int64
+
+	// ctIterator is set when zero samples are injected at created timestamps.
+	ctIterator CreatedTimestampIterator
+	// lastSampleCT is the created timestamp of lastSample at which a zero sample still needs to be injected, or 0.
+	lastSampleCT int64
+	// prevT is the timestamp of the previous sample read from the iterator.
+	prevT int64
 }
 
 type matrixSelector struct {
@@ -45,9 +53,14 @@ type matrixSelector struct {
 	storage    SeriesSelector
 	scalarArg  float64
 	scalarArg2 float64
-	scanners   []matrixScanner
-	series     []labels.Labels
-	once       sync.Once
+	// param and param2 replace scalarArg and scalarArg2
+	// when the parameters change between steps.
+	param     *StepParameter
+	param2    *StepParameter
+	paramOnce sync.Once
+	scanners  []matrixScanner
+	series    []labels.Labels
+	once      sync.Once
 
 	functionName string
 	call         ringbuffer.FunctionCall
@@ -55,14 +68,15 @@ type matrixSelector struct {
 	opts         *query.Options
 
 	numSteps      int
-	mint          int64
 	maxt          int64
-	step          int64
 	selectRange   int64
 	offset        int64
 	isExtFunction bool
 
-	currentStep     int64
+	currentStep int64
+	// stepIndex is the index of the step at currentStep in the query, used to look up
+	// parameters which change from step to step.
+	stepIndex       int64
 	currentSeries   int64
 	seriesBatchSize int64
 
@@ -72,26 +86,56 @@ type matrixSelector struct {
 	// Lookback delta for extended range functions.
 	extLookbackDelta int64
 
+	// anchored and smoothed range selectors also select samples up to
+	// lookbackDelta before the range start, and smoothed selectors
+	// select samples up to lookbackDelta after the range end.
+	anchored      bool
+	smoothed      bool
+	lookbackDelta int64
+
+	// err is returned when the selector is executed. Like in Prometheus, functions
+	// which do not support the anchored or smoothed modifier fail at evaluation time.
+	err error
+
 	nonCounterMetric string
 	hasFloats        bool
 }
 
-var ErrNativeHistogramsNotSupported = errors.New("native histograms are not supported in extended range functions")
+var (
+	ErrNativeHistogramsNotSupported = errors.New("native histograms are not supported in extended range functions")
+
+	ErrNativeHistogramsNotSupportedWithModifiers = errors.New("smoothed and anchored modifiers do not work with native histograms")
+)
 
 const sampleLimitCheckInterval = 500
 
 // NewMatrixSelector creates operator which selects vector of series over time.
 func NewMatrixSelector(
 	selector SeriesSelector,
-	functionName string,
+	funcExpr *logicalplan.FunctionCall,
 	arg float64,
 	arg2 float64,
+	param, param2 *StepParameter,
 	opts *query.Options,
 	selectRange, offset time.Duration,
+	anchored, smoothed bool,
 	batchSize int64,
 	shard, numShard int,
 ) (model.VectorOperator, error) {
-	call, err := ringbuffer.NewRangeVectorFunc(functionName)
+	var (
+		functionName = funcExpr.Func.Name
+		call         ringbuffer.FunctionCall
+		evalErr      error
+		err          error
+	)
+	switch _, seasonal := parse.SeasonalFunctions[functionName]; {
+	case anchored || smoothed:
+		call, evalErr = ringbuffer.NewExtendedRangeVectorFunc(functionName, smoothed)
+	case seasonal:
+		call, err = ringbuffer.NewSeasonalRangeVectorFunc(funcExpr)
+	default:
+		call, err = ringbuffer.NewRangeVectorFunc(functionName, opts.Functions)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -101,13 +145,13 @@ func NewMatrixSelector(
 		functionName: functionName,
 		scalarArg:    arg,
 		scalarArg2:   arg2,
+		param:        param,
+		param2:       param2,
 		fhReader:     &histogram.FloatHistogram{},
 
 		opts:          opts,
 		numSteps:      opts.NumStepsPerBatch(),
-		mint:          opts.Start.UnixMilli(),
 		maxt:          opts.End.UnixMilli(),
-		step:          opts.Step.Milliseconds(),
 		isExtFunction: parse.IsExtFunction(functionName),
 
 		selectRange:     selectRange.Milliseconds(),
@@ -119,12 +163,12 @@ func NewMatrixSelector(
 		numShards: numShard,
 
 		extLookbackDelta: opts.ExtLookbackDelta.Milliseconds(),
-	}
 
-	// For instant queries, set the step to a positive value
-	// so that the operator can terminate.
-	if m.step == 0 {
-		m.step = 1
+		anchored:      anchored,
+		smoothed:      smoothed,
+		lookbackDelta: opts.LookbackDelta.Milliseconds(),
+
+		err: evalErr,
 	}
 
 	m.telemetry = telemetry.NewTelemetry(m, opts)
@@ -132,10 +176,19 @@ func NewMatrixSelector(
 }
 
 func (o *matrixSelector) Explain() []model.VectorOperator {
-	return nil
+	var params []model.VectorOperator
+	for _, p := range []*StepParameter{o.param, o.param2} {
+		if p != nil {
+			params = append(params, p.op)
+		}
+	}
+	return params
 }
 
 func (o *matrixSelector) Series(ctx context.Context) ([]labels.Labels, error) {
+	if o.err != nil {
+		return nil, o.err
+	}
 	if err := o.loadSeries(ctx); err != nil {
 		return nil, err
 	}
@@ -148,6 +201,9 @@ func (o *matrixSelector) Next(ctx context.Context, buf []model.StepVector) (int,
 		return 0, ctx.Err()
 	default:
 	}
+	if o.err != nil {
+		return 0, o.err
+	}
 
 	if o.currentStep > o.maxt {
 		if o.nonCounterMetric != "" && o.hasFloats {
@@ -159,6 +215,9 @@ func (o *matrixSelector) Next(ctx context.Context, buf []model.StepVector) (int,
 	if err := o.loadSeries(ctx); err != nil {
 		return 0, err
 	}
+	if err := o.loadParams(ctx); err != nil {
+		return 0, err
+	}
 
 	ts := o.currentStep
 	n := 0
@@ -175,33 +234,43 @@ func (o *matrixSelector) Next(ctx context.Context, buf []model.StepVector) (int,
 	for currStep := 0; currStep < maxSteps && ts <= o.maxt; currStep++ {
 		buf[n].Reset(ts)
 		n++
-		ts += o.step
+		ts = o.opts.NextStep(ts)
 	}
 
-	// Reset the current timestamp.
-	ts = o.currentStep
 	firstSeries := o.currentSeries
 	batchSamplesDelta := 0
 	for ; o.currentSeries-firstSeries < o.seriesBatchSize && o.currentSeries < int64(len(o.scanners)); o.currentSeries++ {
-		var (
-			scanner  = &o.scanners[o.currentSeries]
-			seriesTs = ts
-		)
+		scanner := &o.scanners[o.currentSeries]
 
 		sampleCountBefore := scanner.buffer.SampleCount()
 
-		for currStep := 0; currStep < n && seriesTs <= o.maxt; currStep++ {
+		for currStep := range n {
+			seriesTs := buf[currStep].T
 			maxt := seriesTs - o.offset
 			mint := maxt - o.selectRange
+			switch {
+			case o.anchored:
+				mint -= o.lookbackDelta
+			case o.smoothed:
+				mint -= o.lookbackDelta
+				maxt += o.lookbackDelta
+			}
 
-			if err := scanner.selectPoints(mint, maxt, seriesTs, o.fhReader, o.isExtFunction); err != nil {
+			if err := scanner.selectPoints(mint, maxt, seriesTs, o.fhReader, o.isExtFunction, o.anchored || o.smoothed); err != nil {
 				return 0, err
 			}
 			// TODO(saswatamcode): Handle multi-arg functions for matrixSelectors.
 			// Also, allow operator to exist independently without being nested
 			// under parser.Call by implementing new data model.
 			// https://github.com/thanos-io/promql-engine/issues/39
-			f, h, ok, warn, err := scanner.buffer.Eval(ctx, o.scalarArg, o.scalarArg2, scanner.metricAppearedTs)
+			scalarArg, scalarArg2 := o.scalarArg, o.scalarArg2
+			if o.param != nil {
+				scalarArg = o.param.at(o.stepIndex + int64(currStep))
+			}
+			if o.param2 != nil {
+				scalarArg2 = o.param2.at(o.stepIndex + int64(currStep))
+			}
+			f, h, ok, warn, err := scanner.buffer.Eval(ctx, scalarArg, scalarArg2, scanner.metricAppearedTs)
 			if err != nil {
 				return 0, err
 			}
@@ -220,7 +289,6 @@ func (o *matrixSelector) Next(ctx context.Context, buf []model.StepVector) (int,
 				}
 			}
 			o.telemetry.IncrementSamplesAtTimestamp(scanner.buffer.SampleCount(), seriesTs)
-			seriesTs += o.step
 		}
 
 		sampleCountAfter := scanner.buffer.SampleCount()
@@ -235,7 +303,8 @@ func (o *matrixSelector) Next(ctx context.Context, buf []model.StepVector) (int,
 	}
 
 	if o.currentSeries == int64(len(o.scanners)) {
-		o.currentStep += o.step * int64(n)
+		o.currentStep = ts
+		o.stepIndex += int64(n)
 		o.currentSeries = 0
 	}
 	return n, nil
@@ -268,7 +337,7 @@ func (o *matrixSelector) loadSeries(ctx context.Context) error {
 			origLbls := s.Labels()
 			lbls := origLbls
 			if o.functionName != "last_over_time" && o.functionName != "first_over_time" {
-				lbls = extlabels.DropReserved(lbls, b)
+				lbls = extlabels.DropMetricName(lbls, b, o.opts.EnableDelayedNameRemoval)
 			}
 			o.scanners[i] = matrixScanner{
 				labels:           lbls,
@@ -278,6 +347,10 @@ func (o *matrixSelector) loadSeries(ctx context.Context) error {
 				lastSample:       ringbuffer.Sample{T: math.MinInt64},
 				buffer:           o.newBuffer(ctx),
 				metricAppearedTs: math.MinInt64,
+				prevT:            math.MinInt64,
+			}
+			if _, ok := createdTimestampFunctions[o.functionName]; ok && o.opts.CreatedTimestamps {
+				o.scanners[i].ctIterator, _ = o.scanners[i].iterator.(CreatedTimestampIterator)
 			}
 			o.series[i] = lbls
 		}
@@ -303,6 +376,34 @@ func (o *matrixSelector) loadSeries(ctx context.Context) error {
 	return err
 }
 
+func (o *matrixSelector) loadParams(ctx context.Context) error {
+	var err error
+	o.paramOnce.Do(func() {
+		for _, p := range []*StepParameter{o.param, o.param2} {
+			if p == nil {
+				continue
+			}
+			if err = p.load(ctx); err != nil {
+				return
+			}
+		}
+		if o.param == nil || o.functionName != "quantile_over_time" {
+			return
+		}
+		for _, v := range o.param.values {
+			if math.IsNaN(v) || v < 0 || v > 1 {
+				warnings.AddToContext(annotations.NewInvalidQuantileWarning(v, posrange.PositionRange{}), ctx)
+			}
+		}
+	})
+	for _, p := range []*StepParameter{o.param, o.param2} {
+		if err == nil && p != nil {
+			err = p.err
+		}
+	}
+	return err
+}
+
 func (o *matrixSelector) shouldCheckSampleLimit(firstSeries int64) bool {
 	seriesProcessed := o.currentSeries + 1 - firstSeries
 
@@ -317,7 +418,7 @@ func (o *matrixSelector) shouldCheckSampleLimit(firstSeries int64) bool {
 }
 
 func (o *matrixSelector) newBuffer(ctx context.Context) ringbuffer.Buffer {
-	if ringbuffer.UseStreamingRingBuffers(*o.opts, o.selectRange) {
+	if !o.anchored && !o.smoothed && ringbuffer.UseStreamingRingBuffers(*o.opts, o.selectRange) {
 		switch o.functionName {
 		case "rate":
 			return ringbuffer.NewRateBuffer(ctx, *o.opts, true, true, o.selectRange, o.offset)
@@ -343,6 +444,17 @@ func (o *matrixSelector) newBuffer(ctx context.Context) ringbuffer.Buffer {
 			return ringbuffer.NewPresentOverTimeBuffer(*o.opts, o.selectRange, o.offset)
 		case "last_over_time":
 			return ringbuffer.NewLastOverTimeBuffer(*o.opts, o.selectRange, o.offset)
+		case "zscore_over_time":
+			return ringbuffer.NewZScoreOverTimeBuffer(*o.opts, o.selectRange, o.offset)
+		case "skew_over_time":
+			return ringbuffer.NewSkewOverTimeBuffer(*o.opts, o.selectRange, o.offset)
+		case "kurtosis_over_time":
+			return ringbuffer.NewKurtosisOverTimeBuffer(*o.opts, o.selectRange, o.offset)
+		case "ewma_over_time":
+			// Smoothing factors which change between steps or are invalid are handled by the generic buffer.
+			if o.param == nil && ringbuffer.ValidEWMAFactor(o.scalarArg) {
+				return ringbuffer.NewEWMAOverTimeBuffer(*o.opts, o.selectRange, o.offset, o.scalarArg)
+			}
 		}
 	}
 
@@ -374,9 +486,11 @@ func (m *matrixScanner) selectPoints(
 	mint, maxt, evalt int64,
 	fh *histogram.FloatHistogram,
 	isExtFunction bool,
+	isExtendedRange bool,
 ) error {
 	m.buffer.Reset(mint, evalt)
 	if m.lastSample.T > maxt {
+		m.lastSampleCT = m.injectCreatedTimestamp(m.lastSampleCT, mint, maxt, m.lastSample.V)
 		return nil
 	}
 
@@ -385,8 +499,12 @@ func (m *matrixScanner) selectPoints(
 	}
 	mint = max(mint, m.buffer.MaxT()+1)
 	if m.lastSample.T > mint {
+		if isExtendedRange && m.lastSample.V.H != nil {
+			return ErrNativeHistogramsNotSupportedWithModifiers
+		}
+		m.injectCreatedTimestamp(m.lastSampleCT, mint, maxt, m.lastSample.V)
 		m.buffer.Push(m.lastSample.T, m.lastSample.V)
-		m.lastSample.T = math.MinInt64
+		m.lastSample.T, m.lastSampleCT = math.MinInt64, 0
 		mint = max(mint, m.buffer.MaxT()+1)
 	}
 
@@ -399,7 +517,11 @@ func (m *matrixScanner) selectPoints(
 			}
 			var t int64
 			t, fh = m.iterator.AtFloatHistogram(fh)
-			if value.IsStaleNaN(fh.Sum) || t < mint {
+			if value.IsStaleNaN(fh.Sum) {
+				continue
+			}
+			ct := m.createdTimestamp(t)
+			if t < mint {
 				continue
 			}
 			if t > maxt {
@@ -409,9 +531,14 @@ func (m *matrixScanner) selectPoints(
 				} else {
 					fh.CopyTo(m.lastSample.V.H)
 				}
+				m.lastSampleCT = m.injectCreatedTimestamp(ct, mint, maxt, ringbuffer.Value{H: fh})
 				return nil
 			}
 			if t > mint {
+				if isExtendedRange {
+					return ErrNativeHistogramsNotSupportedWithModifiers
+				}
+				m.injectCreatedTimestamp(ct, mint, maxt, ringbuffer.Value{H: fh})
 				m.buffer.Push(t, ringbuffer.Value{H: fh})
 			}
 		case chunkenc.ValFloat:
@@ -422,8 +549,10 @@ func (m *matrixScanner) selectPoints(
 			if m.metricAppearedTs == math.MinInt64 {
 				m.metricAppearedTs = t
 			}
+			ct := m.createdTimestamp(t)
 			if t > maxt {
 				m.lastSample.T, m.lastSample.V.F, m.lastSample.V.H = t, v, nil
+				m.lastSampleCT = m.injectCreatedTimestamp(ct, mint, maxt, ringbuffer.Value{F: v})
 				return nil
 			}
 			if isExtFunction {
@@ -437,6 +566,7 @@ func (m *matrixScanner) selectPoints(
 				}
 			} else {
 				if t > mint {
+					m.injectCreatedTimestamp(ct, mint, maxt, ringbuffer.Value{F: v})
 					m.buffer.Push(t, ringbuffer.Value{F: v})
 				}
 			}
@@ -445,6 +575,34 @@ func (m *matrixScanner) selectPoints(
 	return m.iterator.Err()
 }
 
+// createdTimestamp returns the created timestamp of the current sample with timestamp t if the counter
+// was created after the previous sample, and 0 otherwise.
+func (m *matrixScanner) createdTimestamp(t int64) int64 {
+	prevT := m.prevT
+	m.prevT = t
+	if m.ctIterator == nil {
+		return 0
+	}
+	ct := m.ctIterator.AtCT()
+	if ct == 0 || ct <= prevT || ct >= t {
+		return 0
+	}
+	return ct
+}
+
+// injectCreatedTimestamp pushes a zero sample at the created timestamp if it is within the range (mint, maxt].
+// Created timestamps after the range are returned so that the zero sample can be injected in a later step.
+func (m *matrixScanner) injectCreatedTimestamp(ct, mint, maxt int64, v ringbuffer.Value) int64 {
+	switch {
+	case ct == 0:
+	case ct > maxt:
+		return ct
+	case ct > mint:
+		m.buffer.Push(ct, createdTimestampZero(v))
+	}
+	return 0
+}
+
 // emitRingbufferWarnings converts warnings.Warnings flags to proper annotations with metric names.
 func emitRingbufferWarnings(ctx context.Context, warn warnings.Warnings, metricName string) {
 	if warn&warnings.WarnNotCounter != 0 {
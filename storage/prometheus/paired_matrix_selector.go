@@ -0,0 +1,269 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/extlabels"
+	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/ringbuffer"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// pairedScanner selects the samples of two matched series into a paired ring buffer.
+type pairedScanner struct {
+	left   matrixScanner
+	right  matrixScanner
+	buffer *ringbuffer.PairedRingBuffer
+}
+
+// pairedMatrixSelector evaluates range vector functions of two series, such as corr_over_time(a[5m], b[5m]).
+// Series of both selectors are matched on all labels apart from the metric name, like in one-to-one vector
+// matching, and the samples of each matched pair are selected into a paired ring buffer. Series without a
+// match are dropped, and more than one series with the same labels in either selector result in an error.
+// Matching on a subset of the labels, like with on() or ignoring() in binary operations, is not supported.
+type pairedMatrixSelector struct {
+	telemetry telemetry.OperatorTelemetry
+
+	left        SeriesSelector
+	right       SeriesSelector
+	leftRange   int64
+	leftOffset  int64
+	rightRange  int64
+	rightOffset int64
+
+	functionName string
+	call         ringbuffer.PairedFunctionCall
+	fhReader     *histogram.FloatHistogram
+	opts         *query.Options
+
+	numSteps    int
+	maxt        int64
+	currentStep int64
+
+	once     sync.Once
+	series   []labels.Labels
+	scanners []pairedScanner
+}
+
+// NewPairedMatrixSelector creates an operator which evaluates the range vector function of two series with the given name.
+func NewPairedMatrixSelector(
+	left, right SeriesSelector,
+	functionName string,
+	opts *query.Options,
+	leftRange, leftOffset, rightRange, rightOffset time.Duration,
+) (model.VectorOperator, error) {
+	call, err := ringbuffer.NewPairedRangeVectorFunc(functionName)
+	if err != nil {
+		return nil, err
+	}
+	o := &pairedMatrixSelector{
+		left:        left,
+		right:       right,
+		leftRange:   leftRange.Milliseconds(),
+		leftOffset:  leftOffset.Milliseconds(),
+		rightRange:  rightRange.Milliseconds(),
+		rightOffset: rightOffset.Milliseconds(),
+
+		functionName: functionName,
+		call:         call,
+		fhReader:     &histogram.FloatHistogram{},
+		opts:         opts,
+
+		numSteps:    opts.NumStepsPerBatch(),
+		maxt:        opts.End.UnixMilli(),
+		currentStep: opts.Start.UnixMilli(),
+	}
+
+	o.telemetry = telemetry.NewTelemetry(o, opts)
+	return telemetry.NewOperator(o.telemetry, o), nil
+}
+
+func (o *pairedMatrixSelector) Explain() []model.VectorOperator {
+	return nil
+}
+
+func (o *pairedMatrixSelector) String() string {
+	return fmt.Sprintf(
+		"[pairedMatrixSelector] %v({%v}[%s], {%v}[%s])",
+		o.functionName,
+		o.left.Matchers(),
+		time.Duration(o.leftRange)*time.Millisecond,
+		o.right.Matchers(),
+		time.Duration(o.rightRange)*time.Millisecond,
+	)
+}
+
+func (o *pairedMatrixSelector) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *pairedMatrixSelector) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return 0, err
+	}
+	if o.currentStep > o.maxt {
+		return 0, nil
+	}
+
+	n := 0
+	nextStep := o.currentStep
+	for ; n < min(o.numSteps, len(buf)) && nextStep <= o.maxt; nextStep = o.opts.NextStep(nextStep) {
+		buf[n].Reset(nextStep)
+		n++
+	}
+
+	samplesDelta := 0
+	for i := range o.scanners {
+		scanner := &o.scanners[i]
+		sampleCountBefore := scanner.buffer.SampleCount()
+
+		for currStep := range n {
+			ts := buf[currStep].T
+			leftMaxt := ts - o.leftOffset
+			if err := scanner.left.selectPoints(leftMaxt-o.leftRange, leftMaxt, ts, o.fhReader, false, false); err != nil {
+				return 0, err
+			}
+			rightMaxt := ts - o.rightOffset
+			if err := scanner.right.selectPoints(rightMaxt-o.rightRange, rightMaxt, ts, o.fhReader, false, false); err != nil {
+				return 0, err
+			}
+
+			f, ok, warn := scanner.buffer.Eval()
+			if warn != 0 {
+				emitRingbufferWarnings(ctx, warn, scanner.left.metricName)
+			}
+			if ok {
+				buf[currStep].AppendSample(uint64(i), f)
+			}
+			o.telemetry.IncrementSamplesAtTimestamp(scanner.buffer.SampleCount(), ts)
+		}
+		samplesDelta += scanner.buffer.SampleCount() - sampleCountBefore
+	}
+	if samplesDelta > 0 {
+		o.opts.SampleTracker.Add(samplesDelta)
+		if err := o.opts.SampleTracker.CheckLimit(); err != nil {
+			return 0, err
+		}
+	} else if samplesDelta < 0 {
+		o.opts.SampleTracker.Remove(-samplesDelta)
+	}
+
+	o.currentStep = nextStep
+	return n, nil
+}
+
+func (o *pairedMatrixSelector) loadSeries(ctx context.Context) error {
+	leftSeries, err := o.left.GetSeries(ctx, 0, 1)
+	if err != nil {
+		return err
+	}
+	rightSeries, err := o.right.GetSeries(ctx, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	// Series are indexed by the hash of their labels without the reserved labels,
+	// and labels are compared on a hash hit to tell collisions from matches.
+	var (
+		b           labels.ScratchBuilder
+		rightLabels = make([]labels.Labels, len(rightSeries))
+		rightIndex  = make(map[uint64][]int, len(rightSeries))
+		leftLabels  = make([]labels.Labels, len(leftSeries))
+		leftIndex   = make(map[uint64][]int, len(leftSeries))
+	)
+	for i, s := range rightSeries {
+		rightLabels[i] = extlabels.DropReserved(s.Labels(), b)
+		h := rightLabels[i].Hash()
+		if j, ok := findSeries(rightIndex[h], rightLabels, rightLabels[i]); ok {
+			return o.duplicateSeriesError("second", rightSeries[j].Labels(), s.Labels())
+		}
+		rightIndex[h] = append(rightIndex[h], i)
+	}
+
+	o.series = make([]labels.Labels, 0, min(len(leftSeries), len(rightSeries)))
+	o.scanners = make([]pairedScanner, 0, min(len(leftSeries), len(rightSeries)))
+	for i, s := range leftSeries {
+		lbls := extlabels.DropReserved(s.Labels(), b)
+		h := lbls.Hash()
+		if j, ok := findSeries(leftIndex[h], leftLabels, lbls); ok {
+			return o.duplicateSeriesError("first", leftSeries[j].Labels(), s.Labels())
+		}
+		leftLabels[i] = lbls
+		leftIndex[h] = append(leftIndex[h], i)
+
+		j, ok := findSeries(rightIndex[h], rightLabels, lbls)
+		if !ok {
+			continue
+		}
+		buffer := ringbuffer.NewPaired(ctx, 8, o.leftRange, o.leftOffset, o.rightRange, o.rightOffset, o.call)
+		o.scanners = append(o.scanners, pairedScanner{
+			left:   newPairedMatrixScanner(s, buffer.Left()),
+			right:  newPairedMatrixScanner(rightSeries[j], buffer.Right()),
+			buffer: buffer,
+		})
+		if o.opts.EnableDelayedNameRemoval {
+			lbls = extlabels.DropMetricName(s.Labels(), b, true)
+		}
+		o.series = append(o.series, lbls)
+	}
+	return nil
+}
+
+// findSeries returns the index of the series with the given labels among the candidates.
+func findSeries(candidates []int, series []labels.Labels, lbls labels.Labels) (int, bool) {
+	for _, i := range candidates {
+		if labels.Equal(series[i], lbls) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (o *pairedMatrixSelector) duplicateSeriesError(argument string, first, second labels.Labels) error {
+	if labels.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	return errors.Newf(
+		"found duplicate series for the match group in the %s argument of %s: %s and %s; series of each argument must have unique labels apart from the metric name",
+		argument, o.functionName, first, second,
+	)
+}
+
+func newPairedMatrixScanner(s SignedSeries, buffer ringbuffer.Buffer) matrixScanner {
+	lbls := s.Labels()
+	return matrixScanner{
+		labels:           lbls,
+		metricName:       lbls.Get(labels.MetricName),
+		signature:        s.Signature,
+		iterator:         s.Iterator(nil),
+		lastSample:       ringbuffer.Sample{T: math.MinInt64},
+		buffer:           buffer,
+		metricAppearedTs: math.MinInt64,
+		prevT:            math.MinInt64,
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestFindSeriesComparesLabels(t *testing.T) {
+	series := []labels.Labels{
+		labels.FromStrings("pod", "a"),
+		labels.FromStrings("pod", "b"),
+	}
+
+	// Candidates share the hash of the labels, so a colliding series must not be matched.
+	_, ok := findSeries([]int{0}, series, labels.FromStrings("pod", "b"))
+	testutil.Assert(t, !ok)
+
+	i, ok := findSeries([]int{0, 1}, series, labels.FromStrings("pod", "b"))
+	testutil.Assert(t, ok)
+	testutil.Equals(t, 1, i)
+
+	_, ok = findSeries(nil, series, labels.FromStrings("pod", "a"))
+	testutil.Assert(t, !ok)
+}
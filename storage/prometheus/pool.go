@@ -36,12 +36,23 @@ func (p *SelectorPool) GetSelector(mint, maxt, step int64, matchers []*labels.Ma
 }
 
 func (p *SelectorPool) GetFilteredSelector(mint, maxt, step int64, matchers, filters []*labels.Matcher, hints storage.SelectHints) SeriesSelector {
+	// Hash shards are resolved in the engine instead of in storage since
+	// not every querier supports sharding. This also allows all shards
+	// of a selector to share the same underlying series.
+	shardIndex, shardCount := hints.ShardIndex, hints.ShardCount
+	hints.ShardIndex, hints.ShardCount = 0, 0
+
 	key := hashMatchers(matchers, mint, maxt, hints)
 	if _, ok := p.selectors[key]; !ok {
 		p.selectors[key] = newSeriesSelector(p.querier, matchers, hints)
 	}
 
-	return NewFilteredSelector(p.selectors[key], NewFilter(filters))
+	return &filteredSelector{
+		selector:   p.selectors[key],
+		filter:     NewFilter(filters),
+		shardIndex: shardIndex,
+		shardCount: shardCount,
+	}
 }
 
 func hashMatchers(matchers []*labels.Matcher, mint, maxt int64, hints storage.SelectHints) uint64 {
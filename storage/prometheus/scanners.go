@@ -6,16 +6,20 @@ package prometheus
 import (
 	"context"
 	"math"
+	"time"
 
 	"github.com/thanos-io/promql-engine/execution/exchange"
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/execution/parse"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/ringbuffer"
+	engstorage "github.com/thanos-io/promql-engine/storage"
 	"github.com/thanos-io/promql-engine/warnings"
 
 	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/promql/parser/posrange"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
@@ -28,6 +32,8 @@ type Scanners struct {
 	querier storage.Querier
 }
 
+var _ engstorage.ParamScanners = &Scanners{}
+
 func (s *Scanners) Close() error {
 	return s.querier.Close()
 }
@@ -64,22 +70,28 @@ func (p Scanners) NewVectorSelector(
 		selector = newHistogramStatsSelector(selector)
 	}
 
-	operators := make([]model.VectorOperator, 0, opts.DecodingConcurrency)
-	for i := range opts.DecodingConcurrency {
-		operator := exchange.NewConcurrent(
-			NewVectorSelector(
+	concurrency := decodingConcurrency(opts, logicalNode)
+	operators := make([]model.VectorOperator, 0, concurrency)
+	for i := range concurrency {
+		var operator model.VectorOperator
+		// Like in Prometheus, timestamp() returns the timestamps of the samples for smoothed selectors.
+		if logicalNode.Smoothed && !logicalNode.SelectTimestamp {
+			operator = NewSmoothedVectorSelector(selector, opts, logicalNode.Offset, logicalNode.BatchSize, i, concurrency)
+		} else {
+			operator = NewVectorSelector(
 				selector,
 				opts,
 				logicalNode.Offset,
 				logicalNode.BatchSize,
 				logicalNode.SelectTimestamp,
 				i,
-				opts.DecodingConcurrency,
-			), 2, opts)
-		operators = append(operators, operator)
+				concurrency,
+			)
+		}
+		operators = append(operators, exchange.NewConcurrent(operator, 2, opts))
 	}
 
-	return exchange.NewCoalesce(opts, logicalNode.BatchSize*int64(opts.DecodingConcurrency), operators...), nil
+	return exchange.NewCoalesce(opts, logicalNode.BatchSize*int64(concurrency), operators...), nil
 }
 
 func (p Scanners) NewMatrixSelector(
@@ -89,40 +101,94 @@ func (p Scanners) NewMatrixSelector(
 	logicalNode logicalplan.MatrixSelector,
 	call logicalplan.FunctionCall,
 ) (model.VectorOperator, error) {
+	return p.NewMatrixSelectorWithParams(ctx, opts, hints, logicalNode, call, nil)
+}
+
+func (p Scanners) NewMatrixSelectorWithParams(
+	ctx context.Context,
+	opts *query.Options,
+	hints storage.SelectHints,
+	logicalNode logicalplan.MatrixSelector,
+	call logicalplan.FunctionCall,
+	params []model.VectorOperator,
+) (model.VectorOperator, error) {
+	if _, ok := parse.PairedRangeFunctions[call.Func.Name]; ok {
+		return p.newPairedMatrixSelector(opts, hints, call)
+	}
+
 	arg := 0.0
 	arg2 := 0.0
+	var param, param2 *StepParameter
 	switch call.Func.Name {
 	case "quantile_over_time":
 		unwrap, err := logicalplan.UnwrapFloat(call.Args[0])
 		if err != nil {
-			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "quantile_over_time with expression as first argument is not supported")
+			if len(params) == 0 || params[0] == nil {
+				return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "quantile_over_time with expression as first argument is not supported")
+			}
+			param = NewStepParameter(params[0], opts)
+			break
 		}
 		arg = unwrap
 		if math.IsNaN(unwrap) || unwrap < 0 || unwrap > 1 {
 			warnings.AddToContext(annotations.NewInvalidQuantileWarning(unwrap, posrange.PositionRange{}), ctx)
 		}
-	case "predict_linear":
+	case "predict_linear", "ewma_over_time":
 		unwrap, err := logicalplan.UnwrapFloat(call.Args[1])
 		if err != nil {
-			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "predict_linear with expression as second argument is not supported")
+			if len(params) < 2 || params[1] == nil {
+				return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "%s with expression as second argument is not supported", call.Func.Name)
+			}
+			param = NewStepParameter(params[1], opts)
+			break
 		}
 		arg = unwrap
-	case "double_exponential_smoothing":
+	case "double_exponential_smoothing", "holt_winters_seasonal", "predict_seasonal":
 		sf, err := logicalplan.UnwrapFloat(call.Args[1])
 		if err != nil {
-			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "double_exponential_smoothing with expression as second argument is not supported")
+			if len(params) < 3 || params[1] == nil {
+				return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "%s with expression as second argument is not supported", call.Func.Name)
+			}
+			param = NewStepParameter(params[1], opts)
 		}
-
 		tf, err := logicalplan.UnwrapFloat(call.Args[2])
 		if err != nil {
-			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "double_exponential_smoothing with expression as third argument is not supported")
-		}
-
-		if sf <= 0 || sf >= 1 || tf <= 0 || tf >= 1 {
-			return nil, nil
+			if len(params) < 3 || params[2] == nil {
+				return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "%s with expression as third argument is not supported", call.Func.Name)
+			}
+			param2 = NewStepParameter(params[2], opts)
 		}
 		arg = sf
 		arg2 = tf
+	default:
+		if _, ok := opts.Functions.Get(call.Func.Name); !ok {
+			break
+		}
+		// User defined functions receive their scalar arguments in order.
+		var (
+			args       [2]float64
+			stepParams [2]*StepParameter
+			n          int
+		)
+		for i, a := range call.Args {
+			if a.ReturnType() != parser.ValueTypeScalar {
+				continue
+			}
+			if n == len(args) {
+				return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "%s with more than %d scalar arguments is not supported", call.Func.Name, len(args))
+			}
+			if unwrap, err := logicalplan.UnwrapFloat(a); err == nil {
+				args[n] = unwrap
+			} else {
+				if len(params) <= i || params[i] == nil {
+					return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "%s with expression as argument is not supported", call.Func.Name)
+				}
+				stepParams[n] = NewStepParameter(params[i], opts)
+			}
+			n++
+		}
+		arg, arg2 = args[0], args[1]
+		param, param2 = stepParams[0], stepParams[1]
 	}
 
 	vs := logicalNode.VectorSelector
@@ -136,19 +202,24 @@ func (p Scanners) NewMatrixSelector(
 		selector = newHistogramStatsSelector(selector)
 	}
 
-	operators := make([]model.VectorOperator, 0, opts.DecodingConcurrency)
-	for i := range opts.DecodingConcurrency {
+	concurrency := decodingConcurrency(opts, *vs)
+	operators := make([]model.VectorOperator, 0, concurrency)
+	for i := range concurrency {
 		operator, err := NewMatrixSelector(
 			selector,
-			call.Func.Name,
+			&call,
 			arg,
 			arg2,
+			param,
+			param2,
 			opts,
 			logicalNode.Range,
 			vs.Offset,
+			logicalNode.Anchored,
+			logicalNode.Smoothed,
 			vs.BatchSize,
 			i,
-			opts.DecodingConcurrency,
+			concurrency,
 		)
 		if err != nil {
 			return nil, err
@@ -156,7 +227,48 @@ func (p Scanners) NewMatrixSelector(
 		operators = append(operators, exchange.NewConcurrent(operator, 2, opts))
 	}
 
-	return exchange.NewCoalesce(opts, vs.BatchSize*int64(opts.DecodingConcurrency), operators...), nil
+	return exchange.NewCoalesce(opts, vs.BatchSize*int64(concurrency), operators...), nil
+}
+
+// newPairedMatrixSelector creates an operator for range vector functions of two series, whose arguments are both matrix selectors.
+// All series of both selectors need to be matched before samples can be selected, so they are not decoded concurrently.
+func (p Scanners) newPairedMatrixSelector(opts *query.Options, hints storage.SelectHints, call logicalplan.FunctionCall) (model.VectorOperator, error) {
+	var (
+		selectors [2]SeriesSelector
+		ranges    [2]time.Duration
+		offsets   [2]time.Duration
+	)
+	for i, arg := range call.Args {
+		ms, ok := arg.(*logicalplan.MatrixSelector)
+		if !ok {
+			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "%s is only supported with matrix selectors as arguments", call.Func.Name)
+		}
+		if ms.Anchored || ms.Smoothed {
+			_, err := ringbuffer.NewExtendedRangeVectorFunc(call.Func.Name, ms.Smoothed)
+			return nil, err
+		}
+
+		vs := ms.VectorSelector
+		selectors[i] = p.selectors.GetFilteredSelector(hints.Start, hints.End, opts.Step.Milliseconds(), vs.LabelMatchers, vs.Filters, hints)
+		if vs.DecodeNativeHistogramStats {
+			selectors[i] = newHistogramStatsSelector(selectors[i])
+		}
+		ranges[i], offsets[i] = ms.Range, vs.Offset
+	}
+
+	operator, err := NewPairedMatrixSelector(selectors[0], selectors[1], call.Func.Name, opts, ranges[0], offsets[0], ranges[1], offsets[1])
+	if err != nil {
+		return nil, err
+	}
+	return exchange.NewConcurrent(operator, 2, opts), nil
+}
+
+// decodingConcurrency returns the number of goroutines used to decode samples for the selector.
+func decodingConcurrency(opts *query.Options, vs logicalplan.VectorSelector) int {
+	if vs.DecodingConcurrency > 0 {
+		return vs.DecodingConcurrency
+	}
+	return opts.DecodingConcurrency
 }
 
 type histogramStatsSelector struct {
@@ -187,5 +299,9 @@ func newHistogramStatsSeries(series storage.Series) histogramStatsSeries {
 }
 
 func (h histogramStatsSeries) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
-	return promql.NewHistogramStatsIterator(h.Series.Iterator(it))
+	next := h.Series.Iterator(it)
+	if ct, ok := next.(CreatedTimestampIterator); ok {
+		return histogramStatsCTIterator{Iterator: promql.NewHistogramStatsIterator(next), ct: ct}
+	}
+	return promql.NewHistogramStatsIterator(next)
 }
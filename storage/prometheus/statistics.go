@@ -0,0 +1,41 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package prometheus
+
+import (
+	"context"
+
+	"github.com/thanos-io/promql-engine/logicalplan"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// PostingsStatistics estimates the number of series matching a selector
+// by counting postings in a TSDB index, such as the index of the head block.
+type PostingsStatistics struct {
+	index tsdb.IndexReader
+}
+
+var _ logicalplan.StatisticsProvider = PostingsStatistics{}
+
+// NewPostingsStatistics creates statistics backed by the postings of the given index.
+func NewPostingsStatistics(index tsdb.IndexReader) PostingsStatistics {
+	return PostingsStatistics{index: index}
+}
+
+func (s PostingsStatistics) SeriesCount(ctx context.Context, matchers []*labels.Matcher) (int64, bool) {
+	postings, err := tsdb.PostingsForMatchers(ctx, s.index, matchers...)
+	if err != nil {
+		return 0, false
+	}
+	var count int64
+	for postings.Next() {
+		count++
+	}
+	if postings.Err() != nil {
+		return 0, false
+	}
+	return count, true
+}
@@ -0,0 +1,74 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package prometheus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostingsStatistics(t *testing.T) {
+	opts := tsdb.DefaultHeadOptions()
+	opts.ChunkDirRoot = t.TempDir()
+	head, err := tsdb.NewHead(nil, nil, nil, nil, opts, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, head.Close()) })
+
+	app := head.Appender(context.Background())
+	for _, series := range []labels.Labels{
+		labels.FromStrings(labels.MetricName, "http_requests_total", "job", "api", "pod", "1"),
+		labels.FromStrings(labels.MetricName, "http_requests_total", "job", "api", "pod", "2"),
+		labels.FromStrings(labels.MetricName, "http_requests_total", "job", "db", "pod", "3"),
+		labels.FromStrings(labels.MetricName, "errors_total", "job", "api", "pod", "1"),
+	} {
+		_, err := app.Append(0, series, 0, 1)
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	ix, err := head.Index()
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, ix.Close()) })
+	stats := NewPostingsStatistics(ix)
+
+	for _, tcase := range []struct {
+		name     string
+		matchers []*labels.Matcher
+		expected int64
+	}{
+		{
+			name:     "metric name",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "http_requests_total")},
+			expected: 3,
+		},
+		{
+			name: "metric name and label",
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "http_requests_total"),
+				labels.MustNewMatcher(labels.MatchNotEqual, "job", "db"),
+			},
+			expected: 2,
+		},
+		{
+			name:     "regex",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "1|3")},
+			expected: 3,
+		},
+		{
+			name:     "no matches",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "missing")},
+			expected: 0,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			count, ok := stats.SeriesCount(context.Background(), tcase.matchers)
+			require.True(t, ok)
+			require.Equal(t, tcase.expected, count)
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package prometheus
+
+import (
+	"context"
+	"math"
+	"sync"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/query"
+)
+
+// StepParameter is a scalar function parameter which can change from step to step,
+// such as the quantile in quantile_over_time(scalar(foo), bar[5m]).
+// The parameter is evaluated once for all steps so that it can be shared
+// between the operators selecting different shards of the same series.
+type StepParameter struct {
+	op   model.VectorOperator
+	opts *query.Options
+
+	once   sync.Once
+	values []float64
+	err    error
+}
+
+// NewStepParameter creates a parameter whose value at each step is evaluated by op.
+func NewStepParameter(op model.VectorOperator, opts *query.Options) *StepParameter {
+	return &StepParameter{op: op, opts: opts}
+}
+
+func (p *StepParameter) load(ctx context.Context) error {
+	p.once.Do(func() {
+		p.values = make([]float64, 0, p.opts.TotalSteps())
+		buf := make([]model.StepVector, p.opts.StepsBatch)
+		for {
+			n, err := p.op.Next(ctx, buf)
+			if err != nil {
+				p.err = err
+				return
+			}
+			if n == 0 {
+				return
+			}
+			for _, vector := range buf[:n] {
+				v := math.NaN()
+				if len(vector.Samples) == 1 {
+					v = vector.Samples[0]
+				}
+				p.values = append(p.values, v)
+			}
+		}
+	})
+	return p.err
+}
+
+// at returns the value of the parameter at the step with the given index.
+func (p *StepParameter) at(step int64) float64 {
+	if step < 0 || step >= int64(len(p.values)) {
+		return math.NaN()
+	}
+	return p.values[step]
+}
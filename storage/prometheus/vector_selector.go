@@ -41,7 +41,6 @@ type vectorSelector struct {
 	mint            int64
 	maxt            int64
 	lookbackDelta   int64
-	step            int64
 	offset          int64
 	seriesBatchSize int64
 
@@ -52,6 +51,7 @@ type vectorSelector struct {
 	numShards int
 
 	selectTimestamp bool
+	smoothed        bool
 
 	opts               *query.Options
 	lastTrackedSamples int
@@ -66,12 +66,40 @@ func NewVectorSelector(
 	selectTimestamp bool,
 	shard, numShards int,
 ) model.VectorOperator {
-	o := &vectorSelector{
+	o := newVectorSelector(selector, queryOpts, offset, batchSize, selectTimestamp, shard, numShards)
+	o.telemetry = telemetry.NewTelemetry(o, queryOpts)
+	return telemetry.NewOperator(o.telemetry, o)
+}
+
+// NewSmoothedVectorSelector creates operator which selects vector of series with the smoothed modifier.
+// Values are interpolated linearly between the last sample before and the first sample after each step,
+// which are at most lookbackDelta apart from the step. Without a sample after the step, the last sample is used.
+func NewSmoothedVectorSelector(
+	selector SeriesSelector,
+	queryOpts *query.Options,
+	offset time.Duration,
+	batchSize int64,
+	shard, numShards int,
+) model.VectorOperator {
+	o := newVectorSelector(selector, queryOpts, offset, batchSize, false, shard, numShards)
+	o.smoothed = true
+	o.telemetry = telemetry.NewTelemetry(o, queryOpts)
+	return telemetry.NewOperator(o.telemetry, o)
+}
+
+func newVectorSelector(
+	selector SeriesSelector,
+	queryOpts *query.Options,
+	offset time.Duration,
+	batchSize int64,
+	selectTimestamp bool,
+	shard, numShards int,
+) *vectorSelector {
+	return &vectorSelector{
 		storage: selector,
 
 		mint:            queryOpts.Start.UnixMilli(),
 		maxt:            queryOpts.End.UnixMilli(),
-		step:            queryOpts.Step.Milliseconds(),
 		currentStep:     queryOpts.Start.UnixMilli(),
 		lookbackDelta:   queryOpts.LookbackDelta.Milliseconds(),
 		offset:          offset.Milliseconds(),
@@ -85,15 +113,6 @@ func NewVectorSelector(
 
 		opts: queryOpts,
 	}
-
-	// For instant queries, set the step to a positive value
-	// so that the operator can terminate.
-	if o.step == 0 {
-		o.step = 1
-	}
-
-	o.telemetry = telemetry.NewTelemetry(o, queryOpts)
-	return telemetry.NewOperator(o.telemetry, o)
 }
 
 func (o *vectorSelector) String() string {
@@ -140,21 +159,22 @@ func (o *vectorSelector) Next(ctx context.Context, buf []model.StepVector) (int,
 	for currStep := 0; currStep < maxSteps && ts <= o.maxt; currStep++ {
 		buf[n].Reset(ts)
 		n++
-		ts += o.step
+		ts = o.opts.NextStep(ts)
 	}
 
 	var currStepSamples int
 	var totalSamples int
-	// Reset the current timestamp.
-	ts = o.currentStep
 	fromSeries := o.currentSeries
 
+	selectPoint := selectPoint
+	if o.smoothed {
+		selectPoint = selectSmoothedPoint
+	}
+
 	for ; o.currentSeries-fromSeries < o.seriesBatchSize && o.currentSeries < int64(len(o.scanners)); o.currentSeries++ {
-		var (
-			series   = o.scanners[o.currentSeries]
-			seriesTs = ts
-		)
-		for currStep := 0; currStep < n && seriesTs <= o.maxt; currStep++ {
+		series := o.scanners[o.currentSeries]
+		for currStep := range n {
+			seriesTs := buf[currStep].T
 			currStepSamples = 0
 			t, v, h, ok, err := selectPoint(series.samples, seriesTs, o.lookbackDelta, o.offset)
 			if err != nil {
@@ -176,7 +196,6 @@ func (o *vectorSelector) Next(ctx context.Context, buf []model.StepVector) (int,
 				totalSamples += currStepSamples
 			}
 			o.telemetry.IncrementSamplesAtTimestamp(currStepSamples, seriesTs)
-			seriesTs += o.step
 		}
 
 		if o.shouldCheckSampleLimit(fromSeries) {
@@ -187,7 +206,7 @@ func (o *vectorSelector) Next(ctx context.Context, buf []model.StepVector) (int,
 	}
 
 	if o.currentSeries == int64(len(o.scanners)) {
-		o.currentStep += o.step * int64(n)
+		o.currentStep = ts
 		o.currentSeries = 0
 	}
 	return n, nil
@@ -202,7 +221,7 @@ func (o *vectorSelector) loadSeries(ctx context.Context) error {
 			return
 		}
 
-		b := labels.NewBuilder(labels.EmptyLabels())
+		var b labels.ScratchBuilder
 		o.scanners = make([]vectorScanner, len(series))
 		o.series = make([]labels.Labels, len(series))
 		for i, s := range series {
@@ -211,15 +230,13 @@ func (o *vectorSelector) loadSeries(ctx context.Context) error {
 				signature: s.Signature,
 				samples:   storage.NewMemoizedIterator(s.Iterator(nil), o.lookbackDelta),
 			}
-			b.Reset(s.Labels())
+			lbls := s.Labels()
 			// if we have pushed down a timestamp function into the scan we need to drop
 			// the reserved labels (__name__, __type__, __unit__)
 			if o.selectTimestamp {
-				b.Del(labels.MetricName)
-				b.Del(extlabels.MetricType)
-				b.Del(extlabels.MetricUnit)
+				lbls = extlabels.DropMetricName(lbls, b, o.opts.EnableDelayedNameRemoval)
 			}
-			o.series[i] = b.Labels()
+			o.series[i] = lbls
 		}
 
 		numSeries := int64(len(o.series))
@@ -286,3 +303,45 @@ func selectPoint(it *storage.MemoizedSeriesIterator, ts, lookbackDelta, offset i
 	}
 	return t, v, fh, true, nil
 }
+
+// selectSmoothedPoint interpolates the value at ts between the last sample before and the
+// first sample after ts, like Prometheus does for vector selectors with the smoothed modifier.
+func selectSmoothedPoint(it *storage.MemoizedSeriesIterator, ts, lookbackDelta, offset int64) (int64, float64, *histogram.FloatHistogram, bool, error) {
+	refTime := ts - offset
+
+	var (
+		nextT   int64
+		nextV   float64
+		hasNext bool
+	)
+	switch valueType := it.Seek(refTime); valueType {
+	case chunkenc.ValNone:
+		if it.Err() != nil {
+			return 0, 0, nil, false, it.Err()
+		}
+	case chunkenc.ValFloatHistogram, chunkenc.ValHistogram:
+		if t := it.AtT(); t <= refTime+lookbackDelta {
+			return 0, 0, nil, false, ErrNativeHistogramsNotSupportedWithModifiers
+		}
+	case chunkenc.ValFloat:
+		nextT, nextV = it.At()
+		hasNext = nextT <= refTime+lookbackDelta && !value.IsStaleNaN(nextV)
+	default:
+		panic(errors.Newf("unknown value type %v", valueType))
+	}
+	if hasNext && nextT == refTime {
+		return refTime, nextV, nil, true, nil
+	}
+
+	prevT, prevV, prevFH, ok := it.PeekPrev()
+	if !ok || prevT <= refTime-lookbackDelta || value.IsStaleNaN(prevV) {
+		return 0, 0, nil, false, nil
+	}
+	if prevFH != nil {
+		return 0, 0, nil, false, ErrNativeHistogramsNotSupportedWithModifiers
+	}
+	if !hasNext {
+		return refTime, prevV, nil, true, nil
+	}
+	return refTime, prevV + (nextV-prevV)*float64(refTime-prevT)/float64(nextT-prevT), nil, true, nil
+}
@@ -18,3 +18,12 @@ type Scanners interface {
 	NewVectorSelector(ctx context.Context, opts *query.Options, hints storage.SelectHints, selector logicalplan.VectorSelector) (model.VectorOperator, error)
 	NewMatrixSelector(ctx context.Context, opts *query.Options, hints storage.SelectHints, selector logicalplan.MatrixSelector, call logicalplan.FunctionCall) (model.VectorOperator, error)
 }
+
+// ParamScanners are Scanners which support range vector functions with scalar
+// arguments that are not constant and are evaluated at each step.
+type ParamScanners interface {
+	Scanners
+	// NewMatrixSelectorWithParams creates an operator which applies the range vector function call to the selector.
+	// params holds an operator for each scalar argument of call which is not a constant and is nil otherwise.
+	NewMatrixSelectorWithParams(ctx context.Context, opts *query.Options, hints storage.SelectHints, selector logicalplan.MatrixSelector, call logicalplan.FunctionCall, params []model.VectorOperator) (model.VectorOperator, error)
+}